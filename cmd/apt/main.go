@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/apt"
+	"github.com/imjasonh/kontain.me/pkg/health"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+func main() {
+	ctx := context.Background()
+	st, err := serve.NewStorage(ctx)
+	if err != nil {
+		log.Fatalf("serve.NewStorage: %v", err)
+	}
+	kc, err := serve.UpstreamKeychain()
+	if err != nil {
+		log.Fatalf("serve.UpstreamKeychain: %v", err)
+	}
+	t := serve.TracingTransport(http.DefaultTransport)
+	// apt.kontain.me/curl/jq -> install curl and jq on debian
+	debian := &apt.Handler{Storage: st, Distro: apt.Debian, Keychain: kc, Transport: t}
+	// apt.kontain.me/alpine/curl/jq -> install curl and jq on alpine
+	alpine := &apt.Handler{Storage: st, Distro: apt.Alpine, Prefixes: []string{"alpine/"}, Keychain: kc, Transport: t}
+	s := &server{
+		router: &api.Router{Storage: st, Manifests: api.ManifestHandlerFunc(func(w http.ResponseWriter, r *http.Request, rt api.Route) {
+			if strings.HasPrefix(rt.Name, "alpine/") {
+				alpine.ServeManifest(w, r, rt)
+				return
+			}
+			debian.ServeManifest(w, r, rt)
+		})},
+	}
+	http.Handle("/v2/", s)
+	http.Handle("/metrics", serve.MetricsHandler())
+	health.Register(http.DefaultServeMux, st.Ping)
+	http.Handle("/token", st.TokenHandler())
+	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/apt", http.StatusSeeOther))
+
+	log.Println("Starting...")
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+		log.Printf("Defaulting to port %s", port)
+	}
+	log.Printf("Listening on port %s", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+}
+
+type server struct {
+	router *api.Router
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
+	s.router.ServeHTTP(w, r)
+}
@@ -0,0 +1,7 @@
+#!/usr/bin/env bash
+
+set -euxo pipefail
+
+time crane validate --remote=apt.kontain.me/curl/jq
+time crane validate --remote=apt.kontain.me/curl/jq
+time crane validate --remote=apt.kontain.me/alpine/curl/jq:3.14
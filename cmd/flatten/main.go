@@ -9,6 +9,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
@@ -16,21 +17,35 @@ import (
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/health"
 	"github.com/imjasonh/kontain.me/pkg/serve"
 	"golang.org/x/sync/errgroup"
 )
 
+// upstream is the transport for upstream registry fetches, which are traced
+// as part of the request that needs them.
+var upstream = serve.TracingTransport(http.DefaultTransport)
+
 func main() {
 	ctx := context.Background()
-	st, err := serve.NewStorage(ctx)
+	st, err := serve.NewStorage(ctx, serve.WithNegativeCache(serve.DefaultNegativeCacheTTL, serve.DefaultNegativeCacheEntries, false))
 	if err != nil {
 		log.Fatalf("serve.NewStorage: %v", err)
 	}
-	http.Handle("/v2/", &server{
-		info:    log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error:   log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-		storage: st,
-	})
+	kc, err := serve.UpstreamKeychain()
+	if err != nil {
+		log.Fatalf("serve.UpstreamKeychain: %v", err)
+	}
+	s := &server{
+		storage:  st,
+		keychain: kc,
+	}
+	s.router = &api.Router{Storage: st, Manifests: api.ManifestHandlerFunc(s.serveFlattenManifest)}
+	http.Handle("/v2/", s)
+	http.Handle("/metrics", serve.MetricsHandler())
+	health.Register(http.DefaultServeMux, st.Ping)
+	http.Handle("/token", st.TokenHandler())
 	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/flatten", http.StatusSeeOther))
 
 	log.Println("Starting...")
@@ -44,31 +59,17 @@ func main() {
 }
 
 type server struct {
-	info, error *log.Logger
-	storage     *serve.Storage
+	storage *serve.Storage
+	router  *api.Router
+
+	// keychain authenticates fetches of upstream images.
+	keychain authn.Keychain
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.info.Println("handler:", r.Method, r.URL)
-	path := strings.TrimPrefix(r.URL.String(), "/v2/")
-
-	switch {
-	case path == "":
-		// API Version check.
-		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-		return
-	case strings.Contains(path, "/blobs/"),
-		strings.Contains(path, "/manifests/sha256:"):
-		// Extract requested blob digest and redirect to serve it from GCS.
-		// If it doesn't exist, this will return 404.
-		parts := strings.Split(r.URL.Path, "/")
-		digest := parts[len(parts)-1]
-		serve.Blob(w, r, digest)
-	case strings.Contains(path, "/manifests/"):
-		s.serveFlattenManifest(w, r)
-	default:
-		serve.Error(w, serve.ErrNotFound)
-	}
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
+	s.router.ServeHTTP(w, r)
 }
 
 var acceptableMediaTypes = map[types.MediaType]bool{
@@ -81,17 +82,14 @@ var acceptableMediaTypes = map[types.MediaType]bool{
 func cacheKey(orig string) string { return fmt.Sprintf("flatten-%s", orig) }
 
 // flatten.kontain.me/ubuntu -> flatten ubuntu and serve
-func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
+func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
 	ctx := r.Context()
-	path := strings.TrimPrefix(r.URL.Path, "/v2/")
-	parts := strings.Split(path, "/")
-
-	refstr := strings.Join(parts[:len(parts)-2], "/")
-	tagOrDigest := parts[len(parts)-1]
-	if strings.HasPrefix(tagOrDigest, "sha256:") {
-		refstr += "@" + tagOrDigest
+	log := serve.LoggerFrom(ctx)
+	refstr := rt.Name
+	if rt.Tag == "" {
+		refstr += "@" + rt.Digest.String()
 	} else {
-		refstr += ":" + tagOrDigest
+		refstr += ":" + rt.Tag
 	}
 	for strings.HasPrefix(refstr, "flatten.kontain.me/") {
 		refstr = strings.TrimPrefix(refstr, "flatten.kontain.me/")
@@ -99,7 +97,12 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 
 	ref, err := name.ParseReference(refstr)
 	if err != nil {
-		s.error.Printf("ERROR (ParseReference(%q)): %v", refstr, err)
+		log.Error("parsing upstream reference", "ref", refstr, "error", err)
+		serve.Error(w, err)
+		return
+	}
+	if err := s.storage.CachedFailure(ctx, ref); err != nil {
+		log.Info("upstream failure cached", "ref", ref, "error", err)
 		serve.Error(w, err)
 		return
 	}
@@ -109,17 +112,18 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 	var ck string
 
 	// Determine whether the ref is for an image or index.
-	d, err := remote.Head(ref, remote.WithContext(ctx))
+	d, err := remote.Head(ref, remote.WithContext(ctx), remote.WithTransport(upstream), remote.WithAuthFromKeychain(s.keychain))
 	if err != nil {
-		s.error.Printf("ERROR (remote.Head(%q)): %v", ref, err)
+		log.Error("checking upstream manifest", "ref", ref, "error", err)
 		var h v1.Hash
 		// HEAD failed, let's figure out if it was an index or image by doing GETs.
-		idx, err = remote.Index(ref, remote.WithContext(ctx))
+		idx, err = remote.Index(ref, remote.WithContext(ctx), remote.WithTransport(upstream), remote.WithAuthFromKeychain(s.keychain))
 		if err != nil {
-			s.error.Printf("ERROR (remote.Index): %v", err)
-			img, err = remote.Image(ref, remote.WithContext(ctx))
+			log.Error("fetching upstream index", "error", err)
+			img, err = remote.Image(ref, remote.WithContext(ctx), remote.WithTransport(upstream), remote.WithAuthFromKeychain(s.keychain))
 			if err != nil {
-				s.error.Printf("ERROR (remote.Image): %v", err)
+				log.Error("fetching upstream image", "error", err)
+				s.storage.RecordFailure(ctx, ref, err)
 				serve.Error(w, err)
 				return
 			}
@@ -131,50 +135,50 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 			h, err = img.Digest()
 		}
 		if err != nil {
-			s.error.Printf("ERROR (Digest): %v", err)
+			log.Error("computing digest", "error", err)
 			serve.Error(w, err)
 			return
 		}
 
 		// Check if we have a flattened manifest cached (since HEAD failed
 		// before), and if so serve it directly.
-		ck = cacheKey(h.String())
+		ck = s.storage.CacheKey(ctx, cacheKey(h.String()))
 		if _, err := s.storage.BlobExists(ctx, ck); err == nil {
-			s.info.Println("serving cached manifest:", ck)
+			log.Info("serving cached manifest", "key", ck)
 			serve.Blob(w, r, ck)
 			return
 		}
 	} else {
 		if !acceptableMediaTypes[d.MediaType] {
 			err = fmt.Errorf("unknown media type: %s", d.MediaType)
-			s.error.Printf("ERROR (serveFlattenManifest): %v", err)
+			log.Error("checking upstream manifest", "error", err)
 			serve.Error(w, err)
 			return
 		}
 
 		// Check if we have a flattened manifest cached, and if so serve it
 		// directly.
-		ck = cacheKey(d.Digest.String())
+		ck = s.storage.CacheKey(ctx, cacheKey(d.Digest.String()))
 		if _, err := s.storage.BlobExists(ctx, ck); err == nil {
-			s.info.Println("serving cached manifest:", ck)
+			log.Info("serving cached manifest", "key", ck)
 			serve.Blob(w, r, ck)
 			return
 		}
 
 		switch d.MediaType {
 		case types.OCIImageIndex, types.DockerManifestList:
-			idx, err = remote.Index(ref, remote.WithContext(ctx))
+			idx, err = remote.Index(ref, remote.WithContext(ctx), remote.WithTransport(upstream), remote.WithAuthFromKeychain(s.keychain))
 			if err != nil {
 				err = fmt.Errorf("remote.Index: %v", err)
-				s.error.Printf("ERROR (serveFlattenManifest): %v", err)
+				log.Error("fetching upstream index", "error", err)
 				serve.Error(w, err)
 				return
 			}
 		case types.OCIManifestSchema1, types.DockerManifestSchema2:
-			img, err = remote.Image(ref, remote.WithContext(ctx))
+			img, err = remote.Image(ref, remote.WithContext(ctx), remote.WithTransport(upstream), remote.WithAuthFromKeychain(s.keychain))
 			if err != nil {
 				err = fmt.Errorf("remote.Image: %v", err)
-				s.error.Printf("ERROR (serveFlattenManifest): %v", err)
+				log.Error("fetching upstream image", "error", err)
 				serve.Error(w, err)
 				return
 			}
@@ -182,14 +186,14 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if idx != nil {
-		fidx, err := s.flattenIndex(idx)
+		fidx, err := s.flattenIndex(ctx, idx)
 		if err != nil {
 			serve.Error(w, err)
 			return
 		}
 
 		if err := s.storage.ServeIndex(w, r, fidx, ck); err != nil {
-			s.error.Printf("ERROR (storage.ServeIndex): %v", err)
+			log.Error("serving index", "error", err)
 			serve.Error(w, err)
 			return
 		}
@@ -197,14 +201,14 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if img != nil {
-		fimg, err := s.flatten(img)
+		fimg, err := s.flatten(ctx, img)
 		if err != nil {
 			serve.Error(w, err)
 			return
 		}
 
 		if err := s.storage.ServeManifest(w, r, fimg, ck); err != nil {
-			s.error.Printf("ERROR (storage.ServeManifest): %v", err)
+			log.Error("serving manifest", "error", err)
 			serve.Error(w, err)
 			return
 		}
@@ -213,10 +217,11 @@ func (s *server) serveFlattenManifest(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (s *server) flattenIndex(idx v1.ImageIndex) (v1.ImageIndex, error) {
+func (s *server) flattenIndex(ctx context.Context, idx v1.ImageIndex) (v1.ImageIndex, error) {
+	log := serve.LoggerFrom(ctx)
 	im, err := idx.IndexManifest()
 	if err != nil {
-		s.error.Printf("ERROR (index.IndexManifest): %v", err)
+		log.Error("reading index manifest", "error", err)
 		return nil, err
 	}
 	// Flatten each image in the manifest.
@@ -227,16 +232,16 @@ func (s *server) flattenIndex(idx v1.ImageIndex) (v1.ImageIndex, error) {
 		g.Go(func() error {
 			img, err := idx.Image(m.Digest)
 			if err != nil {
-				s.error.Printf("ERROR (idx.Image): %v", err)
+				log.Error("fetching image of index", "digest", m.Digest, "error", err)
 				return err
 			}
-			fimg, err := s.flatten(img)
+			fimg, err := s.flatten(ctx, img)
 			if err != nil {
 				return err
 			}
 			m.Digest, err = fimg.Digest()
 			if err != nil {
-				s.error.Printf("ERROR (fimg.Digest): %v", err)
+				log.Error("computing digest", "error", err)
 				return err
 			}
 			adds[i] = mutate.IndexAddendum{
@@ -247,33 +252,34 @@ func (s *server) flattenIndex(idx v1.ImageIndex) (v1.ImageIndex, error) {
 		})
 	}
 	if err := g.Wait(); err != nil {
-		s.error.Printf("ERROR (flattenIndex): %v", err)
+		log.Error("flattening index", "error", err)
 		return nil, err
 	}
 	return mutate.AppendManifests(empty.Index, adds...), nil
 }
 
-func (s *server) flatten(img v1.Image) (v1.Image, error) {
+func (s *server) flatten(ctx context.Context, img v1.Image) (v1.Image, error) {
+	log := serve.LoggerFrom(ctx)
 	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) { return mutate.Extract(img), nil })
 	if err != nil {
-		s.error.Printf("ERROR (tarball.LayerFromOpener): %v", err)
+		log.Error("flattening layers", "error", err)
 		return nil, err
 	}
 	fimg, err := mutate.AppendLayers(empty.Image, l)
 	if err != nil {
-		s.error.Printf("ERROR (mutate.AppendLayers): %v", err)
+		log.Error("appending layer", "error", err)
 		return nil, err
 	}
 
 	// Copy over basic information from original config file.
 	ocf, err := img.ConfigFile()
 	if err != nil {
-		s.error.Printf("ERROR (img.ConfigFile): %v", err)
+		log.Error("reading config", "error", err)
 		return nil, err
 	}
 	ncf, err := fimg.ConfigFile()
 	if err != nil {
-		s.error.Printf("ERROR (empty.Image.ConfigFile): %v", err)
+		log.Error("reading flattened config", "error", err)
 		return nil, err
 	}
 	cf := ncf.DeepCopy()
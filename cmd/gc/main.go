@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/imjasonh/kontain.me/pkg/gc"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+var (
+	dryRun      = flag.Bool("dry-run", false, "If true, report what would be deleted without deleting anything")
+	gracePeriod = flag.Duration("grace-period", 24*time.Hour, "Blobs modified more recently than this are kept")
+	inventory   = flag.String("inventory", "", "If set, path to an OSS inventory report CSV to enumerate blobs from, instead of listing the bucket")
+)
+
+func main() {
+	flag.Parse()
+	ctx := context.Background()
+	st, err := serve.NewStorage(ctx)
+	if err != nil {
+		log.Fatalf("serve.NewStorage: %v", err)
+	}
+
+	report, err := gc.Run(ctx, st, gc.Options{
+		DryRun:      *dryRun,
+		GracePeriod: *gracePeriod,
+		Inventory:   *inventory,
+	})
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	for _, name := range report.Deleted {
+		log.Printf("%s %s", verb, name)
+	}
+	for _, tag := range report.ExpiredTags {
+		log.Printf("%s expired tag %s", verb, tag)
+	}
+	for _, name := range report.Failed {
+		log.Printf("failed to delete %s", name)
+	}
+	log.Printf("scanned %d blobs, %d referenced; %s %d (%d bytes)", report.Scanned, report.Referenced, verb, len(report.Deleted), report.DeletedBytes)
+	if err != nil {
+		log.Fatalf("gc.Run: %v", err)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	gauthn "github.com/google/go-containerregistry/pkg/v1/google"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-github/v32/github"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/health"
 	"github.com/imjasonh/kontain.me/pkg/run"
 	"github.com/imjasonh/kontain.me/pkg/serve"
 )
@@ -36,17 +38,22 @@ var commitRE = regexp.MustCompile("[a-f0-9]{40}")
 
 const base = "packs/run:v3alpha2"
 
+// upstream is the transport for upstream registry fetches, which are traced
+// as part of the request that needs them.
+var upstream = serve.TracingTransport(http.DefaultTransport)
+
 func main() {
 	ctx := context.Background()
 	st, err := serve.NewStorage(ctx)
 	if err != nil {
 		log.Fatalf("serve.NewStorage: %v", err)
 	}
-	http.Handle("/v2/", &server{
-		info:    log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error:   log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-		storage: st,
-	})
+	s := &server{storage: st}
+	s.router = &api.Router{Storage: st, Manifests: api.ManifestHandlerFunc(s.serveKanikoManifest)}
+	http.Handle("/v2/", s)
+	http.Handle("/metrics", serve.MetricsHandler())
+	health.Register(http.DefaultServeMux, st.Ping)
+	http.Handle("/token", st.TokenHandler())
 	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/kaniko", http.StatusSeeOther))
 
 	log.Println("Starting...")
@@ -60,92 +67,59 @@ func main() {
 }
 
 type server struct {
-	info, error *log.Logger
-	storage     *serve.Storage
+	storage *serve.Storage
+	router  *api.Router
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.info.Println("handler:", r.Method, r.URL)
-	path := strings.TrimPrefix(r.URL.String(), "/v2/")
-
-	switch {
-	case path == "": // API Version check.
-		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-	case strings.Contains(path, "/blobs/"),
-		strings.Contains(path, "/manifests/sha256:"):
-		// Extract requested blob digest and redirect to serve it from GCS.
-		// If it doesn't exist, this will return 404.
-		parts := strings.Split(r.URL.Path, "/")
-		digest := parts[len(parts)-1]
-		serve.Blob(w, r, digest)
-	case strings.Contains(path, "/manifests/"):
-		s.serveKanikoManifest(w, r)
-	default:
-		serve.Error(w, serve.ErrNotFound)
-	}
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
+	s.router.ServeHTTP(w, r)
 }
 
-func (s *server) serveKanikoManifest(w http.ResponseWriter, r *http.Request) {
+func (s *server) serveKanikoManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
 	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
 
 	// Prepare workspace.
 	if err := s.prepareWorkspace(); err != nil {
-		s.error.Println("ERROR:", err)
+		log.Error("preparing workspace", "error", err)
 		serve.Error(w, err)
 		return
 	}
 	// Clean up workspace.
 	defer func() {
 		if err := os.RemoveAll("/tmp"); err != nil {
-			s.error.Printf("RemoveAll(/tmp): %v", err)
+			log.Error("cleaning up workspace", "error", err)
 		}
 		os.Setenv("HOME", "/home/")
 	}()
 
 	// Determine source repo and revision.
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 {
+	parts := strings.Split(rt.Name, "/")
+	if len(parts) < 2 {
 		serve.Error(w, errors.New("Must specify GitHub repository"))
 		return
 	}
-	ghOwner, ghRepo := parts[2], parts[3]
-	path := strings.Join(parts[4:len(parts)-2], "/")
-	tagOrDigest := parts[len(parts)-1]
-
-	// If request is for image by digest, try to serve it from GCS.
-	if strings.HasPrefix(tagOrDigest, "sha256:") {
-		desc, err := s.storage.BlobExists(ctx, tagOrDigest)
-		if err != nil {
-			s.error.Printf("ERROR (storage.BlobExists): %s", err)
-			serve.Error(w, serve.ErrNotFound)
-			return
-		}
-		if r.Method == http.MethodHead {
-			w.Header().Set("Docker-Content-Digest", tagOrDigest)
-			w.Header().Set("Content-Type", string(desc.MediaType))
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.Size))
-			return
-		}
-		serve.Blob(w, r, tagOrDigest)
-		return
-	}
+	ghOwner, ghRepo := parts[0], parts[1]
+	path := strings.Join(parts[2:], "/")
 
 	// If the image tag looks like a commit SHA, see if we already have a
 	// manifest cached for that revision and serve it directly.  Otherwise,
 	// resolve the branch/tag/whatever to a SHA and redirect to that SHA
 	// image tag.
-	revision := tagOrDigest
+	revision := rt.Tag
 	if commitRE.MatchString(revision) {
-		ck := cacheKey(path, revision)
+		ck := s.storage.CacheKey(ctx, cacheKey(path, revision))
 		if _, err := s.storage.BlobExists(ctx, ck); err == nil {
-			s.info.Println("serving cached manifest:", ck)
+			log.Info("serving cached manifest", "key", ck)
 			serve.Blob(w, r, ck)
 			return
 		}
 	} else {
-		revision, err := s.resolveCommit(ghOwner, ghRepo, revision)
+		revision, err := s.resolveCommit(ctx, ghOwner, ghRepo, revision)
 		if err != nil {
-			s.error.Println("ERROR(resolveCommit):", err)
+			log.Error("resolving commit", "ref", revision, "error", err)
 			serve.Error(w, err)
 			return
 		}
@@ -154,26 +128,29 @@ func (s *server) serveKanikoManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch, detect and build source.
-	image, err := s.fetchAndBuild(ghOwner, ghRepo, revision, path)
+	// Fetch, detect and build source, unless another request is already
+	// building it.
+	ck := s.storage.CacheKey(ctx, cacheKey(path, revision))
+	image, err := s.storage.BuildOnce(ck, func() (interface{}, error) {
+		return s.fetchAndBuild(ctx, ghOwner, ghRepo, revision, path)
+	})
 	if err != nil {
-		s.error.Println("ERROR:", err)
+		log.Error("building image", "error", err)
 		serve.Error(w, err)
 		return
 	}
 
 	// Serve new image manifest.
-	img, err := s.getImage(ctx, image)
+	img, err := s.getImage(ctx, image.(string))
 	if err != nil {
-		s.error.Println("ERROR:", err)
+		log.Error("fetching built image", "image", image, "error", err)
 		serve.Error(w, err)
 		return
 	}
 
 	// Serve the manifest.
-	ck := cacheKey(path, revision)
 	if err := s.storage.ServeManifest(w, r, img, ck); err != nil {
-		s.error.Printf("ERROR (storage.ServeManifest): %v", err)
+		log.Error("serving manifest", "error", err)
 		serve.Error(w, err)
 		return
 	}
@@ -188,8 +165,7 @@ func cacheKey(path, revision string) string {
 // If the image tag is "latest", use the repo's default branch.
 // If the image tag is "latest-release", look up the repo's latest release tag.
 // In any case, resolve the branch/tag/whatever to a commit SHA.
-func (s *server) resolveCommit(owner, repo, ref string) (string, error) {
-	ctx := context.Background()
+func (s *server) resolveCommit(ctx context.Context, owner, repo, ref string) (string, error) {
 	client := github.NewClient(nil)
 
 	if ref == "latest" {
@@ -214,7 +190,7 @@ func (s *server) resolveCommit(owner, repo, ref string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	s.info.Printf("Resolved %q -> %q\n", ref, commit.GetSHA())
+	serve.LoggerFrom(ctx).Info("resolved commit", "ref", ref, "sha", commit.GetSHA())
 	return commit.GetSHA(), nil
 }
 
@@ -240,7 +216,7 @@ func (s *server) prepareWorkspace() error {
 	return nil
 }
 
-func (s *server) fetchAndBuild(ghOwner, ghRepo, revision, path string) (string, error) {
+func (s *server) fetchAndBuild(ctx context.Context, ghOwner, ghRepo, revision, path string) (string, error) {
 	image := fmt.Sprintf("gcr.io/%s/kaniko:built-at-%d", projectID, time.Now().Unix())
 	source := fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", ghOwner, ghRepo, revision)
 
@@ -253,7 +229,7 @@ func (s *server) fetchAndBuild(ghOwner, ghRepo, revision, path string) (string,
   --destination=%s \
   --cache-repo=gcr.io/%s`, path, path, image, projectID),
 	} {
-		if err := run.Do(s.info.Writer(), cmd); err != nil {
+		if err := run.Do(serve.LoggerFrom(ctx).Writer(serve.LevelInfo), cmd); err != nil {
 			return "", fmt.Errorf("Running %q: %v", cmd, err)
 		}
 	}
@@ -269,5 +245,5 @@ func (s *server) getImage(ctx context.Context, image string) (v1.Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	return remote.Image(ref, remote.WithAuth(authn), remote.WithContext(ctx))
+	return remote.Image(ref, remote.WithAuth(authn), remote.WithContext(ctx), remote.WithTransport(upstream))
 }
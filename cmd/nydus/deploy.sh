@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+
+set -euxo pipefail
+
+gcloud run deploy nydus \
+  --project=kontaindotme \
+  --region=us-central1 \
+  --allow-unauthenticated \
+  --set-env-vars=BUCKET=kontaindotme \
+  --image=$(KO_DOCKER_REPO=gcr.io/kontaindotme ko publish -P ./cmd/nydus) \
+  --memory=4Gi \
+  --cpu=1 \
+  --concurrency=80 \
+  --timeout=300 # 5m
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/health"
+	"github.com/imjasonh/kontain.me/pkg/mirror"
+	"github.com/imjasonh/kontain.me/pkg/nydus"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+func main() {
+	ctx := context.Background()
+	st, err := serve.NewStorage(ctx, serve.WithNegativeCache(serve.DefaultNegativeCacheTTL, serve.DefaultNegativeCacheEntries, false))
+	if err != nil {
+		log.Fatalf("serve.NewStorage: %v", err)
+	}
+	kc, err := serve.UpstreamKeychain()
+	if err != nil {
+		log.Fatalf("serve.UpstreamKeychain: %v", err)
+	}
+	s := &server{
+		// nydus.kontain.me/ubuntu -> convert ubuntu to nydus and serve
+		router: nydus.NewRouter(&nydus.Handler{
+			Storage: st,
+			Upstream: mirror.Upstream{
+				Prefixes:  []string{"nydus.kontain.me/"},
+				Keychain:  kc,
+				Transport: serve.TracingTransport(http.DefaultTransport),
+			},
+		}),
+	}
+	http.Handle("/v2/", s)
+	http.Handle("/metrics", serve.MetricsHandler())
+	health.Register(http.DefaultServeMux, st.Ping)
+	http.Handle("/token", st.TokenHandler())
+	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/nydus", http.StatusSeeOther))
+
+	log.Println("Starting...")
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+		log.Printf("Defaulting to port %s", port)
+	}
+	log.Printf("Listening on port %s", port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+}
+
+type server struct {
+	router *api.Router
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
+	s.router.ServeHTTP(w, r)
+}
@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+
+set -euxo pipefail
+
+time crane validate --remote=nydus.kontain.me/busybox
+time crane validate --remote=nydus.kontain.me/busybox
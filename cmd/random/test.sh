@@ -4,3 +4,4 @@ set -euxo pipefail
 
 time crane validate --remote=random.kontain.me/random
 time crane validate --remote=random.kontain.me/random:4x10
+time crane validate --remote=random.kontain.me/random:4x10mb-amd64-arm64
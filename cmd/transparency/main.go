@@ -21,10 +21,7 @@ import (
 )
 
 func main() {
-	http.Handle("/v2/", &server{
-		info:  log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error: log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-	})
+	http.Handle("/v2/", &server{})
 	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/flatten", http.StatusSeeOther))
 
 	log.Println("Starting...")
@@ -37,12 +34,11 @@ func main() {
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
 
-type server struct {
-	info, error *log.Logger
-}
+type server struct{}
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.info.Println("handler:", r.Method, r.URL)
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
 	path := strings.TrimPrefix(r.URL.String(), "/v2/")
 	parts := strings.Split(path, "/")
 
@@ -78,6 +74,7 @@ func reqToRef(r *http.Request) (name.Reference, error) {
 }
 
 func (s *server) handleBlobs(w http.ResponseWriter, r *http.Request) {
+	log := serve.LoggerFrom(r.Context())
 	parts := strings.Split(r.URL.Path, "/")
 	parts = parts[1:]
 	if parts[len(parts)-1] == "" {
@@ -97,23 +94,23 @@ func (s *server) handleBlobs(w http.ResponseWriter, r *http.Request) {
 
 	tr, err := transport.NewWithContext(r.Context(), ref.Context().Registry, authn.Anonymous, http.DefaultTransport, []string{ref.Scope(transport.PullScope)})
 	if err != nil {
-		s.error.Println(err)
+		log.Error("connecting upstream", "error", err)
 		serve.Error(w, err)
 		return
 	}
 
 	dig := parts[len(parts)-1]
 	url := "https://" + ref.Context().RegistryStr() + "/v2/" + ref.Context().String() + "/blobs/" + dig
-	s.info.Println("url:", url)
+	log.Info("fetching blob", "url", url)
 	req, err := http.NewRequest("HEAD", url, nil)
 	if err != nil {
-		s.error.Println(err)
+		log.Error("fetching blob", "url", url, "error", err)
 		serve.Error(w, err)
 		return
 	}
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		s.error.Println(err)
+		log.Error("fetching blob", "url", url, "error", err)
 		serve.Error(w, err)
 		return
 	}
@@ -123,16 +120,17 @@ func (s *server) handleBlobs(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) handleManifests(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
 	ref, err := reqToRef(r)
 	if err != nil {
-		s.error.Println(err)
+		log.Error("parsing reference", "error", err)
 		serve.Error(w, err)
 		return
 	}
 
 	desc, err := remote.Get(ref)
 	if err != nil {
-		s.error.Println(err)
+		log.Error("fetching manifest", "ref", ref, "error", err)
 		serve.Error(w, err)
 		return
 	}
@@ -145,19 +143,19 @@ func (s *server) handleManifests(w http.ResponseWriter, r *http.Request) {
 		if err == errRekordNotFound {
 			// Ref wasn't found, record it.
 			if err := s.record(ctx, ref, cur); err != nil {
-				s.error.Printf("ERROR (record): %v", ref, err)
+				log.Error("recording in rekor", "ref", ref, "error", err)
 				serve.Error(w, err)
 				return
 			}
 		} else if err != nil {
 			// Lookup failed!
-			s.error.Printf("ERROR (lookup): %v", ref, err)
+			log.Error("looking up in rekor", "ref", ref, "error", err)
 			serve.Error(w, err)
 			return
 		} else {
-			s.info.Printf("rekor: %s -> %s", ref, got)
+			log.Info("found in rekor", "ref", ref, "digest", got)
 			if got != cur {
-				s.error.Printf("ERROR (mismatch): got %q, want %q", got, cur)
+				log.Error("rekor digest mismatch", "ref", ref, "got", got, "want", cur)
 				serve.Error(w, fmt.Errorf("rekor digest mismatch: got %q, want %q", got, cur))
 				return
 			}
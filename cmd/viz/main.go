@@ -14,15 +14,13 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/imjasonh/kontain.me/pkg/serve"
 	"github.com/tmc/dot"
 )
 
 func main() {
 	http.Handle("/", http.FileServer(http.Dir("/var/run/ko")))
-	http.Handle("/viz", &server{
-		info:  log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error: log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-	})
+	http.Handle("/viz", &server{})
 	log.Println("Starting...")
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -33,13 +31,12 @@ func main() {
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
 
-type server struct {
-	info, error *log.Logger
-}
+type server struct{}
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(serve.RequestContext(w, r))
 	ctx := r.Context()
-	s.info.Println("handler:", r.Method, r.URL)
+	serve.LoggerFrom(ctx).Info("handler", "method", r.Method, "url", r.URL.String())
 	if r.Method != http.MethodPost {
 		http.Error(w, "must be post", http.StatusMethodNotAllowed)
 		return
@@ -12,6 +12,8 @@ import (
 
 	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/imjasonh/delay/pkg/delay"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/health"
 	"github.com/imjasonh/kontain.me/pkg/serve"
 )
 
@@ -24,11 +26,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("serve.NewStorage: %v", err)
 	}
-	http.Handle("/v2/", &server{
-		info:    log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error:   log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-		storage: st,
-	})
+	s := &server{storage: st}
+	s.router = &api.Router{Storage: st, Manifests: api.ManifestHandlerFunc(s.serveWaitManifest)}
+	http.Handle("/v2/", s)
+	http.Handle("/metrics", serve.MetricsHandler())
+	health.Register(http.DefaultServeMux, st.Ping)
+	http.Handle("/token", st.TokenHandler())
 	http.Handle("/", http.RedirectHandler("https://github.com/imjasonh/kontain.me/blob/main/cmd/wait", http.StatusSeeOther))
 
 	log.Println("Starting...")
@@ -42,31 +45,14 @@ func main() {
 }
 
 type server struct {
-	info, error *log.Logger
-	storage     *serve.Storage
+	storage *serve.Storage
+	router  *api.Router
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.info.Println("handler:", r.Method, r.URL)
-	path := strings.TrimPrefix(r.URL.String(), "/v2/")
-
-	switch {
-	case path == "":
-		// API Version check.
-		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-		return
-	case strings.Contains(path, "/blobs/"),
-		strings.Contains(path, "/manifests/sha256:"):
-		// Extract requested blob digest and redirect to serve it from GCS.
-		// If it doesn't exist, this will return 404.
-		parts := strings.Split(r.URL.Path, "/")
-		digest := parts[len(parts)-1]
-		serve.Blob(w, r, digest)
-	case strings.Contains(path, "/manifests/"):
-		s.serveWaitManifest(w, r)
-	default:
-		serve.Error(w, serve.ErrNotFound)
-	}
+	r = r.WithContext(serve.RequestContext(w, r))
+	serve.LoggerFrom(r.Context()).Info("handler", "method", r.Method, "url", r.URL.String())
+	s.router.ServeHTTP(w, r)
 }
 
 func cacheKey(name string) string {
@@ -78,35 +64,15 @@ func cacheKey(name string) string {
 // - latest defaults to 10s
 // if manifest for name exists, serve it.
 // if a placeholder exists, a wait is ongoing.
-func (s *server) serveWaitManifest(w http.ResponseWriter, r *http.Request) {
+func (s *server) serveWaitManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
 	ctx := r.Context()
-	path := strings.TrimPrefix(r.URL.Path, "/v2/")
-	parts := strings.Split(path, "/")
-	name := strings.Join(parts[:len(parts)-2], "/")
-
-	// If request is for image by digest, try to serve it from GCS.
-	tagOrDigest := parts[len(parts)-1]
-	if strings.HasPrefix(tagOrDigest, "sha256:") {
-		desc, err := s.storage.BlobExists(ctx, tagOrDigest)
-		if err != nil {
-			s.error.Printf("ERROR (storage.BlobExists): %s", err)
-			serve.Error(w, serve.ErrNotFound)
-			return
-		}
-		if r.Method == http.MethodHead {
-			w.Header().Set("Docker-Content-Digest", tagOrDigest)
-			w.Header().Set("Content-Type", string(desc.MediaType))
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.Size))
-			return
-		}
-		serve.Blob(w, r, tagOrDigest)
-		return
-	}
+	log := serve.LoggerFrom(ctx)
+	name := rt.Name
 
 	// The image has already been built; serve it.
 	ck := cacheKey(name)
 	if _, err := s.storage.BlobExists(ctx, ck); err == nil {
-		s.info.Printf("blob %q exists, serving", ck)
+		log.Info("serving cached image", "key", ck)
 		serve.Blob(w, r, ck)
 		return
 	}
@@ -115,42 +81,42 @@ func (s *server) serveWaitManifest(w http.ResponseWriter, r *http.Request) {
 	// contents.
 	phn := fmt.Sprintf("placeholder-%s", ck)
 	if _, err := s.storage.BlobExists(ctx, phn); err == nil {
-		s.info.Printf("placeholder %q exists", phn)
+		log.Info("waiting for image", "placeholder", phn)
 		serve.Error(w, fmt.Errorf("waiting for image..."))
 		return
 	}
 
 	// No cached image or placeholder exists; enqueue a new task.
-	tag := tagOrDigest
+	tag := rt.Tag
 	if tag == "latest" {
 		tag = "10s"
 	}
 	dur, err := time.ParseDuration(tag)
 	if err != nil {
-		s.error.Println(err)
+		log.Error("parsing duration", "error", err)
 		serve.Error(w, err)
 		return
 	}
 	if dur > time.Hour {
 		err := fmt.Errorf("duration > 1h (%s)", dur)
-		s.error.Println(err)
+		log.Error("parsing duration", "error", err)
 		serve.Error(w, err)
 		return
 	}
-	s.info.Printf("generating random image %q in %s", ck, dur)
+	log.Info("generating random image", "key", ck, "delay", dur.String())
 
 	// Enqueue the task for later.
 	if err := laterFunc.Call(ctx, r, queueName,
 		delay.WithArgs(ck),
 		delay.WithDelay(dur)); err != nil {
-		s.error.Printf("ERROR (laterFunc.Call): %v", err)
+		log.Error("enqueuing task", "error", err)
 		serve.Error(w, err)
 		return
 	}
 
 	// Write the placeholder object.
 	if err := s.storage.WriteObject(ctx, phn, fmt.Sprintf("serving image at %s", time.Now().Add(dur))); err != nil {
-		s.error.Printf("ERROR (storage.WriteObject): %v", err)
+		log.Error("writing placeholder", "error", err)
 		serve.Error(w, err)
 		return
 	}
@@ -162,7 +128,7 @@ const size = 100
 const num = 10
 
 var laterFunc = delay.Func("later", func(ctx context.Context, ck string) error {
-	log.Printf("generating random image for cache key %q", ck)
+	serve.LoggerFrom(ctx).Info("generating random image", "key", ck)
 	img, err := random.Image(size, num)
 	if err != nil {
 		return err
@@ -6,7 +6,7 @@ require (
 	cloud.google.com/go v0.97.0
 	github.com/aliyun/aliyun-oss-go-sdk v2.1.10+incompatible
 	github.com/baiyubin/aliyun-sts-go-sdk v0.0.0-20180326062324-cfa1a18b161f // indirect
-	github.com/containerd/stargz-snapshotter/estargz v0.9.0 // indirect
+	github.com/containerd/stargz-snapshotter/estargz v0.9.0
 	github.com/docker/cli v20.10.9+incompatible // indirect
 	github.com/docker/docker v20.10.9+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.6.4 // indirect
@@ -15,12 +15,15 @@ require (
 	github.com/google/go-github/v32 v32.1.0
 	github.com/google/ko v0.9.3
 	github.com/imjasonh/delay v0.0.0-20210102151318-8339250e8458
+	github.com/klauspost/compress v1.13.6
 	github.com/tmc/dot v0.0.0-20180926222610-6d252d5ff882
+	go.opencensus.io v0.23.0
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	golang.org/x/mod v0.5.1
 	golang.org/x/net v0.0.0-20211007125505-59d4e928ea9d // indirect
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac // indirect
+	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/tools v0.1.7 // indirect
 	google.golang.org/api v0.58.0 // indirect
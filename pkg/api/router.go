@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// Kind is the kind of request a Route is for.
+type Kind int
+
+const (
+	// Version is the API version check, /v2/.
+	Version Kind = iota
+	// Catalog is /v2/_catalog.
+	Catalog
+	// Tags is /v2/<name>/tags/list.
+	Tags
+	// Referrers is /v2/<name>/referrers/<digest>.
+	Referrers
+	// Blob is /v2/<name>/blobs/<digest>.
+	Blob
+	// Upload is /v2/<name>/blobs/uploads/, with an optional session ID.
+	Upload
+	// Manifest is /v2/<name>/manifests/<reference>, a tag or digest.
+	Manifest
+)
+
+var (
+	// nameRE matches repository names, as defined by the distribution
+	// spec: path components of lowercase letters and digits, separated by
+	// periods, underscores or dashes.
+	nameRE = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+	// tagRE matches tags, as defined by the distribution spec.
+	tagRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// Route is a parsed /v2/ API request path.
+type Route struct {
+	Kind Kind
+
+	// Name is the repository, for every kind but Version and Catalog.
+	Name string
+
+	// Tag is the tag of a Manifest route by tag, without the compression
+	// suffix it may have, as serve.SplitTagCompression says.
+	Tag string
+
+	// Digest is the digest of a Blob or Referrers route, or a Manifest
+	// route by digest.
+	Digest v1.Hash
+
+	// Session is the upload session ID of an Upload route, if it's for a
+	// session that's been started.
+	Session string
+}
+
+// Reference returns the tag or digest of a Manifest route.
+func (rt Route) Reference() string {
+	if rt.Tag != "" {
+		return rt.Tag
+	}
+	return rt.Digest.String()
+}
+
+// Parse parses the path of a /v2/ API request. Repository names, tags and
+// digests are validated, returning errors that serve.WriteError reports as
+// NAME_INVALID, TAG_INVALID or DIGEST_INVALID, respectively, as are upload
+// session IDs, which must be as serve.IsUploadSessionID says, or else are
+// reported as BLOB_UPLOAD_UNKNOWN.
+//
+// Names may have any number of path components; the last /blobs/,
+// /manifests/, /tags/ or /referrers/ in the path ends the name, as
+// serve.ParseRequestPath splits it.
+func Parse(path string) (Route, error) {
+	p, ok := serve.ParseRequestPath(path)
+	return parse(path, p, ok)
+}
+
+// parse validates the path, as split by serve.ParseRequestPath, and returns
+// the Route it's for.
+func parse(path string, p serve.RequestPath, ok bool) (Route, error) {
+	if !ok {
+		return Route{}, fmt.Errorf("%w: %q isn't a registry API path", serve.ErrNotFound, path)
+	}
+	rt := Route{Name: p.Repo}
+	switch p.Section {
+	case serve.SectionVersion:
+		return Route{Kind: Version}, nil
+	case serve.SectionCatalog:
+		return Route{Kind: Catalog}, nil
+	case serve.SectionUploads:
+		rt.Kind, rt.Session = Upload, p.Reference
+		if rt.Session != "" && !serve.IsUploadSessionID(rt.Session) {
+			return Route{}, serve.NewError(http.StatusNotFound, transport.BlobUploadUnknownErrorCode, "upload %s not found", rt.Session)
+		}
+	case serve.SectionBlobs:
+		rt.Kind = Blob
+		if err := parseDigest(p.Reference, &rt.Digest); err != nil {
+			return Route{}, err
+		}
+	case serve.SectionManifests:
+		rt.Kind = Manifest
+		if strings.Contains(p.Reference, ":") {
+			if err := parseDigest(p.Reference, &rt.Digest); err != nil {
+				return Route{}, err
+			}
+		} else if tagRE.MatchString(p.Reference) {
+			rt.Tag, _ = serve.SplitTagCompression(p.Reference)
+		} else {
+			return Route{}, serve.NewError(http.StatusBadRequest, transport.TagInvalidErrorCode, "invalid tag %q", p.Reference)
+		}
+	case serve.SectionReferrers:
+		rt.Kind = Referrers
+		if err := parseDigest(p.Reference, &rt.Digest); err != nil {
+			return Route{}, err
+		}
+	case serve.SectionTags:
+		rt.Kind = Tags
+	}
+	if !nameRE.MatchString(rt.Name) {
+		return Route{}, fmt.Errorf("%w: %q", serve.ErrNameInvalid, rt.Name)
+	}
+	return rt, nil
+}
+
+func parseDigest(s string, h *v1.Hash) error {
+	d, err := v1.NewHash(s)
+	if err != nil {
+		return serve.NewError(http.StatusBadRequest, transport.DigestInvalidErrorCode, "invalid digest %q: %v", s, err)
+	}
+	*h = d
+	return nil
+}
+
+// ManifestHandler serves the manifests a service produces, such as by
+// building them, for requests by tag.
+type ManifestHandler interface {
+	ServeManifest(w http.ResponseWriter, r *http.Request, rt Route)
+}
+
+// ManifestHandlerFunc is a func that's a ManifestHandler.
+type ManifestHandlerFunc func(w http.ResponseWriter, r *http.Request, rt Route)
+
+// ServeManifest calls f.
+func (f ManifestHandlerFunc) ServeManifest(w http.ResponseWriter, r *http.Request, rt Route) {
+	f(w, r, rt)
+}
+
+// Router serves the registry API under /v2/ from Storage, passing requests
+// for manifests by tag to Manifests.
+//
+// Pushes, and requests for tags that have been pushed, are served by
+// Storage.ServePush first. Blobs and manifests by digest are served from
+// Storage, as are the catalog, tags/list and referrers APIs. The contents of
+// blobs and manifests that Storage streams, rather than redirecting to, are
+// checked against their digests with serve.VerifyDigests.
+//
+// Requests for manifests by tag may ask for their layers to be recompressed
+// with a suffix of the tag, as serve.SplitTagCompression says: Manifests is
+// passed the tag without it, and a request whose context has the compression,
+// for Storage.CacheKey.
+//
+// The middleware requests pass through is built from Storage on the first
+// request, so Storage mustn't be changed once the Router is serving.
+type Router struct {
+	Storage   *serve.Storage
+	Manifests ManifestHandler
+
+	// ManifestsByDigest, if set, makes requests for manifests by digest
+	// go to Manifests too, for services that produce them on demand
+	// rather than serving what they've written.
+	ManifestsByDigest bool
+
+	// handler is the middleware requests are routed through, built once
+	// so that what it remembers, such as verified credentials, is kept
+	// between requests.
+	once    sync.Once
+	handler http.Handler
+}
+
+type routeKey struct{}
+
+// parsedRoute is the Route a request was parsed as, or the error parsing
+// it, carried in its context through the middleware to dispatch.
+type parsedRoute struct {
+	route Route
+	err   error
+}
+
+// ServeHTTP routes the request, tracing it with serve.Trace and counting it
+// in the metrics served by serve.MetricsHandler. If Storage requires
+// requests to be authorized, those that aren't are refused with a challenge,
+// as by serve.RequireAuth, and if it limits clients, those over their limits
+// are refused with 429s, as by Storage.Limit. Each address is limited before
+// its requests are authorized too, as by Storage.LimitAddresses.
+//
+// The path is parsed once, and carried in the request's context with
+// serve.WithRequestPath for the middleware and Storage handlers it passes
+// through.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := serve.ParseRequestPath(r.URL.Path)
+	if ok {
+		r = r.WithContext(serve.WithRequestPath(r.Context(), p))
+	}
+	route, err := parse(r.URL.Path, p, ok)
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, parsedRoute{route: route, err: err}))
+	rt.once.Do(func() {
+		h := rt.Storage.LimitAddresses(rt.Storage.RequireAuth(rt.Storage.Limit(http.HandlerFunc(rt.dispatch))))
+		rt.handler = serve.Trace(serve.Instrument(h))
+	})
+	rt.handler.ServeHTTP(w, r)
+}
+
+// dispatch serves the request by the Route ServeHTTP parsed it as.
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	pr, _ := r.Context().Value(routeKey{}).(parsedRoute)
+	route, err := pr.route, pr.err
+	if err != nil {
+		serve.WriteError(w, err)
+		return
+	}
+	if route.Kind == Version {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		return
+	}
+	if rt.Storage.ServePush(w, r) {
+		return
+	}
+
+	switch route.Kind {
+	case Catalog:
+		rt.Storage.ServeCatalog(w, r)
+	case Tags:
+		rt.Storage.ServeTags(w, r)
+	case Referrers:
+		rt.Storage.ServeReferrers(w, r)
+	case Blob:
+		rt.serveBlob(w, r, route.Digest)
+	case Manifest:
+		if route.Tag == "" && !rt.ManifestsByDigest {
+			rt.serveBlob(w, r, route.Digest)
+			return
+		}
+		// Manifests handlers write with the layer compression the
+		// request asks for, and key what they've written by it.
+		ctx, err := serve.RequestLayerCompression(r.Context(), r)
+		if err != nil {
+			serve.WriteError(w, err)
+			return
+		}
+		rt.Manifests.ServeManifest(w, r.WithContext(ctx), route)
+	default:
+		// Uploads that ServePush didn't serve, for repositories that
+		// can't be pushed to.
+		serve.WriteError(w, serve.NewError(http.StatusForbidden, transport.DeniedErrorCode, "repository %q is read-only", route.Name))
+	}
+}
+
+// serveBlob serves the blob or manifest with the digest from Storage,
+// verifying its contents if they're streamed.
+func (rt *Router) serveBlob(w http.ResponseWriter, r *http.Request, digest v1.Hash) {
+	serve.VerifyDigests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.Storage.ServeBlob(w, r, digest.String())
+	})).ServeHTTP(w, r)
+}
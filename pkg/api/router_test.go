@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParse(t *testing.T) {
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	session := strings.Repeat("0f", 16)
+	for _, tc := range []struct {
+		path string
+		want Route
+	}{
+		{"/v2/", Route{Kind: Version}},
+		{"/v2", Route{Kind: Version}},
+		{"/v2/_catalog", Route{Kind: Catalog}},
+		{"/v2/app/tags/list", Route{Kind: Tags, Name: "app"}},
+		{"/v2/org/team/app/blobs/" + digest.String(), Route{Kind: Blob, Name: "org/team/app", Digest: digest}},
+		{"/v2/app/blobs/uploads/", Route{Kind: Upload, Name: "app"}},
+		{"/v2/app/blobs/uploads/" + session, Route{Kind: Upload, Name: "app", Session: session}},
+		{"/v2/app/manifests/v1", Route{Kind: Manifest, Name: "app", Tag: "v1"}},
+		{"/v2/app/manifests/v1__zstd", Route{Kind: Manifest, Name: "app", Tag: "v1"}},
+		{"/v2/app/manifests/" + digest.String(), Route{Kind: Manifest, Name: "app", Digest: digest}},
+		{"/v2/app/referrers/" + digest.String(), Route{Kind: Referrers, Name: "app", Digest: digest}},
+		// The last section in the path ends the name.
+		{"/v2/app/manifests/x/manifests/v1", Route{Kind: Manifest, Name: "app/manifests/x", Tag: "v1"}},
+	} {
+		got, err := Parse(tc.path)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.path, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		code transport.ErrorCode
+		err  error
+	}{
+		{path: "/v1/app/manifests/v1", err: serve.ErrNotFound},
+		{path: "/v2/app/unknown", err: serve.ErrNotFound},
+		{path: "/v2/App/manifests/v1", err: serve.ErrNameInvalid},
+		{path: "/v2/app/manifests/" + strings.Repeat("t", 129), code: transport.TagInvalidErrorCode},
+		{path: "/v2/app/manifests/sha256:short", code: transport.DigestInvalidErrorCode},
+		{path: "/v2/app/blobs/latest", code: transport.DigestInvalidErrorCode},
+		{path: "/v2/app/referrers/latest", code: transport.DigestInvalidErrorCode},
+		{path: "/v2/app/blobs/uploads/session", code: transport.BlobUploadUnknownErrorCode},
+		// A session of the nested repository app/nested.
+		{path: "/v2/app/blobs/uploads/nested/" + strings.Repeat("0f", 16), code: transport.BlobUploadUnknownErrorCode},
+	} {
+		_, err := Parse(tc.path)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded", tc.path)
+			continue
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Parse(%q) = %v, want %v", tc.path, err, tc.err)
+		}
+		if tc.code != "" {
+			var terr *transport.Error
+			if !errors.As(err, &terr) || len(terr.Errors) != 1 || terr.Errors[0].Code != tc.code {
+				t.Errorf("Parse(%q) = %v, want %s", tc.path, err, tc.code)
+			}
+		}
+	}
+}
+
+func TestRouterRemembersVerifiedCredentials(t *testing.T) {
+	// A cost high enough that checking the password dwarfs serving the
+	// request.
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(path, []byte("user:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	st, err := serve.NewStorage(context.Background(), serve.WithConfig(serve.Config{Backend: "mem", AuthHtpasswd: path}))
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	rt := &Router{Storage: st}
+
+	get := func() time.Duration {
+		r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		r.SetBasicAuth("user", "secret")
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		rt.ServeHTTP(rec, r)
+		d := time.Since(start)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /v2/ = %d %s", rec.Code, rec.Body)
+		}
+		return d
+	}
+	first, second := get(), get()
+	if second > first/4 {
+		t.Errorf("second request took %s, first %s; want the password checked once", second, first)
+	}
+}
@@ -0,0 +1,340 @@
+package apt
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Alpine is Alpine Linux, whose packages are installed onto the alpine image
+// of the release.
+var Alpine Distro = alpine{}
+
+type alpine struct{}
+
+// alpineRepositories are the repositories of a release packages are
+// installed from, in order of preference.
+var alpineRepositories = []string{"main", "community"}
+
+const (
+	alpineInstalled = "lib/apk/db/installed"
+	alpineWorld     = "etc/apk/world"
+)
+
+func (alpine) release(tag string) (string, string) {
+	switch tag {
+	case "latest":
+		return "latest-stable", "alpine:latest"
+	case "edge":
+		return "edge", "alpine:edge"
+	default:
+		return "v" + tag, "alpine:" + tag
+	}
+}
+
+func (alpine) mirror() string { return "https://dl-cdn.alpinelinux.org/alpine" }
+
+func (alpine) arch(p v1.Platform) (string, error) {
+	switch p.Architecture {
+	case "amd64":
+		return "x86_64", nil
+	case "arm64":
+		return "aarch64", nil
+	case "arm":
+		if p.Variant == "v6" {
+			return "armhf", nil
+		}
+		return "armv7", nil
+	case "386":
+		return "x86", nil
+	case "ppc64le", "s390x", "riscv64":
+		return p.Architecture, nil
+	}
+	return "", fmt.Errorf("alpine has no packages for %s", p.Architecture)
+}
+
+func (alpine) index(get getter, mirror, release, arch string) ([]*pkg, error) {
+	var pkgs []*pkg
+	for _, repo := range alpineRepositories {
+		dir := path.Join(release, repo, arch)
+		b, err := alpineIndex(get, fmt.Sprintf("%s/%s/APKINDEX.tar.gz", mirror, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paragraphs(b) {
+			pk := alpinePackage(p)
+			if pk.name == "" {
+				continue
+			}
+			pk.path = fmt.Sprintf("%s/%s-%s.apk", dir, pk.name, pk.version)
+			pkgs = append(pkgs, pk)
+		}
+	}
+	return pkgs, nil
+}
+
+// alpineIndex returns the APKINDEX file in the index tarball at the URL.
+func alpineIndex(get getter, url string) ([]byte, error) {
+	rc, err := get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no APKINDEX", url)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == "APKINDEX" {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// alpinePackage returns the package with the entry in an APKINDEX or the
+// installed database.
+func alpinePackage(p []string) *pkg {
+	pk := &pkg{}
+	for _, l := range p {
+		if len(l) < 2 || l[1] != ':' {
+			continue
+		}
+		v := l[2:]
+		switch l[0] {
+		case 'P':
+			pk.name = v
+		case 'V':
+			pk.version = v
+		case 'C':
+			pk.checksum = v
+		case 'D':
+			for _, d := range strings.Fields(v) {
+				if strings.HasPrefix(d, "!") {
+					// Conflicts aren't dependencies.
+					continue
+				}
+				pk.depends = append(pk.depends, []string{alpineName(d)})
+			}
+		case 'p':
+			for _, pr := range strings.Fields(v) {
+				pk.provides = append(pk.provides, alpineName(pr))
+			}
+		}
+	}
+	pk.fields = p
+	return pk
+}
+
+// alpineName returns the name in a dependency or what a package provides,
+// without its version constraint.
+func alpineName(d string) string {
+	if i := strings.IndexAny(d, "<>=~"); i >= 0 {
+		return d[:i]
+	}
+	return d
+}
+
+// unpack writes the files in an apk, which is the gzipped tarball segments
+// of its signature, its control files and its files, one after another.
+// Control files are those whose names start with a dot.
+//
+// If the index has the checksum of the package, which is the SHA-1 of the
+// control segment, it's checked, and so is the SHA-256 of the files segment
+// that the control segment's .PKGINFO records as its datahash, so that every
+// file written is one the index vouches for.
+func (alpine) unpack(p *pkg, r io.Reader, fn func(*tar.Header, io.Reader) error) error {
+	var want []byte
+	if strings.HasPrefix(p.checksum, "Q1") {
+		var err error
+		if want, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(p.checksum, "Q1")); err != nil {
+			return fmt.Errorf("invalid checksum %q: %v", p.checksum, err)
+		}
+	}
+	br := bufio.NewReader(r)
+	var control bool    // whether the control segment has been read
+	var datahash string // the digest of the files segment it records
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		sha1sum, sha256sum := sha1.New(), sha256.New()
+		sr := &segmentReader{r: br, w: io.MultiWriter(sha1sum, sha256sum)}
+		zr, err := gzip.NewReader(sr)
+		if err != nil {
+			return err
+		}
+		zr.Multistream(false)
+		tr := tar.NewReader(zr)
+		var pkginfo bool
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Name == ".PKGINFO" {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				pkginfo, datahash = true, alpineDatahash(b)
+				continue
+			}
+			if strings.HasPrefix(hdr.Name, ".") {
+				continue
+			}
+			if err := fn(hdr, tr); err != nil {
+				return err
+			}
+		}
+		// Read the rest of the segment, so that all of it is digested.
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			return err
+		}
+		switch {
+		case pkginfo:
+			if want != nil && !bytes.Equal(sha1sum.Sum(nil), want) {
+				return fmt.Errorf("%s has checksum Q1%s, but the index says %s", p.path, base64.StdEncoding.EncodeToString(sha1sum.Sum(nil)), p.checksum)
+			}
+			control = true
+		case control && want != nil && datahash != "":
+			if got := hex.EncodeToString(sha256sum.Sum(nil)); got != datahash {
+				return fmt.Errorf("%s has data hash %s, but its .PKGINFO says %q", p.path, got, datahash)
+			}
+		}
+	}
+	if want != nil && !control {
+		return fmt.Errorf("%s has no .PKGINFO to check the index's checksum against", p.path)
+	}
+	return nil
+}
+
+// alpineDatahash returns the datahash that the .PKGINFO records.
+func alpineDatahash(pkginfo []byte) string {
+	for _, l := range strings.Split(string(pkginfo), "\n") {
+		if i := strings.IndexByte(l, '='); i >= 0 && strings.TrimSpace(l[:i]) == "datahash" {
+			return strings.TrimSpace(l[i+1:])
+		}
+	}
+	return ""
+}
+
+// segmentReader reads a segment of an apk from r, writing what it reads to
+// w. It's an io.ByteReader, so that gzip reads no further than the end of
+// the segment's stream.
+type segmentReader struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.w.Write(p[:n])
+	return n, err
+}
+
+func (sr *segmentReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.w.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (alpine) databases() []string { return []string{alpineInstalled, alpineWorld} }
+
+func (alpine) installed(db map[string][]byte) map[string]bool {
+	installed := map[string]bool{}
+	for _, p := range paragraphs(db[alpineInstalled]) {
+		pk := alpinePackage(p)
+		if pk.name == "" {
+			continue
+		}
+		installed[pk.name] = true
+		for _, pr := range pk.provides {
+			installed[pr] = true
+		}
+	}
+	return installed
+}
+
+// record adds the packages to the installed database, with the directories
+// and files each owns, and the requested packages to the world file, so
+// that apk in the image keeps them.
+func (alpine) record(db map[string][]byte, requested []string, pkgs []*pkg, own map[string][]owned) map[string][]byte {
+	var ps [][]string
+	for _, pk := range pkgs {
+		p := append([]string(nil), pk.fields...)
+		var dirs []string
+		files := map[string][]string{}
+		for _, o := range own[pk.name] {
+			dir, file := o.name, ""
+			if !o.dir {
+				dir, file = path.Split(o.name)
+				dir = strings.TrimSuffix(dir, "/")
+			}
+			if dir == "" {
+				continue
+			}
+			if _, ok := files[dir]; !ok {
+				dirs = append(dirs, dir)
+				files[dir] = nil
+			}
+			if file != "" {
+				files[dir] = append(files[dir], file)
+			}
+		}
+		for _, d := range dirs {
+			p = append(p, "F:"+d)
+			for _, f := range files[d] {
+				p = append(p, "R:"+f)
+			}
+		}
+		ps = append(ps, p)
+	}
+
+	world := map[string]bool{}
+	for _, w := range strings.Fields(string(db[alpineWorld])) {
+		world[w] = true
+	}
+	for _, n := range requested {
+		world[n] = true
+	}
+	names := make([]string, 0, len(world))
+	for w := range world {
+		names = append(names, w)
+	}
+	sort.Strings(names)
+
+	return map[string][]byte{
+		alpineInstalled: appendParagraphs(db[alpineInstalled], ps),
+		alpineWorld:     []byte(strings.Join(names, "\n") + "\n"),
+	}
+}
+
+func (alpine) command(names []string) string { return "apk add " + strings.Join(names, " ") }
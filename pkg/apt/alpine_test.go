@@ -0,0 +1,106 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+// apkSegment returns a gzipped tarball of the files, ending the tarball only
+// if end is set, as apks do for their files segment.
+func apkSegment(t *testing.T, files map[string]string, end bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if end {
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// apk returns an apk with the files, and the checksum its index entry would
+// have.
+func apk(t *testing.T, files map[string]string) ([]byte, string) {
+	t.Helper()
+	data := apkSegment(t, files, true)
+	datahash := sha256.Sum256(data)
+	control := apkSegment(t, map[string]string{
+		".PKGINFO": "pkgname = test\ndatahash = " + hex.EncodeToString(datahash[:]) + "\n",
+	}, false)
+	sig := apkSegment(t, map[string]string{".SIGN.RSA.test.rsa.pub": "signature"}, false)
+	sum := sha1.Sum(control)
+	return append(append(sig, control...), data...), "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestAlpineUnpackChecksums(t *testing.T) {
+	b, checksum := apk(t, map[string]string{"usr/bin/test": "hello"})
+	other, _ := apk(t, map[string]string{"usr/bin/test": "goodbye"})
+	for _, tc := range []struct {
+		desc     string
+		apk      []byte
+		checksum string
+		ok       bool
+	}{
+		{"matching", b, checksum, true},
+		{"no checksum", other, "", true},
+		{"other package", other, checksum, false},
+		{"bad checksum", b, "Q1" + base64.StdEncoding.EncodeToString(make([]byte, sha1.Size)), false},
+	} {
+		var names []string
+		err := Alpine.unpack(&pkg{path: "test.apk", checksum: tc.checksum}, bytes.NewReader(tc.apk), func(hdr *tar.Header, r io.Reader) error {
+			names = append(names, hdr.Name)
+			return nil
+		})
+		if tc.ok && err != nil {
+			t.Errorf("%s: unpack: %v", tc.desc, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%s: unpack succeeded, want error", tc.desc)
+		}
+		if tc.ok && strings.Join(names, ",") != "usr/bin/test" {
+			t.Errorf("%s: unpacked %v, want only usr/bin/test", tc.desc, names)
+		}
+	}
+}
+
+func TestAlpineUnpackTamperedData(t *testing.T) {
+	b, checksum := apk(t, map[string]string{"usr/bin/test": "hello"})
+	// Replace the files segment, keeping the signature and control
+	// segments the checksum covers.
+	data := apkSegment(t, map[string]string{"usr/bin/test": "hello"}, true)
+	tampered := append(b[:len(b)-len(data)], apkSegment(t, map[string]string{"usr/bin/test": "evil"}, true)...)
+	err := Alpine.unpack(&pkg{path: "test.apk", checksum: checksum}, bytes.NewReader(tampered), func(*tar.Header, io.Reader) error { return nil })
+	if err == nil {
+		t.Error("unpack of tampered files succeeded, want error")
+	}
+}
+
+func TestPackagesPlus(t *testing.T) {
+	h := &Handler{Prefixes: []string{"apt.kontain.me/"}}
+	got := h.packages("apt.kontain.me/libstdc_plus_plus6/g_plus_plus/curl")
+	if want := []string{"curl", "g++", "libstdc++6"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("packages = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,757 @@
+// Package apt builds images of distribution packages as they're pulled: the
+// requested packages, and those they depend on that the base image doesn't
+// already have, are fetched from the distribution's mirror and unpacked into
+// a new layer on its base image, and recorded in its package database. Built
+// images are written to Storage, keyed by the digest of the set of packages
+// installed, and served from there on later pulls.
+//
+// Packages are unpacked, not installed: their maintainer scripts aren't run,
+// so packages that rely on them to be usable may not be.
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// DefaultIndexMaxAge is how long a package index is used before it's fetched
+// again, if the Handler doesn't say.
+const DefaultIndexMaxAge = time.Hour
+
+// Distro is a distribution whose packages a Handler installs: Alpine or
+// Debian.
+type Distro interface {
+	// release returns the release the tag names, and the image its
+	// packages are installed onto.
+	release(tag string) (release, base string)
+
+	// mirror is the URL of the distribution's default package mirror.
+	mirror() string
+
+	// arch returns the distribution's name for the platform's
+	// architecture.
+	arch(p v1.Platform) (string, error)
+
+	// index fetches the packages available in the release for the
+	// architecture from the mirror.
+	index(get getter, mirror, release, arch string) ([]*pkg, error)
+
+	// unpack calls fn with every file in the package's file, checking
+	// the checksums the index or the file itself have for its parts.
+	unpack(p *pkg, r io.Reader, fn func(*tar.Header, io.Reader) error) error
+
+	// databases are the files of the package database in the image.
+	databases() []string
+
+	// installed returns the packages the database files record, and what
+	// they provide.
+	installed(db map[string][]byte) map[string]bool
+
+	// record returns the database files updated to record the packages
+	// installed, with the files each owns, and those requested.
+	record(db map[string][]byte, requested []string, pkgs []*pkg, owned map[string][]owned) map[string][]byte
+
+	// command is the command the layer is described as created by.
+	command(names []string) string
+}
+
+// pkg is a package in a distribution's index.
+type pkg struct {
+	name, version string
+
+	// depends are the package's dependencies, each satisfied by any of
+	// its alternatives, by name or by what packages provide.
+	depends  [][]string
+	provides []string
+
+	// path is where the package file is, relative to the mirror, and
+	// sha256, if the index has it, is its digest.
+	path, sha256 string
+
+	// checksum, if the index has it, is the checksum of the package's
+	// control segment, for Alpine.
+	checksum string
+
+	// fields are the lines of the package's entry in the index, as the
+	// database records them.
+	fields []string
+}
+
+// owned is a file a package installed.
+type owned struct {
+	name string
+	dir  bool
+}
+
+// getter fetches the URL.
+type getter func(url string) (io.ReadCloser, error)
+
+// Handler is an api.ManifestHandler that installs the packages a request
+// names, one per path component of the repository, so that for Debian,
+//
+//	/v2/curl/jq/manifests/latest
+//
+// serves curl and jq installed on debian:stable-slim. The tag is the release,
+// such as bullseye for Debian or 3.14 or edge for Alpine; latest is the
+// current stable release.
+//
+// Repository names can't have a +, which package names like g++ and
+// libstdc++6 do, so it's written _plus, as in g_plus_plus. Debian package
+// names can't have an _, so that's never ambiguous for Debian.
+type Handler struct {
+	Storage *serve.Storage
+
+	// Distro is the distribution whose packages are installed.
+	Distro Distro
+
+	// Prefixes are stripped from the start of requested repositories, as
+	// many times as they appear there, to give the packages.
+	Prefixes []string
+
+	// Mirror is the URL of the package mirror. If it's empty, the
+	// distribution's default mirror is used.
+	Mirror string
+
+	// Platform is the platform images are built for. If it's nil, they're
+	// built for linux/amd64.
+	Platform *v1.Platform
+
+	// IndexMaxAge is how long a package index is used before it's fetched
+	// again. If it's zero, DefaultIndexMaxAge is used.
+	IndexMaxAge time.Duration
+
+	// Keychain authenticates fetches of base images. If it's nil, they're
+	// anonymous.
+	Keychain authn.Keychain
+
+	// Transport is used for fetches of base images and from the mirror.
+	// If it's nil, they use http.DefaultTransport, traced with
+	// serve.TracingTransport.
+	Transport http.RoundTripper
+
+	// indexes holds the package indexes fetched, by mirror, release and
+	// architecture, and bases the filesystems of base images scanned, by
+	// digest.
+	indexes, bases sync.Map
+}
+
+// NewRouter returns a Router serving the images the Handler builds.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h}
+}
+
+// cacheKey is the name the image with the packages installed on the base
+// image is written under.
+func cacheKey(release, arch string, base v1.Hash, requested []string, pkgs []*pkg) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %s %s\n", release, arch, base, strings.Join(requested, " "))
+	for _, p := range pkgs {
+		fmt.Fprintf(h, "%s=%s %s\n", p.name, p.version, p.path)
+	}
+	return fmt.Sprintf("apt-%x", h.Sum(nil))
+}
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	names := h.packages(rt.Name)
+	release, baseName := h.Distro.release(rt.Tag)
+	log := serve.LoggerFrom(ctx).With("packages", strings.Join(names, " "), "release", release)
+
+	plat := h.platform()
+	arch, err := h.Distro.arch(plat)
+	if err != nil {
+		log.Error("finding architecture", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	get := h.getter(ctx)
+	mirror := strings.TrimSuffix(h.Mirror, "/")
+	if mirror == "" {
+		mirror = h.Distro.mirror()
+	}
+	index, err := h.index(get, mirror, release, arch)
+	if err != nil {
+		log.Error("fetching package index", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	base, bfs, err := h.base(ctx, baseName, plat)
+	if err != nil {
+		log.Error("fetching base image", "base", baseName, "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	pkgs, err := resolve(index, h.Distro.installed(bfs.files), names)
+	if err != nil {
+		log.Error("resolving packages", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	bd, err := base.Digest()
+	if err != nil {
+		serve.WriteError(w, err)
+		return
+	}
+	ck := h.Storage.CacheKey(ctx, cacheKey(release, arch, bd, names, pkgs))
+	if _, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		log.Debug("serving built manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	// Fetch and unpack the packages, unless another request is already
+	// building the same set.
+	img, err := h.Storage.BuildOnce(ck, func() (interface{}, error) {
+		log.Info("installing packages", "count", len(pkgs))
+		return h.build(get, mirror, base, bfs, names, pkgs)
+	})
+	if err != nil {
+		log.Error("building", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	if err := h.Storage.ServeManifest(w, r, img.(v1.Image), ck); err != nil {
+		log.Error("serving built image", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// packages returns the sorted, distinct packages a request for the
+// repository names, with each _plus replaced by +.
+func (h *Handler) packages(repo string) []string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, p := range h.Prefixes {
+			if p != "" && strings.HasPrefix(repo, p) {
+				repo, stripped = strings.TrimPrefix(repo, p), true
+			}
+		}
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range strings.Split(repo, "/") {
+		n = strings.ReplaceAll(n, "_plus", "+")
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *Handler) platform() v1.Platform {
+	if h.Platform != nil {
+		return *h.Platform
+	}
+	return v1.Platform{OS: "linux", Architecture: "amd64"}
+}
+
+func (h *Handler) transport() http.RoundTripper {
+	if h.Transport != nil {
+		return h.Transport
+	}
+	return serve.TracingTransport(http.DefaultTransport)
+}
+
+// getter returns a getter fetching from the mirror as part of the request
+// with the context.
+func (h *Handler) getter(ctx context.Context) getter {
+	client := &http.Client{Transport: h.transport()}
+	return func(url string) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
+
+type cachedIndex struct {
+	fetched time.Time
+	pkgs    []*pkg
+}
+
+// index returns the packages available in the release, fetching its index
+// unless it was fetched less than IndexMaxAge ago.
+func (h *Handler) index(get getter, mirror, release, arch string) ([]*pkg, error) {
+	maxAge := h.IndexMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultIndexMaxAge
+	}
+	key := strings.Join([]string{mirror, release, arch}, " ")
+	if v, ok := h.indexes.Load(key); ok {
+		if ci := v.(*cachedIndex); time.Since(ci.fetched) < maxAge {
+			return ci.pkgs, nil
+		}
+	}
+	pkgs, err := h.Distro.index(get, mirror, release, arch)
+	if err != nil {
+		return nil, err
+	}
+	h.indexes.Store(key, &cachedIndex{fetched: time.Now(), pkgs: pkgs})
+	return pkgs, nil
+}
+
+// base fetches the base image for the platform, and the parts of its
+// filesystem installing packages on it needs, which are scanned once for
+// each base image.
+func (h *Handler) base(ctx context.Context, base string, plat v1.Platform) (v1.Image, *baseFS, error) {
+	ref, err := name.ParseReference(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithTransport(h.transport()), remote.WithPlatform(plat)}
+	if h.Keychain != nil {
+		opts = append(opts, remote.WithAuthFromKeychain(h.Keychain))
+	}
+	img, err := remote.Image(ref, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := img.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if v, ok := h.bases.Load(d); ok {
+		return img, v.(*baseFS), nil
+	}
+	bfs, err := scanBase(img, h.Distro.databases())
+	if err != nil {
+		return nil, nil, fmt.Errorf("scanning base image %s: %v", base, err)
+	}
+	h.bases.Store(d, bfs)
+	return img, bfs, nil
+}
+
+// resolve returns the named packages, and those they depend on, that aren't
+// installed, sorted by name.
+func resolve(index []*pkg, installed map[string]bool, names []string) ([]*pkg, error) {
+	byName := map[string]*pkg{}
+	provided := map[string][]*pkg{}
+	for _, p := range index {
+		if _, ok := byName[p.name]; !ok {
+			byName[p.name] = p
+		}
+		for _, pr := range p.provides {
+			provided[pr] = append(provided[pr], p)
+		}
+	}
+
+	selected := map[string]*pkg{}
+	var queue []*pkg
+	add := func(p *pkg) {
+		if !installed[p.name] && selected[p.name] == nil {
+			selected[p.name] = p
+			queue = append(queue, p)
+		}
+	}
+	satisfied := func(n string) bool {
+		if installed[n] || selected[n] != nil {
+			return true
+		}
+		for _, p := range provided[n] {
+			if selected[p.name] != nil {
+				return true
+			}
+		}
+		return false
+	}
+	find := func(n string) *pkg {
+		if p := byName[n]; p != nil {
+			return p
+		}
+		if ps := provided[n]; len(ps) > 0 {
+			return ps[0]
+		}
+		return nil
+	}
+
+	for _, n := range names {
+		p := byName[n]
+		if p == nil {
+			return nil, serve.NewError(http.StatusNotFound, transport.NameUnknownErrorCode, "no package %q", n)
+		}
+		add(p)
+	}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+	deps:
+		for _, alts := range p.depends {
+			for _, a := range alts {
+				if satisfied(a) {
+					continue deps
+				}
+			}
+			for _, a := range alts {
+				if dep := find(a); dep != nil {
+					add(dep)
+					continue deps
+				}
+			}
+			return nil, fmt.Errorf("%s depends on %s, which no package provides", p.name, strings.Join(alts, " | "))
+		}
+	}
+
+	pkgs := make([]*pkg, 0, len(selected))
+	for _, p := range selected {
+		pkgs = append(pkgs, p)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+	return pkgs, nil
+}
+
+// build returns the base image with the packages unpacked in a new layer,
+// along with the updated package database.
+func (h *Handler) build(get getter, mirror string, base v1.Image, bfs *baseFS, names []string, pkgs []*pkg) (v1.Image, error) {
+	if len(pkgs) == 0 {
+		return base, nil
+	}
+	var buf bytes.Buffer
+	lw := &layerWriter{tw: tar.NewWriter(&buf), base: bfs, dirs: map[string]bool{}}
+	own := map[string][]owned{}
+	for _, p := range pkgs {
+		if err := h.unpack(get, mirror, p, func(hdr *tar.Header, r io.Reader) error {
+			o, err := lw.add(hdr, r)
+			if err == nil && o.name != "" {
+				own[p.name] = append(own[p.name], o)
+			}
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("unpacking %s %s: %v", p.name, p.version, err)
+		}
+	}
+	db := h.Distro.record(bfs.files, names, pkgs, own)
+	paths := make([]string, 0, len(db))
+	for p := range db {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := lw.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     p,
+			Mode:     0644,
+			Size:     int64(len(db[p])),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := lw.tw.Write(db[p]); err != nil {
+			return nil, err
+		}
+	}
+	if err := lw.tw.Close(); err != nil {
+		return nil, err
+	}
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mt, err := base.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	lmt := types.DockerLayer
+	if mt == types.OCIManifestSchema1 {
+		lmt = types.OCILayer
+	}
+	return mutate.Append(base, mutate.Addendum{
+		Layer:     layer,
+		MediaType: lmt,
+		History:   v1.History{CreatedBy: h.Distro.command(names)},
+	})
+}
+
+// unpack fetches the package file and calls fn with every file in it,
+// checking its digest if the index has it.
+func (h *Handler) unpack(get getter, mirror string, p *pkg, fn func(*tar.Header, io.Reader) error) error {
+	rc, err := get(mirror + "/" + p.path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	var sum hash.Hash
+	if p.sha256 != "" {
+		sum = sha256.New()
+		r = io.TeeReader(rc, sum)
+	}
+	if err := h.Distro.unpack(p, r, fn); err != nil {
+		return err
+	}
+	// Read the rest of the file, so that all of it is digested.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if sum != nil {
+		if got := hex.EncodeToString(sum.Sum(nil)); got != p.sha256 {
+			return fmt.Errorf("%s has sha256 %s, but the index says %s", p.path, got, p.sha256)
+		}
+	}
+	return nil
+}
+
+// baseFS is what installing packages on a base image needs to know of its
+// filesystem: its symlinks, which the paths of files in packages are resolved
+// through, and the files of its package database.
+type baseFS struct {
+	symlinks map[string]string
+	files    map[string][]byte
+}
+
+// scanBase reads the base image's symlinks and the named files from its
+// layers, in order, applying whiteouts.
+func scanBase(img v1.Image, files []string) (*baseFS, error) {
+	bfs := &baseFS{symlinks: map[string]string{}, files: map[string][]byte{}}
+	want := map[string]bool{}
+	for _, f := range files {
+		want[f] = true
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		if err := bfs.scanLayer(l, want); err != nil {
+			return nil, err
+		}
+	}
+	return bfs, nil
+}
+
+func (bfs *baseFS) scanLayer(l v1.Layer, want map[string]bool) error {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == ".wh..wh..opq":
+			bfs.remove(strings.TrimSuffix(dir, "/"), false)
+			continue
+		case strings.HasPrefix(base, ".wh."):
+			bfs.remove(dir+strings.TrimPrefix(base, ".wh."), true)
+			continue
+		}
+		delete(bfs.symlinks, name)
+		delete(bfs.files, name)
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink:
+			bfs.symlinks[name] = hdr.Linkname
+		case want[name] && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA):
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			bfs.files[name] = b
+		}
+	}
+}
+
+// remove forgets what's under the path, and if self is set, the path
+// itself.
+func (bfs *baseFS) remove(p string, self bool) {
+	under := func(n string) bool {
+		return (self && n == p) || p == "" || strings.HasPrefix(n, p+"/")
+	}
+	for n := range bfs.symlinks {
+		if under(n) {
+			delete(bfs.symlinks, n)
+		}
+	}
+	for n := range bfs.files {
+		if under(n) {
+			delete(bfs.files, n)
+		}
+	}
+}
+
+// resolve returns the path with the symlinks among its parents resolved,
+// and, if full is set, the symlink it is itself, so that files in packages
+// that are under directories the base image links elsewhere, as with merged
+// /usr, are written where the links point, rather than replacing them.
+func (bfs *baseFS) resolve(name string, full bool) string {
+	// Bound the links followed, in case they loop.
+	for i := 0; i < 40; i++ {
+		parts := strings.Split(name, "/")
+		n := len(parts)
+		if !full {
+			n--
+		}
+		resolved := false
+		for j := 1; j <= n; j++ {
+			prefix := strings.Join(parts[:j], "/")
+			target, ok := bfs.symlinks[prefix]
+			if !ok {
+				continue
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(prefix), target)
+			}
+			name = cleanName(path.Join(target, strings.Join(parts[j:], "/")))
+			resolved = true
+			break
+		}
+		if !resolved {
+			break
+		}
+	}
+	return name
+}
+
+// cleanName returns the path of the file in a tarball relative to the root,
+// which is the empty string.
+func cleanName(n string) string {
+	return strings.TrimPrefix(path.Clean("/"+n), "/")
+}
+
+// layerWriter writes the files of packages to a layer.
+type layerWriter struct {
+	tw   *tar.Writer
+	base *baseFS
+
+	// dirs are the directories written, which packages share.
+	dirs map[string]bool
+}
+
+// add writes the file to the layer, returning what the package owns, if
+// anything.
+func (lw *layerWriter) add(hdr *tar.Header, r io.Reader) (owned, error) {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	default:
+		return owned{}, nil
+	}
+	dir := hdr.Typeflag == tar.TypeDir
+	name := cleanName(hdr.Name)
+	if name == "" {
+		return owned{}, nil
+	}
+	name = lw.base.resolve(name, dir)
+	if dir {
+		if lw.dirs[name] {
+			return owned{name: name, dir: true}, nil
+		}
+		lw.dirs[name] = true
+	}
+
+	h := *hdr
+	h.Name = name
+	if dir {
+		h.Name += "/"
+	}
+	if h.Typeflag == tar.TypeLink {
+		h.Linkname = lw.base.resolve(cleanName(h.Linkname), false)
+	}
+	// Drop the records of package tools, such as the checksums apk
+	// keeps, keeping extended attributes.
+	h.PAXRecords = nil
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if h.PAXRecords == nil {
+				h.PAXRecords = map[string]string{}
+			}
+			h.PAXRecords[k] = v
+		}
+	}
+	h.Format = tar.FormatUnknown
+	if err := lw.tw.WriteHeader(&h); err != nil {
+		return owned{}, err
+	}
+	if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+		if _, err := io.Copy(lw.tw, r); err != nil {
+			return owned{}, err
+		}
+	}
+	return owned{name: name, dir: dir}, nil
+}
+
+// paragraphs splits the lines of the file into paragraphs of lines, which
+// are separated by blank lines.
+func paragraphs(b []byte) [][]string {
+	var ps [][]string
+	var p []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(l) == "" {
+			if len(p) > 0 {
+				ps = append(ps, p)
+			}
+			p = nil
+			continue
+		}
+		p = append(p, l)
+	}
+	if len(p) > 0 {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// appendParagraphs returns the database file with the paragraphs appended,
+// separated by blank lines.
+func appendParagraphs(db []byte, ps [][]string) []byte {
+	var buf bytes.Buffer
+	if s := strings.TrimRight(string(db), "\n"); s != "" {
+		buf.WriteString(s)
+		buf.WriteString("\n\n")
+	}
+	for i, p := range ps {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		for _, l := range p {
+			buf.WriteString(l)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
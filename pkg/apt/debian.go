@@ -0,0 +1,323 @@
+package apt
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Debian is Debian, whose packages are installed onto the debian slim image
+// of the release.
+var Debian Distro = debian{}
+
+type debian struct{}
+
+const debianStatus = "var/lib/dpkg/status"
+
+// debianIndexOnly are the fields of the index that aren't recorded in the
+// status database.
+var debianIndexOnly = map[string]bool{
+	"Filename":        true,
+	"Size":            true,
+	"MD5sum":          true,
+	"SHA1":            true,
+	"SHA256":          true,
+	"SHA512":          true,
+	"Description-md5": true,
+}
+
+func (debian) release(tag string) (string, string) {
+	if tag == "latest" {
+		tag = "stable"
+	}
+	return tag, fmt.Sprintf("debian:%s-slim", tag)
+}
+
+func (debian) mirror() string { return "https://deb.debian.org/debian" }
+
+func (debian) arch(p v1.Platform) (string, error) {
+	switch p.Architecture {
+	case "amd64", "arm64", "s390x", "riscv64":
+		return p.Architecture, nil
+	case "arm":
+		if p.Variant == "v5" {
+			return "armel", nil
+		}
+		return "armhf", nil
+	case "386":
+		return "i386", nil
+	case "ppc64le":
+		return "ppc64el", nil
+	case "mips64le":
+		return "mips64el", nil
+	}
+	return "", fmt.Errorf("debian has no packages for %s", p.Architecture)
+}
+
+func (debian) index(get getter, mirror, release, arch string) ([]*pkg, error) {
+	rc, err := get(fmt.Sprintf("%s/dists/%s/main/binary-%s/Packages.gz", mirror, release, arch))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []*pkg
+	for _, p := range paragraphs(b) {
+		if pk := debianPackage(p); pk.name != "" {
+			pkgs = append(pkgs, pk)
+		}
+	}
+	return pkgs, nil
+}
+
+// debianFields returns the fields of an entry in the index or the status
+// database, with continuation lines joined.
+func debianFields(p []string) map[string]string {
+	f := map[string]string{}
+	var last string
+	for _, l := range p {
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			if last != "" {
+				f[last] += "\n" + l
+			}
+			continue
+		}
+		i := strings.IndexByte(l, ':')
+		if i < 0 {
+			continue
+		}
+		last = l[:i]
+		f[last] = strings.TrimSpace(l[i+1:])
+	}
+	return f
+}
+
+// debianPackage returns the package with the entry in the index.
+func debianPackage(p []string) *pkg {
+	f := debianFields(p)
+	pk := &pkg{
+		name:    f["Package"],
+		version: f["Version"],
+		path:    f["Filename"],
+		sha256:  f["SHA256"],
+	}
+	for _, field := range []string{"Pre-Depends", "Depends"} {
+		for _, d := range debianList(f[field]) {
+			var alts []string
+			for _, a := range strings.Split(d, "|") {
+				alts = append(alts, debianName(a))
+			}
+			pk.depends = append(pk.depends, alts)
+		}
+	}
+	for _, pr := range debianList(f["Provides"]) {
+		pk.provides = append(pk.provides, debianName(pr))
+	}
+
+	// Record the entry as installed, without the fields only the index
+	// has.
+	var skip bool
+	for _, l := range p {
+		if !strings.HasPrefix(l, " ") && !strings.HasPrefix(l, "\t") {
+			i := strings.IndexByte(l, ':')
+			skip = i >= 0 && debianIndexOnly[l[:i]]
+			if !skip && i >= 0 && l[:i] == "Package" {
+				pk.fields = append(pk.fields, l, "Status: install ok installed")
+				continue
+			}
+		}
+		if !skip {
+			pk.fields = append(pk.fields, l)
+		}
+	}
+	return pk
+}
+
+// debianList splits a comma-separated field.
+func debianList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// debianName returns the name of the package in a relation, without its
+// version constraint, architecture qualifier or architecture restrictions.
+func debianName(r string) string {
+	r = strings.TrimSpace(r)
+	if i := strings.IndexAny(r, " (["); i >= 0 {
+		r = r[:i]
+	}
+	if i := strings.IndexByte(r, ':'); i >= 0 {
+		r = r[:i]
+	}
+	return r
+}
+
+// unpack writes the files in a deb, which is an ar archive of its version,
+// its control files and its files, in a tarball compressed with gzip, xz,
+// zstd or bzip2, or not at all. xz tarballs are decompressed by running xz.
+func (debian) unpack(_ *pkg, r io.Reader, fn func(*tar.Header, io.Reader) error) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != "!<arch>\n" {
+		return errors.New("not a deb")
+	}
+	for {
+		hdr := make([]byte, 60)
+		if _, err := io.ReadFull(br, hdr); err == io.EOF {
+			return errors.New("deb has no data tarball")
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil {
+			return fmt.Errorf("deb member %q has bad size: %v", name, err)
+		}
+		if strings.HasPrefix(name, "data.tar") {
+			return debianData(io.LimitReader(br, size), strings.TrimPrefix(name, "data.tar"), fn)
+		}
+		// Members are padded to an even size.
+		if _, err := io.CopyN(ioutil.Discard, br, size+size%2); err != nil {
+			return err
+		}
+	}
+}
+
+// debianData writes the files in a deb's data tarball, compressed as its
+// extension says.
+func debianData(r io.Reader, ext string, fn func(*tar.Header, io.Reader) error) error {
+	var wait func() error
+	switch ext {
+	case "":
+	case ".gz":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	case ".bz2":
+		r = bzip2.NewReader(r)
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case ".xz":
+		var stderr bytes.Buffer
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin, cmd.Stderr = r, &stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("running xz: %v", err)
+		}
+		r = out
+		wait = func() error {
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("xz: %v: %s", err, stderr.String())
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("deb data tarball has unknown compression %q", ext)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = fn(hdr, tr)
+		}
+		if err != nil {
+			if wait != nil {
+				io.Copy(ioutil.Discard, r)
+				wait()
+			}
+			return err
+		}
+	}
+	if wait != nil {
+		// Read the rest of xz's output, so that it can exit.
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+		return wait()
+	}
+	return nil
+}
+
+func (debian) databases() []string { return []string{debianStatus} }
+
+func (debian) installed(db map[string][]byte) map[string]bool {
+	installed := map[string]bool{}
+	for _, p := range paragraphs(db[debianStatus]) {
+		f := debianFields(p)
+		if !strings.HasSuffix(f["Status"], " installed") {
+			continue
+		}
+		installed[f["Package"]] = true
+		for _, pr := range debianList(f["Provides"]) {
+			installed[debianName(pr)] = true
+		}
+	}
+	return installed
+}
+
+// record adds the packages to the status database, and writes the lists of
+// the files each owns, for dpkg in the image.
+func (debian) record(db map[string][]byte, requested []string, pkgs []*pkg, own map[string][]owned) map[string][]byte {
+	files := map[string][]byte{}
+	var ps [][]string
+	for _, pk := range pkgs {
+		ps = append(ps, pk.fields)
+
+		list := pk.name
+		if f := debianFields(pk.fields); f["Multi-Arch"] == "same" {
+			list += ":" + f["Architecture"]
+		}
+		var buf bytes.Buffer
+		buf.WriteString("/.\n")
+		for _, o := range own[pk.name] {
+			buf.WriteString("/" + o.name + "\n")
+		}
+		files[fmt.Sprintf("var/lib/dpkg/info/%s.list", list)] = buf.Bytes()
+	}
+	files[debianStatus] = appendParagraphs(db[debianStatus], ps)
+	return files
+}
+
+func (debian) command(names []string) string { return "apt-get install " + strings.Join(names, " ") }
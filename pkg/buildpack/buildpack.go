@@ -0,0 +1,322 @@
+// Package buildpack builds apps from source on GitHub into images as they're
+// pulled, with Cloud Native Buildpacks: the requested repository is fetched at
+// the requested revision and built and exported by the buildpacks lifecycle,
+// onto a run image. Built images are written to Storage and served from there
+// on later pulls of the same commit.
+package buildpack
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-github/v32/github"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/run"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+const (
+	// DefaultRunImage is the image apps are exported onto if the Handler
+	// doesn't name one.
+	DefaultRunImage = "gcr.io/buildpacks/gcp/run:v1"
+
+	// DefaultLifecycle is the directory the lifecycle binaries are in if
+	// the Handler doesn't name one, as in builder images.
+	DefaultLifecycle = "/lifecycle"
+)
+
+var commitRE = regexp.MustCompile("[a-f0-9]{40}")
+
+// Handler is an api.ManifestHandler that builds the app in the GitHub
+// repository a request is for, so that
+//
+//	/v2/googlecloudplatform/buildpack-samples/sample-go/manifests/latest
+//
+// serves the sample-go directory of
+// github.com/googlecloudplatform/buildpack-samples, at the head of its
+// default branch, built with buildpacks.
+//
+// The tag is the revision: latest for the default branch, latest-release for
+// the latest release, or a branch, tag or commit. Requests for anything but a
+// full commit SHA are redirected to the commit it resolves to, so that each
+// commit is built once.
+//
+// The lifecycle exports the image to a registry, from which it's fetched and
+// written to Storage, so the Handler must run where the lifecycle binaries,
+// and the buildpacks they detect, are installed, as in a builder image. Only
+// one build may run at a time, since the lifecycle's $HOME is replaced for
+// each.
+type Handler struct {
+	Storage *serve.Storage
+
+	// Repository is where the lifecycle exports images, e.g.
+	// gcr.io/my-project; each is pushed to a new image in it.
+	Repository string
+
+	// RunImage is the image apps are exported onto. If it's empty,
+	// DefaultRunImage is used.
+	RunImage string
+
+	// Lifecycle is the directory the lifecycle binaries are in. If it's
+	// empty, DefaultLifecycle is used.
+	Lifecycle string
+
+	// Keychain authenticates the lifecycle's pushes to Repository and
+	// fetches of the images it exports. If it's nil, they're anonymous.
+	Keychain authn.Keychain
+
+	// Transport is used for fetches of exported images. If it's nil, they
+	// use http.DefaultTransport, traced with serve.TracingTransport.
+	Transport http.RoundTripper
+
+	// GitHub resolves revisions to commits. If it's nil, an
+	// unauthenticated client is used.
+	GitHub *github.Client
+}
+
+// NewRouter returns a Router serving the images the Handler builds.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h}
+}
+
+// cacheKey is the name the image built for the path at the revision is
+// written under.
+func cacheKey(path, revision string) string {
+	ck := []byte(fmt.Sprintf("%s-%s", strings.ReplaceAll(path, "/", "_"), revision))
+	return fmt.Sprintf("buildpack-%x", md5.Sum(ck))
+}
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
+
+	// Determine source repo and revision.
+	parts := strings.Split(rt.Name, "/")
+	if len(parts) < 2 {
+		serve.WriteError(w, fmt.Errorf("%w: must specify GitHub repository", serve.ErrNameInvalid))
+		return
+	}
+	ghOwner, ghRepo := parts[0], parts[1]
+	path := strings.Join(parts[2:], "/")
+	log = log.With("repo", ghOwner+"/"+ghRepo, "path", path)
+
+	// If the image tag looks like a commit SHA, see if we already have a
+	// manifest cached for that revision and serve it directly.  Otherwise,
+	// resolve the branch/tag/whatever to a SHA and redirect to that SHA
+	// image tag.
+	revision := rt.Tag
+	if !commitRE.MatchString(revision) {
+		commit, err := h.resolveCommit(ctx, ghOwner, ghRepo, revision)
+		if err != nil {
+			log.Error("resolving revision", "revision", revision, "error", err)
+			serve.WriteError(w, err)
+			return
+		}
+		log.Info("resolved revision", "revision", revision, "commit", commit)
+		path := r.URL.Path[:strings.LastIndex(r.URL.Path, "/")+1] + commit
+		http.Redirect(w, r, path, http.StatusSeeOther)
+		return
+	}
+	ck := h.Storage.CacheKey(ctx, cacheKey(path, revision))
+	if _, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		log.Debug("serving built manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	// Fetch, detect and build source, unless another request is already
+	// building it.
+	img, err := h.Storage.BuildOnce(ck, func() (interface{}, error) {
+		image, err := h.fetchAndBuild(ctx, ghOwner, ghRepo, revision, path)
+		if err != nil {
+			return nil, err
+		}
+		return h.getImage(ctx, image)
+	})
+	if err != nil {
+		log.Error("building", "commit", revision, "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	if err := h.Storage.ServeManifest(w, r, img.(v1.Image), ck); err != nil {
+		log.Error("serving built image", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// resolveCommit resolves a ref (branch, tag, PR, commit) into its SHA. If the
+// ref is "latest", the repo's default branch is used; if it's
+// "latest-release", the repo's latest release tag is.
+func (h *Handler) resolveCommit(ctx context.Context, owner, repo, ref string) (string, error) {
+	client := h.GitHub
+	if client == nil {
+		client = github.NewClient(nil)
+	}
+
+	if ref == "latest" {
+		repo, _, err := client.Repositories.Get(ctx, owner, repo)
+		if err != nil {
+			return "", err
+		}
+		ref = repo.GetDefaultBranch()
+	}
+	if ref == "latest-release" {
+		release, resp, err := client.Repositories.GetLatestRelease(ctx, owner, repo)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return "", fmt.Errorf("%w: repository has no releases", serve.ErrNotFound)
+		}
+		if err != nil {
+			return "", err
+		}
+		ref = release.GetTagName()
+	}
+
+	commit, _, err := client.Repositories.GetCommit(ctx, owner, repo, ref)
+	if err != nil {
+		return "", err
+	}
+	return commit.GetSHA(), nil
+}
+
+// fetchAndBuild fetches the source at the commit, builds the app at the path
+// in it, and returns the image the lifecycle exported.
+func (h *Handler) fetchAndBuild(ctx context.Context, ghOwner, ghRepo, revision, path string) (string, error) {
+	if h.Repository == "" {
+		return "", errors.New("no repository to export images to")
+	}
+	image := fmt.Sprintf("%s/built-%d", h.Repository, time.Now().UnixNano())
+	source := fmt.Sprintf("https://github.com/%s/%s/archive/%s.tar.gz", ghOwner, ghRepo, revision)
+
+	if resp, err := http.Head(source); err != nil {
+		return "", err
+	} else if resp.StatusCode == http.StatusNotFound {
+		return "", serve.ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD %s (%d): %s", source, resp.StatusCode, resp.Status)
+	}
+
+	src, layers, err := prepareWorkspace()
+	if err != nil {
+		return "", err
+	}
+	// Clean up workspace.
+	defer func() {
+		for _, dir := range []string{src, layers, os.Getenv("HOME")} {
+			if err := os.RemoveAll(dir); err != nil {
+				serve.LoggerFrom(ctx).Error("removing workspace", "dir", dir, "error", err)
+			}
+		}
+		os.Setenv("HOME", "/home/")
+	}()
+	if err := h.writeDockerConfig(image); err != nil {
+		return "", err
+	}
+
+	lc := h.Lifecycle
+	if lc == "" {
+		lc = DefaultLifecycle
+	}
+	base := h.RunImage
+	if base == "" {
+		base = DefaultRunImage
+	}
+	srcpath := filepath.Join(src, path)
+	out := serve.LoggerFrom(ctx).Writer(serve.LevelInfo)
+	for _, cmd := range []string{
+		fmt.Sprintf("chown -R %d:%d %s", os.Geteuid(), os.Getgid(), src),
+		fmt.Sprintf("chown -R %d:%d %s", os.Geteuid(), os.Getgid(), layers),
+		fmt.Sprintf("curl -fsSL %s | tar xz --strip-components=1 -C %s", source, src),
+		fmt.Sprintf("%s/detector -app=%s -group=%s/group.toml -plan=%s/plan.toml", lc, srcpath, layers, layers),
+		fmt.Sprintf("%s/analyzer -layers=%s -group=%s/group.toml %s", lc, layers, layers, image),
+		fmt.Sprintf("%s/builder -layers=%s -app=%s -group=%s/group.toml -plan=%s/plan.toml", lc, layers, srcpath, layers, layers),
+		fmt.Sprintf("%s/exporter -layers=%s -app=%s -image=%s -group=%s/group.toml %s", lc, layers, srcpath, base, layers, image),
+	} {
+		if err := run.Do(out, cmd); err != nil {
+			return "", fmt.Errorf("Running %q: %v", cmd, err)
+		}
+	}
+	return image, nil
+}
+
+// prepareWorkspace creates the directories the app's source and its layers
+// are written to, and sets $HOME to a new one, since it's otherwise not
+// writable.
+func prepareWorkspace() (string, string, error) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", "", err
+	}
+	layers, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", "", err
+	}
+	home, err := ioutil.TempDir("", "")
+	if err != nil {
+		return "", "", err
+	}
+	os.Setenv("HOME", home)
+	return src, layers, nil
+}
+
+// writeDockerConfig writes the credentials the Keychain has for the image's
+// registry to ~/.docker/config.json, for the lifecycle to push with.
+func (h *Handler) writeDockerConfig(image string) error {
+	if h.Keychain == nil {
+		return nil
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+	auth, err := h.Keychain.Resolve(ref.Context().Registry)
+	if err != nil {
+		return err
+	}
+	cfg, err := auth.Authorization()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]map[string]*authn.AuthConfig{
+		"auths": {ref.Context().RegistryStr(): cfg},
+	})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(os.Getenv("HOME"), ".docker")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), b, 0600)
+}
+
+// getImage fetches the image the lifecycle exported.
+func (h *Handler) getImage(ctx context.Context, image string) (v1.Image, error) {
+	ref, err := name.NewTag(image, name.WeakValidation)
+	if err != nil {
+		return nil, err
+	}
+	t := h.Transport
+	if t == nil {
+		t = serve.TracingTransport(http.DefaultTransport)
+	}
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithTransport(t)}
+	if h.Keychain != nil {
+		opts = append(opts, remote.WithAuthFromKeychain(h.Keychain))
+	}
+	return remote.Image(ref, opts...)
+}
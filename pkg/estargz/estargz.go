@@ -0,0 +1,237 @@
+// Package estargz serves upstream images with their layers converted to
+// eStargz, for the stargz snapshotter to pull lazily: each layer is rewritten
+// as a seekable gzip with a table of contents and a landmark file, and its
+// descriptor in the manifest is annotated with the digest of the table of
+// contents and the layer's uncompressed size. Converted images are written
+// to Storage and served from there on later pulls.
+package estargz
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/mirror"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// Handler is an api.ManifestHandler that converts the layers of the
+// upstream image or index a request is for to eStargz, so that with the
+// prefix estargz/,
+//
+//	/v2/estargz/docker.io/library/ubuntu/manifests/latest
+//
+// serves docker.io/library/ubuntu:latest with eStargz layers.
+type Handler struct {
+	Storage *serve.Storage
+	mirror.Upstream
+}
+
+// NewRouter returns a Router serving the images the Handler converts,
+// passing requests for manifests by digest to it too, so that images pinned
+// by the digest of the upstream image are converted. Requests by the digest
+// of a converted manifest are served from Storage.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h, ManifestsByDigest: true}
+}
+
+// cacheKey is the name the conversion of the upstream manifest with the
+// digest is written under.
+func cacheKey(digest string) string { return fmt.Sprintf("estargz-%s", digest) }
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
+	if rt.Tag == "" {
+		if _, err := h.Storage.BlobExists(ctx, rt.Digest.String()); err == nil {
+			serve.VerifyDigests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.Storage.ServeBlob(w, r, rt.Digest.String())
+			})).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	ref, err := h.Reference(rt)
+	if err != nil {
+		log.Error("parsing upstream reference", "error", err)
+		serve.WriteError(w, fmt.Errorf("%w: %v", serve.ErrNameInvalid, err))
+		return
+	}
+	log = log.With("upstream", ref.String())
+	if err := h.Storage.CachedFailure(ctx, ref); err != nil {
+		log.Info("upstream failure cached", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	desc, err := remote.Get(ref, h.RemoteOptions(r)...)
+	if err != nil {
+		log.Error("fetching upstream manifest", "error", err)
+		h.Storage.RecordFailure(ctx, ref, err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	// Serve the conversion of the upstream manifest if it's been written.
+	ck := h.Storage.CacheKey(ctx, cacheKey(desc.Digest.String()))
+	if d, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Docker-Content-Digest", d.Digest.String())
+			w.Header().Set("Content-Type", string(d.MediaType))
+			w.Header().Set("Content-Length", fmt.Sprint(d.Size))
+			return
+		}
+		log.Debug("serving converted manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	if err := h.convert(w, r, desc, ck); err != nil {
+		log.Error("converting to estargz", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// convert converts the upstream image or index to eStargz, then writes and
+// serves it, also under the cache key.
+func (h *Handler) convert(w http.ResponseWriter, r *http.Request, desc *remote.Descriptor, ck string) error {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if idx, err = ConvertIndex(idx); err != nil {
+			return fmt.Errorf("converting index: %v", err)
+		}
+		return h.Storage.ServeIndex(w, r, idx, ck)
+
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return errors.New("docker schema 1 images are not supported")
+
+	default:
+		// Assume anything else is an image, since some registries don't set
+		// mediaTypes properly.
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if img, err = ConvertImage(img); err != nil {
+			return fmt.Errorf("converting image: %v", err)
+		}
+		return h.Storage.ServeManifest(w, r, img, ck)
+	}
+}
+
+// ConvertImage returns the image with each of its layers converted to
+// eStargz, annotated with the digest of its table of contents and its
+// uncompressed size.
+func ConvertImage(img v1.Image) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	ocfg := cfg.DeepCopy()
+	ocfg.History = nil
+	ocfg.RootFS.DiffIDs = nil
+
+	oimg, err := mutate.ConfigFile(empty.Image, ocfg)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	adds := make([]mutate.Addendum, 0, len(layers))
+	for _, layer := range layers {
+		// Cache the compressed layer, so that it's only built once as
+		// it's digested, measured and written.
+		ol, err := tarball.LayerFromOpener(layer.Uncompressed, tarball.WithEstargz, tarball.WithCompressedCaching)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := partial.Descriptor(ol)
+		if err != nil {
+			return nil, err
+		}
+		size, err := uncompressedSize(ol)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer:     ol,
+			MediaType: types.DockerLayer,
+			Annotations: map[string]string{
+				estargz.TOCJSONDigestAnnotation:         desc.Annotations[estargz.TOCJSONDigestAnnotation],
+				estargz.StoreUncompressedSizeAnnotation: fmt.Sprint(size),
+			},
+		})
+	}
+	return mutate.Append(oimg, adds...)
+}
+
+// uncompressedSize returns the size of the layer's uncompressed contents,
+// decompressing its cached compressed blob rather than building it again.
+func uncompressedSize(l v1.Layer) (int64, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	return io.Copy(ioutil.Discard, zr)
+}
+
+// ConvertIndex returns the index with each of its images converted as by
+// ConvertImage.
+func ConvertIndex(idx v1.ImageIndex) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	adds := make([]mutate.IndexAddendum, 0, len(im.Manifests))
+	for _, desc := range im.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		oimg, err := ConvertImage(img)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add: oimg,
+			Descriptor: v1.Descriptor{
+				URLs:        desc.URLs,
+				MediaType:   desc.MediaType,
+				Annotations: desc.Annotations,
+				Platform:    desc.Platform,
+			},
+		})
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), mt), nil
+}
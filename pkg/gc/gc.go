@@ -0,0 +1,61 @@
+package gc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// Options configures a garbage collection.
+type Options struct {
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+
+	// GracePeriod protects blobs modified within it, as they may belong
+	// to an image still being written. The default is a day.
+	GracePeriod time.Duration
+
+	// Inventory, if set, is the path of an OSS inventory report CSV to
+	// enumerate blobs from, instead of listing the bucket. It's cheaper
+	// for large buckets, but doesn't include blobs written since the
+	// report was generated, which are then never collected in this run.
+	Inventory string
+}
+
+// Run deletes the blobs in the storage that aren't reachable from any
+// stored manifest or tag, and returns a report of what was deleted.
+func Run(ctx context.Context, st *serve.Storage, opts Options) (serve.GCReport, error) {
+	objects, err := enumerate(ctx, st, opts)
+	if err != nil {
+		return serve.GCReport{}, err
+	}
+	return st.CollectGarbage(ctx, objects, serve.GCOptions{
+		DryRun:      opts.DryRun,
+		GracePeriod: opts.GracePeriod,
+	})
+}
+
+// enumerate returns the blobs in the storage, from the inventory report if
+// one is given.
+func enumerate(ctx context.Context, st *serve.Storage, opts Options) ([]serve.GCObject, error) {
+	if opts.Inventory == "" {
+		objects, err := st.ListBlobs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing blobs: %v", err)
+		}
+		return objects, nil
+	}
+	f, err := os.Open(opts.Inventory)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	objects, err := st.ReadInventory(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading inventory %s: %v", opts.Inventory, err)
+	}
+	return objects, nil
+}
@@ -0,0 +1,77 @@
+// Package health serves liveness and readiness checks, for deployments such
+// as Kubernetes to tell when a service is up and when it can serve traffic.
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long a readiness check's result is reused for, so
+// that frequent probes don't each reach the storage.
+const DefaultCacheTTL = 10 * time.Second
+
+// Register adds the /healthz and /readyz handlers to the mux, with readiness
+// given by check and its result cached for DefaultCacheTTL:
+//
+//	health.Register(http.DefaultServeMux, st.Ping)
+func Register(mux *http.ServeMux, check func(context.Context) error) {
+	mux.HandleFunc("/healthz", Live)
+	mux.Handle("/readyz", NewChecker(check, DefaultCacheTTL))
+}
+
+// Live responds that the service is alive, which it is if it's serving HTTP
+// at all.
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Checker reports whether the service is ready to serve traffic, by running a
+// check such as serve.Storage.Ping and caching its result, whether it
+// succeeded or failed, for a while.
+type Checker struct {
+	check func(context.Context) error
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// NewChecker returns a Checker that runs check at most once per ttl.
+func NewChecker(check func(context.Context) error, ttl time.Duration) *Checker {
+	return &Checker{check: check, ttl: ttl}
+}
+
+// Check returns the result of the check, run now if it hasn't been within
+// the TTL. Concurrent callers wait for a single check. Checks that fail
+// because ctx is done aren't cached, since they say nothing of readiness.
+func (c *Checker) Check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+		return c.err
+	}
+	err := c.check(ctx)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+	c.err, c.checked = err, time.Now()
+	return err
+}
+
+// ServeHTTP responds 200 OK if the check succeeds, and 503 Service
+// Unavailable with its error if it doesn't.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := c.Check(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
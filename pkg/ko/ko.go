@@ -0,0 +1,344 @@
+// Package ko builds Go programs into images as they're pulled: the module
+// providing the requested import path is fetched from the Go module proxy, at
+// the version the tag names, and the package is built with ko onto its base
+// image, for every platform the base image supports. Built images are written
+// to Storage and served from there on later pulls of the same version.
+package ko
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/ko/pkg/build"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/zip"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultProxy is the Go module proxy modules are fetched from if the
+	// Handler doesn't name one.
+	DefaultProxy = "https://proxy.golang.org"
+
+	// DefaultBaseImage is the image programs are built onto if the Handler
+	// doesn't name one, and the module's .ko.yaml doesn't either.
+	DefaultBaseImage = "gcr.io/distroless/static:nonroot"
+)
+
+// Handler is an api.ManifestHandler that builds the Go package a request is
+// for, so that with the prefix ko/,
+//
+//	/v2/ko/github.com/google/ko/manifests/latest
+//
+// serves github.com/google/ko at its latest version, built with ko. The tag
+// is the module version: latest, a semver release, or a branch or commit the
+// module proxy resolves.
+type Handler struct {
+	Storage *serve.Storage
+
+	// Prefixes are stripped from the start of requested repositories, as
+	// many times as they appear there, to give the import path.
+	Prefixes []string
+
+	// Proxy is the URL of the Go module proxy modules are fetched from. If
+	// it's empty, DefaultProxy is used.
+	Proxy string
+
+	// BaseImage is the image programs are built onto, unless the module's
+	// .ko.yaml says otherwise. If it's empty, DefaultBaseImage is used.
+	BaseImage string
+
+	// Keychain authenticates fetches of base images. If it's nil, they're
+	// anonymous.
+	Keychain authn.Keychain
+
+	// Transport is used for fetches of base images and from the module
+	// proxy. If it's nil, they use http.DefaultTransport, traced with
+	// serve.TracingTransport.
+	Transport http.RoundTripper
+}
+
+// NewRouter returns a Router serving the images the Handler builds.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h}
+}
+
+// cacheKey is the name the image built for the import path at the module
+// version is written under.
+func cacheKey(importpath, version string) string {
+	ck := []byte(fmt.Sprintf("%s-%s", importpath, version))
+	return fmt.Sprintf("ko-%x", md5.Sum(ck))
+}
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	ip := h.importPath(rt.Name)
+	log := serve.LoggerFrom(ctx).With("importpath", ip)
+
+	// Traverse up from the importpath to find the module root, by checking
+	// whether the path is a module path that returns a version.
+	mod, version, err := h.walkUp(ctx, ip, rt.Tag)
+	if err != nil {
+		log.Error("finding module", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	log = log.With("module", mod, "version", version)
+
+	// Check if we've already got a manifest for this importpath + resolved version.
+	ck := h.Storage.CacheKey(ctx, cacheKey(ip, version))
+	if _, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		log.Debug("serving built manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	// Pull the module source from the module proxy and build it, unless
+	// another request is already building it.
+	br, err := h.Storage.BuildOnce(ck, func() (interface{}, error) {
+		return h.fetchAndBuild(ctx, mod, version, strings.TrimPrefix(ip, mod))
+	})
+	if err != nil {
+		log.Error("building", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	switch br := br.(type) {
+	case v1.ImageIndex:
+		err = h.Storage.ServeIndex(w, r, br, ck)
+	case v1.Image:
+		err = h.Storage.ServeManifest(w, r, br, ck)
+	default:
+		err = fmt.Errorf("build result was %T, not an image or index", br)
+	}
+	if err != nil {
+		log.Error("serving built image", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// importPath returns the import path a request for the repository is for.
+func (h *Handler) importPath(repo string) string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, p := range h.Prefixes {
+			if p != "" && strings.HasPrefix(repo, p) {
+				repo, stripped = strings.TrimPrefix(repo, p), true
+			}
+		}
+	}
+	return repo
+}
+
+func (h *Handler) transport() http.RoundTripper {
+	if h.Transport != nil {
+		return h.Transport
+	}
+	return serve.TracingTransport(http.DefaultTransport)
+}
+
+// proxyGet fetches the path from the module proxy.
+func (h *Handler) proxyGet(ctx context.Context, path string) (*http.Response, error) {
+	proxy := h.Proxy
+	if proxy == "" {
+		proxy = DefaultProxy
+	}
+	url := strings.TrimSuffix(proxy, "/") + "/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: h.transport()}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// walkUp returns the module providing the import path, e.g.
+// github.com/google/go-containerregistry for
+// github.com/google/go-containerregistry/cmd/crane, and the version the tag
+// resolves to, by checking whether the module proxy has version info for
+// each of its parents in turn.
+func (h *Handler) walkUp(ctx context.Context, importpath, tag string) (string, string, error) {
+	parts := strings.Split(importpath, "/")
+	for i := len(parts); i > 0; i-- {
+		check := strings.Join(parts[:i], "/")
+		if resolved, err := h.getVersion(ctx, check, tag); err == nil {
+			return check, resolved, nil
+		}
+	}
+	return "", "", serve.NewError(http.StatusNotFound, transport.NameUnknownErrorCode, "no module provides %s at %s", importpath, tag)
+}
+
+func (h *Handler) getVersion(ctx context.Context, mod, version string) (string, error) {
+	emod, err := module.EscapePath(mod)
+	if err != nil {
+		return "", err
+	}
+	path := emod + "/@latest"
+	if version != "latest" {
+		ever, err := module.EscapeVersion(version)
+		if err != nil {
+			return "", err
+		}
+		path = fmt.Sprintf("%s/@v/%s.info", emod, ever)
+	}
+	resp, err := h.proxyGet(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var v module.Version
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+func (h *Handler) fetchAndBuild(ctx context.Context, mod, version, subpath string) (build.Result, error) {
+	log := serve.LoggerFrom(ctx)
+	emod, err := module.EscapePath(mod)
+	if err != nil {
+		return nil, err
+	}
+	ever, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.proxyGet(ctx, fmt.Sprintf("%s/@v/%s.zip", emod, ever))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Write a temp zip file.
+	tmpzip, err := ioutil.TempFile("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpzip.Name()) // Clean up the zip file.
+	if _, err := io.Copy(tmpzip, resp.Body); err != nil {
+		tmpzip.Close()
+		return nil, err
+	}
+	tmpzip.Close()
+
+	// Clean up the temp dir. If building is successful, we'll serve a
+	// cached manifest and not need to rebuild.
+	tmpdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Unzip and validate the module zip file.
+	if err := zip.Unzip(tmpdir, module.Version{
+		Path:    mod,
+		Version: version,
+	}, tmpzip.Name()); err != nil {
+		return nil, err
+	}
+
+	// ko build the package.
+	g, err := build.NewGo(
+		ctx, tmpdir,
+		build.WithBaseImages(h.baseImages(tmpdir)),
+		build.WithPlatforms("all"),
+		build.WithConfig(map[string]build.Config{
+			mod + subpath: build.Config{
+				// Go module proxy zips include only
+				// modules.txt in vendor/, so force mod mode to
+				// avoid go build errors.
+				Flags: build.FlagArray{"-mod=mod"},
+			},
+		}),
+		build.WithCreationTime(v1.Time{Time: time.Unix(0, 0)}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ip := build.StrictScheme + mod + subpath
+	if err := g.IsSupportedReference(ip); err != nil {
+		return nil, err
+	}
+	log.Info("ko build", "importpath", ip)
+	return g.Build(ctx, ip)
+}
+
+// baseImages returns the build.GetBase that fetches the base image of each
+// import path in the module unzipped in dir, as its .ko.yaml says, if it has
+// one.
+func (h *Handler) baseImages(dir string) build.GetBase {
+	return func(ctx context.Context, ip string) (name.Reference, build.Result, error) {
+		log := serve.LoggerFrom(ctx)
+		base := h.BaseImage
+		if base == "" {
+			base = DefaultBaseImage
+		}
+		f, err := os.Open(filepath.Join(dir, ".ko.yaml"))
+		if err == nil {
+			defer f.Close()
+			var y struct {
+				DefaultBaseImage   string            `yaml:"defaultBaseImage"`
+				BaseImageOverrides map[string]string `yaml:"baseImageOverrides"`
+			}
+			if err := yaml.NewDecoder(f).Decode(&y); err != nil {
+				return nil, nil, fmt.Errorf("reading .ko.yaml: %v", err)
+			}
+			if y.DefaultBaseImage != "" {
+				base = y.DefaultBaseImage
+			}
+			if bio := y.BaseImageOverrides[ip]; bio != "" {
+				base = bio
+			}
+		}
+		log.Info("using base image", "base", base, "importpath", ip)
+
+		ref, err := name.ParseReference(base)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts := []remote.Option{remote.WithContext(ctx), remote.WithTransport(h.transport())}
+		if h.Keychain != nil {
+			opts = append(opts, remote.WithAuthFromKeychain(h.Keychain))
+		}
+		d, err := remote.Head(ref, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch d.MediaType {
+		case types.DockerManifestList, types.OCIImageIndex:
+			idx, err := remote.Index(ref, opts...)
+			return ref, idx, err
+		case types.DockerManifestSchema2, types.OCIManifestSchema1:
+			img, err := remote.Image(ref, opts...)
+			return ref, img, err
+		default:
+			return nil, nil, fmt.Errorf("base image %s has unknown media type %s", base, d.MediaType)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package mirror serves a pull-through cache of images from upstream
+// registries: manifests requested by tag or digest are fetched from the
+// registry named in the request path, written to Storage with their blobs,
+// and served from there, so that later pulls don't reach the upstream
+// registry.
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// Upstream resolves the upstream references of requests for images served
+// from another registry, and fetches them. The repository requested, with
+// its Prefixes stripped, is the upstream repository. Repositories without a
+// registry are on Docker Hub, as with docker pull.
+type Upstream struct {
+	// Prefixes are stripped from the start of requested repositories, as
+	// many times as they appear there, to give the upstream repository.
+	Prefixes []string
+
+	// Keychain authenticates fetches from upstream registries. If it's
+	// nil, they're anonymous.
+	Keychain authn.Keychain
+
+	// Transport is used for fetches from upstream registries. If it's nil,
+	// they use http.DefaultTransport, traced with serve.TracingTransport.
+	Transport http.RoundTripper
+}
+
+// Reference returns the upstream reference a manifest request is for.
+func (u Upstream) Reference(rt api.Route) (name.Reference, error) {
+	repo := rt.Name
+	for stripped := true; stripped; {
+		stripped = false
+		for _, p := range u.Prefixes {
+			if p != "" && strings.HasPrefix(repo, p) {
+				repo, stripped = strings.TrimPrefix(repo, p), true
+			}
+		}
+	}
+	if rt.Tag != "" {
+		return name.ParseReference(repo + ":" + rt.Tag)
+	}
+	return name.ParseReference(repo + "@" + rt.Digest.String())
+}
+
+// RemoteOptions returns the options for fetches of upstream images made
+// while serving the request.
+func (u Upstream) RemoteOptions(r *http.Request) []remote.Option {
+	t := u.Transport
+	if t == nil {
+		t = serve.TracingTransport(http.DefaultTransport)
+	}
+	opts := []remote.Option{remote.WithContext(r.Context()), remote.WithTransport(t)}
+	if u.Keychain != nil {
+		opts = append(opts, remote.WithAuthFromKeychain(u.Keychain))
+	}
+	return opts
+}
+
+// Handler is an api.ManifestHandler that mirrors the upstream image or index
+// a request is for, so that with the prefix mirror/,
+//
+//	/v2/mirror/docker.io/library/ubuntu/manifests/latest
+//
+// mirrors docker.io/library/ubuntu:latest.
+type Handler struct {
+	Storage *serve.Storage
+	Upstream
+}
+
+// NewRouter returns a Router serving the images the Handler mirrors, passing
+// requests for manifests by digest to it too, so that images pinned by
+// digest that haven't been mirrored yet are.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h, ManifestsByDigest: true}
+}
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
+	ref, err := h.Reference(rt)
+	if err != nil {
+		log.Error("parsing upstream reference", "error", err)
+		serve.WriteError(w, fmt.Errorf("%w: %v", serve.ErrNameInvalid, err))
+		return
+	}
+	log = log.With("upstream", ref.String())
+	if err := h.Storage.CachedFailure(ctx, ref); err != nil {
+		log.Info("upstream failure cached", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	// Manifests pinned by digest that have been mirrored are served from
+	// storage without consulting the upstream registry, since they can't
+	// have changed.
+	if d, ok := ref.(name.Digest); ok {
+		if _, err := h.Storage.BlobExists(ctx, d.DigestStr()); err == nil {
+			h.serveStored(w, r, d.DigestStr())
+			return
+		}
+	}
+
+	desc, idx, img, err := h.describe(r, ref)
+	if err != nil {
+		log.Error("fetching upstream manifest", "error", err)
+		h.Storage.RecordFailure(ctx, ref, err)
+		serve.WriteError(w, err)
+		return
+	}
+	// Manifests mirrored with their layers recompressed are written under
+	// a key of their own, since their digests aren't the upstream's.
+	key := h.Storage.CacheKey(ctx, desc.Digest.String())
+	var also []string
+	if key != desc.Digest.String() {
+		also = []string{key}
+	} else if r.Method == http.MethodHead {
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("Content-Type", string(desc.MediaType))
+		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+		return
+	}
+	if _, err := h.Storage.BlobExists(ctx, key); err == nil {
+		h.serveStored(w, r, key)
+		return
+	}
+
+	// The manifest hasn't been mirrored yet: fetch it and its blobs, and
+	// write them.
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		if idx == nil {
+			if idx, err = remote.Index(ref, h.RemoteOptions(r)...); err != nil {
+				log.Error("fetching upstream index", "error", err)
+				serve.WriteError(w, err)
+				return
+			}
+		}
+		if err := h.Storage.ServeIndex(w, r, idx, also...); err != nil {
+			log.Error("mirroring index", "error", err)
+			serve.WriteError(w, err)
+		}
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		if img == nil {
+			if img, err = remote.Image(ref, h.RemoteOptions(r)...); err != nil {
+				log.Error("fetching upstream image", "error", err)
+				h.Storage.RecordFailure(ctx, ref, err)
+				serve.WriteError(w, err)
+				return
+			}
+		}
+		if err := h.Storage.ServeManifest(w, r, img, also...); err != nil {
+			log.Error("mirroring image", "error", err)
+			serve.WriteError(w, err)
+		}
+	default:
+		err := fmt.Errorf("unsupported media type %s", desc.MediaType)
+		log.Error("mirroring manifest", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// serveStored serves the mirrored manifest with the digest, or written under
+// the key, from storage, verifying its contents, as api.Router serves
+// manifests by digest.
+func (h *Handler) serveStored(w http.ResponseWriter, r *http.Request, key string) {
+	serve.VerifyDigests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Storage.ServeBlob(w, r, key)
+	})).ServeHTTP(w, r)
+}
+
+// describe returns the descriptor of the upstream manifest, from a HEAD
+// request if the registry answers them, or else from fetching it, in which
+// case the index or image fetched is returned too.
+func (h *Handler) describe(r *http.Request, ref name.Reference) (*v1.Descriptor, v1.ImageIndex, v1.Image, error) {
+	d, err := remote.Head(ref, h.RemoteOptions(r)...)
+	if err == nil {
+		return d, nil, nil, nil
+	}
+	serve.LoggerFrom(r.Context()).Debug("upstream HEAD failed, fetching manifest", "upstream", ref.String(), "error", err)
+
+	// Figure out whether it's an index or an image by fetching it.
+	var desci interface {
+		Digest() (v1.Hash, error)
+		Size() (int64, error)
+		MediaType() (types.MediaType, error)
+	}
+	idx, err := remote.Index(ref, h.RemoteOptions(r)...)
+	var img v1.Image
+	if err != nil {
+		if img, err = remote.Image(ref, h.RemoteOptions(r)...); err != nil {
+			return nil, nil, nil, err
+		}
+		idx, desci = nil, img
+	} else {
+		desci = idx
+	}
+	digest, err := desci.Digest()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	size, err := desci.Size()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mt, err := desci.MediaType()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &v1.Descriptor{Digest: digest, MediaType: mt, Size: size}, idx, img, nil
+}
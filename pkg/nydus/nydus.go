@@ -0,0 +1,192 @@
+// Package nydus serves upstream images converted to nydus (RAFS) format, for
+// the nydus snapshotter to pull lazily: each layer is converted to a nydus
+// data blob, and a final layer holds the bootstrap describing the image's
+// filesystem. Converted images are written to Storage and served from there
+// on later pulls.
+package nydus
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/mirror"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+// remoteImageFeature is the OS feature nydus images are marked with in
+// indexes, so that nydus-aware clients pick them.
+const remoteImageFeature = "nydus.remoteimage.v1"
+
+// Handler is an api.ManifestHandler that converts the upstream image or
+// index a request is for to nydus format, so that with the prefix nydus/,
+//
+//	/v2/nydus/docker.io/library/ubuntu/manifests/latest
+//
+// serves docker.io/library/ubuntu:latest converted to nydus. Each image of
+// an index is converted, except for those for an unknown platform, such as
+// attestations, which are dropped.
+type Handler struct {
+	Storage *serve.Storage
+	mirror.Upstream
+}
+
+// NewRouter returns a Router serving the images the Handler converts,
+// passing requests for manifests by digest to it too, so that images pinned
+// by the digest of the upstream image are converted. Requests by the digest
+// of a converted manifest are served from Storage.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h, ManifestsByDigest: true}
+}
+
+// cacheKey is the name the conversion of the upstream manifest with the
+// digest is written under.
+func cacheKey(digest string) string { return fmt.Sprintf("nydus-%s", digest) }
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	log := serve.LoggerFrom(ctx)
+	if rt.Tag == "" {
+		if _, err := h.Storage.BlobExists(ctx, rt.Digest.String()); err == nil {
+			serve.VerifyDigests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.Storage.ServeBlob(w, r, rt.Digest.String())
+			})).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	ref, err := h.Reference(rt)
+	if err != nil {
+		log.Error("parsing upstream reference", "error", err)
+		serve.WriteError(w, fmt.Errorf("%w: %v", serve.ErrNameInvalid, err))
+		return
+	}
+	log = log.With("upstream", ref.String())
+	if err := h.Storage.CachedFailure(ctx, ref); err != nil {
+		log.Info("upstream failure cached", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	desc, err := remote.Get(ref, h.RemoteOptions(r)...)
+	if err != nil {
+		log.Error("fetching upstream manifest", "error", err)
+		h.Storage.RecordFailure(ctx, ref, err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	// Serve the conversion of the upstream manifest if it's been written.
+	ck := h.Storage.CacheKey(ctx, cacheKey(desc.Digest.String()))
+	if d, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Docker-Content-Digest", d.Digest.String())
+			w.Header().Set("Content-Type", string(d.MediaType))
+			w.Header().Set("Content-Length", fmt.Sprint(d.Size))
+			return
+		}
+		log.Debug("serving converted manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	if err := h.convert(w, r, desc, ck); err != nil {
+		log.Error("converting to nydus", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// convert converts the upstream image or index to nydus, then writes and
+// serves it, also under the cache key.
+func (h *Handler) convert(w http.ResponseWriter, r *http.Request, desc *remote.Descriptor, ck string) error {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempDir("", "nydus-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		if idx, err = convertIndex(idx, tmp); err != nil {
+			return fmt.Errorf("converting index: %v", err)
+		}
+		return h.Storage.ServeIndex(w, r, idx, ck)
+
+	case types.DockerManifestSchema1, types.DockerManifestSchema1Signed:
+		return errors.New("docker schema 1 images are not supported")
+
+	default:
+		// Assume anything else is an image, since some registries don't set
+		// mediaTypes properly.
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		return h.Storage.ServeNydus(w, r, img, ck)
+	}
+}
+
+// convertIndex converts each image of the index for a known platform to
+// nydus, writing the conversions' files under dir, and returns an index of
+// the converted images.
+func convertIndex(idx v1.ImageIndex, dir string) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var adds []mutate.IndexAddendum
+	for i, desc := range im.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			continue
+		}
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			return nil, fmt.Errorf("nested index %s is not supported", desc.Digest)
+		}
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		cd := filepath.Join(dir, fmt.Sprintf("image-%d", i))
+		if err := os.Mkdir(cd, 0755); err != nil {
+			return nil, err
+		}
+		nimg, err := serve.ConvertNydus(img, cd)
+		if err != nil {
+			return nil, fmt.Errorf("converting %s: %v", desc.Digest, err)
+		}
+		var platform v1.Platform
+		if desc.Platform != nil {
+			platform = *desc.Platform
+		}
+		platform.OSFeatures = append(append([]string(nil), platform.OSFeatures...), remoteImageFeature)
+		adds = append(adds, mutate.IndexAddendum{
+			Add: nimg,
+			Descriptor: v1.Descriptor{
+				MediaType:   desc.MediaType,
+				Annotations: desc.Annotations,
+				Platform:    &platform,
+			},
+		})
+	}
+	if len(adds) == 0 {
+		return nil, errors.New("index has no images to convert")
+	}
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), mt), nil
+}
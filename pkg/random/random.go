@@ -0,0 +1,287 @@
+// Package random serves synthetic images of random data, for load-testing
+// pullers and snapshotters. The number and size of an image's layers, and the
+// platforms it's for, are encoded in its tag, and its data is generated from a
+// seed derived from the tag, so that the same tag always serves the same
+// image. Generated images are written to Storage and served from there on
+// later pulls.
+package random
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/api"
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+const (
+	// DefaultMaxLayers, DefaultMaxLayerSize, DefaultMaxPlatforms and
+	// DefaultMaxTotalSize limit the images a Handler generates, if it
+	// doesn't say.
+	DefaultMaxLayers    = 99
+	DefaultMaxLayerSize = 100 * 1000 * 1000
+	DefaultMaxPlatforms = 8
+	DefaultMaxTotalSize = 1000 * 1000 * 1000
+)
+
+// Handler is an api.ManifestHandler that generates the image of random data
+// a request's tag describes. The tag is any of, separated by dashes:
+//
+//   - the number and size of layers, as in 4x10mb, in bytes unless it has a
+//     unit of kb, mb or gb, or kib, mib or gib;
+//   - the platforms the image is for, as in arm64, armv7 or s390x, which if
+//     there's more than one make it an index of an image for each.
+//
+// so that 4x10mb-amd64-arm64 is an index of images for linux/amd64 and
+// linux/arm64, each with four 10 MB layers. The default is a single 10 MB
+// layer, for no platform in particular. Any other parts of the tag, such as
+// latest, only change the seed the image's data is generated from.
+type Handler struct {
+	Storage *serve.Storage
+
+	// MaxLayers and MaxLayerSize limit the number and size, in bytes, of
+	// the layers of images generated. If they're zero, DefaultMaxLayers
+	// and DefaultMaxLayerSize are used.
+	MaxLayers    int64
+	MaxLayerSize int64
+
+	// MaxPlatforms limits the number of platforms a tag may name, and
+	// MaxTotalSize the total size, in bytes, of the layers generated for
+	// it, across the images for every platform. If they're zero,
+	// DefaultMaxPlatforms and DefaultMaxTotalSize are used.
+	MaxPlatforms int
+	MaxTotalSize int64
+}
+
+// NewRouter returns a Router serving the images the Handler generates.
+func NewRouter(h *Handler) *api.Router {
+	return &api.Router{Storage: h.Storage, Manifests: h}
+}
+
+// cacheKey is the name the image generated for the tag is written under.
+func cacheKey(tag string) string { return fmt.Sprintf("random-%x", md5.Sum([]byte(tag))) }
+
+// ServeManifest implements api.ManifestHandler.
+func (h *Handler) ServeManifest(w http.ResponseWriter, r *http.Request, rt api.Route) {
+	ctx := r.Context()
+	log := serve.LoggerFrom(ctx).With("tag", rt.Tag)
+	spec, err := h.parse(rt.Tag)
+	if err != nil {
+		log.Info("invalid random image", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+
+	ck := h.Storage.CacheKey(ctx, cacheKey(rt.Tag))
+	if _, err := h.Storage.BlobExists(ctx, ck); err == nil {
+		log.Debug("serving generated manifest", "key", ck)
+		h.Storage.ServeBlob(w, r, ck)
+		return
+	}
+
+	log.Info("generating random image", "layers", spec.layers, "size", spec.size, "platforms", len(spec.platforms))
+	br, err := h.Storage.BuildOnce(ck, func() (interface{}, error) {
+		return spec.generate(rt.Tag)
+	})
+	if err != nil {
+		log.Error("generating", "error", err)
+		serve.WriteError(w, err)
+		return
+	}
+	switch br := br.(type) {
+	case v1.ImageIndex:
+		err = h.Storage.ServeIndex(w, r, br, ck)
+	case v1.Image:
+		err = h.Storage.ServeManifest(w, r, br, ck)
+	}
+	if err != nil {
+		log.Error("serving generated image", "error", err)
+		serve.WriteError(w, err)
+	}
+}
+
+// spec describes a random image.
+type spec struct {
+	layers, size int64
+	platforms    []v1.Platform
+}
+
+var (
+	sizeRE = regexp.MustCompile(`^([0-9]+)x([0-9]+)([kmg]i?b|b)?$`)
+	archRE = regexp.MustCompile(`^(amd64|arm64|arm|386|ppc64le|s390x|riscv64|mips64le)(v[0-9])?$`)
+
+	units = map[string]int64{
+		"": 1, "b": 1,
+		"kb": 1000, "mb": 1000 * 1000, "gb": 1000 * 1000 * 1000,
+		"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+	}
+)
+
+// parse returns the spec of the image the tag describes, within the
+// Handler's limits.
+func (h *Handler) parse(tag string) (*spec, error) {
+	s := &spec{layers: 1, size: 10 * 1000 * 1000} // 10MB
+	seen := map[string]bool{}
+	for _, part := range strings.Split(strings.ToLower(tag), "-") {
+		if m := sizeRE.FindStringSubmatch(part); m != nil {
+			layers, err := strconv.ParseInt(m[1], 10, 64)
+			if err != nil {
+				return nil, serve.NewError(http.StatusBadRequest, transport.TagInvalidErrorCode, "invalid number of layers %q", m[1])
+			}
+			size, err := strconv.ParseInt(m[2], 10, 64)
+			if err != nil || size > (1<<62)/units[m[3]] {
+				return nil, serve.NewError(http.StatusBadRequest, transport.TagInvalidErrorCode, "invalid layer size %q", m[2]+m[3])
+			}
+			s.layers, s.size = layers, size*units[m[3]]
+			continue
+		}
+		if m := archRE.FindStringSubmatch(part); m != nil {
+			p := v1.Platform{OS: "linux", Architecture: m[1], Variant: m[2]}
+			if !seen[part] {
+				seen[part] = true
+				s.platforms = append(s.platforms, p)
+			}
+		}
+	}
+
+	maxLayers, maxSize, maxPlatforms, maxTotal := h.MaxLayers, h.MaxLayerSize, h.MaxPlatforms, h.MaxTotalSize
+	if maxLayers == 0 {
+		maxLayers = DefaultMaxLayers
+	}
+	if maxSize == 0 {
+		maxSize = DefaultMaxLayerSize
+	}
+	if maxPlatforms == 0 {
+		maxPlatforms = DefaultMaxPlatforms
+	}
+	if maxTotal == 0 {
+		maxTotal = DefaultMaxTotalSize
+	}
+	if s.layers > maxLayers {
+		return nil, fmt.Errorf("%w: %d layers requested, at most %d allowed", serve.ErrTooLarge, s.layers, maxLayers)
+	}
+	if s.size > maxSize {
+		return nil, fmt.Errorf("%w: %d byte layers requested, at most %d allowed", serve.ErrTooLarge, s.size, maxSize)
+	}
+	if len(s.platforms) > maxPlatforms {
+		return nil, fmt.Errorf("%w: %d platforms requested, at most %d allowed", serve.ErrTooLarge, len(s.platforms), maxPlatforms)
+	}
+	images := int64(len(s.platforms))
+	if images == 0 {
+		images = 1
+	}
+	// Divide rather than multiply, so that large limits can't overflow.
+	if s.size > 0 && (s.layers > maxTotal/s.size || s.layers*s.size > maxTotal/images) {
+		return nil, fmt.Errorf("%w: %d images of %d %d byte layers requested, at most %d bytes allowed", serve.ErrTooLarge, images, s.layers, s.size, maxTotal)
+	}
+	return s, nil
+}
+
+// seed returns the seed of the data of the image generated for the tag and
+// platform.
+func seed(tag string, p *v1.Platform) int64 {
+	key := tag
+	if p != nil {
+		key += fmt.Sprintf(" %s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return int64(binary.BigEndian.Uint64(sum[:8]))
+}
+
+// generate returns the image the spec describes, or the index of an image
+// for each of its platforms if it has more than one.
+func (s *spec) generate(tag string) (interface{}, error) {
+	switch len(s.platforms) {
+	case 0:
+		return s.image(tag, nil)
+	case 1:
+		return s.image(tag, &s.platforms[0])
+	}
+	adds := make([]mutate.IndexAddendum, 0, len(s.platforms))
+	for i := range s.platforms {
+		p := &s.platforms[i]
+		img, err := s.image(tag, p)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{MediaType: types.DockerManifestSchema2, Platform: p},
+		})
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.DockerManifestList), nil
+}
+
+// image returns an image of the spec's layers for the platform, if any.
+func (s *spec) image(tag string, p *v1.Platform) (v1.Image, error) {
+	rnd := rand.New(rand.NewSource(seed(tag, p)))
+	adds := make([]mutate.Addendum, 0, s.layers)
+	for i := int64(0); i < s.layers; i++ {
+		l, err := layer(fmt.Sprintf("random_file_%d", i), s.size, rnd.Int63())
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer: l,
+			History: v1.History{
+				Author:    "random.kontain.me",
+				Comment:   fmt.Sprintf("this is a random history %d of %d", i, s.layers),
+				CreatedBy: "random",
+			},
+		})
+	}
+	img, err := mutate.Append(empty.Image, adds...)
+	if err != nil || p == nil {
+		return img, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = p.OS, p.Architecture
+	return mutate.ConfigFile(img, cfg)
+}
+
+// layer returns a layer of one file of random data generated from the seed.
+// The data is generated again each time the layer is read, rather than held
+// in memory.
+func layer(name string, size, seed int64) (v1.Layer, error) {
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			tw := tar.NewWriter(pw)
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0400,
+				Size:     size,
+			}); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.CopyN(tw, rand.New(rand.NewSource(seed)), size); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.CloseWithError(tw.Close())
+		}()
+		return pr, nil
+	}, tarball.WithCompressionLevel(gzip.BestSpeed))
+}
@@ -0,0 +1,32 @@
+package random
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/imjasonh/kontain.me/pkg/serve"
+)
+
+func TestParseLimits(t *testing.T) {
+	h := &Handler{}
+	for _, tc := range []struct {
+		tag string
+		ok  bool
+	}{
+		{"latest", true},
+		{"4x10mb-amd64-arm64", true},
+		{"10x100mb", true},
+		{"11x100mb", false},
+		{"3x100mb-amd64-arm64-arm-386-ppc64le", false},
+		{"1x1kb-amd64-arm64-arm-386-ppc64le-s390x-riscv64-mips64le", true},
+		{"1x1kb-amd64-arm64-arm-386-ppc64le-s390x-riscv64-mips64le-armv7", false},
+		{"100x1mb", false},
+	} {
+		_, err := h.parse(tc.tag)
+		if tc.ok && err != nil {
+			t.Errorf("parse(%q) = %v", tc.tag, err)
+		} else if !tc.ok && !errors.Is(err, serve.ErrTooLarge) {
+			t.Errorf("parse(%q) = %v, want %v", tc.tag, err, serve.ErrTooLarge)
+		}
+	}
+}
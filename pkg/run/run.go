@@ -14,7 +14,6 @@ func Do(stdout io.Writer, command string) error {
 	cmd.Stderr = io.MultiWriter(stdout, &out)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("Error running %q: %s\n=====Command output=====\n%s", command, err, string(out.Bytes()))
-		return err
 	}
 	return nil
 }
@@ -0,0 +1,257 @@
+package serve
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoadHtpasswd reads the users and bcrypt password hashes of an htpasswd
+// file, as written by htpasswd -B. Other hash formats aren't supported.
+func LoadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %q isn't a bcrypt hash", path, n, user)
+		}
+		users[user] = hash
+	}
+	return users, sc.Err()
+}
+
+// BasicAuth wraps a handler so that each request must bear the basic auth
+// credentials of one of the users, which maps usernames to bcrypt password
+// hashes, as read by LoadHtpasswd. Others get a 401 response with a Basic
+// challenge, which docker login answers.
+//
+// Credentials that were verified are remembered for a few minutes, since
+// clients send them with every request of a pull, and bcrypt is slow by
+// design.
+func BasicAuth(users map[string]string, next http.Handler) http.Handler {
+	verified := newCredentialCache(verifiedCredentialTTL)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		hash, found := users[user]
+		if !ok || !found || !verified.check(user, pass, hash) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kontain.me"`)
+			writeErr(w, http.StatusUnauthorized, transport.UnauthorizedErrorCode, "valid username and password required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAuthenticatedUser(r.Context(), user)))
+	})
+}
+
+const (
+	// verifiedCredentialTTL is how long BasicAuth remembers credentials it
+	// verified.
+	verifiedCredentialTTL = 5 * time.Minute
+
+	// maxVerifiedCredentials is how many verified credentials BasicAuth
+	// remembers at once.
+	maxVerifiedCredentials = 10000
+)
+
+// credentialCache remembers basic auth credentials that matched their bcrypt
+// hashes, by the SHA-256 of the user, password and hash, so that the
+// password isn't kept, and a changed hash isn't matched.
+type credentialCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newCredentialCache(ttl time.Duration) *credentialCache {
+	return &credentialCache{ttl: ttl, verified: map[[sha256.Size]byte]time.Time{}}
+}
+
+// check reports whether the password matches the user's bcrypt hash.
+func (c *credentialCache) check(user, pass, hash string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	now := time.Now()
+	c.mu.Lock()
+	exp, ok := c.verified[key]
+	c.mu.Unlock()
+	if ok && now.Before(exp) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.verified) >= maxVerifiedCredentials {
+		for k, exp := range c.verified {
+			if !now.Before(exp) {
+				delete(c.verified, k)
+			}
+		}
+		if len(c.verified) >= maxVerifiedCredentials {
+			// They're all still valid; start over rather than grow.
+			c.verified = map[[sha256.Size]byte]time.Time{}
+		}
+	}
+	c.verified[key] = now.Add(c.ttl)
+	return true
+}
+
+// Allowlist wraps a registry handler so that requests must come from one of
+// the networks, if any are given, and be for a repository in one of the
+// namespaces, if any are given, or nested under one. Others get a 403
+// response. The API version check and catalog aren't for any repository,
+// so only the networks apply to them.
+//
+// A request comes from its connection's address, or, if trustForwardedFor
+// is set, from the address the proxy in front of the service added to the
+// end of its X-Forwarded-For header, as Cloud Run's does.
+func Allowlist(nets []*net.IPNet, namespaces []string, trustForwardedFor bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(nets) > 0 {
+			ip := clientIP(r, trustForwardedFor)
+			if !inNetworks(ip, nets) {
+				writeErr(w, http.StatusForbidden, transport.DeniedErrorCode, fmt.Sprintf("requests from %s aren't allowed", ip))
+				return
+			}
+		}
+		if p, _ := requestPath(r); p.Repo != "" && len(namespaces) > 0 && !inNamespaces(p.Repo, namespaces) {
+			repo := p.Repo
+			writeErr(w, http.StatusForbidden, transport.DeniedErrorCode, fmt.Sprintf("repository %q isn't allowed", repo))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address the request came from, or nil if it can't be
+// parsed.
+func clientIP(r *http.Request, trustForwardedFor bool) net.IP {
+	if trustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func inNamespaces(repo string, namespaces []string) bool {
+	for _, ns := range namespaces {
+		if inNamespace(repo, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessConfig is the allowlist and users registry requests are checked
+// against, before any token; see Config.AllowCIDRs, Config.AllowNamespaces
+// and Config.AuthHtpasswd.
+type accessConfig struct {
+	nets              []*net.IPNet
+	namespaces        []string
+	trustForwardedFor bool
+	users             map[string]string
+}
+
+// wrap wraps a registry handler with the allowlist, then basic auth.
+func (a *accessConfig) wrap(next http.Handler) http.Handler {
+	if a.users != nil {
+		next = BasicAuth(a.users, next)
+	}
+	if len(a.nets) > 0 || len(a.namespaces) > 0 {
+		next = Allowlist(a.nets, a.namespaces, a.trustForwardedFor, next)
+	}
+	return next
+}
+
+// trustForwardedFor reports whether the config takes the address requests
+// come from from their X-Forwarded-For header.
+func (c Config) trustForwardedFor() (bool, error) {
+	if c.TrustForwardedFor == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(c.TrustForwardedFor)
+	if err != nil {
+		return false, fmt.Errorf("invalid TRUST_FORWARDED_FOR %q, must be true or false", c.TrustForwardedFor)
+	}
+	return b, nil
+}
+
+// access returns the allowlist and users the config checks registry requests
+// against, or nil if it sets none.
+func (c Config) access() (*accessConfig, error) {
+	if len(c.AllowCIDRs) == 0 && len(c.AllowNamespaces) == 0 && c.AuthHtpasswd == "" {
+		return nil, nil
+	}
+	a := &accessConfig{namespaces: c.AllowNamespaces}
+	for _, cidr := range c.AllowCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// A bare address allows only itself.
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed network (ALLOW_CIDRS) %q", cidr)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		a.nets = append(a.nets, n)
+	}
+	var err error
+	if a.trustForwardedFor, err = c.trustForwardedFor(); err != nil {
+		return nil, err
+	}
+	if c.AuthHtpasswd != "" {
+		users, err := LoadHtpasswd(c.AuthHtpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("reading users (AUTH_HTPASSWD): %v", err)
+		}
+		a.users = users
+	}
+	return a, nil
+}
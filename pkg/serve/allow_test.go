@@ -0,0 +1,62 @@
+package serve
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdWithTokensRejected(t *testing.T) {
+	for _, cfg := range []Config{
+		{AuthHtpasswd: "htpasswd", AuthTokenKey: "key.pem", AuthPolicy: "policy.json"},
+		{AuthHtpasswd: "htpasswd", AuthPublicKey: "key.pem", AuthRealm: "https://example.com/token"},
+	} {
+		cfg.Backend = "mem"
+		if _, err := NewStorage(context.Background(), WithConfig(cfg)); err == nil || !strings.Contains(err.Error(), "AUTH_HTPASSWD") {
+			t.Errorf("NewStorage(%+v) = %v, want an AUTH_HTPASSWD error", cfg, err)
+		}
+	}
+}
+
+func TestPushNamespacesRequireAuth(t *testing.T) {
+	cfg := Config{Backend: "mem", PushNamespaces: []string{"pushed"}}
+	if _, err := NewStorage(context.Background(), WithConfig(cfg)); err == nil || !strings.Contains(err.Error(), "PUSH_NAMESPACES") {
+		t.Errorf("NewStorage without auth = %v, want a PUSH_NAMESPACES error", err)
+	}
+	if _, err := NewStorage(context.Background(), WithConfig(cfg), WithAuth(allowAll{}, "", "")); err != nil {
+		t.Errorf("NewStorage with auth: %v", err)
+	}
+}
+
+func TestCredentialCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCredentialCache(verifiedCredentialTTL)
+	if c.check("alice", "wrong", string(hash)) {
+		t.Error("wrong password accepted")
+	}
+	if len(c.verified) != 0 {
+		t.Errorf("wrong password remembered: %v", c.verified)
+	}
+	for i := 0; i < 2; i++ {
+		if !c.check("alice", "secret", string(hash)) {
+			t.Errorf("check %d: right password refused", i)
+		}
+	}
+	if len(c.verified) != 1 {
+		t.Errorf("remembered %d credentials, want 1", len(c.verified))
+	}
+
+	// A cached password isn't accepted once the hash changes.
+	other, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.check("alice", "secret", string(other)) {
+		t.Error("old password accepted against a new hash")
+	}
+}
@@ -0,0 +1,74 @@
+package serve
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Annotation keys are case-sensitive, but metadata header names aren't, so
+// keys are stored base32-encoded, which survives case folding.
+const metaAnnotationPrefix = "Annotation-"
+
+var annotationEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// SetAnnotations replaces the annotations recorded in the metadata of the
+// manifest blob with the given digest.
+func (s *Storage) SetAnnotations(ctx context.Context, digest string, annotations map[string]string) error {
+	key := s.blobKey(digest)
+	info, err := s.objects.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	// Setting metadata replaces all of it, so carry over everything that
+	// isn't an annotation.
+	meta := annotationMeta(annotations)
+	for k, v := range info.Meta {
+		if !strings.HasPrefix(k, metaAnnotationPrefix) {
+			meta[k] = v
+		}
+	}
+	return s.objects.CopyWithMeta(key, key, info.ContentType, meta)
+}
+
+// GetAnnotations returns the annotations recorded in the metadata of the
+// manifest blob with the given digest.
+func (s *Storage) GetAnnotations(ctx context.Context, digest string) (map[string]string, error) {
+	info, err := s.objects.Stat(s.blobKey(digest))
+	if err != nil {
+		return nil, err
+	}
+	return parseAnnotations(info.Meta)
+}
+
+// annotationMeta returns the metadata recording annotations.
+func annotationMeta(annotations map[string]string) map[string]string {
+	meta := map[string]string{}
+	for k, v := range annotations {
+		meta[http.CanonicalHeaderKey(metaAnnotationPrefix+annotationEncoding.EncodeToString([]byte(k)))] = url.QueryEscape(v)
+	}
+	return meta
+}
+
+func parseAnnotations(meta map[string]string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for k, v := range meta {
+		if !strings.HasPrefix(k, metaAnnotationPrefix) {
+			continue
+		}
+		ak, err := annotationEncoding.DecodeString(strings.ToUpper(strings.TrimPrefix(k, metaAnnotationPrefix)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation metadata %q: %v", k, err)
+		}
+		av, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation metadata %q value: %v", k, err)
+		}
+		annotations[string(ak)] = av
+	}
+	return annotations, nil
+}
@@ -0,0 +1,285 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Actions an Authorizer is asked to authorize. ActionCatalog is listing
+// every repository, with /v2/_catalog, which isn't for any one repository.
+const (
+	ActionPull    = "pull"
+	ActionPush    = "push"
+	ActionCatalog = "catalog"
+)
+
+// catalogPath is the path of the catalog API.
+const catalogPath = "/v2/_catalog"
+
+// Authorizer decides whether a request may perform an action on a
+// repository. Authorize returns nil if the request is allowed. repo is empty
+// for the API version check and the catalog, whose action is ActionCatalog.
+type Authorizer interface {
+	Authorize(r *http.Request, action, repo string) error
+}
+
+// RequireAuth wraps a registry handler so that each request under /v2/ must
+// be authorized by a, pulls for GET and HEAD requests and pushes otherwise.
+// Unauthorized requests get a 401 response with a WWW-Authenticate challenge
+// pointing clients at the token service at realm, so that docker login
+// flows work. An empty realm is /token on the host the request was sent to,
+// for services served on many hostnames.
+func RequireAuth(a Authorizer, realm, service string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realm := realm
+		if realm == "" {
+			realm = requestRealm(r)
+		}
+		p, _ := requestPath(r)
+		repo := p.Repo
+		action := ActionPush
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			action = ActionPull
+		}
+		scope := fmt.Sprintf("repository:%s:%s", repo, action)
+		if p.Section == SectionCatalog {
+			action, scope = ActionCatalog, catalogScope
+		}
+		// Authorizers that verify who the request is from record it
+		// here as they authorize it, so it needn't be verified again.
+		sub := new(verifiedSubject)
+		r = r.WithContext(context.WithValue(r.Context(), verifiedSubjectKey{}, sub))
+		if err := a.Authorize(r, action, repo); err != nil {
+			challenge := fmt.Sprintf("Bearer realm=%q,service=%q", realm, service)
+			if repo != "" || action == ActionCatalog {
+				challenge += fmt.Sprintf(",scope=%q", scope)
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeErr(w, http.StatusUnauthorized, transport.UnauthorizedErrorCode, err.Error())
+			return
+		}
+		if sub.name != "" {
+			r = r.WithContext(withAuthenticatedUser(r.Context(), sub.name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type verifiedSubjectKey struct{}
+
+// verifiedSubject is where an Authorizer records the subject of the token
+// it verified, for RequireAuth.
+type verifiedSubject struct{ name string }
+
+// recordSubject records the subject of the request's verified token, if
+// it's being authorized by RequireAuth.
+func recordSubject(r *http.Request, name string) {
+	if sub, ok := r.Context().Value(verifiedSubjectKey{}).(*verifiedSubject); ok {
+		sub.name = name
+	}
+}
+
+// requestRealm returns the URL of /token on the host the request was sent
+// to, with the scheme the client used, as reported by the proxy it came
+// through, if any.
+func requestRealm(r *http.Request) string {
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + r.Host + "/token"
+}
+
+// JWTAuthorizer authorizes requests bearing a JWT signed by a token service,
+// in the format used by the Docker token authentication flow.
+type JWTAuthorizer struct {
+	key     crypto.PublicKey
+	issuer  string
+	service string
+}
+
+// NewJWTAuthorizer returns an Authorizer validating bearer tokens signed
+// with the PEM-encoded public key or certificate, with RS256 or ES256.
+// Tokens must have been issued by issuer for service, if those are set.
+func NewJWTAuthorizer(keyPEM []byte, issuer, service string) (*JWTAuthorizer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in public key")
+	}
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	default:
+		var err error
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	return &JWTAuthorizer{key: key, issuer: issuer, service: service}, nil
+}
+
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  interface{}   `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat,omitempty"`
+	ID        string        `json:"jti,omitempty"`
+	Access    []tokenAccess `json:"access"`
+}
+
+// tokenAccess is the access a token grants to one resource.
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// Authorize implements Authorizer.
+func (a *JWTAuthorizer) Authorize(r *http.Request, action, repo string) error {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return fmt.Errorf("%w: bearer token required", ErrUnauthorized)
+	}
+	claims, err := a.verify(strings.TrimPrefix(h, "Bearer "))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	recordSubject(r, claims.Subject)
+	switch {
+	case action == ActionCatalog:
+		if claims.grants("registry", "catalog", "*") {
+			return nil
+		}
+		return fmt.Errorf("%w: token does not grant access to the catalog", ErrUnauthorized)
+	case repo == "":
+		// Any valid token may check the API version.
+		return nil
+	case claims.grants("repository", repo, action):
+		return nil
+	}
+	return fmt.Errorf("%w: token does not grant %s access to %s", ErrUnauthorized, action, repo)
+}
+
+// grants reports whether the token grants the action on the resource of the
+// type and name.
+func (c *tokenClaims) grants(typ, name, action string) bool {
+	for _, acc := range c.Access {
+		if acc.Type == typ && acc.Name == name && containsAction(acc.Actions, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the token's signature and validity, and returns its claims.
+func (a *JWTAuthorizer) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(hb, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch key := a.key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected token algorithm %q", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("unexpected token algorithm %q", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, fmt.Errorf("invalid token signature")
+		}
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+	if a.service != "" && !hasAudience(claims.Audience, a.service) {
+		return nil, fmt.Errorf("token not issued for %q", a.service)
+	}
+	return &claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or list of strings,
+// includes want.
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package serve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestIssuer returns a TokenIssuer with a new key, issuing tokens to the
+// users, whose passwords are their names, with the grants given.
+func newTestIssuer(t *testing.T, users map[string][]Grant, anonymous []Grant) *TokenIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &TokenPolicy{Users: map[string]TokenUser{}, Anonymous: anonymous}
+	for user, grants := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.Users[user] = TokenUser{Password: string(hash), Access: grants}
+	}
+	ti, err := NewTokenIssuer(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), "issuer", "service", policy)
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %v", err)
+	}
+	return ti
+}
+
+// issue returns a token the issuer issues the user, or an anonymous client if
+// user is empty, for the scopes.
+func issue(t *testing.T, ti *TokenIssuer, user string, scopes ...string) string {
+	t.Helper()
+	q := url.Values{"service": {"service"}, "scope": scopes}
+	req := httptest.NewRequest(http.MethodGet, "/token?"+q.Encode(), nil)
+	if user != "" {
+		req.SetBasicAuth(user, user)
+	}
+	rec := httptest.NewRecorder()
+	ti.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("issuing token for %q: %d %s", user, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	ti := newTestIssuer(t, map[string][]Grant{
+		"alice": {{Namespace: "alice", Actions: []string{"pull", "push"}}},
+		"admin": {{Namespace: "", Actions: []string{"pull"}}},
+	}, nil)
+	a := ti.Authorizer()
+
+	for _, c := range []struct {
+		desc, user, path, action, repo string
+		scopes                         []string
+		ok                             bool
+	}{
+		{desc: "anonymous version check", path: "/v2/", ok: true},
+		{desc: "anonymous catalog", path: catalogPath, action: ActionCatalog, scopes: []string{catalogScope}},
+		{desc: "anonymous pull", path: "/v2/alice/app/manifests/latest", action: ActionPull, repo: "alice/app", scopes: []string{"repository:alice/app:pull"}},
+		{desc: "granted push", user: "alice", path: "/v2/alice/app/manifests/latest", action: ActionPush, repo: "alice/app", scopes: []string{"repository:alice/app:pull,push"}, ok: true},
+		{desc: "unrequested repo", user: "alice", path: "/v2/alice/other/manifests/latest", action: ActionPull, repo: "alice/other", scopes: []string{"repository:alice/app:pull"}},
+		{desc: "ungranted repo", user: "alice", path: "/v2/bob/app/manifests/latest", action: ActionPull, repo: "bob/app", scopes: []string{"repository:bob/app:pull"}},
+		{desc: "catalog without every repo", user: "alice", path: catalogPath, action: ActionCatalog, scopes: []string{catalogScope}},
+		{desc: "catalog with every repo", user: "admin", path: catalogPath, action: ActionCatalog, scopes: []string{catalogScope}, ok: true},
+		{desc: "catalog unrequested", user: "admin", path: catalogPath, action: ActionCatalog, scopes: []string{"repository:bob/app:pull"}},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.path, nil)
+			req.Header.Set("Authorization", "Bearer "+issue(t, ti, c.user, c.scopes...))
+			if err := a.Authorize(req, c.action, c.repo); (err == nil) != c.ok {
+				t.Errorf("Authorize = %v, want ok %t", err, c.ok)
+			}
+		})
+	}
+}
+
+func TestRequireAuthCatalog(t *testing.T) {
+	ti := newTestIssuer(t, nil, []Grant{{Namespace: "public", Actions: []string{"pull"}}})
+	h := RequireAuth(ti.Authorizer(), "https://example.com/token", "service", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	token := issue(t, ti, "", catalogScope)
+
+	for _, path := range []string{"/v2/", catalogPath} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		want := http.StatusOK
+		if path == catalogPath {
+			want = http.StatusUnauthorized
+		}
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+		if path == catalogPath {
+			if got, want := rec.Header().Get("WWW-Authenticate"), `Bearer realm="https://example.com/token",service="service",scope="registry:catalog:*"`; got != want {
+				t.Errorf("challenge = %s, want %s", got, want)
+			}
+		}
+	}
+}
+
+func TestVerifyRequiresExpiry(t *testing.T) {
+	ti := newTestIssuer(t, nil, nil)
+	now := time.Now()
+	for _, c := range []struct {
+		desc string
+		exp  int64
+		ok   bool
+	}{
+		{desc: "unexpired", exp: now.Add(time.Hour).Unix(), ok: true},
+		{desc: "expired", exp: now.Add(-time.Hour).Unix()},
+		{desc: "no expiry"},
+	} {
+		token, err := ti.sign(tokenClaims{Issuer: "issuer", Audience: "service", ExpiresAt: c.exp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ti.Authorizer().verify(token); (err == nil) != c.ok {
+			t.Errorf("%s: verify = %v, want ok %t", c.desc, err, c.ok)
+		}
+	}
+}
+
+func TestRequireAuthRecordsSubject(t *testing.T) {
+	ti := newTestIssuer(t, map[string][]Grant{
+		"alice": {{Namespace: "alice", Actions: []string{"pull"}}},
+	}, nil)
+	var user string
+	h := RequireAuth(ti.Authorizer(), "https://example.com/token", "service", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = authenticatedUser(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/v2/alice/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+issue(t, ti, "alice", "repository:alice/app:pull"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d %s", rec.Code, rec.Body)
+	}
+	if user != "alice" {
+		t.Errorf("authenticated user = %q, want alice", user)
+	}
+}
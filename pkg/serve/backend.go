@@ -0,0 +1,77 @@
+package serve
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Backend stores the objects underlying a Storage: blobs, upload sessions
+// and stats, by key. Storage is backed by an Aliyun OSS bucket unless another
+// Backend is given with WithBackend.
+//
+// Metadata keys are canonicalized as HTTP header names, since backends store
+// them as headers and don't preserve their case. Backends must return errors
+// wrapping ErrObjectNotFound for missing objects.
+type Backend interface {
+	// Put writes the object, replacing any existing object with the key.
+	Put(key string, r io.Reader, contentType string, meta map[string]string) error
+	// Get returns the object's contents.
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns the object's size, content type and metadata.
+	Stat(key string) (ObjectInfo, error)
+	// Exists reports whether the object exists.
+	Exists(key string) (bool, error)
+	// Copy copies the object, with its content type and metadata.
+	Copy(src, dst string) error
+	// CopyWithMeta copies the object, replacing its content type and
+	// metadata. src and dst may be the same, to replace an object's
+	// metadata in place.
+	CopyWithMeta(src, dst, contentType string, meta map[string]string) error
+	// Delete deletes the objects. Missing objects are ignored.
+	Delete(keys ...string) error
+	// DeleteBatch deletes up to 1000 objects in one request,
+	// and returns the keys of those that were deleted, which include
+	// missing objects.
+	DeleteBatch(keys []string) (deleted []string, err error)
+	// Append appends to the object at pos, which must be its current size,
+	// creating it if pos is 0, and returns its new size. If pos isn't the
+	// object's current size, Append returns ErrAppendPosition.
+	Append(key string, r io.Reader, pos int64) (int64, error)
+	// List returns the keys of all objects with the prefix.
+	List(prefix string) ([]string, error)
+	// Serve responds with the object's contents, or a redirect to them.
+	Serve(w http.ResponseWriter, r *http.Request, key string)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+	// Meta holds the object's user metadata.
+	Meta map[string]string
+}
+
+var (
+	// ErrObjectNotFound is returned by backends for missing objects.
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrObjectExists is returned by backends that refuse to overwrite an
+	// existing object.
+	ErrObjectExists = errors.New("object already exists")
+
+	// ErrAppendPosition is returned by Backend.Append if the position
+	// given isn't the object's current size.
+	ErrAppendPosition = errors.New("append position does not match object size")
+)
+
+// canonicalMeta returns meta with its keys canonicalized.
+func canonicalMeta(meta map[string]string) map[string]string {
+	out := make(map[string]string, len(meta))
+	for k, v := range meta {
+		out[http.CanonicalHeaderKey(k)] = v
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// defaultImmutableMaxAge is how long responses for manifests and blobs
+// requested by digest, which can never change, may be cached by default.
+const defaultImmutableMaxAge = 365 * 24 * time.Hour
+
+// cacheMaxAges are how long responses may be cached; see WithCacheControl.
+type cacheMaxAges struct {
+	immutable, tag time.Duration
+}
+
+// WithCacheControl sets how long clients and proxies may cache responses for
+// manifests and blobs requested by digest, which are marked immutable, and
+// for manifests requested by tag, which can change. By default, responses by
+// digest may be cached for a year, and responses by tag have no
+// Cache-Control header.
+func WithCacheControl(immutableMaxAge, tagMaxAge time.Duration) Option {
+	return func(s *Storage) error {
+		if immutableMaxAge < 0 || tagMaxAge < 0 {
+			return fmt.Errorf("negative cache max age %s and %s", immutableMaxAge, tagMaxAge)
+		}
+		s.cacheMaxAges = &cacheMaxAges{immutable: immutableMaxAge, tag: tagMaxAge}
+		return nil
+	}
+}
+
+// immutableCacheControl returns the Cache-Control header for responses by
+// digest.
+func (s *Storage) immutableCacheControl() string {
+	age := defaultImmutableMaxAge
+	if s.cacheMaxAges != nil {
+		age = s.cacheMaxAges.immutable
+	}
+	return fmt.Sprintf("max-age=%d, immutable", int64(age/time.Second))
+}
+
+// cacheFoundWriter sets a Cache-Control header on responses that aren't
+// errors, when their status is written: a blob that isn't found may yet be
+// written, so its 404 mustn't be cached, let alone as immutable. A
+// Cache-Control the response already has, such as for a redirect to a
+// signed URL that expires, is kept.
+type cacheFoundWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *cacheFoundWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < http.StatusBadRequest && w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", w.cacheControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheFoundWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// setManifestCacheHeaders sets the ETag for a manifest response to the
+// manifest's digest, and its Cache-Control according to whether the manifest
+// was requested by digest or by tag. It reports whether the client already
+// has the manifest, per its If-None-Match header, in which case it has
+// responded with 304 Not Modified and nothing more should be written.
+func (s *Storage) setManifestCacheHeaders(w http.ResponseWriter, r *http.Request, digest v1.Hash) bool {
+	etag := fmt.Sprintf("%q", digest.String())
+	w.Header().Set("ETag", etag)
+	if isDigestRequest(r) {
+		w.Header().Set("Cache-Control", s.immutableCacheControl())
+	} else if s.cacheMaxAges != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(s.cacheMaxAges.tag/time.Second)))
+	}
+	if matchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// isDigestRequest reports whether r requests a manifest by digest.
+func isDigestRequest(r *http.Request) bool {
+	p, _ := requestPath(r)
+	_, ok := p.Digest()
+	return ok && p.Section == SectionManifests
+}
+
+// isManifestRequest reports whether r requests a manifest, by tag or digest.
+func isManifestRequest(r *http.Request) bool {
+	p, _ := requestPath(r)
+	return p.Section == SectionManifests
+}
+
+// matchesETag reports whether the If-None-Match header value matches etag.
+func matchesETag(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
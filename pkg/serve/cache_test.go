@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestServeBlobCachesOnlyFoundBlobs(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	contents := "contents"
+	h, _, err := v1.SHA256(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := "sha256:" + strings.Repeat("0", 64)
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := httptest.NewRecorder()
+		s.ServeBlob(w, httptest.NewRequest(method, "/v2/app/blobs/"+missing, nil), missing)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s missing blob: status %d, want %d", method, w.Code, http.StatusNotFound)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "" {
+			t.Errorf("%s missing blob: Cache-Control %q, want none", method, cc)
+		}
+	}
+
+	if err := s.writeBlob(context.Background(), h.String(), h, ioutil.NopCloser(strings.NewReader(contents)), "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := httptest.NewRecorder()
+		s.ServeBlob(w, httptest.NewRequest(method, "/v2/app/blobs/"+h.String(), nil), h.String())
+		if w.Code != http.StatusOK {
+			t.Errorf("%s blob: status %d, want %d", method, w.Code, http.StatusOK)
+		}
+		if got, want := w.Header().Get("Cache-Control"), s.immutableCacheControl(); got != want {
+			t.Errorf("%s blob: Cache-Control %q, want %q", method, got, want)
+		}
+	}
+}
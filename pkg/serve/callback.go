@@ -0,0 +1,204 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// defaultCallbackBody is the callback body OSS sends by default, which
+// HandleOSSCallback parses into a BlobCallbackEvent. OSS substitutes the
+// variables, and quotes them since the body is JSON.
+const defaultCallbackBody = `{"bucket":${bucket},"object":${object},"etag":${etag},"size":${size},"mimeType":${mimeType},"digest":${x:digest}}`
+
+// maxCallbackBodySize bounds the size of callback requests read by
+// HandleOSSCallback.
+const maxCallbackBodySize = 1 << 20
+
+// ossCallback is the callback OSS is asked to make once a blob is written.
+type ossCallback struct {
+	url, body string
+}
+
+// WithOSSCallback asks OSS to POST to callbackURL each time it finishes
+// writing a blob with PutObject, such as to index it or invalidate a CDN.
+// The callback body is callbackBody, which may use OSS's callback variables
+// along with ${x:digest}, the blob's digest. If it's empty, the body is the
+// JSON that HandleOSSCallback parses.
+//
+// If the callback fails, OSS still writes the blob, but the write fails.
+func WithOSSCallback(callbackURL, callbackBody string) Option {
+	return func(s *Storage) error {
+		u, err := url.Parse(callbackURL)
+		if err != nil {
+			return fmt.Errorf("invalid callback URL %q: %v", callbackURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid callback URL %q, must be http or https", callbackURL)
+		}
+		if callbackBody == "" {
+			callbackBody = defaultCallbackBody
+		}
+		s.callback = &ossCallback{url: callbackURL, body: callbackBody}
+		return nil
+	}
+}
+
+// options returns the options requesting the callback for a blob with the
+// given digest.
+func (c *ossCallback) options(digest string) ([]oss.Option, error) {
+	cb, err := json.Marshal(map[string]string{
+		"callbackUrl":      c.url,
+		"callbackBody":     c.body,
+		"callbackBodyType": "application/json",
+	})
+	if err != nil {
+		return nil, err
+	}
+	vars, err := json.Marshal(map[string]string{"x:digest": digest})
+	if err != nil {
+		return nil, err
+	}
+	return []oss.Option{
+		oss.Callback(base64.StdEncoding.EncodeToString(cb)),
+		oss.CallbackVar(base64.StdEncoding.EncodeToString(vars)),
+	}, nil
+}
+
+// BlobCallbackEvent describes a blob OSS finished writing, as sent to the
+// callback URL with the default callback body.
+type BlobCallbackEvent struct {
+	Bucket   string `json:"bucket"`
+	Object   string `json:"object"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Digest   string `json:"digest"`
+}
+
+// HandleOSSCallback handles a callback request from OSS, requested with
+// WithOSSCallback. It verifies that the request was signed by OSS, parses
+// the default callback body and passes it to OnBlobCallback, if set, then
+// responds to OSS. If it returns an error, nothing has been written to w.
+func (s *Storage) HandleOSSCallback(w http.ResponseWriter, r *http.Request) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+	if err != nil {
+		return fmt.Errorf("reading callback: %v", err)
+	}
+	if err := verifyOSSCallback(r, body); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	var ev BlobCallbackEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return fmt.Errorf("parsing callback: %v", err)
+	}
+	if s.OnBlobCallback != nil {
+		if err := s.OnBlobCallback(r.Context(), ev); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(`{"Status":"OK"}`))
+	return err
+}
+
+// ossPublicKeys caches the public keys OSS signs callbacks with, by URL.
+var ossPublicKeys sync.Map
+
+// verifyOSSCallback checks the signature of the callback request, which OSS
+// makes over its path, query and body with the key at the URL in the
+// X-Oss-Pub-Key-Url header.
+func verifyOSSCallback(r *http.Request, body []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get("Authorization"))
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("invalid callback signature")
+	}
+	keyURL, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Oss-Pub-Key-Url"))
+	if err != nil {
+		return fmt.Errorf("invalid callback public key URL")
+	}
+	pub, err := ossPublicKey(r.Context(), string(keyURL))
+	if err != nil {
+		return err
+	}
+
+	path, err := url.PathUnescape(r.URL.EscapedPath())
+	if err != nil {
+		return err
+	}
+	authStr := path
+	if r.URL.RawQuery != "" {
+		authStr += "?" + r.URL.RawQuery
+	}
+	authStr += "\n" + string(body)
+	sum := md5.Sum([]byte(authStr))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.MD5, sum[:], sig); err != nil {
+		return fmt.Errorf("callback signature doesn't match")
+	}
+	return nil
+}
+
+// ossPublicKeyPrefix is the prefix of the URLs of the keys OSS signs
+// callbacks with.
+const ossPublicKeyPrefix = "https://gosspublic.alicdn.com/"
+
+// ossPublicKey fetches the key OSS signs callbacks with, which must be hosted
+// by OSS, so that a forged request can't name its own key.
+//
+// The key is always fetched over HTTPS, so that it can't be replaced in
+// transit. OSS names its keys with http:// URLs, which are upgraded.
+func ossPublicKey(ctx context.Context, keyURL string) (*rsa.PublicKey, error) {
+	if strings.HasPrefix(keyURL, "http://") {
+		keyURL = "https://" + strings.TrimPrefix(keyURL, "http://")
+	}
+	if !strings.HasPrefix(keyURL, ossPublicKeyPrefix) {
+		return nil, fmt.Errorf("callback public key URL %q isn't an HTTPS URL hosted by OSS", keyURL)
+	}
+	if pub, ok := ossPublicKeys.Load(keyURL); ok {
+		return pub.(*rsa.PublicKey), nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, keyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("fetching callback public key: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching callback public key: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching callback public key: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("callback public key isn't PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing callback public key: %v", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("callback public key isn't an RSA key")
+	}
+	ossPublicKeys.Store(keyURL, pub)
+	return pub, nil
+}
@@ -0,0 +1,35 @@
+package serve
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestOSSPublicKeyRequiresHTTPS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keyURL = ossPublicKeyPrefix + "callback_pub_key_v1.pem"
+	ossPublicKeys.Store(keyURL, &key.PublicKey)
+	defer ossPublicKeys.Delete(keyURL)
+
+	// OSS's http:// URLs are fetched over HTTPS, and so find the key
+	// cached by its https:// URL.
+	for _, u := range []string{keyURL, "http://gosspublic.alicdn.com/callback_pub_key_v1.pem"} {
+		if pub, err := ossPublicKey(context.Background(), u); err != nil || pub != &key.PublicKey {
+			t.Errorf("ossPublicKey(%q) = %v, %v, want the cached key", u, pub, err)
+		}
+	}
+	for _, u := range []string{
+		"ftp://gosspublic.alicdn.com/callback_pub_key_v1.pem",
+		"https://example.com/callback_pub_key_v1.pem",
+		"https://gosspublic.alicdn.com.example.com/callback_pub_key_v1.pem",
+	} {
+		if _, err := ossPublicKey(context.Background(), u); err == nil {
+			t.Errorf("ossPublicKey(%q): want error", u)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package serve
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const reposPrefix = "repos/"
+
+// recordRepo records the repository in the catalog, as an empty object at
+// repos/<repo>, in the namespace of the blob prefix, unless it's already
+// been recorded.
+func (s *Storage) recordRepo(repo string) error {
+	if _, ok := s.repos.Load(repo); ok {
+		return nil
+	}
+	key := s.metaKey(reposPrefix) + repo
+	ok, err := s.objects.Exists(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.objects.Put(key, strings.NewReader(""), "text/plain; charset=utf-8", nil); err != nil {
+			return err
+		}
+	}
+	s.repos.Store(repo, struct{}{})
+	return nil
+}
+
+// Repositories returns the repositories that ServeManifest and ServeIndex
+// have served images from, sorted.
+func (s *Storage) Repositories() ([]string, error) {
+	prefix := s.metaKey(reposPrefix)
+	keys, err := s.objects.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]string, 0, len(keys))
+	for _, k := range keys {
+		repos = append(repos, strings.TrimPrefix(k, prefix))
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// catalog is the response of the catalog API.
+type catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+// ServeCatalog serves the catalog API for requests to /v2/_catalog, listing
+// the repositories that ServeManifest and ServeIndex have served images
+// from. Results are paginated with the n and last parameters, like
+// ServeTags.
+func (s *Storage) ServeCatalog(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(w, r)
+	repos, err := s.Repositories()
+	if err != nil {
+		WriteError(w, withRequestIDErr(ctx, err))
+		return
+	}
+	if repos, err = paginate(w, r, repos); err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set(metaContentType, "application/json")
+	json.NewEncoder(w).Encode(&catalog{Repositories: repos})
+}
@@ -0,0 +1,247 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	defaultOSSEndpoint = "oss-cn-beijing.aliyuncs.com"
+	defaultOSSBucket   = "nydus-demo"
+)
+
+// Config identifies where a Storage stores objects, and the credentials to
+// access them with.
+type Config struct {
+	// Backend selects where objects are stored: oss, the default, s3,
+	// gcs, fs, in files under Dir, or mem, in memory until the process
+	// exits, for development.
+	Backend string
+
+	// Bucket and Endpoint identify the bucket, for the oss, s3 and gcs
+	// backends. The OSS endpoint defaults to oss-cn-beijing.aliyuncs.com
+	// and its bucket to nydus-demo; the S3 endpoint defaults to the one
+	// for Region, and the GCS endpoint to storage.googleapis.com.
+	Bucket, Endpoint string
+
+	// Region is the S3 region. The default is us-east-1.
+	Region string
+
+	// AccessID and AccessKey are the credentials to access OSS or S3
+	// with. GCS uses the application default credentials.
+	AccessID, AccessKey string
+
+	// Scheme is used to connect to the bucket, and in redirects to blobs:
+	// http or https, the default.
+	Scheme string
+
+	// Dir is the directory the fs backend stores objects in.
+	Dir string
+
+	// BlobPrefix is the prefix of the keys blobs are stored under. The
+	// default is blobs/. The other objects the service stores are
+	// stored under the path components before its last, so that with
+	// prod/blobs, tags are stored under prod/tags/; see WithBlobPrefix.
+	BlobPrefix string
+
+	// BlobServing is how blobs are served: redirect, the default, to
+	// redirect clients to the bucket, or proxy, to stream them through the
+	// service, honoring Range requests, for clients that can't follow
+	// redirects to the bucket's domain.
+	BlobServing string
+
+	// PushNamespaces are the repositories, along with those nested under
+	// them, that clients may push to; see ServePush. By default nothing
+	// may be pushed. Their tags never expire with CacheTTL. Requests must
+	// be authenticated, with AuthTokenKey, AuthPublicKey, AuthHtpasswd or
+	// WithAuth, so that not just anyone can push.
+	PushNamespaces []string
+
+	// CacheTTL, if set, is how long images may go unpulled before
+	// CollectGarbage purges them, as a duration such as 720h. Pulls
+	// record their time in the metadata of the manifests and tags pulled.
+	CacheTTL string
+
+	// TraceSampleRate, if set, is the fraction of requests, between 0 and
+	// 1, whose traces are logged; see Trace.
+	TraceSampleRate string
+
+	// LogLevel, if set, is the least severe level of lines logged: debug,
+	// info, which is the default, warn or error.
+	LogLevel string
+
+	// AuthTokenKey, if set, is the path of a PEM-encoded RSA or P-256
+	// private key to issue registry tokens with, at the handler returned
+	// by Storage.TokenHandler, to the users of the TokenPolicy at
+	// AuthPolicy. Registry requests must then bear one; see RequireAuth.
+	AuthTokenKey string
+
+	// AuthPolicy is the path of the TokenPolicy, as JSON, saying who
+	// tokens are issued to and what they grant.
+	AuthPolicy string
+
+	// AuthPublicKey, if set instead of AuthTokenKey, is the path of the
+	// PEM-encoded public key or certificate of an external token
+	// service, whose tokens registry requests must bear.
+	AuthPublicKey string
+
+	// AuthRealm is the URL of the token service clients are sent to. The
+	// default is /token on the host the request was sent to.
+	AuthRealm string
+
+	// AuthService and AuthIssuer name the registry that tokens are for,
+	// and the token service that issues them. Both default to
+	// kontain.me.
+	AuthService, AuthIssuer string
+
+	// AuthHtpasswd, if set, is the path of an htpasswd file of users and
+	// bcrypt password hashes, one of whom registry requests must bear
+	// the basic auth credentials of; see BasicAuth. It can't be set with
+	// AuthTokenKey or AuthPublicKey, since clients then send tokens
+	// instead.
+	AuthHtpasswd string
+
+	// AllowCIDRs, if set, are the networks, or addresses, that registry
+	// requests must come from, and AllowNamespaces the repositories,
+	// along with those nested under them, that they may be for; see
+	// Allowlist. TrustForwardedFor, if true, takes the address requests
+	// come from from the X-Forwarded-For header added by the proxy in
+	// front of the service.
+	AllowCIDRs, AllowNamespaces []string
+	TrustForwardedFor           string
+
+	// RateLimit and RateBurst, if set, are how many requests per second
+	// each client may make on average, and at once; BytesQuota, if set,
+	// is how many bytes may be written to storage for each client per
+	// QuotaWindow, which defaults to 24h. See Limits.
+	RateLimit, RateBurst    string
+	BytesQuota, QuotaWindow string
+
+	// NegativeCacheTTL, NegativeCacheEntries and NegativeCachePersist, if
+	// set, configure the cache of failed upstream lookups, overriding
+	// WithNegativeCache: how long failures are remembered, as a duration,
+	// or 0 to disable the cache, how many are remembered in memory, and
+	// whether they're recorded in the bucket too.
+	NegativeCacheTTL, NegativeCacheEntries string
+	NegativeCachePersist                   string
+}
+
+// ConfigFromEnv returns the Config given by the environment: STORAGE_BACKEND,
+// BUCKET, ENDPOINT, REGION, ACCESS_KEY_ID, ACCESS_KEY_SECRET, SCHEME,
+// STORAGE_DIR, BLOB_PREFIX, BLOB_SERVING, PUSH_NAMESPACES, which is
+// comma-separated, CACHE_TTL, TRACE_SAMPLE_RATE, LOG_LEVEL, AUTH_TOKEN_KEY,
+// AUTH_POLICY, AUTH_PUBLIC_KEY, AUTH_REALM, AUTH_SERVICE, AUTH_ISSUER,
+// AUTH_HTPASSWD, ALLOW_CIDRS and ALLOW_NAMESPACES, which are
+// comma-separated, TRUST_FORWARDED_FOR, RATE_LIMIT, RATE_BURST, BYTES_QUOTA,
+// QUOTA_WINDOW, NEGATIVE_CACHE_TTL, NEGATIVE_CACHE_ENTRIES and
+// NEGATIVE_CACHE_PERSIST. NewStorage uses it unless WithConfig is given.
+func ConfigFromEnv() Config {
+	return Config{
+		Backend:     os.Getenv("STORAGE_BACKEND"),
+		Bucket:      os.Getenv("BUCKET"),
+		Endpoint:    os.Getenv("ENDPOINT"),
+		Region:      os.Getenv("REGION"),
+		AccessID:    os.Getenv("ACCESS_KEY_ID"),
+		AccessKey:   os.Getenv("ACCESS_KEY_SECRET"),
+		Scheme:      os.Getenv("SCHEME"),
+		Dir:         os.Getenv("STORAGE_DIR"),
+		BlobPrefix:  os.Getenv("BLOB_PREFIX"),
+		BlobServing: os.Getenv("BLOB_SERVING"),
+
+		PushNamespaces:  splitList(os.Getenv("PUSH_NAMESPACES")),
+		CacheTTL:        os.Getenv("CACHE_TTL"),
+		TraceSampleRate: os.Getenv("TRACE_SAMPLE_RATE"),
+		LogLevel:        os.Getenv("LOG_LEVEL"),
+
+		AuthTokenKey:  os.Getenv("AUTH_TOKEN_KEY"),
+		AuthPolicy:    os.Getenv("AUTH_POLICY"),
+		AuthPublicKey: os.Getenv("AUTH_PUBLIC_KEY"),
+		AuthRealm:     os.Getenv("AUTH_REALM"),
+		AuthService:   os.Getenv("AUTH_SERVICE"),
+		AuthIssuer:    os.Getenv("AUTH_ISSUER"),
+
+		AuthHtpasswd:      os.Getenv("AUTH_HTPASSWD"),
+		AllowCIDRs:        splitList(os.Getenv("ALLOW_CIDRS")),
+		AllowNamespaces:   splitList(os.Getenv("ALLOW_NAMESPACES")),
+		TrustForwardedFor: os.Getenv("TRUST_FORWARDED_FOR"),
+
+		RateLimit:   os.Getenv("RATE_LIMIT"),
+		RateBurst:   os.Getenv("RATE_BURST"),
+		BytesQuota:  os.Getenv("BYTES_QUOTA"),
+		QuotaWindow: os.Getenv("QUOTA_WINDOW"),
+
+		NegativeCacheTTL:     os.Getenv("NEGATIVE_CACHE_TTL"),
+		NegativeCacheEntries: os.Getenv("NEGATIVE_CACHE_ENTRIES"),
+		NegativeCachePersist: os.Getenv("NEGATIVE_CACHE_PERSIST"),
+	}
+}
+
+// splitList returns the non-empty elements of the comma-separated list.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.Trim(strings.TrimSpace(e), "/"); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// WithConfig configures the Storage with cfg instead of the environment.
+// Options given after it, such as WithScheme, override its fields.
+func WithConfig(cfg Config) Option {
+	return func(s *Storage) error {
+		s.config = cfg
+		s.scheme = cfg.Scheme
+		s.blobPrefix = cfg.BlobPrefix
+		return nil
+	}
+}
+
+// withDefaults returns the config with defaults filled in for its backend.
+func (c Config) withDefaults() Config {
+	if c.Backend == "" {
+		c.Backend = "oss"
+	}
+	if c.Backend == "oss" {
+		if c.Endpoint == "" {
+			c.Endpoint = defaultOSSEndpoint
+		}
+		if c.Bucket == "" {
+			c.Bucket = defaultOSSBucket
+		}
+	}
+	return c
+}
+
+// validate reports what's missing or invalid in the config, which must have
+// had its defaults filled in.
+func (c Config) validate() error {
+	switch c.Backend {
+	case "oss":
+		if (c.AccessID == "") != (c.AccessKey == "") {
+			return errors.New("OSS access key ID and secret (ACCESS_KEY_ID and ACCESS_KEY_SECRET) must be set together")
+		}
+	case "s3":
+		if c.Bucket == "" {
+			return errors.New("S3 bucket (BUCKET) must be set")
+		}
+		if c.AccessID == "" || c.AccessKey == "" {
+			return errors.New("S3 access key ID and secret (ACCESS_KEY_ID and ACCESS_KEY_SECRET) must be set")
+		}
+	case "gcs":
+		if c.Bucket == "" {
+			return errors.New("GCS bucket (BUCKET) must be set")
+		}
+	case "fs":
+		if c.Dir == "" {
+			return errors.New("storage directory (STORAGE_DIR) must be set for the fs backend")
+		}
+	case "mem":
+	default:
+		return fmt.Errorf("unknown storage backend (STORAGE_BACKEND) %q, must be oss, s3, gcs, fs or mem", c.Backend)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package serve
+
+import (
+	"context"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+type opUploadsKey struct{}
+
+// opUploads tracks the blobs uploaded by one operation, such as writing an
+// index and all its images, so that a blob shared by several of them is
+// only uploaded once, even when they're written concurrently.
+type opUploads struct {
+	m sync.Map // opUploadKey -> *opUpload
+}
+
+// opUploadKey identifies an upload by the blob's name and what it's written
+// as: the media type of the descriptor it's written with, and how it's
+// compressed. Images of an index can share a layer but write it differently,
+// such as a Docker and an OCI image writing it uncompressed, or an OCI image
+// recompressing it when a Docker image can't, so their descriptors differ.
+type opUploadKey struct {
+	name        string
+	mediaType   types.MediaType
+	compression LayerCompression
+}
+
+type opUpload struct {
+	done chan struct{}
+	desc v1.Descriptor
+	err  error
+}
+
+// withOpUploads returns a context tracking the blobs uploaded by the
+// operation, unless ctx already does, for an operation it's part of.
+func withOpUploads(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(opUploadsKey{}).(*opUploads); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, opUploadsKey{}, &opUploads{})
+}
+
+// uploadOnce calls write to upload the blob, unless it's already being or
+// been uploaded in the same way by the same operation, in which case it
+// waits for that upload and returns its result, and first is false.
+func uploadOnce(ctx context.Context, key opUploadKey, write func() (v1.Descriptor, error)) (desc v1.Descriptor, first bool, err error) {
+	ops, ok := ctx.Value(opUploadsKey{}).(*opUploads)
+	if !ok {
+		desc, err := write()
+		return desc, true, err
+	}
+	u := &opUpload{done: make(chan struct{})}
+	if v, loaded := ops.m.LoadOrStore(key, u); loaded {
+		u := v.(*opUpload)
+		select {
+		case <-u.done:
+			return u.desc, false, u.err
+		case <-ctx.Done():
+			return v1.Descriptor{}, false, ctx.Err()
+		}
+	}
+	u.desc, u.err = write()
+	close(u.done)
+	return u.desc, true, u.err
+}
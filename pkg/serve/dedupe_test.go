@@ -0,0 +1,158 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestUploadOnceKeyedByMediaType(t *testing.T) {
+	ctx := withOpUploads(context.Background())
+	writes := 0
+	write := func(mt types.MediaType) func() (v1.Descriptor, error) {
+		return func() (v1.Descriptor, error) {
+			writes++
+			return v1.Descriptor{MediaType: mt}, nil
+		}
+	}
+	for _, tc := range []struct {
+		key   opUploadKey
+		first bool
+		want  types.MediaType
+	}{
+		{opUploadKey{name: "sha256:a", mediaType: types.DockerUncompressedLayer}, true, types.DockerUncompressedLayer},
+		{opUploadKey{name: "sha256:a", mediaType: types.OCIUncompressedLayer}, true, types.OCIUncompressedLayer},
+		{opUploadKey{name: "sha256:a", mediaType: types.OCILayer, compression: CompressZstd}, true, types.OCILayer},
+		{opUploadKey{name: "sha256:a", mediaType: types.DockerUncompressedLayer}, false, types.DockerUncompressedLayer},
+	} {
+		desc, first, err := uploadOnce(ctx, tc.key, write(tc.key.mediaType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != tc.first || desc.MediaType != tc.want {
+			t.Errorf("uploadOnce(%v) = %s, first %t; want %s, first %t", tc.key, desc.MediaType, first, tc.want, tc.first)
+		}
+	}
+	if writes != 3 {
+		t.Errorf("wrote %d times, want 3", writes)
+	}
+}
+
+// slowLayer is a layer whose contents take a while to read, so that images
+// sharing it are still writing it at the same time.
+type slowLayer struct{ v1.Layer }
+
+func (l slowLayer) Uncompressed() (io.ReadCloser, error) {
+	time.Sleep(100 * time.Millisecond)
+	return l.Layer.Uncompressed()
+}
+
+func TestWriteMixedIndexSharedLayer(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.StoreUncompressed = true
+	l, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker, err := mutate.AppendLayers(empty.Image, slowLayer{l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oci, err := convertImage(docker, dockerToOCI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: docker},
+		mutate.IndexAddendum{Add: oci})
+
+	ctx := context.Background()
+	desc, _, err := s.writeIndex(ctx, idx)
+	if err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	b, err := s.readBlob(ctx, desc.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var im v1.IndexManifest
+	if err := json.Unmarshal(b, &im); err != nil {
+		t.Fatal(err)
+	}
+	want := map[types.MediaType]types.MediaType{
+		types.DockerManifestSchema2: types.DockerUncompressedLayer,
+		types.OCIManifestSchema1:    types.OCIUncompressedLayer,
+	}
+	for _, d := range im.Manifests {
+		b, err := s.readBlob(ctx, d.Digest.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m v1.Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		for _, ld := range m.Layers {
+			if ld.MediaType != want[d.MediaType] {
+				t.Errorf("%s manifest has a layer of type %s, want %s", d.MediaType, ld.MediaType, want[d.MediaType])
+			}
+		}
+	}
+}
+
+// countingPutter is a Backend that counts how many times each object is
+// written, taking a while to write each so that writers race.
+type countingPutter struct {
+	Backend
+
+	mu   sync.Mutex
+	puts map[string]int
+}
+
+func (b *countingPutter) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	b.mu.Lock()
+	b.puts[key]++
+	b.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	return b.Backend.Put(key, r, contentType, meta)
+}
+
+func TestWriteIndexUploadsSharedLayerOnce(t *testing.T) {
+	b := &countingPutter{Backend: newMemBackend(), puts: map[string]int{}}
+	s := newTestStorage(t, Config{}, WithBackend(b))
+	shared, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var adds []mutate.IndexAddendum
+	for i := 0; i < 3; i++ {
+		own, err := random.Layer(1024, types.DockerLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := mutate.AppendLayers(empty.Image, shared, own)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.IndexAddendum{Add: img})
+	}
+	if _, _, err := s.writeIndex(context.Background(), mutate.AppendManifests(empty.Index, adds...)); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	digest, err := shared.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := b.puts[s.blobKey(digest.String())]; n != 1 {
+		t.Errorf("shared layer was written %d times, want once", n)
+	}
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"net/http"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// maxVerifyBuffer is how much of a response VerifyDigests holds back before
+// it starts streaming it, so that corrupt manifests and small blobs can be
+// answered with an error instead.
+const maxVerifyBuffer = 4 << 20
+
+// VerifyDigests wraps a registry handler so that the contents of blobs and
+// manifests it serves by digest, rather than redirecting to, are checked
+// against the digest requested, protecting clients from corruption in the
+// storage layer.
+//
+// Responses no larger than 4 MiB, such as manifests, are held until they're
+// verified, and are replaced with a 502 Bad Gateway if they don't match.
+// Larger responses are streamed as they're served, holding back only their
+// last write, and the connection is aborted before that's sent if they don't
+// match, so that the client sees a truncated response rather than a corrupt
+// one. Responses to HEAD and Range requests, and redirects, aren't checked.
+func VerifyDigests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want, ok := requestedDigest(r)
+		if !ok || r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h, err := v1.Hasher(want.Algorithm)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		dv := &digestVerifier{ResponseWriter: w, want: want, h: h}
+		next.ServeHTTP(dv, r)
+		dv.finish(r)
+	})
+}
+
+// requestedDigest returns the digest of the blob or manifest the request is
+// for, if it's for one by digest.
+func requestedDigest(r *http.Request) (v1.Hash, bool) {
+	p, _ := requestPath(r)
+	if p.Section != SectionBlobs && p.Section != SectionManifests {
+		return v1.Hash{}, false
+	}
+	return p.Digest()
+}
+
+// digestVerifier is a ResponseWriter that hashes a successful response's
+// body as it's written, holding it back until it's verified; see
+// VerifyDigests.
+type digestVerifier struct {
+	http.ResponseWriter
+	want v1.Hash
+	h    hash.Hash
+
+	// status is the status written, or 0 if none has been yet.
+	status int
+	// passthrough is set once the response is known not to be verified,
+	// because it isn't a 200.
+	passthrough bool
+	// buf holds the body until it's verified or grows too large, or, once
+	// streaming, the last write.
+	buf       bytes.Buffer
+	streaming bool
+}
+
+func (d *digestVerifier) WriteHeader(status int) {
+	if d.status != 0 {
+		return
+	}
+	d.status = status
+	if status != http.StatusOK {
+		d.passthrough = true
+		d.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (d *digestVerifier) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.passthrough {
+		return d.ResponseWriter.Write(p)
+	}
+	d.h.Write(p)
+	if d.streaming {
+		// Send the previous write, and hold back this one.
+		if _, err := d.ResponseWriter.Write(d.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		d.buf.Reset()
+		d.buf.Write(p)
+		return len(p), nil
+	}
+	d.buf.Write(p)
+	if d.buf.Len() <= maxVerifyBuffer {
+		return len(p), nil
+	}
+
+	// Too large to hold: send all but this write.
+	d.streaming = true
+	d.ResponseWriter.WriteHeader(http.StatusOK)
+	b := d.buf.Bytes()
+	if _, err := d.ResponseWriter.Write(b[:len(b)-len(p)]); err != nil {
+		return 0, err
+	}
+	last := append([]byte(nil), p...)
+	d.buf.Reset()
+	d.buf.Write(last)
+	return len(p), nil
+}
+
+// finish verifies the response once the handler has served it, and sends
+// what was held back if it matches.
+func (d *digestVerifier) finish(r *http.Request) {
+	if d.passthrough || d.status == 0 {
+		return
+	}
+	got := v1.Hash{Algorithm: d.want.Algorithm, Hex: fmt.Sprintf("%x", d.h.Sum(nil))}
+	if got == d.want {
+		if !d.streaming {
+			d.ResponseWriter.WriteHeader(http.StatusOK)
+		}
+		d.ResponseWriter.Write(d.buf.Bytes())
+		return
+	}
+
+	errorf(r.Context(), "serving %s: contents have digest %s", d.want, got)
+	if d.streaming {
+		// It's too late to send an error; abort the response instead.
+		panic(http.ErrAbortHandler)
+	}
+	for _, k := range []string{metaContentLength, metaDockerContentDigest, "ETag", "Cache-Control", "Last-Modified", "Accept-Ranges"} {
+		d.Header().Del(k)
+	}
+	writeErr(d.ResponseWriter, http.StatusBadGateway, unknownErrorCode, fmt.Sprintf("stored contents of %s have digest %s", d.want, got))
+}
@@ -0,0 +1,79 @@
+package serve
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// serveContents returns a handler that serves contents to every request.
+func serveContents(contents []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("a", 64))
+		w.Write(contents)
+	})
+}
+
+func TestVerifyDigests(t *testing.T) {
+	want := []byte("contents")
+	digest, _, err := v1.SHA256(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/v2/app/blobs/" + digest.String()
+
+	rec := httptest.NewRecorder()
+	VerifyDigests(serveContents(want)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Errorf("GET = %d %q, want %d %q", rec.Code, rec.Body, http.StatusOK, want)
+	}
+
+	rec = httptest.NewRecorder()
+	VerifyDigests(serveContents([]byte("corrupt"))).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("GET of corrupt contents = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if strings.Contains(rec.Body.String(), "corrupt") {
+		t.Errorf("corrupt contents were served: %q", rec.Body)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != "" {
+		t.Errorf("Docker-Content-Digest = %q, want none", got)
+	}
+
+	// Only GETs are checked.
+	rec = httptest.NewRecorder()
+	VerifyDigests(serveContents([]byte("corrupt"))).ServeHTTP(rec, httptest.NewRequest(http.MethodHead, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("HEAD = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestVerifyDigestsAbortsLargeResponses(t *testing.T) {
+	want := bytes.Repeat([]byte("a"), maxVerifyBuffer+1)
+	digest, _, err := v1.SHA256(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), want...)
+	corrupt[len(corrupt)-1] = 'b'
+	h := VerifyDigests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Written in two parts, so the last is held back.
+		w.Write(corrupt[:maxVerifyBuffer])
+		w.Write(corrupt[maxVerifyBuffer:])
+	}))
+
+	rec := httptest.NewRecorder()
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", r)
+		}
+		if rec.Body.Len() >= len(corrupt) {
+			t.Errorf("served all %d bytes of corrupt contents", rec.Body.Len())
+		}
+	}()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/app/blobs/"+digest.String(), nil))
+}
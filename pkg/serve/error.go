@@ -1,29 +1,134 @@
 package serve
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 )
 
-var ErrNotFound = errors.New("repository or commit not found")
+var (
+	ErrNotFound         = errors.New("repository or commit not found")
+	ErrBlobNotFound     = errors.New("blob not found")
+	ErrDigestMismatch   = errors.New("digest mismatch")
+	ErrSizeMismatch     = errors.New("size mismatch")
+	ErrTooLarge         = errors.New("content exceeds size limit")
+	ErrUnauthorized     = errors.New("authentication required")
+	ErrPlatformNotFound = errors.New("no image for platform")
+	ErrNameInvalid      = errors.New("invalid repository name")
+)
+
+// Error codes used by the distribution spec but not defined by transport.
+const (
+	unknownErrorCode     transport.ErrorCode = "UNKNOWN"
+	unavailableErrorCode transport.ErrorCode = "UNAVAILABLE"
+)
+
+// NewError returns an error that WriteError writes as a registry error
+// response with the given status and error code, such as
+// transport.NameUnknownErrorCode, for errors the sentinels above don't
+// describe.
+func NewError(status int, code transport.ErrorCode, format string, args ...interface{}) error {
+	return &transport.Error{
+		StatusCode: status,
+		Errors: []transport.Diagnostic{{
+			Code:    code,
+			Message: fmt.Sprintf(format, args...),
+		}},
+	}
+}
 
-func Error(w http.ResponseWriter, err error) {
-	code := "MANIFEST_UNKNOWN"
-	httpCode := http.StatusNotFound
-	if terr, ok := err.(*transport.Error); ok {
-		http.Error(w, "", terr.StatusCode)
-		json.NewEncoder(w).Encode(terr.Errors)
+// Error is WriteError, for existing callers.
+func Error(w http.ResponseWriter, err error) { WriteError(w, err) }
+
+// WriteError writes the registry error response for err, as specified by the
+// OCI distribution spec, so that clients can show why a request failed.
+// Errors from a remote registry, and those from NewError, are passed through
+// as is. Errors not otherwise recognized are reported as unknown manifests,
+// since they're usually failures to produce the image being pulled.
+func WriteError(w http.ResponseWriter, err error) {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		writeTransportErr(w, terr)
 		return
 	}
 
-	http.Error(w, "", httpCode)
+	status, code := http.StatusNotFound, transport.ManifestUnknownErrorCode
+	switch {
+	case errors.Is(err, ErrBlobNotFound):
+		status, code = http.StatusNotFound, transport.BlobUnknownErrorCode
+	case errors.Is(err, ErrUnauthorized):
+		status, code = http.StatusUnauthorized, transport.UnauthorizedErrorCode
+	case errors.Is(err, ErrTooLarge):
+		status, code = http.StatusRequestEntityTooLarge, transport.SizeInvalidErrorCode
+	case errors.Is(err, ErrDigestMismatch):
+		status, code = http.StatusBadRequest, transport.DigestInvalidErrorCode
+	case errors.Is(err, ErrSizeMismatch):
+		status, code = http.StatusBadRequest, transport.SizeInvalidErrorCode
+	case errors.Is(err, ErrNameInvalid), isBadName(err):
+		status, code = http.StatusBadRequest, transport.NameInvalidErrorCode
+	case errors.Is(err, ErrNotAcceptable):
+		status, code = http.StatusNotAcceptable, transport.UnsupportedErrorCode
+	case errors.Is(err, ErrAppendPosition):
+		status, code = http.StatusRequestedRangeNotSatisfiable, transport.BlobUploadInvalidErrorCode
+	case errors.Is(err, context.DeadlineExceeded), IsRetryable(err):
+		// The bucket is unavailable or overloaded, so the client
+		// should retry, rather than conclude the image doesn't exist.
+		status, code = http.StatusServiceUnavailable, unavailableErrorCode
+	}
+	writeErr(w, status, code, err.Error())
+}
+
+// isBadName reports whether err is from parsing an invalid image reference.
+func isBadName(err error) bool {
+	var nerr *name.ErrBadName
+	return errors.As(err, &nerr)
+}
+
+// writeTransportErr writes a registry error response with the status and
+// errors of terr, giving it an error code for its status if it has none.
+func writeTransportErr(w http.ResponseWriter, terr *transport.Error) {
+	status := terr.StatusCode
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	diags := terr.Errors
+	if len(diags) == 0 {
+		code := unknownErrorCode
+		switch status {
+		case http.StatusNotFound:
+			code = transport.ManifestUnknownErrorCode
+		case http.StatusUnauthorized:
+			code = transport.UnauthorizedErrorCode
+		case http.StatusForbidden:
+			code = transport.DeniedErrorCode
+		case http.StatusTooManyRequests:
+			code = transport.TooManyRequestsErrorCode
+		}
+		diags = []transport.Diagnostic{{Code: code, Message: http.StatusText(status)}}
+	}
+	es := make([]e, 0, len(diags))
+	for _, d := range diags {
+		es = append(es, e{Code: d.Code, Message: d.Message, Detail: d.Detail})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp{Errors: es})
+}
+
+// writeErr writes a registry error response with the given status and error
+// code.
+func writeErr(w http.ResponseWriter, status int, code transport.ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(&resp{
 		Errors: []e{{
 			Code:    code,
-			Message: err.Error(),
+			Message: message,
 		}},
 	})
 }
@@ -33,7 +138,8 @@ type resp struct {
 }
 
 type e struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
-	Reason  string `json:"reason,omitempty"`
+	Code    transport.ErrorCode `json:"code"`
+	Message string              `json:"message"`
+	Reason  string              `json:"reason,omitempty"`
+	Detail  interface{}         `json:"detail,omitempty"`
 }
@@ -0,0 +1,125 @@
+package serve
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// EventOp is the kind of change a StorageEvent describes.
+type EventOp string
+
+const (
+	// BlobWritten is published when a blob named by digest is written.
+	BlobWritten EventOp = "BlobWritten"
+	// TagUpdated is published when a tag or other alias is written,
+	// including by RetagImage.
+	TagUpdated EventOp = "TagUpdated"
+	// ManifestDeleted is published when CollectGarbage deletes an expired
+	// alias.
+	ManifestDeleted EventOp = "ManifestDeleted"
+)
+
+// StorageEvent describes a change to the stored blobs.
+type StorageEvent struct {
+	Op EventOp
+	// Key is the name of the blob or alias.
+	Key string
+	// Digest is the digest of the blob's contents, or of the manifest the
+	// alias refers to, except for ManifestDeleted.
+	Digest v1.Hash
+	// Size is the size of the blob, if known.
+	Size      int64
+	Timestamp time.Time
+}
+
+// EventBus delivers StorageEvents to any number of subscribers, such as for
+// metrics, webhooks, audit logs and CDN invalidation, without the Storage
+// knowing about them.
+type EventBus interface {
+	// Publish delivers the event to every current subscriber.
+	Publish(event StorageEvent)
+	// Subscribe calls handler with every event published until the
+	// returned func is called.
+	Subscribe(handler func(StorageEvent)) (unsubscribe func())
+}
+
+// NewEventBus returns an EventBus that delivers each event to subscribers in
+// the order they subscribed. Handlers are called without any lock held, so
+// they may publish, subscribe or unsubscribe themselves.
+func NewEventBus() EventBus {
+	return &eventBus{}
+}
+
+type eventBus struct {
+	mu       sync.Mutex
+	next     int
+	handlers []subscription
+}
+
+type subscription struct {
+	id      int
+	handler func(StorageEvent)
+}
+
+func (b *eventBus) Publish(event StorageEvent) {
+	b.mu.Lock()
+	handlers := append([]subscription(nil), b.handlers...)
+	b.mu.Unlock()
+	for _, sub := range handlers {
+		sub.handler(event)
+	}
+}
+
+func (b *eventBus) Subscribe(handler func(StorageEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.handlers = append(b.handlers, subscription{id: id, handler: handler})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for i, sub := range b.handlers {
+				if sub.id == id {
+					b.handlers = append(b.handlers[:i:i], b.handlers[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// eventQueueSize is how many events may wait to be published before more
+// are dropped.
+const eventQueueSize = 1024
+
+// publish queues the event to be published on Events, if set, so that slow
+// subscribers don't hold up writes. Events are published one at a time, in
+// the order they're queued, by a single goroutine; if subscribers fall so
+// far behind that the queue is full, the event is dropped and counted in
+// kontain_events_dropped_total. Nothing is published in a dry run.
+func (s *Storage) publish(op EventOp, key string, digest v1.Hash, size int64) {
+	if s.Events == nil || s.DryRun {
+		return
+	}
+	s.eventsOnce.Do(func() {
+		s.events = make(chan StorageEvent, eventQueueSize)
+		go func() {
+			for ev := range s.events {
+				s.Events.Publish(ev)
+			}
+		}()
+	})
+	ev := StorageEvent{Op: op, Key: key, Digest: digest, Size: size, Timestamp: time.Now()}
+	select {
+	case s.events <- ev:
+	default:
+		eventsDropped.inc(1)
+		warnf(context.Background(), "event queue full, dropping %s event for %q", op, key)
+	}
+}
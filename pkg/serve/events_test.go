@@ -0,0 +1,57 @@
+package serve
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestEventBusHandlersMayUnsubscribeAndPublish(t *testing.T) {
+	b := NewEventBus()
+	var got []string
+	var unsubscribe func()
+	unsubscribe = b.Subscribe(func(ev StorageEvent) {
+		got = append(got, ev.Key)
+		unsubscribe()
+		b.Publish(StorageEvent{Key: "from handler"})
+	})
+	b.Subscribe(func(ev StorageEvent) { got = append(got, "second "+ev.Key) })
+
+	done := make(chan struct{})
+	go func() {
+		b.Publish(StorageEvent{Key: "first"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish deadlocked")
+	}
+	want := []string{"first", "second from handler", "second first"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestPublishInOrder(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.Events = NewEventBus()
+	const n = 100
+	keys := make(chan string, n)
+	s.Events.Subscribe(func(ev StorageEvent) { keys <- ev.Key })
+	for i := 0; i < n; i++ {
+		s.publish(BlobWritten, fmt.Sprint(i), v1.Hash{}, 0)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case k := <-keys:
+			if k != fmt.Sprint(i) {
+				t.Fatalf("event %d has key %q, want %q", i, k, fmt.Sprint(i))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d wasn't published", i)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package serve
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ExportManifestTree writes the manifest with the given digest, every
+// manifest it references if it's an index, and every config and layer blob
+// they reference, to w as a tar archive in the OCI image layout format, as
+// consumed by skopeo's oci-archive transport.
+func (s *Storage) ExportManifestTree(ctx context.Context, digest v1.Hash, w io.Writer) error {
+	desc, err := s.BlobExists(ctx, digest.String())
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, digest)
+	} else if err != nil {
+		return err
+	}
+	desc.Digest = digest
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	ib, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{desc},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "index.json", ib); err != nil {
+		return err
+	}
+
+	written := map[v1.Hash]bool{}
+	var export func(h v1.Hash) error
+	export = func(h v1.Hash) error {
+		b, err := s.readBlob(ctx, h.String())
+		if isNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrBlobNotFound, h)
+		} else if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, layoutBlobPath(h), b); err != nil {
+			return err
+		}
+		written[h] = true
+
+		blobs, children, err := manifestRefs(b)
+		if err != nil {
+			return fmt.Errorf("parsing manifest %s: %v", h, err)
+		}
+		for _, bh := range blobs {
+			if written[bh] {
+				continue
+			}
+			if err := s.exportBlob(ctx, tw, bh); err != nil {
+				return err
+			}
+			written[bh] = true
+		}
+		for _, c := range children {
+			if written[c] {
+				continue
+			}
+			if err := export(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := export(digest); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportBlob streams the blob's contents into the archive.
+func (s *Storage) exportBlob(ctx context.Context, tw *tar.Writer, h v1.Hash) error {
+	desc, err := s.BlobExists(ctx, h.String())
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, h)
+	} else if err != nil {
+		return err
+	}
+	rc, err := s.objects.Get(s.blobKey(h.String()))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     layoutBlobPath(h),
+		Mode:     0644,
+		Size:     desc.Size,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, &ctxReader{ctx: ctx, r: rc}); err != nil {
+		return fmt.Errorf("exporting blob %s: %v", h, err)
+	}
+	return nil
+}
+
+// layoutBlobPath returns the path of the blob in an OCI image layout.
+func layoutBlobPath(h v1.Hash) string {
+	return path.Join("blobs", h.Algorithm, h.Hex)
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, bytes.NewReader(b))
+	return err
+}
@@ -0,0 +1,211 @@
+package serve
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewFakeStorage returns a Storage that keeps everything in memory instead
+// of in OSS, for testing code that serves images without OSS credentials or
+// network access.
+//
+// It behaves like a Storage backed by OSS, recording the same metadata and
+// skipping blobs that were already written, except that requests for blobs
+// are served their contents directly instead of being redirected to the
+// bucket. Servers get the same backend from NewStorage with
+// STORAGE_BACKEND=mem.
+func NewFakeStorage() *Storage {
+	return &Storage{
+		objects:    newMemBackend(),
+		blobPrefix: ConfigFromEnv().BlobPrefix,
+		opTimeout:  defaultOperationTimeout,
+
+		MaxBlobSize:      defaultMaxBlobSize,
+		MaxManifestSize:  defaultMaxManifestSize,
+		UploadBufferSize: defaultUploadBufferSize,
+	}
+}
+
+// memBackend stores objects in memory.
+type memBackend struct {
+	mu      sync.Mutex
+	objects map[string]*memObject
+}
+
+type memObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{objects: map[string]*memObject{}}
+}
+
+func (b *memBackend) lookup(key string) (*memObject, error) {
+	o, ok := b.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return o, nil
+}
+
+func (b *memBackend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = &memObject{
+		data: data,
+		info: ObjectInfo{
+			Size:        int64(len(data)),
+			ContentType: contentType,
+			ModTime:     time.Now(),
+			Meta:        canonicalMeta(meta),
+		},
+	}
+	return nil
+}
+
+func (b *memBackend) Get(key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, err := b.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (b *memBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, err := b.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(o.data)) {
+		offset = int64(len(o.data))
+	}
+	return ioutil.NopCloser(io.LimitReader(bytes.NewReader(o.data[offset:]), length)), nil
+}
+
+func (b *memBackend) Stat(key string) (ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, err := b.lookup(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := o.info
+	info.Meta = canonicalMeta(o.info.Meta)
+	return info, nil
+}
+
+func (b *memBackend) Exists(key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.objects[key]
+	return ok, nil
+}
+
+func (b *memBackend) Copy(src, dst string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, err := b.lookup(src)
+	if err != nil {
+		return err
+	}
+	info := o.info
+	info.ModTime = time.Now()
+	b.objects[dst] = &memObject{data: o.data, info: info}
+	return nil
+}
+
+func (b *memBackend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, err := b.lookup(src)
+	if err != nil {
+		return err
+	}
+	b.objects[dst] = &memObject{
+		data: o.data,
+		info: ObjectInfo{
+			Size:        o.info.Size,
+			ContentType: contentType,
+			ModTime:     time.Now(),
+			Meta:        canonicalMeta(meta),
+		},
+	}
+	return nil
+}
+
+func (b *memBackend) Delete(keys ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, k := range keys {
+		delete(b.objects, k)
+	}
+	return nil
+}
+
+func (b *memBackend) DeleteBatch(keys []string) ([]string, error) {
+	return keys, b.Delete(keys...)
+}
+
+func (b *memBackend) Append(key string, r io.Reader, pos int64) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[key]
+	if !ok {
+		o = &memObject{info: ObjectInfo{Meta: map[string]string{}}}
+	}
+	if int64(len(o.data)) != pos {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	o.data = append(o.data[:len(o.data):len(o.data)], data...)
+	o.info.Size = int64(len(o.data))
+	o.info.ModTime = time.Now()
+	b.objects[key] = o
+	return o.info.Size, nil
+}
+
+func (b *memBackend) List(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *memBackend) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	b.mu.Lock()
+	o, err := b.lookup(key)
+	b.mu.Unlock()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if o.info.ContentType != "" {
+		w.Header().Set("Content-Type", o.info.ContentType)
+	}
+	http.ServeContent(w, r, "", o.info.ModTime, bytes.NewReader(o.data))
+}
@@ -0,0 +1,284 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fsBackend stores objects in files under a local directory, for running the
+// service without a cloud account. Blobs are served directly from the files
+// instead of redirecting to a bucket.
+//
+// Each object's contents are in objects/<key> and its content type and
+// metadata in meta/<key>.json, with the key path-escaped so that every
+// object is a file directly in the directory. Objects are written to tmp/
+// first and renamed into place.
+type fsBackend struct {
+	dir string
+
+	// mu serializes writes, so that appends and metadata updates don't
+	// race.
+	mu sync.Mutex
+}
+
+// fsMeta holds what's stored about an object besides its contents.
+type fsMeta struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+func newFSBackend(dir string) (*fsBackend, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("storage directory must be set")
+	}
+	for _, d := range []string{"objects", "meta", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &fsBackend{dir: dir}, nil
+}
+
+func (b *fsBackend) objectPath(key string) string {
+	return filepath.Join(b.dir, "objects", url.PathEscape(key))
+}
+
+func (b *fsBackend) metaPath(key string) string {
+	return filepath.Join(b.dir, "meta", url.PathEscape(key)+".json")
+}
+
+// notFound reports a missing file as a missing object.
+func notFound(err error, key string) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return err
+}
+
+// writeTemp writes r to a new temporary file, and returns its path.
+func (b *fsBackend) writeTemp(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(filepath.Join(b.dir, "tmp"), "object-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeMeta replaces the object's content type and metadata. b.mu must be
+// held.
+func (b *fsBackend) writeMeta(key, contentType string, meta map[string]string) error {
+	j, err := json.Marshal(fsMeta{ContentType: contentType, Meta: canonicalMeta(meta)})
+	if err != nil {
+		return err
+	}
+	tmp, err := b.writeTemp(strings.NewReader(string(j)))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.metaPath(key))
+}
+
+func (b *fsBackend) readMeta(key string) (fsMeta, error) {
+	j, err := ioutil.ReadFile(b.metaPath(key))
+	if os.IsNotExist(err) {
+		return fsMeta{}, nil
+	} else if err != nil {
+		return fsMeta{}, err
+	}
+	var m fsMeta
+	if err := json.Unmarshal(j, &m); err != nil {
+		return fsMeta{}, fmt.Errorf("parsing metadata of %q: %v", key, err)
+	}
+	return m, nil
+}
+
+func (b *fsBackend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	tmp, err := b.writeTemp(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.writeMeta(key, contentType, meta); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, b.objectPath(key))
+}
+
+func (b *fsBackend) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(b.objectPath(key))
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+	return f, nil
+}
+
+func (b *fsBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(b.objectPath(key))
+	if err != nil {
+		return nil, notFound(err, key)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (b *fsBackend) Stat(key string) (ObjectInfo, error) {
+	fi, err := os.Stat(b.objectPath(key))
+	if err != nil {
+		return ObjectInfo{}, notFound(err, key)
+	}
+	m, err := b.readMeta(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Size:        fi.Size(),
+		ContentType: m.ContentType,
+		ModTime:     fi.ModTime(),
+		Meta:        canonicalMeta(m.Meta),
+	}, nil
+}
+
+func (b *fsBackend) Exists(key string) (bool, error) {
+	_, err := os.Stat(b.objectPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *fsBackend) Copy(src, dst string) error {
+	m, err := b.readMeta(src)
+	if err != nil {
+		return err
+	}
+	return b.CopyWithMeta(src, dst, m.ContentType, m.Meta)
+}
+
+func (b *fsBackend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	f, err := os.Open(b.objectPath(src))
+	if err != nil {
+		return notFound(err, src)
+	}
+	defer f.Close()
+	return b.Put(dst, f, contentType, meta)
+}
+
+func (b *fsBackend) Delete(keys ...string) error {
+	_, err := b.DeleteBatch(keys)
+	return err
+}
+
+func (b *fsBackend) DeleteBatch(keys []string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	deleted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if err := os.Remove(b.objectPath(k)); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		if err := os.Remove(b.metaPath(k)); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, k)
+	}
+	return deleted, nil
+}
+
+func (b *fsBackend) Append(key string, r io.Reader, pos int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var size int64
+	if fi, err := os.Stat(b.objectPath(key)); err == nil {
+		size = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if size != pos {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	f, err := os.OpenFile(b.objectPath(key), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Drop what was appended, so that the object's size is still
+		// pos and the append can be retried.
+		os.Truncate(b.objectPath(key), pos)
+		return 0, err
+	}
+	return pos + n, nil
+}
+
+func (b *fsBackend) List(prefix string) ([]string, error) {
+	names, err := ioutil.ReadDir(filepath.Join(b.dir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, fi := range names {
+		k, err := url.PathUnescape(fi.Name())
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *fsBackend) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	f, err := os.Open(b.objectPath(key))
+	if err != nil {
+		Error(w, notFound(err, key))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	m, err := b.readMeta(key)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if m.ContentType != "" {
+		w.Header().Set("Content-Type", m.ContentType)
+	}
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
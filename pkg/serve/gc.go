@@ -0,0 +1,530 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// gcGracePeriod protects recently written blobs from collection, since layer
+// blobs are written before the manifests that reference them.
+const gcGracePeriod = 24 * time.Hour
+
+// maxDeleteObjects is the most keys OSS accepts in one batch delete.
+const maxDeleteObjects = 1000
+
+// GCReport describes the result of a garbage collection.
+type GCReport struct {
+	// Scanned is the number of blobs considered for collection.
+	Scanned int
+	// Referenced is the number of blobs reachable from a tag.
+	Referenced int
+	// Deleted lists the names of unreferenced blobs that were deleted, or
+	// that would have been deleted in a dry run.
+	Deleted []string
+	// DeletedBytes is the total size of the deleted blobs.
+	DeletedBytes int64
+	// Failed lists the names of unreferenced blobs that couldn't be
+	// deleted.
+	Failed []string
+	// ExpiredTags lists the tags recorded in the TagStore, as repo:tag,
+	// that were deleted for not having been pulled within the cache TTL.
+	ExpiredTags []string
+	// ExpiredFailures lists the image references whose failed upstream
+	// lookups, recorded by a persisted negative cache, were deleted for
+	// having expired; see WithNegativeCache.
+	ExpiredFailures []string
+}
+
+// GCObject is a blob that may be collected, as enumerated by ListBlobs or
+// read from an inventory report.
+type GCObject struct {
+	// Name is the blob's name: its digest, or an alias.
+	Name    string
+	Size    int64
+	ModTime time.Time
+
+	// MediaType and LastAccess, when known, let CollectGarbage keep
+	// manifests pulled within the cache TTL; see Config.CacheTTL. They
+	// aren't in inventory reports.
+	MediaType  types.MediaType
+	LastAccess time.Time
+}
+
+// GCOptions configures CollectGarbage.
+type GCOptions struct {
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+
+	// GracePeriod protects blobs modified within it from collection, as
+	// they may belong to an image still being written. The default is a
+	// day.
+	GracePeriod time.Duration
+}
+
+// GCFromInventory deletes blobs that aren't reachable from any tag, using an
+// OSS inventory report to enumerate the bucket's objects instead of listing
+// it, as CollectGarbage does.
+//
+// Records in the inventory CSV begin with the bucket name, followed by the
+// URL-encoded object key, size, last modified date and ETag, as in OSS
+// inventory reports.
+func (s *Storage) GCFromInventory(ctx context.Context, inventoryCSVReader io.Reader, dryRun bool) (GCReport, error) {
+	objects, err := s.ReadInventory(inventoryCSVReader)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("reading inventory: %v", err)
+	}
+	return s.CollectGarbage(ctx, objects, GCOptions{DryRun: dryRun})
+}
+
+// ReadInventory returns the blobs listed in the OSS inventory report, for
+// CollectGarbage; see GCFromInventory.
+func (s *Storage) ReadInventory(r io.Reader) ([]GCObject, error) {
+	var objects []GCObject
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 5 {
+			return nil, fmt.Errorf("got %d columns, want at least 5", len(rec))
+		}
+		key, err := url.QueryUnescape(rec[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", rec[1], err)
+		}
+		if !strings.HasPrefix(key, s.blobKey("")) {
+			continue
+		}
+		name := strings.TrimPrefix(key, s.blobKey(""))
+		size, err := strconv.ParseInt(rec[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for %q: %v", key, err)
+		}
+		modTime, err := time.Parse(time.RFC3339, rec[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid last modified date for %q: %v", key, err)
+		}
+		objects = append(objects, GCObject{Name: name, Size: size, ModTime: modTime})
+	}
+	return objects, nil
+}
+
+// ListBlobs lists every blob, with its size, modification time, media type
+// and last access, for
+// CollectGarbage. It stats each blob, up to 16 at once, so an inventory
+// report is cheaper for large buckets; see GCFromInventory.
+func (s *Storage) ListBlobs(ctx context.Context) ([]GCObject, error) {
+	keys, err := s.objects.List(s.blobKey(""))
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]GCObject, len(keys))
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, maxConcurrentStatReads)
+	for i, k := range keys {
+		i, k := i, k
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, g.Wait()
+		}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			info, err := s.objects.Stat(k)
+			if err != nil {
+				return err
+			}
+			objects[i] = GCObject{
+				Name:       strings.TrimPrefix(k, s.blobKey("")),
+				Size:       info.Size,
+				ModTime:    info.ModTime,
+				MediaType:  blobMediaType(info),
+				LastAccess: lastAccess(info),
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// CollectGarbage deletes the blobs among objects that aren't reachable from
+// any tag.
+//
+// Every blob that isn't named by a digest is a tag (or cache key) alias for
+// a manifest, and is a root: the blobs it references, recursively, are kept.
+// So are those referenced by the tags recorded in the TagStore, including
+// tags pushed with ServePush. Blobs modified within the grace period are
+// kept regardless.
+//
+// Aliases written with an expiry (see Storage.ExpireAfter) that has passed
+// are deleted and are not roots, so that the blobs only they referenced are
+// collected too. If the storage has a cache TTL (see Config.CacheTTL), so
+// are aliases, and tags recorded in the TagStore, that haven't been pulled
+// within it, other than tags pushed to PushNamespaces, while manifests pulled within it are roots, so that images
+// pulled by digest are kept too. Otherwise aliases without an expiry are
+// never deleted. Failed upstream lookups recorded by a persisted negative
+// cache are deleted once they expire. Signatures and
+// artifacts referring to a kept manifest (see WriteSignatureEnvelope and
+// ServeReferrers) are kept too, along with the blobs they reference.
+//
+// If some blobs couldn't be deleted, they're listed in Failed, and the
+// report is returned with an error.
+func (s *Storage) CollectGarbage(ctx context.Context, objects []GCObject, opts GCOptions) (GCReport, error) {
+	if opts.GracePeriod <= 0 {
+		opts.GracePeriod = gcGracePeriod
+	}
+	var candidates, aliases []GCObject
+	for _, o := range objects {
+		if _, err := v1.NewHash(o.Name); err != nil {
+			aliases = append(aliases, o)
+			continue
+		}
+		candidates = append(candidates, o)
+	}
+	sizes := map[string]int64{}
+
+	report := GCReport{Scanned: len(candidates)}
+	var keys, expired []string
+	now := time.Now()
+	roots, expiredTags, err := s.taggedManifests(now)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("listing tags: %v", err)
+	}
+	for _, o := range aliases {
+		exp, err := s.aliasExpired(o.Name, now)
+		if err != nil {
+			return GCReport{}, err
+		}
+		if !exp {
+			roots = append(roots, o.Name)
+			continue
+		}
+		report.Deleted = append(report.Deleted, o.Name)
+		report.DeletedBytes += o.Size
+		keys = append(keys, s.blobKey(o.Name))
+		sizes[o.Name] = o.Size
+		expired = append(expired, o.Name)
+	}
+
+	if s.cacheTTL > 0 {
+		for _, o := range candidates {
+			if isManifestType(o.MediaType) && !o.LastAccess.IsZero() && now.Sub(o.LastAccess) <= s.cacheTTL {
+				roots = append(roots, o.Name)
+			}
+		}
+	}
+
+	referenced, err := s.referencedBlobs(ctx, roots)
+	if err != nil {
+		return GCReport{}, err
+	}
+
+	for _, o := range candidates {
+		if referenced[o.Name] {
+			report.Referenced++
+			continue
+		}
+		if now.Sub(o.ModTime) < opts.GracePeriod {
+			continue
+		}
+		report.Deleted = append(report.Deleted, o.Name)
+		report.DeletedBytes += o.Size
+		keys = append(keys, s.blobKey(o.Name))
+		sizes[o.Name] = o.Size
+	}
+	for _, k := range expiredTags {
+		report.ExpiredTags = append(report.ExpiredTags, tagName(s.metaKey(tagsPrefix), k))
+	}
+	expiredFailures, err := s.expiredFailures(now)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("listing cached failures: %v", err)
+	}
+	for _, k := range expiredFailures {
+		report.ExpiredFailures = append(report.ExpiredFailures, strings.TrimPrefix(k, s.metaKey(negativePrefix)))
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if len(expiredTags) > 0 {
+		if _, failed, err := s.BatchDelete(ctx, expiredTags); err != nil {
+			// The tags are deleted by the next collection instead; the
+			// blobs they referred to weren't collected.
+			warnf(ctx, "deleting %d expired tags: %v", len(failed), err)
+		}
+	}
+	if len(expiredFailures) > 0 {
+		if _, failed, err := s.BatchDelete(ctx, expiredFailures); err != nil {
+			// They're ignored once expired, and deleted by the next
+			// collection instead.
+			warnf(ctx, "deleting %d expired cached failures: %v", len(failed), err)
+		}
+	}
+	if len(keys) == 0 {
+		return report, nil
+	}
+
+	_, failed, err := s.BatchDelete(ctx, keys)
+	notDeleted := map[string]bool{}
+	if len(failed) > 0 {
+		for _, k := range failed {
+			name := strings.TrimPrefix(k, s.blobKey(""))
+			notDeleted[name] = true
+			report.Failed = append(report.Failed, name)
+			report.DeletedBytes -= sizes[name]
+		}
+		deleted := report.Deleted[:0]
+		for _, name := range report.Deleted {
+			if !notDeleted[name] {
+				deleted = append(deleted, name)
+			}
+		}
+		report.Deleted = deleted
+	}
+	for _, name := range expired {
+		if !notDeleted[name] {
+			s.publish(ManifestDeleted, name, v1.Hash{}, sizes[name])
+		}
+	}
+	infof(ctx, "CollectGarbage deleted %d blobs (%d bytes)", len(report.Deleted), report.DeletedBytes)
+	return report, err
+}
+
+// taggedManifests returns the digests of the manifests that tags recorded in
+// the TagStore refer to, and the keys of the tags that haven't been pulled
+// within the cache TTL, whose manifests aren't included. Tags of
+// repositories in PushNamespaces never expire, since they were pushed rather
+// than cached from upstream.
+func (s *Storage) taggedManifests(now time.Time) (digests, expired []string, err error) {
+	prefix := s.metaKey(tagsPrefix)
+	keys, err := s.objects.List(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		info, err := s.objects.Stat(k)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if accessExpired(info, s.cacheTTL, now) && !s.pushable(tagRepo(prefix, k)) {
+			expired = append(expired, k)
+			continue
+		}
+		if d := info.Meta[metaDockerContentDigest]; d != "" {
+			digests = append(digests, d)
+		}
+	}
+	return digests, expired, nil
+}
+
+// tagRepo returns the repository that the TagStore key, under the prefix, is
+// a tag of.
+func tagRepo(prefix, key string) string {
+	key = strings.TrimPrefix(key, prefix)
+	return key[:strings.LastIndex(key, "/")]
+}
+
+// tagName returns the repo:tag that the TagStore key, under the prefix, is
+// for.
+func tagName(prefix, key string) string {
+	key = strings.TrimPrefix(key, prefix)
+	i := strings.LastIndex(key, "/")
+	return key[:i] + ":" + key[i+1:]
+}
+
+// BatchDelete deletes the objects with the given keys, in batches of as many
+// as OSS allows in one request, sent concurrently, and returns the keys that
+// were and weren't deleted. Missing objects count as deleted. A batch that
+// fails doesn't stop the others; if any key wasn't deleted, an error is
+// returned along with the lists.
+func (s *Storage) BatchDelete(ctx context.Context, keys []string) (deleted, failed []string, err error) {
+	if s.DryRun {
+		for _, k := range keys {
+			infof(ctx, "dry run: would delete %q", k)
+		}
+		return nil, nil, nil
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var g errgroup.Group
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		g.Go(func() error {
+			var done []string
+			err := s.withTimeout(ctx, func(ctx context.Context) error {
+				var err error
+				done, err = withContext(ctx, s.objects).DeleteBatch(batch)
+				return err
+			})
+			ok := map[string]bool{}
+			if err == nil {
+				for _, k := range done {
+					ok[k] = true
+				}
+				s.forgetDeleted(done)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for _, k := range batch {
+				if ok[k] {
+					deleted = append(deleted, k)
+				} else {
+					failed = append(failed, k)
+				}
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	if len(failed) > 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("not deleted by OSS")
+		}
+		return deleted, failed, fmt.Errorf("failed to delete %d of %d objects: %v", len(failed), len(deleted)+len(failed), firstErr)
+	}
+	return deleted, nil, nil
+}
+
+// aliasExpired reports whether the named alias has expired: whether the
+// expiry it was written with has passed, or it hasn't been pulled within the
+// cache TTL.
+func (s *Storage) aliasExpired(name string, now time.Time) (bool, error) {
+	info, err := s.objects.Stat(s.blobKey(name))
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if accessExpired(info, s.cacheTTL, now) {
+		return true, nil
+	}
+	v := info.Meta[metaExpireAt]
+	if v == "" {
+		return false, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return false, fmt.Errorf("blob %q has invalid %s metadata %q: %v", name, metaExpireAt, v, err)
+	}
+	return !now.Before(t), nil
+}
+
+// referencedBlobs returns the names of all blobs reachable from the manifests
+// stored under the given root names.
+func (s *Storage) referencedBlobs(ctx context.Context, roots []string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	refKeys, err := s.referrersKeys()
+	if err != nil {
+		return nil, fmt.Errorf("listing referrers: %v", err)
+	}
+	var walk func(name string) error
+	walk = func(name string) error {
+		b, err := s.readBlob(ctx, name)
+		if isNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		h, _, err := v1.SHA256(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		referenced[h.String()] = true
+
+		// Keep the signatures and artifacts referring to the manifest
+		// in any repository along with it, and what they reference.
+		for _, k := range refKeys[h.String()] {
+			refs, err := s.referrers(ctx, k)
+			if err != nil {
+				return err
+			}
+			for _, r := range refs {
+				if referenced[r.Digest.String()] {
+					continue
+				}
+				if err := walk(r.Digest.String()); err != nil {
+					return err
+				}
+			}
+		}
+
+		blobs, children, err := manifestRefs(b)
+		if err != nil {
+			// Not a manifest, e.g. a placeholder object.
+			return nil
+		}
+		for _, h := range blobs {
+			referenced[h.String()] = true
+		}
+		for _, c := range children {
+			if referenced[c.String()] {
+				continue
+			}
+			if err := walk(c.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, r := range roots {
+		if err := walk(r); err != nil {
+			return nil, fmt.Errorf("walking %q: %v", r, err)
+		}
+	}
+	return referenced, nil
+}
+
+// manifestRefs returns the digests of the config and layer blobs referenced
+// by an image manifest, and of the child manifests referenced by an index.
+func manifestRefs(b []byte) (blobs, children []v1.Hash, err error) {
+	var m struct {
+		Config    *v1.Descriptor  `json:"config"`
+		Layers    []v1.Descriptor `json:"layers"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, nil, err
+	}
+	if m.Config != nil {
+		blobs = append(blobs, m.Config.Digest)
+	}
+	for _, l := range m.Layers {
+		blobs = append(blobs, l.Digest)
+	}
+	for _, c := range m.Manifests {
+		children = append(children, c.Digest)
+	}
+	return blobs, children, nil
+}
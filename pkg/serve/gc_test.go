@@ -0,0 +1,125 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// allowAll is an Authorizer that allows every request.
+type allowAll struct{}
+
+func (allowAll) Authorize(*http.Request, string, string) error { return nil }
+
+// newTestStorage returns a Storage backed by memory, configured by cfg and
+// the options.
+func newTestStorage(t *testing.T, cfg Config, opts ...Option) *Storage {
+	t.Helper()
+	cfg.Backend = "mem"
+	s, err := NewStorage(context.Background(), append([]Option{WithConfig(cfg)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	return s
+}
+
+func TestCollectGarbageKeepsPushedTags(t *testing.T) {
+	s := newTestStorage(t, Config{CacheTTL: "24h", PushNamespaces: []string{"pushed"}}, WithAuth(allowAll{}, "", ""))
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	for _, k := range []string{"pushed/app/v1", "pulled/app/v1"} {
+		if err := s.objects.Put(tagsPrefix+k, strings.NewReader(""), "text/plain", map[string]string{
+			metaDockerContentDigest: "sha256:" + strings.Repeat("a", 64),
+			metaCreatedAt:           old,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.CollectGarbage(context.Background(), nil, GCOptions{})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if want := []string{"pulled/app:v1"}; !equalStrings(report.ExpiredTags, want) {
+		t.Errorf("ExpiredTags = %v, want %v", report.ExpiredTags, want)
+	}
+	keys, err := s.objects.List(tagsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{tagsPrefix + "pushed/app/v1"}; !equalStrings(keys, want) {
+		t.Errorf("tags left = %v, want %v", keys, want)
+	}
+}
+
+// equalStrings reports whether a and b hold the same strings, in any order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCollectGarbageKeepsTaggedImage(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	ctx := context.Background()
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, _, err := s.writeImage(ctx, img)
+	if err != nil {
+		t.Fatalf("writeImage: %v", err)
+	}
+	if err := s.Tags().Record("app", "v1", desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	orphan := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}
+	if err := s.objects.Put(s.blobKey(orphan.String()), strings.NewReader("orphan"), "application/octet-stream", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range objects {
+		objects[i].ModTime = time.Now().Add(-48 * time.Hour)
+	}
+	report, err := s.CollectGarbage(ctx, objects, GCOptions{})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if want := []string{orphan.String()}; !equalStrings(report.Deleted, want) {
+		t.Errorf("Deleted = %v, want %v", report.Deleted, want)
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{s.blobKey(desc.Digest.String()), s.blobKey(m.Config.Digest.String())}
+	for _, l := range m.Layers {
+		want = append(want, s.blobKey(l.Digest.String()))
+	}
+	keys, err := s.objects.List(s.blobKey(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(keys, want) {
+		t.Errorf("blobs left = %v, want %v", keys, want)
+	}
+}
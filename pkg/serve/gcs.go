@@ -0,0 +1,656 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultGCSEndpoint = "storage.googleapis.com"
+
+	gcsMetaPrefix = "X-Goog-Meta-"
+
+	// signedURLExpiry is how long redirects to signed blob URLs are valid.
+	signedURLExpiry = 15 * time.Minute
+
+	// maxConcurrentDeletes limits how many objects are deleted at once, since
+	// GCS deletes objects one at a time.
+	maxConcurrentDeletes = 16
+)
+
+// gcsBackend stores objects in a Google Cloud Storage bucket, through its XML
+// API.
+//
+// Clients are redirected to blobs with signed URLs if the credentials can
+// sign them, so that the bucket needn't be public.
+type gcsBackend struct {
+	client                   *http.Client
+	scheme, endpoint, bucket string
+	acl                      string
+
+	// signer signs blob URLs, or is nil if they aren't signed.
+	signer *gcsSigner
+
+	// ctx, if set, is the context requests are made with.
+	ctx context.Context
+}
+
+// gcsConfig identifies a GCS bucket.
+type gcsConfig struct {
+	scheme, endpoint, bucket string
+
+	// acl, if set, is the predefined ACL of objects written to the bucket.
+	acl string
+
+	// connectTimeout and readWriteTimeout bound the client's connections.
+	connectTimeout, readWriteTimeout time.Duration
+}
+
+// newGCSBackend returns a backend for the bucket, authenticating with the
+// application default credentials.
+func newGCSBackend(ctx context.Context, cfg gcsConfig) (*gcsBackend, error) {
+	if cfg.bucket == "" {
+		return nil, fmt.Errorf("GCS bucket must be set")
+	}
+	if cfg.endpoint == "" {
+		cfg.endpoint = defaultGCSEndpoint
+	}
+	// URLs are signed with the IAM Credentials API, which needs the
+	// cloud-platform scope, if there's no private key to sign them with.
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("finding GCS credentials: %v", err)
+	}
+	base := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: cfg.connectTimeout}).DialContext,
+		ResponseHeaderTimeout: cfg.readWriteTimeout,
+		MaxIdleConnsPerHost:   100,
+	}
+	client := &http.Client{Transport: &oauth2.Transport{Source: creds.TokenSource, Base: base}}
+	signer, err := newGCSSigner(creds, client)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsBackend{
+		client:   client,
+		scheme:   cfg.scheme,
+		endpoint: cfg.endpoint,
+		bucket:   cfg.bucket,
+		acl:      cfg.acl,
+		signer:   signer,
+	}, nil
+}
+
+// gcsError is an error response from GCS.
+type gcsError struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *gcsError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("GCS returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("GCS returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// objectURL returns the URL of the object with the key, or of the bucket if
+// key is empty.
+func (b *gcsBackend) objectURL(key string) *url.URL {
+	p := "/" + b.bucket + "/" + key
+	return &url.URL{Scheme: b.scheme, Host: b.endpoint, Path: p, RawPath: s3Escape(p, false)}
+}
+
+func (b *gcsBackend) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := b.objectURL(key)
+	u.RawQuery = query.Encode()
+	return http.NewRequestWithContext(requestCtx(b.ctx), method, u.String(), body)
+}
+
+// WithContext returns a copy of the backend whose requests are made with ctx.
+func (b *gcsBackend) WithContext(ctx context.Context) Backend {
+	c := *b
+	c.ctx = ctx
+	return &c
+}
+
+// do sends the request, and returns the response if it succeeded. Missing
+// objects are reported as ErrObjectNotFound.
+func (b *gcsBackend) do(req *http.Request, key string) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	gerr := &gcsError{StatusCode: resp.StatusCode}
+	if body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil && len(body) > 0 {
+		xml.Unmarshal(body, gerr)
+	}
+	if gerr.Code == "NoSuchKey" || (gerr.StatusCode == http.StatusNotFound && req.Method == http.MethodHead) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return nil, gerr
+}
+
+// setMetaHeaders sets the headers setting the object's content type and
+// metadata, and its ACL.
+func (b *gcsBackend) setMetaHeaders(h http.Header, contentType string, meta map[string]string) {
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		h.Set(gcsMetaPrefix+k, v)
+	}
+	b.setACLHeader(h)
+}
+
+func (b *gcsBackend) setACLHeader(h http.Header) {
+	if b.acl != "" {
+		h.Set("X-Goog-Acl", b.acl)
+	}
+}
+
+func (b *gcsBackend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	return b.put(key, r, contentType, meta, nil)
+}
+
+// put writes the object, with the extra headers given, such as preconditions.
+func (b *gcsBackend) put(key string, r io.Reader, contentType string, meta map[string]string, extra http.Header) error {
+	body, size, cleanup, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	req, err := b.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType == "" {
+		contentType = string(defaultMediaType)
+	}
+	b.setMetaHeaders(req.Header, contentType, meta)
+	for k, v := range extra {
+		req.Header[k] = v
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *gcsBackend) Get(key string) (io.ReadCloser, error) {
+	req, err := b.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *gcsBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := b.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *gcsBackend) Stat(key string) (ObjectInfo, error) {
+	info, _, err := b.stat(key)
+	return info, err
+}
+
+// stat returns the object's info, along with its generation.
+func (b *gcsBackend) stat(key string) (ObjectInfo, string, error) {
+	req, err := b.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, "", err
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return ObjectInfo{}, "", err
+	}
+	resp.Body.Close()
+	h := resp.Header
+	info := ObjectInfo{
+		ContentType: h.Get("Content-Type"),
+		Meta:        map[string]string{},
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		info.Size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ObjectInfo{}, "", fmt.Errorf("object %q has invalid Content-Length %q: %v", key, v, err)
+		}
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		info.ModTime, _ = http.ParseTime(v)
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, gcsMetaPrefix) && len(v) > 0 {
+			info.Meta[strings.TrimPrefix(k, gcsMetaPrefix)] = v[0]
+		}
+	}
+	return info, h.Get("X-Goog-Generation"), nil
+}
+
+func (b *gcsBackend) Exists(key string) (bool, error) {
+	_, err := b.Stat(key)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *gcsBackend) Copy(src, dst string) error {
+	return b.copy(src, dst, b.setACLHeader)
+}
+
+func (b *gcsBackend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	return b.copy(src, dst, func(h http.Header) {
+		h.Set("X-Goog-Metadata-Directive", "REPLACE")
+		b.setMetaHeaders(h, contentType, meta)
+	})
+}
+
+// copy copies the object, with headers set by setHeaders.
+func (b *gcsBackend) copy(src, dst string, setHeaders func(http.Header)) error {
+	req, err := b.newRequest(http.MethodPut, dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Goog-Copy-Source", s3Escape(fmt.Sprintf("/%s/%s", b.bucket, src), false))
+	setHeaders(req.Header)
+	resp, err := b.do(req, src)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *gcsBackend) Delete(keys ...string) error {
+	_, err := b.deleteObjects(keys)
+	return err
+}
+
+func (b *gcsBackend) DeleteBatch(keys []string) ([]string, error) {
+	return b.deleteObjects(keys)
+}
+
+// deleteObjects deletes the objects concurrently, and returns the keys of
+// those that were deleted, which include missing objects. If any fail to be
+// deleted, the first error is returned too.
+func (b *gcsBackend) deleteObjects(keys []string) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		deleted  []string
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, maxConcurrentDeletes)
+	)
+	for _, k := range keys {
+		k := k
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := b.deleteObject(k)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			deleted = append(deleted, k)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, firstErr
+}
+
+func (b *gcsBackend) deleteObject(key string) error {
+	req, err := b.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, key)
+	var gerr *gcsError
+	if isNotFound(err) || (errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Append emulates appending, which GCS doesn't support. Objects of at least
+// appendCopySize bytes are appended to by writing the contents to a
+// temporary object, then composing the object from itself and the temporary
+// object, within GCS, so that each append only sends its own contents;
+// smaller objects are rewritten with the contents appended.
+//
+// Either way, the write is conditional on the object's generation not having
+// changed since its size was read, so concurrent appends fail with
+// ErrAppendPosition as they do in OSS.
+func (b *gcsBackend) Append(key string, r io.Reader, pos int64) (int64, error) {
+	if pos == 0 {
+		cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(r)}
+		err := b.put(key, cr, string(defaultMediaType), nil, http.Header{"X-Goog-If-Generation-Match": {"0"}})
+		if isGCSPreconditionFailed(err) {
+			return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+		}
+		return cr.n, err
+	}
+
+	info, generation, err := b.stat(key)
+	if isNotFound(err) {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	} else if err != nil {
+		return 0, err
+	}
+	if info.Size != pos {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	if pos >= appendCopySize {
+		n, err := b.appendByCompose(key, r, info, generation)
+		if isGCSPreconditionFailed(err) {
+			return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+		}
+		return pos + n, err
+	}
+	rc, err := b.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(io.MultiReader(rc, r))}
+	err = b.put(key, cr, info.ContentType, info.Meta, http.Header{"X-Goog-If-Generation-Match": {generation}})
+	if isGCSPreconditionFailed(err) {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	return cr.n, err
+}
+
+type gcsComposeRequest struct {
+	XMLName    xml.Name `xml:"ComposeRequest"`
+	Components []struct {
+		Name string `xml:"Name"`
+	} `xml:"Component"`
+}
+
+// appendByCompose appends the contents of r to the object, which has the
+// info and generation given, by composing it from itself and a temporary
+// object holding r's contents, on the condition that its generation hasn't
+// changed. It returns the number of bytes appended.
+func (b *gcsBackend) appendByCompose(key string, r io.Reader, info ObjectInfo, generation string) (int64, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return 0, err
+	}
+	tmp := key + ".append-" + id
+	cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(r)}
+	if err := b.put(tmp, cr, info.ContentType, nil, nil); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := b.deleteObject(tmp); err != nil {
+			warnf(requestCtx(b.ctx), "deleting temporary object %q: %v", tmp, err)
+		}
+	}()
+	if cr.n == 0 {
+		return 0, nil
+	}
+
+	var compose gcsComposeRequest
+	for _, name := range []string{key, tmp} {
+		compose.Components = append(compose.Components, struct {
+			Name string `xml:"Name"`
+		}{name})
+	}
+	body, err := xml.Marshal(compose)
+	if err != nil {
+		return 0, err
+	}
+	req, err := b.newRequest(http.MethodPut, key, url.Values{"compose": {""}}, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	b.setMetaHeaders(req.Header, info.ContentType, info.Meta)
+	req.Header.Set("X-Goog-If-Generation-Match", generation)
+	resp, err := b.do(req, key)
+	if err != nil {
+		return 0, err
+	}
+	return cr.n, resp.Body.Close()
+}
+
+func isGCSPreconditionFailed(err error) bool {
+	gerr, ok := err.(*gcsError)
+	return ok && gerr.StatusCode == http.StatusPreconditionFailed
+}
+
+func (b *gcsBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := b.newRequest(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req, "")
+		if err != nil {
+			return nil, err
+		}
+		// GCS lists objects in the same format as S3.
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing list response: %v", err)
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Serve redirects to the object, with a signed URL if the backend signs
+// them. Signed URLs expire, so they may only be cached until then.
+func (b *gcsBackend) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	if b.signer == nil {
+		http.Redirect(w, r, b.objectURL(key).String(), http.StatusSeeOther)
+		return
+	}
+	u, err := b.signedURL(r.Context(), key, time.Now().UTC(), signedURLExpiry)
+	if err != nil {
+		errorf(r.Context(), "signing URL of %q: %v", key, err)
+		writeErr(w, http.StatusInternalServerError, unknownErrorCode, "signing URL failed")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(signedURLExpiry/2/time.Second)))
+	http.Redirect(w, r, u, http.StatusSeeOther)
+}
+
+// signedURL returns a V4 signed URL to GET the object, valid for expiry from
+// now.
+func (b *gcsBackend) signedURL(ctx context.Context, key string, now time.Time, expiry time.Duration) (string, error) {
+	datetime := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/auto/storage/goog4_request", now.Format("20060102"))
+	u := b.objectURL(key)
+	q := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {b.signer.email + "/" + scope},
+		"X-Goog-Date":          {datetime},
+		"X-Goog-Expires":       {strconv.FormatInt(int64(expiry/time.Second), 10)},
+		"X-Goog-SignedHeaders": {"host"},
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", datetime, scope, hex.EncodeToString(sum[:])}, "\n")
+	sig, err := b.signer.sign(ctx, []byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = canonicalQuery(q) + "&X-Goog-Signature=" + hex.EncodeToString(sig)
+	return u.String(), nil
+}
+
+// gcsSigner signs blob URLs as a service account, either with its private
+// key, or with the IAM Credentials API if only its tokens are available, as
+// on GCE and Cloud Run.
+type gcsSigner struct {
+	email string
+
+	// key is the service account's private key, or nil to sign with the
+	// IAM Credentials API using client.
+	key    *rsa.PrivateKey
+	client *http.Client
+}
+
+// newGCSSigner returns a signer for the credentials, or nil if they can't
+// sign URLs, such as user credentials.
+func newGCSSigner(creds *google.Credentials, client *http.Client) (*gcsSigner, error) {
+	if len(creds.JSON) > 0 {
+		var f struct {
+			Type        string `json:"type"`
+			ClientEmail string `json:"client_email"`
+			PrivateKey  string `json:"private_key"`
+		}
+		if err := json.Unmarshal(creds.JSON, &f); err != nil {
+			return nil, fmt.Errorf("parsing GCS credentials: %v", err)
+		}
+		if f.Type != "service_account" || f.PrivateKey == "" {
+			return nil, nil
+		}
+		key, err := parseRSAKey([]byte(f.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing service account key: %v", err)
+		}
+		return &gcsSigner{email: f.ClientEmail, key: key}, nil
+	}
+	if !metadata.OnGCE() {
+		return nil, nil
+	}
+	email, err := metadata.Email("default")
+	if err != nil {
+		return nil, fmt.Errorf("getting service account email: %v", err)
+	}
+	return &gcsSigner{email: email, client: client}, nil
+}
+
+func parseRSAKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// sign returns the RSA SHA-256 signature of b.
+func (s *gcsSigner) sign(ctx context.Context, b []byte) ([]byte, error) {
+	if s.key != nil {
+		sum := sha256.Sum256(b)
+		return rsa.SignPKCS1v15(nil, s.key, crypto.SHA256, sum[:])
+	}
+
+	body, err := json.Marshal(map[string]string{"payload": base64.StdEncoding.EncodeToString(b)})
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:signBlob", url.PathEscape(s.email))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, fmt.Errorf("signBlob returned %d: %s", resp.StatusCode, msg)
+	}
+	var res struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.SignedBlob)
+}
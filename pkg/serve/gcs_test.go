@@ -0,0 +1,112 @@
+package serve
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGCSSignedURLVector checks signed URLs against the "Simple GET" case of
+// GCS's V4 signing conformance tests. The tests' expected signatures are made
+// with a key of their own, so the string to sign is checked, and the
+// signature is verified with the key it's signed with here.
+func TestGCSSignedURLVector(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &gcsBackend{
+		scheme:   "https",
+		endpoint: defaultGCSEndpoint,
+		bucket:   "test-bucket",
+		signer:   &gcsSigner{email: "test-iam-credentials@dummy-project-id.iam.gserviceaccount.com", key: key},
+	}
+	now := time.Date(2019, 2, 1, 9, 0, 0, 0, time.UTC)
+	got, err := b.signedURL(context.Background(), "test-object", now, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	sig, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Del("X-Goog-Signature")
+	const wantQuery = "X-Goog-Algorithm=GOOG4-RSA-SHA256&X-Goog-Credential=test-iam-credentials%40dummy-project-id.iam.gserviceaccount.com%2F20190201%2Fauto%2Fstorage%2Fgoog4_request&X-Goog-Date=20190201T090000Z&X-Goog-Expires=10&X-Goog-SignedHeaders=host"
+	if u.Host != "storage.googleapis.com" || u.Path != "/test-bucket/test-object" || canonicalQuery(q) != wantQuery {
+		t.Errorf("signed URL = %s, want https://storage.googleapis.com/test-bucket/test-object?%s&X-Goog-Signature=...", got, wantQuery)
+	}
+
+	const stringToSign = "GOOG4-RSA-SHA256\n20190201T090000Z\n20190201/auto/storage/goog4_request\n00e2fb794ea93d7adb703edaebdd509821fcc7d4f1a79ac5c8d2b394df109320"
+	sum := sha256.Sum256([]byte(stringToSign))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature doesn't sign the expected string: %v", err)
+	}
+}
+
+func TestGCSAppendComposesLargeObjects(t *testing.T) {
+	for _, composeStatus := range []int{http.StatusOK, http.StatusPreconditionFailed} {
+		var requests []string
+		var tmp string
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests = append(requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/bucket/")+" "+r.URL.RawQuery)
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+			switch {
+			case r.Method == http.MethodHead:
+				resp.Header.Set("Content-Length", strconv.Itoa(appendCopySize))
+				resp.Header.Set("X-Goog-Generation", "7")
+			case r.Method == http.MethodPut && r.URL.RawQuery == "":
+				tmp = strings.TrimPrefix(r.URL.Path, "/bucket/")
+				if b, _ := ioutil.ReadAll(r.Body); string(b) != "chunk" {
+					t.Errorf("wrote %q to the temporary object, want %q", b, "chunk")
+				}
+			case r.Method == http.MethodPut && r.URL.RawQuery == "compose=":
+				var c gcsComposeRequest
+				if err := xml.NewDecoder(r.Body).Decode(&c); err != nil {
+					t.Error(err)
+				}
+				if len(c.Components) != 2 || c.Components[0].Name != "key" || c.Components[1].Name != tmp || r.Header.Get("X-Goog-If-Generation-Match") != "7" {
+					t.Errorf("composed %v with headers %v", c.Components, r.Header)
+				}
+				resp.StatusCode = composeStatus
+			case r.Method == http.MethodDelete:
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				resp.StatusCode = http.StatusBadRequest
+			}
+			return resp, nil
+		})}
+		b := &gcsBackend{client: client, scheme: "https", endpoint: "storage.example.com", bucket: "bucket"}
+
+		n, err := b.Append("key", strings.NewReader("chunk"), appendCopySize)
+		if composeStatus == http.StatusOK && (err != nil || n != appendCopySize+5) {
+			t.Errorf("Append = %d, %v, want %d", n, err, appendCopySize+5)
+		} else if composeStatus != http.StatusOK && !errors.Is(err, ErrAppendPosition) {
+			t.Errorf("Append racing another = %v, want %v", err, ErrAppendPosition)
+		}
+		if !strings.HasPrefix(tmp, "key.append-") {
+			t.Errorf("temporary object %q", tmp)
+		}
+		want := []string{"HEAD key ", "PUT " + tmp + " ", "PUT key compose=", "DELETE " + tmp + " "}
+		if !equalStrings(requests, want) {
+			t.Errorf("requests %q, want %q", requests, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package serve
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+// ImportOCILayout reads a tar archive of an OCI image layout from r, as
+// written by ExportManifestTree or skopeo's oci-archive transport, writes
+// its blobs and manifests, and returns the digest of its root manifest.
+//
+// If the layout's index.json lists a single image or index, that's the
+// root; otherwise index.json itself is written as an index and is the root.
+// The root is also written under each of the aliases.
+func (s *Storage) ImportOCILayout(ctx context.Context, r io.Reader, aliases []string) (v1.Hash, error) {
+	dir, err := ioutil.TempDir("", "oci-layout-")
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractTar(r, dir); err != nil {
+		return v1.Hash{}, fmt.Errorf("extracting OCI layout: %v", err)
+	}
+
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("reading OCI layout: %v", err)
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	var desc *v1.Descriptor
+	switch {
+	case len(im.Manifests) == 1 && im.Manifests[0].MediaType.IsImage():
+		img, err := idx.Image(im.Manifests[0].Digest)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		desc, _, err = s.writeImage(ctx, img, aliases...)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+	case len(im.Manifests) == 1 && im.Manifests[0].MediaType.IsIndex():
+		child, err := idx.ImageIndex(im.Manifests[0].Digest)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		desc, _, err = s.writeIndex(ctx, child, aliases...)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+	default:
+		desc, _, err = s.writeIndex(ctx, idx, aliases...)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+	}
+	return desc.Digest, nil
+}
+
+// extractTar extracts the regular files and directories in the tar archive
+// into dir.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected entry %q of type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
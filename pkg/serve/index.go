@@ -0,0 +1,102 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// AppendToIndex writes the image, then writes a new index manifest made of
+// the already-written index with the given digest plus the image for the
+// given platform, and writes it under each of the aliases. An image already
+// in the index for the same platform is replaced. It returns the digest of
+// the new index manifest.
+func (s *Storage) AppendToIndex(ctx context.Context, indexDigest v1.Hash, img v1.Image, platform v1.Platform, aliases []string) (v1.Hash, error) {
+	ctx = withRequestID(ctx)
+	b, err := s.readBlob(ctx, indexDigest.String())
+	if isNotFound(err) {
+		return v1.Hash{}, fmt.Errorf("%w: %s", ErrBlobNotFound, indexDigest)
+	} else if err != nil {
+		return v1.Hash{}, err
+	}
+	var im v1.IndexManifest
+	if err := json.Unmarshal(b, &im); err != nil {
+		return v1.Hash{}, fmt.Errorf("parsing index %s: %v", indexDigest, err)
+	}
+	mt := im.MediaType
+	if mt == "" {
+		desc, err := s.BlobExists(ctx, indexDigest.String())
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		mt = desc.MediaType
+	}
+	if !mt.IsIndex() {
+		return v1.Hash{}, fmt.Errorf("%s is not an index, got media type %q", indexDigest, mt)
+	}
+
+	desc, _, err := s.writeImage(ctx, img)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	desc.Platform = &platform
+	manifests := make([]v1.Descriptor, 0, len(im.Manifests)+1)
+	for _, m := range im.Manifests {
+		if m.Platform != nil && m.Platform.Equals(platform) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	im.Manifests = append(manifests, *desc)
+	if s.CanonicalizeIndex {
+		canonicalizeIndex(&im)
+	}
+
+	if b, err = json.Marshal(im); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := s.checkManifestSize(len(b)); err != nil {
+		return v1.Hash{}, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), nil); err != nil {
+		return v1.Hash{}, err
+	}
+	var g errgroup.Group
+	for _, a := range aliases {
+		a := a
+		g.Go(func() error {
+			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), nil)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return v1.Hash{}, err
+	}
+	return digest, nil
+}
+
+// canonicalizeIndex sorts the index's manifests by digest, keeping the order
+// of duplicates, and drops empty annotations, so that equivalent indexes
+// marshal identically. Annotations are otherwise marshaled with sorted keys.
+func canonicalizeIndex(im *v1.IndexManifest) {
+	sort.SliceStable(im.Manifests, func(i, j int) bool {
+		return im.Manifests[i].Digest.String() < im.Manifests[j].Digest.String()
+	})
+	if len(im.Annotations) == 0 {
+		im.Annotations = nil
+	}
+	for i := range im.Manifests {
+		if len(im.Manifests[i].Annotations) == 0 {
+			im.Manifests[i].Annotations = nil
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package serve
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestCanonicalizeIndexIgnoresOrder(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.CanonicalizeIndex = true
+	var imgs []v1.Image
+	for i := 0; i < 3; i++ {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs = append(imgs, img)
+	}
+	index := func(order ...int) v1.ImageIndex {
+		var adds []mutate.IndexAddendum
+		for _, i := range order {
+			adds = append(adds, mutate.IndexAddendum{Add: imgs[i]})
+		}
+		return mutate.AppendManifests(empty.Index, adds...)
+	}
+
+	ctx := context.Background()
+	a, _, err := s.writeIndex(ctx, index(0, 1, 2))
+	if err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	b, _, err := s.writeIndex(ctx, index(2, 0, 1))
+	if err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	if a.Digest != b.Digest {
+		t.Errorf("indexes of the same manifests have digests %s and %s", a.Digest, b.Digest)
+	}
+
+	// Without it, the order written is kept.
+	s.CanonicalizeIndex = false
+	c, _, err := s.writeIndex(ctx, index(2, 0, 1))
+	if err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	d, _, err := s.writeIndex(ctx, index(1, 2, 0))
+	if err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	if c.Digest == d.Digest {
+		t.Errorf("indexes in different orders both have digest %s", c.Digest)
+	}
+}
@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// IntegrityReport lists the blobs referenced by a manifest that are present
+// and missing.
+type IntegrityReport struct {
+	Present, Missing []v1.Descriptor
+}
+
+// CheckIntegrity checks that every blob referenced by the manifest with the
+// given digest has been written: the config and layers of an image, or the
+// child manifests of an index, and recursively the blobs they reference.
+// Blobs can be missing if a manifest was written under an alias after its
+// blobs failed to upload.
+func (s *Storage) CheckIntegrity(ctx context.Context, manifestDigest v1.Hash) (IntegrityReport, error) {
+	ctx = withRequestID(ctx)
+	var report IntegrityReport
+	seen := map[v1.Hash]bool{}
+	var check func(h v1.Hash) error
+	check = func(h v1.Hash) error {
+		b, err := s.readBlob(ctx, h.String())
+		if isNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrBlobNotFound, h)
+		} else if err != nil {
+			return err
+		}
+		var m struct {
+			Config    *v1.Descriptor  `json:"config"`
+			Layers    []v1.Descriptor `json:"layers"`
+			Manifests []v1.Descriptor `json:"manifests"`
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return fmt.Errorf("parsing manifest %s: %v", h, err)
+		}
+		var descs []v1.Descriptor
+		if m.Config != nil {
+			descs = append(descs, *m.Config)
+		}
+		descs = append(descs, m.Layers...)
+		descs = append(descs, m.Manifests...)
+
+		var names []string
+		for _, d := range descs {
+			if !seen[d.Digest] {
+				names = append(names, d.Digest.String())
+			}
+		}
+		found, err := s.BlobsExist(ctx, names...)
+		if err != nil {
+			return err
+		}
+		for _, d := range descs {
+			if seen[d.Digest] {
+				continue
+			}
+			seen[d.Digest] = true
+			if _, ok := found[d.Digest.String()]; !ok {
+				report.Missing = append(report.Missing, d)
+				continue
+			}
+			report.Present = append(report.Present, d)
+		}
+		for _, c := range m.Manifests {
+			if _, ok := found[c.Digest.String()]; !ok {
+				continue
+			}
+			if err := check(c.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := check(manifestDigest); err != nil {
+		return IntegrityReport{}, err
+	}
+	return report, nil
+}
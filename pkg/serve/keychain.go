@@ -0,0 +1,118 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// UpstreamKeychain returns the keychain that fetches of upstream images
+// authenticate with, for mirroring images from private registries, and from
+// Docker Hub with an account, to avoid its anonymous pull rate limits. The
+// credentials for a registry are the first found of:
+//
+//   - those in UPSTREAM_AUTH, a comma-separated list of registry=user:password,
+//     or registry=token for a registry token;
+//   - DOCKERHUB_USERNAME and DOCKERHUB_TOKEN, for Docker Hub;
+//   - those in the JSON file at UPSTREAM_CREDENTIALS, which maps registries
+//     to the fields of a docker config.json auth entry, such as username and
+//     password, for per-registry secrets mounted into the service;
+//   - those in the docker config.json in DOCKER_CONFIG or ~/.docker.
+//
+// Registries with none are fetched from anonymously. Images fetched with
+// credentials are served to anyone who can pull from the service, so a
+// service mirroring private images should require auth; see RequireAuth.
+func UpstreamKeychain() (authn.Keychain, error) {
+	env, err := parseUpstreamAuth(os.Getenv("UPSTREAM_AUTH"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_AUTH: %v", err)
+	}
+	if user, token := os.Getenv("DOCKERHUB_USERNAME"), os.Getenv("DOCKERHUB_TOKEN"); user != "" || token != "" {
+		if user == "" || token == "" {
+			return nil, fmt.Errorf("DOCKERHUB_USERNAME and DOCKERHUB_TOKEN must be set together")
+		}
+		if _, ok := env[name.DefaultRegistry]; !ok {
+			env[name.DefaultRegistry] = authn.AuthConfig{Username: user, Password: token}
+		}
+	}
+	file := staticKeychain{}
+	if path := os.Getenv("UPSTREAM_CREDENTIALS"); path != "" {
+		if file, err = loadUpstreamCredentials(path); err != nil {
+			return nil, fmt.Errorf("reading upstream credentials (UPSTREAM_CREDENTIALS): %v", err)
+		}
+	}
+	return authn.NewMultiKeychain(env, file, authn.DefaultKeychain), nil
+}
+
+// staticKeychain holds the credentials for registries, by hostname.
+type staticKeychain map[string]authn.AuthConfig
+
+// Resolve implements authn.Keychain.
+func (k staticKeychain) Resolve(res authn.Resource) (authn.Authenticator, error) {
+	if cfg, ok := k[res.RegistryStr()]; ok {
+		return authn.FromConfig(cfg), nil
+	}
+	return authn.Anonymous, nil
+}
+
+// registryHost returns the hostname images in the registry are fetched from,
+// which for Docker Hub, by any of its names, is index.docker.io.
+func registryHost(registry string) (string, error) {
+	reg, err := name.NewRegistry(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://"), "/"))
+	if err != nil {
+		return "", err
+	}
+	if h := reg.RegistryStr(); h != "registry-1.docker.io" {
+		return h, nil
+	}
+	return name.DefaultRegistry, nil
+}
+
+func parseUpstreamAuth(s string) (staticKeychain, error) {
+	k := staticKeychain{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		i := strings.Index(e, "=")
+		if i <= 0 || i == len(e)-1 {
+			return nil, fmt.Errorf("entry for %q must be registry=user:password or registry=token", strings.SplitN(e, "=", 2)[0])
+		}
+		host, err := registryHost(e[:i])
+		if err != nil {
+			return nil, err
+		}
+		cred := e[i+1:]
+		if j := strings.Index(cred, ":"); j >= 0 {
+			k[host] = authn.AuthConfig{Username: cred[:j], Password: cred[j+1:]}
+		} else {
+			k[host] = authn.AuthConfig{RegistryToken: cred}
+		}
+	}
+	return k, nil
+}
+
+func loadUpstreamCredentials(path string) (staticKeychain, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]authn.AuthConfig
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	k := staticKeychain{}
+	for reg, cfg := range m {
+		host, err := registryHost(reg)
+		if err != nil {
+			return nil, err
+		}
+		k[host] = cfg
+	}
+	return k, nil
+}
@@ -0,0 +1,67 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Labels are stored under their own prefix, so that they can't overwrite the
+// metadata blobs are served with.
+const metaLabelPrefix = "Label-"
+
+// BlobDescriptor describes a blob along with the labels it was written with;
+// see Storage.ExtraMeta.
+type BlobDescriptor struct {
+	v1.Descriptor
+	Labels map[string]string
+}
+
+// BlobExistsWithLabels returns the descriptor of the named blob like
+// BlobExists, along with the labels it was written with. Label keys are in
+// canonical header form, since metadata names aren't case-sensitive.
+func (s *Storage) BlobExistsWithLabels(ctx context.Context, name string) (BlobDescriptor, error) {
+	desc, info, err := s.statBlob(ctx, name)
+	if err != nil {
+		return BlobDescriptor{}, err
+	}
+	labels, err := parseLabels(info.Meta)
+	if err != nil {
+		return BlobDescriptor{}, fmt.Errorf("blob %q: %v", name, err)
+	}
+	return BlobDescriptor{Descriptor: desc, Labels: labels}, nil
+}
+
+// labelMeta returns the metadata recording labels. Keys must be valid header
+// names.
+func labelMeta(labels map[string]string) (map[string]string, error) {
+	meta := map[string]string{}
+	for k, v := range labels {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-')
+		}) >= 0 {
+			return nil, fmt.Errorf("invalid label key %q, must be letters, digits and dashes", k)
+		}
+		meta[http.CanonicalHeaderKey(metaLabelPrefix+k)] = url.QueryEscape(v)
+	}
+	return meta, nil
+}
+
+func parseLabels(meta map[string]string) (map[string]string, error) {
+	labels := map[string]string{}
+	for k, v := range meta {
+		if !strings.HasPrefix(k, metaLabelPrefix) {
+			continue
+		}
+		lv, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label metadata %q value: %v", k, err)
+		}
+		labels[strings.TrimPrefix(k, metaLabelPrefix)] = lv
+	}
+	return labels, nil
+}
@@ -0,0 +1,62 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+// annotationRefName names an image in an OCI image layout's index.json.
+const annotationRefName = "org.opencontainers.image.ref.name"
+
+// ServeOCILayout loads the image or index named ref from the OCI image
+// layout directory dir, then writes and redirects to it as ServeManifest or
+// ServeIndex does.
+//
+// ref is matched against the org.opencontainers.image.ref.name annotations of
+// the layout's index.json, or against the digests of its manifests.
+func (s *Storage) ServeOCILayout(w http.ResponseWriter, r *http.Request, dir, ref string, also ...string) error {
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return fmt.Errorf("reading OCI layout %q: %v", dir, err)
+	}
+	desc, err := findLayoutRef(idx, ref)
+	if err != nil {
+		return fmt.Errorf("OCI layout %q: %v", dir, err)
+	}
+	switch {
+	case desc.MediaType.IsIndex():
+		child, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+		return s.ServeIndex(w, r, child, also...)
+	case desc.MediaType.IsImage():
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		return s.ServeManifest(w, r, img, also...)
+	}
+	return fmt.Errorf("OCI layout %q: %q has unsupported media type %q", dir, ref, desc.MediaType)
+}
+
+// findLayoutRef returns the descriptor in the layout's index named by ref.
+func findLayoutRef(idx v1.ImageIndex, ref string) (*v1.Descriptor, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i, m := range im.Manifests {
+		if m.Annotations[annotationRefName] == ref || m.Digest.String() == ref {
+			return &im.Manifests[i], nil
+		}
+		if n := m.Annotations[annotationRefName]; n != "" {
+			names = append(names, n)
+		}
+	}
+	return nil, fmt.Errorf("%w: no manifest named %q in index.json (found %q)", ErrNotFound, ref, names)
+}
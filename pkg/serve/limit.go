@@ -0,0 +1,76 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultMaxBlobSize     = 10 << 30 // 10 GiB
+	defaultMaxManifestSize = 4 << 20  // 4 MiB
+
+	// defaultUploadBufferSize is kept small, since every layer being
+	// uploaded at once has a buffer.
+	defaultUploadBufferSize = 256 << 10 // 256 KiB
+)
+
+// limitReader is a reader that fails once more than max bytes are read from
+// it, so that oversized uploads are aborted rather than truncated.
+type limitReader struct {
+	r      io.Reader
+	n, max int64
+
+	// exceeded is set to 1, atomically, once the limit's exceeded, since
+	// it may be read while a backend is still reading from another
+	// goroutine.
+	exceeded int32
+}
+
+// isExceeded reports whether more than max bytes have been read.
+func (l *limitReader) isExceeded() bool {
+	return atomic.LoadInt32(&l.exceeded) == 1
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		atomic.StoreInt32(&l.exceeded, 1)
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.max)
+	}
+	return n, err
+}
+
+// checkManifestSize returns an error if a manifest of the given size exceeds
+// MaxManifestSize.
+func (s *Storage) checkManifestSize(size int) error {
+	if s.MaxManifestSize > 0 && int64(size) > s.MaxManifestSize {
+		return fmt.Errorf("%w: manifest is %d bytes, limit is %d", ErrTooLarge, size, s.MaxManifestSize)
+	}
+	return nil
+}
+
+// acquireUpload blocks until a layer upload may start without exceeding
+// MaxConcurrentUploads, and returns a func to call once it's done.
+//
+// Only layer uploads are limited, and not the manifests writing them, so that
+// writing an index can't deadlock with all uploads held by images waiting on
+// their own layers.
+func (s *Storage) acquireUpload(ctx context.Context) (func(), error) {
+	s.uploadsOnce.Do(func() {
+		if s.MaxConcurrentUploads > 0 {
+			s.uploads = semaphore.NewWeighted(int64(s.MaxConcurrentUploads))
+		}
+	})
+	if s.uploads == nil {
+		return func() {}, nil
+	}
+	if err := s.uploads.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { s.uploads.Release(1) }, nil
+}
@@ -0,0 +1,104 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestPutBlobMaxBlobSize(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.MaxBlobSize = 4
+	ctx := context.Background()
+	key := s.blobKey("blob")
+	err := s.putBlob(ctx, "blob", key, ioutil.NopCloser(strings.NewReader("too large")), "text/plain", nil)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("putBlob = %v, want ErrTooLarge", err)
+	}
+	if ok, err := s.objects.Exists(key); err != nil || ok {
+		t.Errorf("Exists = %t, %v; oversized blob was left behind", ok, err)
+	}
+	if err := s.putBlob(ctx, "blob", key, ioutil.NopCloser(strings.NewReader("fits")), "text/plain", nil); err != nil {
+		t.Errorf("putBlob at the limit: %v", err)
+	}
+}
+
+func TestReadBlobMaxManifestSize(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.MaxManifestSize = 4
+	if err := s.objects.Put(s.blobKey("manifest"), strings.NewReader(`{"too":"large"}`), string(types.OCIManifestSchema1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.readBlob(context.Background(), "manifest"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("readBlob = %v, want ErrTooLarge", err)
+	}
+	if err := s.checkManifestSize(5); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("checkManifestSize(5) = %v, want ErrTooLarge", err)
+	}
+	if err := s.checkManifestSize(4); err != nil {
+		t.Errorf("checkManifestSize(4) = %v", err)
+	}
+}
+
+// concurrentPutter is a Backend that records how many layers are being
+// written at once.
+type concurrentPutter struct {
+	Backend
+
+	mu           sync.Mutex
+	active, peak int
+}
+
+func (b *concurrentPutter) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	switch types.MediaType(contentType) {
+	case types.DockerLayer, types.DockerUncompressedLayer, types.OCILayer, types.OCIUncompressedLayer:
+	default:
+		return b.Backend.Put(key, r, contentType, meta)
+	}
+	b.mu.Lock()
+	b.active++
+	if b.active > b.peak {
+		b.peak = b.active
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.active--
+		b.mu.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return b.Backend.Put(key, r, contentType, meta)
+}
+
+func TestMaxConcurrentUploadsAcrossIndex(t *testing.T) {
+	b := &concurrentPutter{Backend: newMemBackend()}
+	s := newTestStorage(t, Config{}, WithBackend(b))
+	s.MaxConcurrentUploads = 2
+	var adds []mutate.IndexAddendum
+	for i := 0; i < 3; i++ {
+		img, err := random.Image(256, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.IndexAddendum{Add: img})
+	}
+	if _, _, err := s.writeIndex(context.Background(), mutate.AppendManifests(empty.Index, adds...)); err != nil {
+		t.Fatalf("writeIndex: %v", err)
+	}
+	if b.peak == 0 {
+		t.Fatal("no layers were written")
+	}
+	if b.peak > s.MaxConcurrentUploads {
+		t.Errorf("%d layers were written at once, want at most %d", b.peak, s.MaxConcurrentUploads)
+	}
+}
@@ -0,0 +1,276 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel returns the level named by s: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", s)
+}
+
+// logLevel returns the level the config sets, or info if it sets none.
+func (c Config) logLevel() (Level, error) {
+	level, err := ParseLevel(c.LogLevel)
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level (LOG_LEVEL): %v", err)
+	}
+	return level, nil
+}
+
+// Logger writes structured log lines, as JSON objects with the time, level
+// and message, followed by the logger's fields and the line's own.
+type Logger struct {
+	out    *logOutput
+	fields []interface{} // alternating keys and values
+}
+
+// logOutput is where a Logger and those derived from it with With write.
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// NewLogger returns a Logger writing lines at or above the level to w.
+func NewLogger(w io.Writer, level Level) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level}}
+}
+
+var (
+	defaultLoggerMu sync.RWMutex
+	defaultLogger   = NewLogger(os.Stderr, LevelInfo)
+)
+
+// DefaultLogger returns the logger used when a context doesn't carry one,
+// writing lines at or above info, or Config.LogLevel, to stderr.
+func DefaultLogger() *Logger {
+	defaultLoggerMu.RLock()
+	defer defaultLoggerMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefaultLogger replaces the logger used when a context doesn't carry
+// one.
+func SetDefaultLogger(l *Logger) {
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	defaultLogger = l
+}
+
+// setLogLevel replaces the default logger with one that logs lines at or
+// above the level to stderr.
+func setLogLevel(level Level) {
+	SetDefaultLogger(NewLogger(os.Stderr, level))
+}
+
+// With returns a logger that adds the alternating keys and values to each
+// line, after those of l.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether lines at the level are written.
+func (l *Logger) Enabled(level Level) bool { return level >= l.out.level }
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes a line at the level with the message and the alternating keys
+// and values, if lines at the level are written.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			var v interface{} = "(missing)"
+			if i+1 < len(fields) {
+				v = fields[i+1]
+			}
+			buf.WriteByte(',')
+			writeJSON(&buf, key)
+			buf.WriteByte(':')
+			writeJSON(&buf, logValue(v))
+		}
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// Writer returns a writer that logs each line written to it at the level,
+// such as the output of a command run for a request. A final line without
+// a newline isn't logged.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.l.Log(w.level, string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// logValue returns v as it's logged: errors and Stringers as strings, and
+// anything else as it's marshaled.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+type loggerKey struct{}
+
+// ContextWithLogger returns ctx carrying the logger, for LoggerFrom.
+func ContextWithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger carried by ctx, or the default logger, with
+// the request ID carried by ctx, if any, added to each line.
+func LoggerFrom(ctx context.Context) *Logger {
+	l, ok := ctx.Value(loggerKey{}).(*Logger)
+	if !ok {
+		l = DefaultLogger()
+	}
+	if id := requestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	return l
+}
+
+// withRequestFields returns ctx carrying a logger that adds the repository
+// and reference the request is for to each line.
+func withRequestFields(ctx context.Context, r *http.Request) context.Context {
+	l, ok := ctx.Value(loggerKey{}).(*Logger)
+	if !ok {
+		l = DefaultLogger()
+	}
+	p, _ := requestPath(r)
+	if p.Repo == "" {
+		return ctx
+	}
+	kv := []interface{}{"repo", p.Repo}
+	if p.Reference != "" && p.Section != SectionUploads {
+		kv = append(kv, "reference", p.Reference)
+	}
+	return ContextWithLogger(ctx, l.With(kv...))
+}
+
+func debugf(ctx context.Context, format string, args ...interface{}) {
+	LoggerFrom(ctx).Log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func infof(ctx context.Context, format string, args ...interface{}) {
+	LoggerFrom(ctx).Log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func warnf(ctx context.Context, format string, args ...interface{}) {
+	LoggerFrom(ctx).Log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func errorf(ctx context.Context, format string, args ...interface{}) {
+	LoggerFrom(ctx).Log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// StdLogger returns a standard library logger that writes each line it's
+// given as a structured line at the level, with the default logger at the
+// time, for code that logs with a *log.Logger.
+func StdLogger(level Level) *log.Logger {
+	return log.New(stdWriter{level: level}, "", 0)
+}
+
+type stdWriter struct{ level Level }
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	DefaultLogger().Log(w.level, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
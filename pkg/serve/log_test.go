@@ -0,0 +1,60 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestContextOnce(t *testing.T) {
+	var buf bytes.Buffer
+	r := httptest.NewRequest("GET", "/v2/foo/bar/manifests/latest", nil)
+	r.Header.Set(headerRequestID, "abc123")
+	r = r.WithContext(ContextWithLogger(context.Background(), NewLogger(&buf, LevelInfo)))
+
+	w := httptest.NewRecorder()
+	r = r.WithContext(RequestContext(w, r))
+	// Storage handlers call it again with the context the binary's
+	// handler logged with.
+	LoggerFrom(RequestContext(w, r)).Info("hello")
+
+	if got := w.Header().Get(headerRequestID); got != "abc123" {
+		t.Errorf("%s = %q, want abc123", headerRequestID, got)
+	}
+	line := buf.String()
+	if n := strings.Count(line, `"repo"`); n != 1 {
+		t.Errorf("line has %d repo fields, want 1: %s", n, line)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("unmarshaling %q: %v", line, err)
+	}
+	for k, want := range map[string]string{"request_id": "abc123", "repo": "foo/bar", "reference": "latest"} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %q", k, got[k], want)
+		}
+	}
+}
+
+func TestLoggerWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewLogger(&buf, LevelInfo).Writer(LevelInfo)
+	fmt.Fprint(w, "one\ntw")
+	fmt.Fprint(w, "o\nthree")
+
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var got struct{ Msg string }
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("unmarshaling %q: %v", line, err)
+		}
+		msgs = append(msgs, got.Msg)
+	}
+	if want := []string{"one", "two"}; strings.Join(msgs, ",") != strings.Join(want, ",") {
+		t.Errorf("logged %q, want %q", msgs, want)
+	}
+}
@@ -0,0 +1,178 @@
+package serve
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// defaultManifestCacheSize is how many bytes of manifests are cached in
+// memory by default; see WithManifestCache.
+const defaultManifestCacheSize = 32 << 20
+
+// manifestCache holds the contents of recently read manifests, keyed by
+// digest, evicting the least recently used once they total more than max
+// bytes. A nil manifestCache caches nothing.
+type manifestCache struct {
+	max int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // of *manifestEntry, most recently used first
+}
+
+type manifestEntry struct {
+	digest string
+	b      []byte
+}
+
+func newManifestCache(max int64) *manifestCache {
+	if max <= 0 {
+		return nil
+	}
+	return &manifestCache{max: max, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// WithManifestCache sets how many bytes of manifests, and other blobs read
+// into memory such as configs, are cached in memory after they're read, so
+// that serving popular manifests inline, and walking them, doesn't read them
+// from the bucket again. Blobs are cached by digest, so they never change.
+// The default is 32 MiB; zero disables the cache.
+func WithManifestCache(maxBytes int64) Option {
+	return func(s *Storage) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("negative manifest cache size %d", maxBytes)
+		}
+		s.manifests = newManifestCache(maxBytes)
+		return nil
+	}
+}
+
+// get returns the cached contents of the blob with the digest.
+func (c *manifestCache) get(digest string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*manifestEntry).b, true
+}
+
+// add caches the contents of the blob with the digest, unless they'd take up
+// more than a quarter of the cache.
+func (c *manifestCache) add(digest string, b []byte) {
+	if c == nil || int64(len(b)) > c.max/4 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[digest]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[digest] = c.order.PushFront(&manifestEntry{digest: digest, b: b})
+	c.size += int64(len(b))
+	for c.size > c.max {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// remove forgets the blob with the digest, once it's deleted.
+func (c *manifestCache) remove(digest string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[digest]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *manifestCache) removeElement(el *list.Element) {
+	e := el.Value.(*manifestEntry)
+	c.order.Remove(el)
+	delete(c.entries, e.digest)
+	c.size -= int64(len(e.b))
+}
+
+// forgetDeleted removes the blobs with the given keys from the manifest
+// cache.
+func (s *Storage) forgetDeleted(keys []string) {
+	for _, k := range keys {
+		s.manifests.remove(strings.TrimPrefix(k, s.blobKey("")))
+	}
+}
+
+// writeResult is the result of writing an image or index, shared by the
+// concurrent requests that asked for it to be written.
+type writeResult struct {
+	desc   *v1.Descriptor
+	report *LayerDeltaReport
+}
+
+// writeOnce calls write to write the image or index with the digest, and
+// its aliases, unless another request is already writing them, in which case
+// it waits for that write and returns its result instead. That way a popular
+// tag pulled by many clients at once, before it's been written, is only
+// fetched and written once.
+//
+// The write is done with the context of the request that started it, so if
+// that request is canceled, the others waiting on it fail too, and are
+// written again when they're retried.
+func (s *Storage) writeOnce(ctx context.Context, digest v1.Hash, also []string, write func() (*v1.Descriptor, *LayerDeltaReport, error)) (*v1.Descriptor, *LayerDeltaReport, error) {
+	// Writes with different layer compression write different manifests.
+	key := strings.Join(append([]string{digest.String(), string(s.layerCompression(ctx))}, also...), ",")
+	v, err, _ := s.writes.Do(key, func() (interface{}, error) {
+		desc, report, err := write()
+		return writeResult{desc: desc, report: report}, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	res := v.(writeResult)
+	desc := *res.desc
+	return &desc, res.report, nil
+}
+
+// writeImageOnce is writeImage, deduplicated with writeOnce.
+func (s *Storage) writeImageOnce(ctx context.Context, img v1.Image, also ...string) (*v1.Descriptor, *LayerDeltaReport, error) {
+	h, err := img.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.writeOnce(ctx, h, also, func() (*v1.Descriptor, *LayerDeltaReport, error) {
+		return s.writeImage(ctx, img, also...)
+	})
+}
+
+// writeIndexOnce is writeIndex, deduplicated with writeOnce.
+func (s *Storage) writeIndexOnce(ctx context.Context, idx v1.ImageIndex, also ...string) (*v1.Descriptor, *LayerDeltaReport, error) {
+	h, err := idx.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.writeOnce(ctx, h, also, func() (*v1.Descriptor, *LayerDeltaReport, error) {
+		return s.writeIndex(ctx, idx, also...)
+	})
+}
+
+// BuildOnce calls build to build the image with the given cache key, unless
+// another request is already building it, in which case it waits for that
+// build and returns its result instead, so that services that build images
+// on demand only build a popular one once when many clients pull it at
+// once. Like writeOnce, a build that fails fails every request waiting on it.
+func (s *Storage) BuildOnce(key string, build func() (interface{}, error)) (interface{}, error) {
+	v, err, _ := s.builds.Do(key, build)
+	return v, err
+}
@@ -0,0 +1,286 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Metrics of the serving path, exported in the Prometheus text format by
+// MetricsHandler.
+var (
+	requestsTotal = newCounterVec("kontain_http_requests_total",
+		"Registry API requests served, by endpoint, method and status code.",
+		"endpoint", "method", "code")
+	requestDuration = newHistogramVec("kontain_http_request_duration_seconds",
+		"How long registry API requests took to serve, by endpoint.",
+		latencyBuckets, "endpoint")
+
+	blobUploadBytes = newCounterVec("kontain_blob_upload_bytes_total",
+		"Bytes of blobs written to storage.")
+	blobUploadDuration = newHistogramVec("kontain_blob_upload_duration_seconds",
+		"How long writing each blob to storage took, including blobs that were skipped because they already existed.",
+		latencyBuckets)
+
+	cacheRequests = newCounterVec("kontain_cache_requests_total",
+		"Cache lookups, by cache (manifest, negative or blob) and result (hit or miss).",
+		"cache", "result")
+
+	storageErrors = newCounterVec("kontain_storage_errors_total",
+		"Failed storage operations, including attempts that were retried, by error code.",
+		"code")
+
+	eventsDropped = newCounterVec("kontain_events_dropped_total",
+		"Storage events dropped because subscribers fell too far behind to queue them.")
+)
+
+// latencyBuckets are the histogram buckets for durations, in seconds, from
+// 5ms to a minute.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// MetricsHandler serves the metrics of the serving path in the Prometheus
+// text format, for a binary to expose at /metrics:
+//
+//	http.Handle("/metrics", serve.MetricsHandler())
+//
+// Requests are counted by Instrument, which api.Router applies to every
+// request it serves.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(metaContentType, "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range []interface{ write(io.Writer) }{
+			requestsTotal, requestDuration,
+			blobUploadBytes, blobUploadDuration,
+			cacheRequests, storageErrors, eventsDropped,
+		} {
+			m.write(w)
+		}
+	})
+}
+
+// Instrument wraps a registry handler so that the requests it serves are
+// counted, and timed, by endpoint; see MetricsHandler.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		endpoint := requestEndpoint(r)
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			requestsTotal.inc(1, endpoint, r.Method, strconv.Itoa(status))
+			requestDuration.observe(time.Since(start).Seconds(), endpoint)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// requestEndpoint returns the registry API endpoint a request is for, for
+// labeling its metrics without one series per repository.
+func requestEndpoint(r *http.Request) string {
+	p, ok := requestPath(r)
+	if !ok {
+		return "other"
+	}
+	switch p.Section {
+	case SectionVersion:
+		return "version"
+	case SectionCatalog:
+		return "catalog"
+	case SectionTags:
+		return "tags"
+	case SectionUploads:
+		return "uploads"
+	}
+	return p.Section
+}
+
+// statusWriter records the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// recordCacheLookup counts a lookup in the named cache.
+func recordCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.inc(1, cache, result)
+}
+
+// storageErrorCode returns the error code of a failed storage operation,
+// such as OSS's NoSuchKey, or its status code if it has none.
+func storageErrorCode(err error) string {
+	var (
+		serr  oss.ServiceError
+		uerr  oss.UnexpectedStatusCodeError
+		s3err *s3Error
+		gerr  *gcsError
+		nerr  net.Error
+	)
+	switch {
+	case errors.As(err, &serr):
+		if serr.Code != "" {
+			return serr.Code
+		}
+		return strconv.Itoa(serr.StatusCode)
+	case errors.As(err, &uerr):
+		return strconv.Itoa(uerr.Got())
+	case errors.As(err, &s3err):
+		if s3err.Code != "" {
+			return s3err.Code
+		}
+		return strconv.Itoa(s3err.StatusCode)
+	case errors.As(err, &gerr):
+		if gerr.Code != "" {
+			return gerr.Code
+		}
+		return strconv.Itoa(gerr.StatusCode)
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	case isNotFound(err):
+		return "not_found"
+	}
+	return "other"
+}
+
+// counterVec is a Prometheus counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label values, joined with \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, k, ""), formatFloat(c.values[k]))
+	}
+}
+
+// histogramVec is a Prometheus histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := strings.Join(labelValues, "\xff")
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, k, formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, k, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, k, ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the label names with the joined values, and the
+// bucket's le label if there is one, as {name="value",...}.
+func labelPairs(names []string, joined, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(joined, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(v)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
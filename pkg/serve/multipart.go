@@ -0,0 +1,183 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// minPartSize and maxParts are OSS's limits on multipart uploads.
+	minPartSize = 100 << 10
+	maxParts    = 10000
+
+	// partAttempts is how many times each part is tried before the upload
+	// fails.
+	partAttempts = 3
+)
+
+// multipartConfig configures multipart uploads to OSS.
+type multipartConfig struct {
+	partSize    int64
+	concurrency int
+}
+
+// WithMultipartUpload uploads blobs larger than partSize bytes to OSS in
+// parts of that size, up to concurrency parts at a time, instead of in a
+// single PutObject, which can time out for multi-GB layers. Each part is
+// retried on failure, so a transient error doesn't restart the whole upload.
+// Multipart uploads aren't bounded by the operation timeout, only each part
+// by the client's timeouts, and they're aborted if they fail or the request
+// writing the blob is cancelled.
+//
+// Parts are buffered in memory, so each upload in progress holds up to
+// concurrency+1 parts; blobs no larger than one part are buffered and then
+// written with PutObject. Part sizes must be at least 100 KiB, and blobs may
+// have at most 10,000 parts.
+func WithMultipartUpload(partSize int64, concurrency int) Option {
+	return func(s *Storage) error {
+		if partSize < minPartSize {
+			return fmt.Errorf("multipart part size %d is less than the minimum of %d bytes", partSize, minPartSize)
+		}
+		if concurrency < 1 {
+			return fmt.Errorf("multipart concurrency must be at least 1, got %d", concurrency)
+		}
+		s.multipart = &multipartConfig{partSize: partSize, concurrency: concurrency}
+		return nil
+	}
+}
+
+// contextPutter is implemented by backends that write objects honoring a
+// context, stopping, and cleaning up after themselves, once it's done, so
+// that their writes needn't be bounded by withTimeout, whose timeout applies
+// to the whole write.
+type contextPutter interface {
+	PutContext(ctx context.Context, key string, r io.Reader, contentType string, meta map[string]string) error
+}
+
+// putMultipart writes the object from r in parts, with the options given
+// when the upload is initiated and completed, respectively. The upload is
+// aborted if it fails or ctx is done before it completes.
+func (b *ossBackend) putMultipart(ctx context.Context, key string, r io.Reader, options, completeOptions []oss.Option) error {
+	partSize := b.multipart.partSize
+	first, err := readPart(r, partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < partSize {
+		return b.bucket.PutObject(key, bytes.NewReader(first), append(options, completeOptions...)...)
+	}
+
+	imur, err := b.bucket.InitiateMultipartUpload(key, options...)
+	if err != nil {
+		return err
+	}
+	parts, err := b.uploadParts(ctx, imur, first, r)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		_, err = b.bucket.CompleteMultipartUpload(imur, parts, completeOptions...)
+	}
+	if err != nil {
+		if aerr := b.bucket.AbortMultipartUpload(imur); aerr != nil {
+			return fmt.Errorf("%v (aborting multipart upload: %v)", err, aerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadParts uploads first, then the rest of r, as parts of the upload,
+// and returns the parts uploaded. It stops once ctx is done.
+func (b *ossBackend) uploadParts(ctx context.Context, imur oss.InitiateMultipartUploadResult, first []byte, r io.Reader) ([]oss.UploadPart, error) {
+	partSize := b.multipart.partSize
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, b.multipart.concurrency)
+	var mu sync.Mutex
+	var parts []oss.UploadPart
+
+	buf := first
+	for num := 1; ; num++ {
+		if num > maxParts {
+			g.Wait()
+			return nil, fmt.Errorf("blob has more than %d parts of %d bytes", maxParts, partSize)
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			if err := g.Wait(); err != nil {
+				return nil, err
+			}
+			return nil, ctx.Err()
+		}
+		part, num := buf, num
+		g.Go(func() error {
+			defer func() { <-sem }()
+			p, err := b.uploadPart(gctx, imur, part, num)
+			if err != nil {
+				return fmt.Errorf("uploading part %d: %v", num, err)
+			}
+			mu.Lock()
+			parts = append(parts, p)
+			mu.Unlock()
+			return nil
+		})
+
+		if int64(len(buf)) < partSize {
+			break
+		}
+		var err error
+		if buf, err = readPart(r, partSize); err != nil {
+			g.Wait()
+			return nil, err
+		}
+		if len(buf) == 0 {
+			break
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// uploadPart uploads a part, retrying it with backoff if it fails, until ctx
+// is done.
+func (b *ossBackend) uploadPart(ctx context.Context, imur oss.InitiateMultipartUploadResult, part []byte, num int) (oss.UploadPart, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return oss.UploadPart{}, err
+		}
+		p, err := b.bucket.UploadPart(imur, bytes.NewReader(part), int64(len(part)), num)
+		if err == nil || attempt == partAttempts {
+			return p, err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return oss.UploadPart{}, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// readPart reads up to size bytes from r, returning fewer only at the end of
+// r.
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
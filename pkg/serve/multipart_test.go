@@ -0,0 +1,107 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMultipartOSS serves the OSS multipart upload API, calling onPart for
+// each part uploaded, and records whether the upload was completed or
+// aborted.
+type fakeMultipartOSS struct {
+	onPart func()
+
+	mu                 sync.Mutex
+	completed, aborted bool
+}
+
+func (f *fakeMultipartOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Get("uploadId") == "":
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>k</Key><UploadId>u</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && q.Get("partNumber") != "":
+		io.Copy(ioutil.Discard, r.Body)
+		f.onPart()
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodPost:
+		f.mu.Lock()
+		f.completed = true
+		f.mu.Unlock()
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>k</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.aborted = true
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestMultipartUploadAbortedWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeMultipartOSS{onPart: cancel}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	b, err := newOSSBackend(ossConfig{
+		scheme:    "http",
+		endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		bucket:    "bucket",
+		accessID:  "id",
+		accessKey: "key",
+		multipart: &multipartConfig{partSize: minPartSize, concurrency: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.PutContext(ctx, "k", bytes.NewReader(make([]byte, 3*minPartSize)), "application/octet-stream", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("PutContext = %v, want %v", err, context.Canceled)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.completed || !f.aborted {
+		t.Errorf("completed = %t, aborted = %t; want the upload aborted", f.completed, f.aborted)
+	}
+}
+
+// recordingPutter is a Backend that records the context objects are put
+// with.
+type recordingPutter struct {
+	Backend
+	ctx context.Context
+}
+
+func (b *recordingPutter) PutContext(ctx context.Context, key string, r io.Reader, contentType string, meta map[string]string) error {
+	b.ctx = ctx
+	return b.Backend.Put(key, r, contentType, meta)
+}
+
+func TestMultipartPutBlobUsesCallerContext(t *testing.T) {
+	b := &recordingPutter{Backend: newMemBackend()}
+	s := newTestStorage(t, Config{}, WithBackend(b), WithMultipartUpload(minPartSize, 1), WithOperationTimeout(time.Minute))
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "caller")
+	if err := s.putBlob(ctx, "blob", s.blobKey("blob"), ioutil.NopCloser(strings.NewReader("contents")), "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.ctx == nil || b.ctx.Value(key{}) != "caller" {
+		t.Fatal("PutContext wasn't called with the caller's context")
+	}
+	if _, ok := b.ctx.Deadline(); ok {
+		t.Error("multipart upload was bounded by the operation timeout")
+	}
+}
@@ -0,0 +1,285 @@
+package serve
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// DefaultNegativeCacheTTL and DefaultNegativeCacheEntries are suggested
+// settings for WithNegativeCache: short enough that an image pushed just
+// after a failed pull is soon found, and small enough to bound the memory
+// used.
+const (
+	DefaultNegativeCacheTTL     = time.Minute
+	DefaultNegativeCacheEntries = 10000
+)
+
+// negativePrefix is the prefix of the keys failures are recorded under, if
+// the negative cache is persisted.
+const negativePrefix = "negative/"
+
+// negativeCache remembers upstream lookups that failed because the image
+// doesn't exist; see WithNegativeCache.
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+	persist    bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *negativeEntry, oldest first
+}
+
+// negativeEntry is a remembered failure, as it's persisted.
+type negativeEntry struct {
+	Ref     string                 `json:"ref"`
+	Status  int                    `json:"status"`
+	Errors  []transport.Diagnostic `json:"errors"`
+	Expires time.Time              `json:"expires"`
+}
+
+// WithNegativeCache remembers, for ttl, upstream lookups of images that
+// failed because the image or repository doesn't exist, so that repeated
+// pulls of it are answered with the same error without asking the upstream
+// registry again; see CachedFailure and RecordFailure. At most maxEntries
+// failures are remembered in memory, forgetting the oldest first.
+//
+// If persist is set, failures are also recorded in the bucket, so that
+// they're shared by every instance of the service, and survive restarts.
+// That costs a read of the bucket for each lookup the instance doesn't
+// remember. CollectGarbage deletes them once they expire.
+//
+// The config's NegativeCacheTTL, NegativeCacheEntries and
+// NegativeCachePersist, if set, override the settings given here.
+func WithNegativeCache(ttl time.Duration, maxEntries int, persist bool) Option {
+	return func(s *Storage) error {
+		c, err := newNegativeCache(ttl, maxEntries, persist)
+		if err != nil {
+			return err
+		}
+		s.negative = c
+		return nil
+	}
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int, persist bool) (*negativeCache, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("negative cache TTL must be positive, got %s", ttl)
+	}
+	if maxEntries < 1 {
+		return nil, fmt.Errorf("negative cache must have at least 1 entry, got %d", maxEntries)
+	}
+	return &negativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		persist:    persist,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}, nil
+}
+
+// negativeCache returns the negative cache the config configures, starting
+// from the settings of nc, which WithNegativeCache may have given, or else
+// the defaults, and overriding those the config sets. It returns nc if the
+// config sets none, and nil if it sets a TTL of zero, to disable the cache.
+func (c Config) negativeCache(nc *negativeCache) (*negativeCache, error) {
+	if c.NegativeCacheTTL == "" && c.NegativeCacheEntries == "" && c.NegativeCachePersist == "" {
+		return nc, nil
+	}
+	ttl, maxEntries, persist := DefaultNegativeCacheTTL, DefaultNegativeCacheEntries, false
+	if nc != nil {
+		ttl, maxEntries, persist = nc.ttl, nc.maxEntries, nc.persist
+	}
+	var err error
+	if c.NegativeCacheTTL != "" {
+		if ttl, err = time.ParseDuration(c.NegativeCacheTTL); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid negative cache TTL (NEGATIVE_CACHE_TTL) %q, must be a positive duration, or 0 to disable the cache", c.NegativeCacheTTL)
+		}
+		if ttl == 0 {
+			return nil, nil
+		}
+	}
+	if c.NegativeCacheEntries != "" {
+		if maxEntries, err = strconv.Atoi(c.NegativeCacheEntries); err != nil || maxEntries < 1 {
+			return nil, fmt.Errorf("invalid negative cache entries (NEGATIVE_CACHE_ENTRIES) %q, must be a positive number", c.NegativeCacheEntries)
+		}
+	}
+	if c.NegativeCachePersist != "" {
+		if persist, err = strconv.ParseBool(c.NegativeCachePersist); err != nil {
+			return nil, fmt.Errorf("invalid NEGATIVE_CACHE_PERSIST %q, must be true or false", c.NegativeCachePersist)
+		}
+	}
+	return newNegativeCache(ttl, maxEntries, persist)
+}
+
+// CachedFailure returns the error that a recent upstream lookup of the image
+// failed with, as recorded by RecordFailure, or nil if there's none, or
+// there's no negative cache. The error is written with WriteError like the
+// original.
+func (s *Storage) CachedFailure(ctx context.Context, ref name.Reference) error {
+	c := s.negative
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	e, ok := c.get(ref.Name(), now)
+	if !ok && c.persist {
+		var err error
+		if e, ok, err = s.readFailure(ref.Name(), now); err != nil {
+			warnf(ctx, "reading cached failure of %s: %v", ref, err)
+			return nil
+		}
+		if ok {
+			c.add(e)
+		}
+	}
+	recordCacheLookup("negative", ok)
+	if !ok {
+		return nil
+	}
+	return &transport.Error{StatusCode: e.Status, Errors: e.Errors}
+}
+
+// RecordFailure records that the upstream lookup of the image failed with
+// err, if there's a negative cache and err says that the image or its
+// repository doesn't exist. Other errors, like those from an upstream
+// registry that's unavailable, aren't recorded, so the next pull tries
+// again. Failures to persist the error are only logged.
+func (s *Storage) RecordFailure(ctx context.Context, ref name.Reference, err error) {
+	c := s.negative
+	if c == nil || !isNegativelyCacheable(err) {
+		return
+	}
+	var terr *transport.Error
+	errors.As(err, &terr)
+	e := &negativeEntry{
+		Ref:     ref.Name(),
+		Status:  terr.StatusCode,
+		Errors:  terr.Errors,
+		Expires: time.Now().Add(c.ttl),
+	}
+	c.add(e)
+	if !c.persist || s.DryRun {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		warnf(ctx, "recording failure of %s: %v", ref, err)
+		return
+	}
+	if err := s.objects.Put(s.metaKey(negativePrefix)+e.Ref, bytes.NewReader(b), "application/json", map[string]string{
+		metaExpireAt: e.Expires.UTC().Format(time.RFC3339),
+	}); err != nil {
+		warnf(ctx, "recording failure of %s: %v", ref, err)
+	}
+}
+
+// isNegativelyCacheable reports whether err is from an upstream registry
+// saying that an image, or its repository, doesn't exist.
+func isNegativelyCacheable(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, d := range terr.Errors {
+		switch d.Code {
+		case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.NameInvalidErrorCode:
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the unexpired failure recorded for ref.
+func (c *negativeCache) get(ref string, now time.Time) (*negativeEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[ref]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*negativeEntry)
+	if !now.Before(e.Expires) {
+		c.order.Remove(el)
+		delete(c.entries, ref)
+		return nil, false
+	}
+	return e, true
+}
+
+// add records the failure, replacing any for the same ref, and forgets the
+// oldest failures if there are too many.
+func (c *negativeCache) add(e *negativeEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.Ref]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[e.Ref] = c.order.PushBack(e)
+	for c.order.Len() > c.maxEntries {
+		el := c.order.Front()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*negativeEntry).Ref)
+	}
+}
+
+// readFailure returns the unexpired failure recorded for ref in the bucket.
+// Expired failures are ignored, and overwritten the next time the lookup
+// fails.
+func (s *Storage) readFailure(ref string, now time.Time) (*negativeEntry, bool, error) {
+	rc, err := s.objects.Get(s.metaKey(negativePrefix) + ref)
+	if isNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+	var e negativeEntry
+	if err := json.NewDecoder(rc).Decode(&e); err != nil {
+		return nil, false, err
+	}
+	if e.Ref != ref || !now.Before(e.Expires) {
+		return nil, false, nil
+	}
+	return &e, true, nil
+}
+
+// expiredFailures returns the keys of the failures recorded in the bucket
+// whose TTL has passed, for CollectGarbage to delete. Failures are recorded
+// whether or not the negative cache is still persisted, so they're swept
+// regardless.
+func (s *Storage) expiredFailures(now time.Time) ([]string, error) {
+	keys, err := s.objects.List(s.metaKey(negativePrefix))
+	if err != nil {
+		return nil, err
+	}
+	var expired []string
+	for _, k := range keys {
+		info, err := s.objects.Stat(k)
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Failures without a valid expiry weren't recorded by
+		// RecordFailure, and are left alone.
+		if t, err := time.Parse(time.RFC3339, info.Meta[metaExpireAt]); err == nil && !now.Before(t) {
+			expired = append(expired, k)
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,54 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestNegativeCacheConfig(t *testing.T) {
+	s := newTestStorage(t, Config{NegativeCacheEntries: "5", NegativeCachePersist: "true"},
+		WithNegativeCache(time.Hour, 100, false))
+	if c := s.negative; c == nil || c.ttl != time.Hour || c.maxEntries != 5 || !c.persist {
+		t.Errorf("negative cache = %+v, want the option's TTL and the config's entries and persistence", c)
+	}
+
+	s = newTestStorage(t, Config{NegativeCacheTTL: "0"}, WithNegativeCache(time.Hour, 100, false))
+	if s.negative != nil {
+		t.Errorf("negative cache = %+v, want it disabled", s.negative)
+	}
+
+	if _, err := NewStorage(context.Background(), WithConfig(Config{Backend: "mem", NegativeCacheEntries: "0"})); err == nil {
+		t.Error("NewStorage with no negative cache entries succeeded, want error")
+	}
+}
+
+func TestCollectGarbageDeletesExpiredFailures(t *testing.T) {
+	s := newTestStorage(t, Config{NegativeCacheTTL: "1h", NegativeCachePersist: "true"})
+	ctx := context.Background()
+	notFound := &transport.Error{StatusCode: http.StatusNotFound}
+	s.RecordFailure(ctx, name.MustParseReference("example.com/gone:latest"), notFound)
+	s.RecordFailure(ctx, name.MustParseReference("example.com/fresh:latest"), notFound)
+	// Expire one of them, as if it had been recorded long ago.
+	s.negative.ttl = -time.Hour
+	s.RecordFailure(ctx, name.MustParseReference("example.com/gone:latest"), notFound)
+
+	report, err := s.CollectGarbage(ctx, nil, GCOptions{})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if want := []string{"example.com/gone:latest"}; !equalStrings(report.ExpiredFailures, want) {
+		t.Errorf("ExpiredFailures = %v, want %v", report.ExpiredFailures, want)
+	}
+	keys, err := s.objects.List(negativePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{negativePrefix + "example.com/fresh:latest"}; !equalStrings(keys, want) {
+		t.Errorf("cached failures = %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,355 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ErrNotAcceptable is returned by ServeManifest and ServeIndex if the
+// manifest can't be served as any media type the client accepts.
+var ErrNotAcceptable = errors.New("manifest not available in an accepted media type")
+
+// Media types that OCI and Docker manifests convert between. Layers with
+// other media types, such as zstd, have no equivalent, so manifests with them
+// can't be converted.
+var (
+	ociToDocker = map[types.MediaType]types.MediaType{
+		types.OCIManifestSchema1:   types.DockerManifestSchema2,
+		types.OCIImageIndex:        types.DockerManifestList,
+		types.OCIConfigJSON:        types.DockerConfigJSON,
+		types.OCILayer:             types.DockerLayer,
+		types.OCIUncompressedLayer: types.DockerUncompressedLayer,
+		types.OCIRestrictedLayer:   types.DockerForeignLayer,
+	}
+	dockerToOCI = map[types.MediaType]types.MediaType{}
+)
+
+func init() {
+	for oci, docker := range ociToDocker {
+		dockerToOCI[docker] = oci
+	}
+}
+
+// convertType returns the media type converted, or as it is if it's already
+// one that's converted to.
+func convertType(conv map[types.MediaType]types.MediaType, mt types.MediaType) (types.MediaType, error) {
+	if to, ok := conv[mt]; ok {
+		return to, nil
+	}
+	for _, to := range conv {
+		if to == mt {
+			return mt, nil
+		}
+	}
+	return "", fmt.Errorf("media type %s can't be converted", mt)
+}
+
+// acceptedTypes returns the media types in the request's Accept headers, or
+// nil if it accepts any.
+func acceptedTypes(r *http.Request) []types.MediaType {
+	var mts []types.MediaType
+	for _, h := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(h, ",") {
+			if i := strings.Index(t, ";"); i >= 0 {
+				t = t[:i]
+			}
+			t = strings.TrimSpace(t)
+			if t == "*/*" {
+				return nil
+			}
+			if t != "" {
+				mts = append(mts, types.MediaType(t))
+			}
+		}
+	}
+	return mts
+}
+
+// negotiate returns the conversion of media types needed to serve a manifest
+// of type mt to a client accepting the given types, or nil if none is
+// needed. It returns ErrNotAcceptable if the client accepts neither mt nor
+// the type it converts to.
+func negotiate(accepted []types.MediaType, mt types.MediaType) (map[types.MediaType]types.MediaType, error) {
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+	for _, a := range accepted {
+		if a == mt {
+			return nil, nil
+		}
+	}
+	for _, conv := range []map[types.MediaType]types.MediaType{ociToDocker, dockerToOCI} {
+		to, ok := conv[mt]
+		if !ok {
+			continue
+		}
+		for _, a := range accepted {
+			if a == to {
+				return conv, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s, client accepts %v", ErrNotAcceptable, mt, accepted)
+}
+
+// accepts reports whether the request accepts manifests of media type mt.
+func accepts(r *http.Request, mt types.MediaType) bool {
+	accepted := acceptedTypes(r)
+	if len(accepted) == 0 {
+		return true
+	}
+	for _, a := range accepted {
+		if a == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateImage returns the image converted to a media type the request
+// accepts, if it doesn't accept the image's own.
+func negotiateImage(r *http.Request, img v1.Image) (v1.Image, error) {
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	conv, err := negotiate(acceptedTypes(r), mt)
+	if err != nil || conv == nil {
+		return img, err
+	}
+	return convertImage(img, conv)
+}
+
+// negotiateIndex returns the index converted to a media type the request
+// accepts, if it doesn't accept the index's own.
+func negotiateIndex(r *http.Request, idx v1.ImageIndex) (v1.ImageIndex, error) {
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	conv, err := negotiate(acceptedTypes(r), mt)
+	if err != nil || conv == nil {
+		return idx, err
+	}
+	return convertIndex(idx, conv)
+}
+
+// storedImage returns the image as it's written under aliases with ctx, and
+// the image served to the request. The stored image doesn't depend on the
+// request, so that an alias holds the same manifest whichever client pulled
+// it last; only the served image is converted to a media type the request
+// accepts. Served is stored if the request accepts it.
+func (s *Storage) storedImage(ctx context.Context, w http.ResponseWriter, r *http.Request, img v1.Image) (stored, served v1.Image, err error) {
+	w.Header().Add("Vary", "Accept")
+	if stored, err = s.ociImageForRecompression(ctx, img); err != nil {
+		return nil, nil, err
+	}
+	mt, err := stored.MediaType()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored != img && !accepts(r, mt) {
+		// Serve the image as it's pulled, rather than the stored
+		// image converted back, which can't be if its layers were
+		// recompressed.
+		served, err = negotiateImage(r, img)
+	} else {
+		served, err = negotiateImage(r, stored)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, served, nil
+}
+
+// storedIndex is storedImage for indexes.
+func (s *Storage) storedIndex(ctx context.Context, w http.ResponseWriter, r *http.Request, idx v1.ImageIndex) (stored, served v1.ImageIndex, err error) {
+	w.Header().Add("Vary", "Accept")
+	if stored, err = s.ociIndexForRecompression(ctx, idx); err != nil {
+		return nil, nil, err
+	}
+	mt, err := stored.MediaType()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored != idx && !accepts(r, mt) {
+		served, err = negotiateIndex(r, idx)
+	} else {
+		served, err = negotiateIndex(r, stored)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, served, nil
+}
+
+// convertedImage is an image with its manifest's media types converted. Its
+// blobs are unchanged.
+type convertedImage struct {
+	v1.Image
+	mt       types.MediaType
+	manifest *v1.Manifest
+	raw      []byte
+	layers   []v1.Layer
+}
+
+// convertImage returns the image with the media types of its manifest, config
+// and layers converted, returning ErrNotAcceptable if any has no conversion.
+func convertImage(img v1.Image, conv map[types.MediaType]types.MediaType) (v1.Image, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	convert := func(what string, from types.MediaType) (types.MediaType, error) {
+		to, err := convertType(conv, from)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s has media type %s, which can't be converted", ErrNotAcceptable, what, from)
+		}
+		changed = changed || to != from
+		return to, nil
+	}
+
+	m = m.DeepCopy()
+	if m.MediaType, err = convert("manifest", mt); err != nil {
+		return nil, err
+	}
+	if m.Config.MediaType, err = convert("config", m.Config.MediaType); err != nil {
+		return nil, err
+	}
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]v1.Layer, len(ls))
+	for i, l := range ls {
+		if m.Layers[i].MediaType, err = convert(fmt.Sprintf("layer %s", m.Layers[i].Digest), m.Layers[i].MediaType); err != nil {
+			return nil, err
+		}
+		layers[i] = &convertedLayer{Layer: l, mt: m.Layers[i].MediaType}
+	}
+	if !changed {
+		return img, nil
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &convertedImage{Image: img, mt: m.MediaType, manifest: m, raw: raw, layers: layers}, nil
+}
+
+func (i *convertedImage) MediaType() (types.MediaType, error) { return i.mt, nil }
+func (i *convertedImage) Manifest() (*v1.Manifest, error)     { return i.manifest.DeepCopy(), nil }
+func (i *convertedImage) RawManifest() ([]byte, error)        { return i.raw, nil }
+func (i *convertedImage) Layers() ([]v1.Layer, error)         { return i.layers, nil }
+func (i *convertedImage) Size() (int64, error)                { return int64(len(i.raw)), nil }
+
+func (i *convertedImage) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+func (i *convertedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		if d, err := l.Digest(); err == nil && d == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+// convertedLayer is a layer with its media type converted.
+type convertedLayer struct {
+	v1.Layer
+	mt types.MediaType
+}
+
+func (l *convertedLayer) MediaType() (types.MediaType, error) { return l.mt, nil }
+
+// convertedIndex is an index with its media type, and those of its images,
+// converted.
+type convertedIndex struct {
+	manifest *v1.IndexManifest
+	raw      []byte
+	images   map[v1.Hash]v1.Image
+}
+
+// convertIndex returns the index and its images with their media types
+// converted, returning ErrNotAcceptable if any has no conversion. Indexes
+// in the index aren't converted.
+func convertIndex(idx v1.ImageIndex, conv map[types.MediaType]types.MediaType) (v1.ImageIndex, error) {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	im = im.DeepCopy()
+	if im.MediaType, err = convertType(conv, mt); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAcceptable, err)
+	}
+	images := map[v1.Hash]v1.Image{}
+	for i, m := range im.Manifests {
+		if !m.MediaType.IsImage() {
+			return nil, fmt.Errorf("%w: index has a %s manifest, which can't be converted", ErrNotAcceptable, m.MediaType)
+		}
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = convertImage(img, conv); err != nil {
+			return nil, err
+		}
+		desc, err := partial.Descriptor(img)
+		if err != nil {
+			return nil, err
+		}
+		im.Manifests[i].MediaType = desc.MediaType
+		im.Manifests[i].Digest = desc.Digest
+		im.Manifests[i].Size = desc.Size
+		images[desc.Digest] = img
+	}
+	raw, err := json.Marshal(im)
+	if err != nil {
+		return nil, err
+	}
+	return &convertedIndex{manifest: im, raw: raw, images: images}, nil
+}
+
+func (i *convertedIndex) MediaType() (types.MediaType, error) { return i.manifest.MediaType, nil }
+func (i *convertedIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+func (i *convertedIndex) RawManifest() ([]byte, error) { return i.raw, nil }
+func (i *convertedIndex) Size() (int64, error)         { return int64(len(i.raw)), nil }
+
+func (i *convertedIndex) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(i.raw))
+	return h, err
+}
+
+func (i *convertedIndex) Image(h v1.Hash) (v1.Image, error) {
+	if img, ok := i.images[h]; ok {
+		return img, nil
+	}
+	return nil, fmt.Errorf("image %s not found in converted index", h)
+}
+
+func (i *convertedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return nil, fmt.Errorf("index %s not found in converted index", h)
+}
@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestServeManifestWritesAliasesUnconverted(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.LayerCompression = CompressZstd
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, err := img.MediaType(); err != nil || mt != types.DockerManifestSchema2 {
+		t.Fatalf("MediaType = %s, %v", mt, err)
+	}
+
+	for _, accept := range []string{string(types.DockerManifestSchema2), string(types.OCIManifestSchema1), ""} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodHead, "/v2/test/manifests/latest", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		if err := s.ServeManifest(w, r, img, "alias"); err != nil {
+			t.Fatalf("ServeManifest(Accept: %q): %v", accept, err)
+		}
+		want := accept
+		if want == "" {
+			want = string(types.OCIManifestSchema1)
+		}
+		if got := w.Header().Get(metaContentType); got != want {
+			t.Errorf("Accept %q: served Content-Type %q, want %q", accept, got, want)
+		}
+		info, err := s.objects.Stat(s.blobKey("alias"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != string(types.OCIManifestSchema1) {
+			t.Errorf("Accept %q: alias has Content-Type %q, want %q", accept, info.ContentType, types.OCIManifestSchema1)
+		}
+	}
+}
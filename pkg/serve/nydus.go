@@ -0,0 +1,397 @@
+package serve
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/imjasonh/kontain.me/pkg/run"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// NydusBlobMediaType is the media type of nydus data blob layers.
+	NydusBlobMediaType types.MediaType = "application/vnd.oci.image.layer.nydus.blob.v1"
+
+	nydusBlobAnnotation      = "containerd.io/snapshot/nydus-blob"
+	nydusBootstrapAnnotation = "containerd.io/snapshot/nydus-bootstrap"
+	nydusFSVersionAnnotation = "containerd.io/snapshot/nydus-fs-version"
+	nydusFSVersion           = "5"
+
+	// nydusBootstrapPath is where the nydus snapshotter expects to find the
+	// bootstrap inside the bootstrap layer.
+	nydusBootstrapPath = "image/image.boot"
+)
+
+// nydusImage is the path to the nydus-image builder binary.
+var nydusImage = "nydus-image"
+
+func init() {
+	if p := os.Getenv("NYDUS_IMAGE"); p != "" {
+		nydusImage = p
+	}
+}
+
+// ServeNydus converts the image to nydus (RAFS v5) format, then writes and
+// redirects to the converted image's manifest as ServeManifest does.
+func (s *Storage) ServeNydus(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
+	ctx := RequestContext(w, r)
+	r = r.WithContext(ctx)
+	tmp, err := ioutil.TempDir("", "nydus-")
+	if err != nil {
+		return withRequestIDErr(ctx, err)
+	}
+	defer os.RemoveAll(tmp)
+	nimg, err := ConvertNydus(img, tmp)
+	if err != nil {
+		return withRequestIDErr(ctx, err)
+	}
+	return s.ServeManifest(w, r, nimg, also...)
+}
+
+// ConvertNydus converts each layer of the image into a nydus data blob using
+// the nydus-image builder, and returns an image made of those blobs followed
+// by a layer containing the final bootstrap.
+//
+// Intermediate and output files are written under dir, which must outlive
+// the returned image.
+//
+// Layer contents are unpacked with their original timestamps, and the
+// bootstrap layer is written with zeroed timestamps, so converting the same
+// image twice produces the same digests.
+func ConvertNydus(img v1.Image, dir string) (v1.Image, error) {
+	blobDir := filepath.Join(dir, "blobs")
+	if err := os.Mkdir(blobDir, 0755); err != nil {
+		return nil, err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	seen := map[string]bool{}
+	var bootstrap string
+	for i, l := range layers {
+		ld := filepath.Join(dir, fmt.Sprintf("layer-%d", i))
+		if err := unpackLayer(l, ld); err != nil {
+			return nil, fmt.Errorf("unpacking layer %d: %v", i, err)
+		}
+		next := filepath.Join(dir, fmt.Sprintf("bootstrap-%d", i))
+		out := filepath.Join(dir, fmt.Sprintf("output-%d.json", i))
+		cmd := fmt.Sprintf("%s create --log-level warn --whiteout-spec oci --fs-version %s --bootstrap %s --blob-dir %s --output-json %s",
+			nydusImage, nydusFSVersion, next, blobDir, out)
+		if bootstrap != "" {
+			cmd += " --parent-bootstrap " + bootstrap
+		}
+		cmd += " " + ld
+		if err := run.Do(log.Writer(), cmd); err != nil {
+			return nil, err
+		}
+		ids, err := readNydusBlobs(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				blobs = append(blobs, id)
+			}
+		}
+		bootstrap = next
+		if err := os.RemoveAll(ld); err != nil {
+			return nil, err
+		}
+	}
+	if bootstrap == "" {
+		return nil, fmt.Errorf("image has no layers to convert")
+	}
+
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.RootFS.DiffIDs = nil
+	cf.History = nil
+	nimg, err := mutate.ConfigFile(empty.Image, cf)
+	if err != nil {
+		return nil, err
+	}
+
+	var adds []mutate.Addendum
+	for _, id := range blobs {
+		l, err := newFileLayer(filepath.Join(blobDir, id), NydusBlobMediaType)
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer:       l,
+			Annotations: map[string]string{nydusBlobAnnotation: "true"},
+		})
+	}
+	bl, err := bootstrapLayer(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	adds = append(adds, mutate.Addendum{
+		Layer: bl,
+		Annotations: map[string]string{
+			nydusBootstrapAnnotation: "true",
+			nydusFSVersionAnnotation: nydusFSVersion,
+		},
+	})
+	return mutate.Append(nimg, adds...)
+}
+
+// readNydusBlobs returns the IDs of the blobs reported in nydus-image's
+// --output-json file.
+func readNydusBlobs(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Blobs []string `json:"blobs"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return out.Blobs, nil
+}
+
+// bootstrapLayer returns a gzipped tar layer containing the bootstrap file at
+// the path the nydus snapshotter expects.
+func bootstrapLayer(path string) (v1.Layer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{{
+		Name:     filepath.Dir(nydusBootstrapPath) + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Unix(0, 0),
+	}, {
+		Name:     nydusBootstrapPath,
+		Typeflag: tar.TypeReg,
+		Mode:     0444,
+		Size:     int64(len(b)),
+		ModTime:  time.Unix(0, 0),
+	}} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	tb := buf.Bytes()
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(tb)), nil
+	})
+}
+
+// unpackLayer extracts the uncompressed contents of the layer into dir,
+// preserving modes and timestamps. Whiteout files are kept as-is, to be
+// interpreted by nydus-image.
+//
+// Entries are written as if dir were the root: symlinks already extracted
+// are resolved against dir, never the host, so an entry can't escape dir by
+// naming a path through one. Symlinks are created with their targets as-is,
+// since they're only followed again relative to dir.
+func unpackLayer(l v1.Layer, dir string) error {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	type mtime struct {
+		path string
+		t    time.Time
+	}
+	var times []mtime
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := unpackPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			// The root itself.
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Replace whatever an earlier entry left at the path, unless both
+		// are directories, so that writing it can't follow a symlink.
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := unpackPath(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			// Device nodes and FIFOs can't be created unprivileged.
+			DefaultLogger().Debug("skipping tar entry with unsupported type", "name", hdr.Name, "type", string(hdr.Typeflag))
+			continue
+		}
+		// Ownership can only be preserved when running as root. Chown
+		// before chmod, since chown clears the setuid and setgid bits.
+		_ = os.Lchown(path, hdr.Uid, hdr.Gid)
+		if hdr.Typeflag != tar.TypeSymlink {
+			if hdr.Typeflag == tar.TypeDir {
+				// Keep directories writable, for the entries in them.
+				mode |= 0700
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+		times = append(times, mtime{path, hdr.ModTime})
+	}
+
+	// Set timestamps last, in reverse, so that creating entries doesn't
+	// update their parent directories' timestamps afterward.
+	for i := len(times) - 1; i >= 0; i-- {
+		tv := unix.NsecToTimeval(times[i].t.UnixNano())
+		if err := unix.Lutimes(times[i].path, []unix.Timeval{tv, tv}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxUnpackSymlinks is how many symlinks unpackPath follows resolving a
+// path before giving up, as the kernel's ELOOP limit does.
+const maxUnpackSymlinks = 40
+
+// unpackPath returns the path in dir of the tar entry name, with the
+// symlinks among its parent directories resolved as if dir were the root.
+// The last element isn't resolved, so that the entry replaces a symlink
+// there rather than writing through it.
+func unpackPath(dir, name string) (string, error) {
+	parts := strings.Split(filepath.Clean("/"+name), "/")
+	last := parts[len(parts)-1]
+	pending := parts[:len(parts)-1]
+	var resolved []string
+	followed := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		cur := filepath.Join(append([]string{dir}, append(resolved, part)...)...)
+		fi, err := os.Lstat(cur)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Missing directories are created as-is.
+			resolved = append(resolved, part)
+			continue
+		}
+		if followed++; followed > maxUnpackSymlinks {
+			return "", fmt.Errorf("tar entry %q: too many levels of symbolic links", name)
+		}
+		target, err := os.Readlink(cur)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(append([]string{dir}, append(resolved, last)...)...), nil
+}
+
+// fileLayer is a layer whose blob is a file stored as-is, without
+// compression, such as a nydus data blob.
+type fileLayer struct {
+	path string
+	h    v1.Hash
+	size int64
+	mt   types.MediaType
+}
+
+func newFileLayer(path string, mt types.MediaType) (*fileLayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLayer{path: path, h: h, size: size, mt: mt}, nil
+}
+
+func (l *fileLayer) Digest() (v1.Hash, error)             { return l.h, nil }
+func (l *fileLayer) DiffID() (v1.Hash, error)             { return l.h, nil }
+func (l *fileLayer) Compressed() (io.ReadCloser, error)   { return os.Open(l.path) }
+func (l *fileLayer) Uncompressed() (io.ReadCloser, error) { return os.Open(l.path) }
+func (l *fileLayer) Size() (int64, error)                 { return l.size, nil }
+func (l *fileLayer) MediaType() (types.MediaType, error)  { return l.mt, nil }
@@ -0,0 +1,100 @@
+package serve
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarLayer returns a layer of the tar entries, with the contents of regular
+// files given by body.
+func tarLayer(t *testing.T, hdrs []*tar.Header, body map[string]string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var b string
+		if hdr.Typeflag == tar.TypeReg {
+			b = body[hdr.Name]
+			hdr.Size = int64(len(b))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestUnpackLayerStaysInDir(t *testing.T) {
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "passwd")
+	if err := ioutil.WriteFile(victim, []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "root")
+	l := tarLayer(t, []*tar.Header{
+		{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "abs/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "rel", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../.." + outside},
+		{Name: "rel/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "over", Typeflag: tar.TypeSymlink, Linkname: victim},
+		{Name: "over", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "abs/passwd"},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755},
+	}, map[string]string{
+		"abs/passwd": "abs",
+		"rel/passwd": "rel",
+		"over":       "over",
+		"bin/su":     "su",
+	})
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackLayer(l, dir); err != nil {
+		t.Fatalf("unpackLayer: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(victim); err != nil || string(b) != "root" {
+		t.Errorf("file outside dir = %q, %v; want it untouched", b, err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dir, outside, "passwd"): "rel",
+		filepath.Join(dir, "over"):            "over",
+		filepath.Join(dir, "hard"):            "rel",
+		filepath.Join(dir, "usr/bin/su"):      "su",
+	} {
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v; want %q", path, b, err, want)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "abs")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("abs isn't a symlink: %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "usr/bin/su")); err != nil {
+		t.Error(err)
+	} else if fi.Mode()&os.ModeSetuid == 0 || fi.Mode().Perm() != 0755 {
+		t.Errorf("usr/bin/su mode = %v, want setuid 0755", fi.Mode())
+	}
+}
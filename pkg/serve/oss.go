@@ -0,0 +1,227 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// ossBackend stores objects in an Aliyun OSS bucket.
+type ossBackend struct {
+	bucket                       *oss.Bucket
+	scheme, endpoint, bucketName string
+	acl                          oss.ACLType
+	callback                     *ossCallback
+	multipart                    *multipartConfig
+	signedURLExpiry              time.Duration
+}
+
+// ossConfig identifies an OSS bucket and the credentials to access it with.
+type ossConfig struct {
+	scheme, endpoint, bucket, accessID, accessKey string
+
+	// acl, if set, is the ACL of objects written to the bucket.
+	acl oss.ACLType
+
+	// callback, if set, is requested when writing blobs to the bucket.
+	callback *ossCallback
+
+	// multipart, if set, makes large objects be written in parts.
+	multipart *multipartConfig
+
+	// signedURLExpiry, if set, makes redirects to objects go to signed URLs
+	// valid for that long.
+	signedURLExpiry time.Duration
+}
+
+func newOSSBackend(cfg ossConfig, options ...oss.ClientOption) (*ossBackend, error) {
+	client, err := oss.New(fmt.Sprintf("%s://%s", cfg.scheme, cfg.endpoint), cfg.accessID, cfg.accessKey, options...)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %v", err)
+	}
+	b, err := client.Bucket(cfg.bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &ossBackend{bucket: b, scheme: cfg.scheme, endpoint: cfg.endpoint, bucketName: cfg.bucket, acl: cfg.acl, callback: cfg.callback, multipart: cfg.multipart, signedURLExpiry: cfg.signedURLExpiry}, nil
+}
+
+// metaOptions returns the options setting the object's content type and
+// metadata.
+func metaOptions(contentType string, meta map[string]string) []oss.Option {
+	options := []oss.Option{oss.ContentType(contentType)}
+	for k, v := range meta {
+		options = append(options, oss.Meta(k, v))
+	}
+	return options
+}
+
+// aclOptions returns the options setting the ACL of written objects.
+func (b *ossBackend) aclOptions() []oss.Option {
+	if b.acl == "" {
+		return nil
+	}
+	return []oss.Option{oss.ObjectACL(b.acl)}
+}
+
+func (b *ossBackend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	return b.PutContext(context.Background(), key, r, contentType, meta)
+}
+
+// PutContext is Put, but stops a multipart upload once ctx is done. Objects
+// written with a single PutObject don't heed ctx, since the SDK doesn't
+// accept one.
+func (b *ossBackend) PutContext(ctx context.Context, key string, r io.Reader, contentType string, meta map[string]string) error {
+	options := append(metaOptions(contentType, meta), b.aclOptions()...)
+	// Only blobs, which have a digest, are reported to the callback.
+	var cbOptions []oss.Option
+	if d := meta[metaDockerContentDigest]; b.callback != nil && d != "" {
+		var err error
+		if cbOptions, err = b.callback.options(d); err != nil {
+			return err
+		}
+	}
+	if b.multipart != nil {
+		return b.putMultipart(ctx, key, r, options, cbOptions)
+	}
+	return b.bucket.PutObject(key, r, append(options, cbOptions...)...)
+}
+
+func (b *ossBackend) Get(key string) (io.ReadCloser, error) {
+	return b.bucket.GetObject(key)
+}
+
+func (b *ossBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return b.bucket.GetObject(key, oss.Range(offset, offset+length-1))
+}
+
+func (b *ossBackend) Stat(key string) (ObjectInfo, error) {
+	h, err := b.bucket.GetObjectDetailedMeta(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := ObjectInfo{
+		ContentType: h.Get(oss.HTTPHeaderContentType),
+		Meta:        map[string]string{},
+	}
+	if v := h.Get(oss.HTTPHeaderContentLength); v != "" {
+		info.Size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("object %q has invalid %s %q: %v", key, oss.HTTPHeaderContentLength, v, err)
+		}
+	}
+	if v := h.Get(oss.HTTPHeaderLastModified); v != "" {
+		info.ModTime, _ = http.ParseTime(v)
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, oss.HTTPHeaderOssMetaPrefix) && len(v) > 0 {
+			info.Meta[strings.TrimPrefix(k, oss.HTTPHeaderOssMetaPrefix)] = v[0]
+		}
+	}
+	return info, nil
+}
+
+func (b *ossBackend) Exists(key string) (bool, error) {
+	return b.bucket.IsObjectExist(key)
+}
+
+func (b *ossBackend) Copy(src, dst string) error {
+	_, err := b.bucket.CopyObject(src, dst, b.aclOptions()...)
+	return err
+}
+
+func (b *ossBackend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	options := append([]oss.Option{oss.MetadataDirective(oss.MetaReplace)}, metaOptions(contentType, meta)...)
+	options = append(options, b.aclOptions()...)
+	_, err := b.bucket.CopyObject(src, dst, options...)
+	return err
+}
+
+func (b *ossBackend) Delete(keys ...string) error {
+	switch len(keys) {
+	case 0:
+		return nil
+	case 1:
+		return b.bucket.DeleteObject(keys[0])
+	}
+	_, err := b.bucket.DeleteObjects(keys, oss.DeleteObjectsQuiet(true))
+	return err
+}
+
+func (b *ossBackend) DeleteBatch(keys []string) ([]string, error) {
+	res, err := b.bucket.DeleteObjects(keys)
+	if err != nil {
+		return nil, err
+	}
+	return res.DeletedObjects, nil
+}
+
+func (b *ossBackend) Append(key string, r io.Reader, pos int64) (int64, error) {
+	next, err := b.bucket.AppendObject(key, r, pos)
+	if serr, ok := err.(oss.ServiceError); ok && serr.Code == "PositionNotEqualToLength" {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	return next, err
+}
+
+func (b *ossBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		opts := []oss.Option{oss.Prefix(prefix)}
+		if token != "" {
+			opts = append(opts, oss.ContinuationToken(token))
+		}
+		res, err := b.bucket.ListObjectsV2(opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range res.Objects {
+			keys = append(keys, o.Key)
+		}
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// WithSignedURLs redirects clients to blobs with signed OSS URLs that expire
+// after the given time, rather than plain URLs, so that the bucket needn't be
+// public. Responses with signed URLs may only be cached privately, for half
+// the expiry, so that no cache hands out an expired URL.
+//
+// The OSS credentials are used to sign URLs, so they must be set, and objects
+// may not also be made public with WithObjectACL. GCS buckets are signed for
+// automatically when the credentials can sign.
+func WithSignedURLs(expiry time.Duration) Option {
+	return func(s *Storage) error {
+		if expiry < time.Second {
+			return fmt.Errorf("signed URL expiry %s is less than a second", expiry)
+		}
+		s.signedURLExpiry = expiry
+		return nil
+	}
+}
+
+func (b *ossBackend) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	if b.signedURLExpiry > 0 {
+		u, err := b.bucket.SignURL(key, oss.HTTPGet, int64(b.signedURLExpiry/time.Second))
+		if err != nil {
+			errorf(r.Context(), "signing URL of %q: %v", key, err)
+			writeErr(w, http.StatusInternalServerError, unknownErrorCode, "signing URL failed")
+			return
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(b.signedURLExpiry/2/time.Second)))
+		http.Redirect(w, r, u, http.StatusSeeOther)
+		return
+	}
+	url := fmt.Sprintf("%s://%s.%s/%s", b.scheme, b.bucketName, b.endpoint, key)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
@@ -0,0 +1,123 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Sections of the registry API a RequestPath can be for.
+const (
+	SectionVersion   = ""
+	SectionCatalog   = "_catalog"
+	SectionTags      = "tags/list"
+	SectionReferrers = "referrers"
+	SectionBlobs     = "blobs"
+	SectionUploads   = "blobs/uploads"
+	SectionManifests = "manifests"
+)
+
+// RequestPath is the path of a /v2/ API request, split into the repository
+// it names and what it requests of it. It's split once, by ParseRequestPath,
+// and carried in the request's context by WithRequestPath, so that the
+// authorizers, middleware and handlers a request passes through all agree on
+// what it's for.
+type RequestPath struct {
+	// Section is which API the request is for, one of the Section
+	// constants.
+	Section string
+
+	// Repo is the repository, for every section but the version check and
+	// the catalog.
+	Repo string
+
+	// Reference is the tag or digest of a manifest, the digest of a blob or
+	// a referrers request, or the session ID of an upload, if it's for a
+	// session that's been started. Tags may have a compression suffix, as
+	// SplitTagCompression says.
+	Reference string
+}
+
+// ParseRequestPath splits the path of a /v2/ API request, reporting whether
+// it is one. The repository and reference aren't validated; api.Parse does
+// that.
+//
+// Repositories may have any number of path components; the last /blobs/,
+// /manifests/, /tags/list or /referrers/ in the path ends the repository.
+func ParseRequestPath(path string) (RequestPath, bool) {
+	if path == "/v2" || path == "/v2/" {
+		return RequestPath{Section: SectionVersion}, true
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		return RequestPath{}, false
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	if path == SectionCatalog {
+		return RequestPath{Section: SectionCatalog}, true
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads"); i >= 0 {
+		rest := path[i+len("/blobs/uploads"):]
+		if rest != "" && rest[0] != '/' {
+			return RequestPath{}, false
+		}
+		return RequestPath{Section: SectionUploads, Repo: path[:i], Reference: strings.Trim(rest, "/")}, true
+	}
+	for _, section := range []string{SectionBlobs, SectionManifests, SectionReferrers} {
+		sep := "/" + section + "/"
+		if i := strings.LastIndex(path, sep); i >= 0 {
+			return RequestPath{Section: section, Repo: path[:i], Reference: path[i+len(sep):]}, true
+		}
+	}
+	if strings.HasSuffix(path, "/"+SectionTags) {
+		return RequestPath{Section: SectionTags, Repo: strings.TrimSuffix(path, "/"+SectionTags)}, true
+	}
+	return RequestPath{}, false
+}
+
+// Tag returns the tag of a request for a manifest by tag, or "".
+func (p RequestPath) Tag() string {
+	if p.Section != SectionManifests || !tagRE.MatchString(p.Reference) {
+		return ""
+	}
+	return p.Reference
+}
+
+// Digest returns the digest of a request for a blob, a manifest by digest or
+// referrers, reporting whether it's for one.
+func (p RequestPath) Digest() (v1.Hash, bool) {
+	switch p.Section {
+	case SectionBlobs, SectionManifests, SectionReferrers:
+		h, err := v1.NewHash(p.Reference)
+		return h, err == nil
+	}
+	return v1.Hash{}, false
+}
+
+type requestPathKey struct{}
+
+// WithRequestPath returns ctx carrying the request's parsed path, for the
+// handlers the request is passed to, such as by api.Router, which parses it
+// once as it routes the request.
+func WithRequestPath(ctx context.Context, p RequestPath) context.Context {
+	return context.WithValue(ctx, requestPathKey{}, p)
+}
+
+// contextRepo returns the repository of the request whose parsed path ctx
+// carries, or "" if it carries none, such as for images written outside of
+// a request for them.
+func contextRepo(ctx context.Context) string {
+	p, _ := ctx.Value(requestPathKey{}).(RequestPath)
+	return p.Repo
+}
+
+// requestPath returns the request's parsed path, from its context if it's
+// been parsed already, or else parsed from its URL, reporting whether it's
+// an API path.
+func requestPath(r *http.Request) (RequestPath, bool) {
+	if p, ok := r.Context().Value(requestPathKey{}).(RequestPath); ok {
+		return p, true
+	}
+	return ParseRequestPath(r.URL.Path)
+}
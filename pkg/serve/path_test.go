@@ -0,0 +1,44 @@
+package serve
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequestPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want RequestPath
+		ok   bool
+	}{
+		{"/v2/", RequestPath{Section: SectionVersion}, true},
+		{"/v2/_catalog", RequestPath{Section: SectionCatalog}, true},
+		{"/v2/a/b/tags/list", RequestPath{Section: SectionTags, Repo: "a/b"}, true},
+		{"/v2/a/manifests/latest", RequestPath{Section: SectionManifests, Repo: "a", Reference: "latest"}, true},
+		{"/v2/a/blobs/sha256:abc", RequestPath{Section: SectionBlobs, Repo: "a", Reference: "sha256:abc"}, true},
+		{"/v2/a/blobs/uploads/", RequestPath{Section: SectionUploads, Repo: "a"}, true},
+		{"/v2/a/blobs/uploads/id", RequestPath{Section: SectionUploads, Repo: "a", Reference: "id"}, true},
+		{"/v2/a/referrers/sha256:abc", RequestPath{Section: SectionReferrers, Repo: "a", Reference: "sha256:abc"}, true},
+		// The last section in the path ends the repository, whichever
+		// it is.
+		{"/v2/a/manifests/b/blobs/sha256:abc", RequestPath{Section: SectionBlobs, Repo: "a/manifests/b", Reference: "sha256:abc"}, true},
+		{"/v2/a/blobs/uploadsx", RequestPath{}, false},
+		{"/v2/a", RequestPath{}, false},
+		{"/other", RequestPath{}, false},
+	} {
+		got, ok := ParseRequestPath(tc.path)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("ParseRequestPath(%q) = %+v, %t; want %+v, %t", tc.path, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRequestPathFromContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v2/a/manifests/latest", nil)
+	want := RequestPath{Section: SectionManifests, Repo: "parsed", Reference: "v1"}
+	r = r.WithContext(WithRequestPath(context.Background(), want))
+	if got, ok := requestPath(r); got != want || !ok {
+		t.Errorf("requestPath = %+v, %t; want %+v from the context", got, ok, want)
+	}
+}
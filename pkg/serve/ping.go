@@ -0,0 +1,80 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// pingKey is the key of the object probed by backends that can't check
+// their bucket directly. It needn't exist.
+const pingKey = "health/ping"
+
+// pinger is implemented by backends that can cheaply check that their bucket
+// is reachable with their credentials.
+type pinger interface {
+	Ping() error
+}
+
+// ping checks that the backend's bucket is reachable with its credentials,
+// probing for an object if the backend can't check the bucket directly.
+func ping(b Backend) error {
+	if p, ok := b.(pinger); ok {
+		return p.Ping()
+	}
+	_, err := b.Exists(pingKey)
+	return err
+}
+
+func (b *retryBackend) Ping() error {
+	return b.do(func() error { return ping(b.Backend) })
+}
+
+// Ping lists at most one object, which fails if the bucket doesn't exist or
+// the credentials are invalid, unlike a HEAD of a missing object, whose 404
+// doesn't say whether it's the object or the bucket that's missing. The SDK
+// has no HeadBucket.
+func (b *ossBackend) Ping() error {
+	_, err := b.bucket.ListObjects(oss.MaxKeys(1))
+	return err
+}
+
+// Ping lists at most one object, like the OSS backend's, since a HEAD of a
+// missing object doesn't say whether the bucket exists.
+func (b *s3Backend) Ping() error {
+	req, err := b.newRequest(http.MethodGet, "", url.Values{"list-type": {"2"}, "max-keys": {"1"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Ping lists at most one object, like the S3 backend's.
+func (b *gcsBackend) Ping() error {
+	req, err := b.newRequest(http.MethodGet, "", url.Values{"list-type": {"2"}, "max-keys": {"1"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Ping checks that the storage's bucket is reachable and its credentials are
+// valid, within the operation timeout, for readiness checks.
+func (s *Storage) Ping(ctx context.Context) error {
+	err := s.withTimeout(ctx, func(ctx context.Context) error { return ping(withContext(ctx, s.objects)) })
+	if err != nil {
+		return fmt.Errorf("storage unreachable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package serve
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// roundTripFunc is an http.RoundTripper that calls itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestPingListsOneObject(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusForbidden} {
+		var queries []string
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			queries = append(queries, r.Method+" "+r.URL.RawQuery)
+			return &http.Response{
+				StatusCode: status,
+				Body:       ioutil.NopCloser(strings.NewReader("<ListBucketResult></ListBucketResult>")),
+				Header:     http.Header{},
+			}, nil
+		})}
+		for _, b := range []Backend{
+			&s3Backend{client: client, scheme: "https", endpoint: "s3.example.com", bucket: "bucket", region: defaultRegion},
+			&gcsBackend{client: client, scheme: "https", endpoint: "storage.example.com", bucket: "bucket"},
+		} {
+			queries = nil
+			err := ping(b)
+			if (err == nil) != (status == http.StatusOK) {
+				t.Errorf("%T: ping with status %d = %v", b, status, err)
+			}
+			if want := []string{"GET list-type=2&max-keys=1"}; !equalStrings(queries, want) {
+				t.Errorf("%T: requests %v, want %v", b, queries, want)
+			}
+		}
+	}
+}
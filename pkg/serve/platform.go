@@ -0,0 +1,51 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ServeImageForPlatform writes the image in the index for the given platform
+// like ServeManifest, and redirects to its manifest rather than the index's,
+// so that clients don't have to fetch the index to pick their image. The
+// index itself isn't written.
+//
+// An image matches if its OS and architecture are the platform's, and so are
+// its variant and OS version, if the platform has them. It returns an error
+// wrapping ErrPlatformNotFound if no image matches.
+func (s *Storage) ServeImageForPlatform(w http.ResponseWriter, r *http.Request, idx v1.ImageIndex, platform v1.Platform, also ...string) error {
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, m := range im.Manifests {
+		if !m.MediaType.IsImage() || m.Platform == nil || !platformMatches(platform, *m.Platform) {
+			continue
+		}
+		img, err := idx.Image(m.Digest)
+		if err != nil {
+			return err
+		}
+		return s.ServeManifest(w, r, img, also...)
+	}
+	return fmt.Errorf("%w: %s", ErrPlatformNotFound, platformString(platform))
+}
+
+// platformMatches reports whether got satisfies want.
+func platformMatches(want, got v1.Platform) bool {
+	return want.OS == got.OS &&
+		want.Architecture == got.Architecture &&
+		(want.Variant == "" || want.Variant == got.Variant) &&
+		(want.OSVersion == "" || want.OSVersion == got.OSVersion)
+}
+
+// platformString returns the platform as os/arch[/variant].
+func platformString(p v1.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeGetter is implemented by backends that can read part of an object.
+type rangeGetter interface {
+	// GetRange returns length bytes of the object's contents, starting at
+	// offset.
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// getRange returns length bytes of the object's contents starting at offset,
+// reading and discarding the start of the object if the backend can't read
+// part of it.
+func getRange(b Backend, key string, offset, length int64) (io.ReadCloser, error) {
+	if rg, ok := b.(rangeGetter); ok {
+		return rg.GetRange(key, offset, length)
+	}
+	rc, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, length), rc}, nil
+}
+
+// proxyBlobs reports whether the config has blobs streamed through the
+// service, rather than redirecting to them.
+func (c Config) proxyBlobs() (bool, error) {
+	switch c.BlobServing {
+	case "", "redirect":
+		return false, nil
+	case "proxy":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown blob serving mode (BLOB_SERVING) %q, must be redirect or proxy", c.BlobServing)
+}
+
+// serveObject responds with the object from the backend, streaming it
+// through the service if blobs are proxied and otherwise as the backend
+// serves it, usually with a redirect.
+func (s *Storage) serveObject(w http.ResponseWriter, r *http.Request, b Backend, key string) {
+	if s.proxyBlobs {
+		proxyObject(w, r, b, key)
+		return
+	}
+	b.Serve(w, r, key)
+}
+
+// proxyObject responds with the object's contents, read from the backend,
+// honoring Range and conditional request headers, so that clients needn't
+// follow a redirect to the bucket.
+func proxyObject(w http.ResponseWriter, r *http.Request, b Backend, key string) {
+	info, err := b.Stat(key)
+	if isNotFound(err) {
+		WriteError(w, fmt.Errorf("%w: %s", ErrBlobNotFound, key))
+		return
+	} else if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set(metaContentType, string(blobMediaType(info)))
+	if d := info.Meta[metaDockerContentDigest]; d != "" {
+		w.Header().Set(metaDockerContentDigest, d)
+		w.Header().Set("ETag", strconv.Quote(d))
+	}
+	or := &objectReader{b: b, key: key, size: info.Size, end: rangeEnd(r, info.Size)}
+	defer or.Close()
+	http.ServeContent(w, r, "", info.ModTime, or)
+}
+
+// objectReader reads an object for http.ServeContent, getting the range of
+// it that's read after each seek.
+type objectReader struct {
+	b         Backend
+	key       string
+	size, off int64
+	// end, if less than size, is where the range requested ends, so that
+	// reading it doesn't get the rest of the object.
+	end int64
+	rc  io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.rc == nil {
+		end := o.size
+		if o.off < o.end {
+			end = o.end
+		}
+		rc, err := getRange(o.b, o.key, o.off, end-o.off)
+		if err != nil {
+			return 0, err
+		}
+		o.rc = rc
+	}
+	n, err := o.rc.Read(p)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		// This range is done, but there's more of the object.
+		o.rc.Close()
+		o.rc, err = nil, nil
+	}
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+	if offset != o.off {
+		o.Close()
+		o.off = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.rc == nil {
+		return nil
+	}
+	err := o.rc.Close()
+	o.rc = nil
+	return err
+}
+
+// rangeEnd returns the end of the single byte range requested, or size if
+// the whole object, or several ranges, are requested.
+func rangeEnd(r *http.Request, size int64) int64 {
+	spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+	if spec == r.Header.Get("Range") || strings.Contains(spec, ",") {
+		return size
+	}
+	i := strings.Index(spec, "-")
+	if i <= 0 || i == len(spec)-1 {
+		// A suffix range, or one to the end of the object.
+		return size
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(spec[i+1:]), 10, 64)
+	if err != nil || last+1 > size {
+		return size
+	}
+	return last + 1
+}
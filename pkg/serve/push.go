@@ -0,0 +1,251 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// PushLayer writes the blob streamed from r, as received in the body of a
+// blob upload request, verifying that its contents match dgst and size.
+//
+// Blobs are content-addressed and shared across repositories, so repo is
+// only used for error reporting. If size is negative, it is not checked.
+func (s *Storage) PushLayer(ctx context.Context, repo string, dgst v1.Hash, r io.Reader, size int64) error {
+	if dgst.Algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %q", dgst.Algorithm)
+	}
+	// writeBlob verifies the digest as the blob is written.
+	cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(r)}
+	if err := s.writeBlob(ctx, dgst.String(), dgst, cr, string(defaultMediaType), nil); err != nil {
+		var merr *DigestMismatchError
+		if errors.As(err, &merr) {
+			return fmt.Errorf("%w: pushed %s to %s, got %s", ErrDigestMismatch, dgst, repo, merr.Actual)
+		}
+		return err
+	}
+
+	if size >= 0 && cr.n != size {
+		// writeBlob doesn't read blobs that already exist, so check the
+		// size of the one that's there, which is left in place.
+		if cr.n == 0 {
+			if info, err := s.objects.Stat(s.blobKey(dgst.String())); err == nil {
+				if info.Size == size {
+					return nil
+				}
+				return fmt.Errorf("%w: pushed %s to %s, existing blob is %d bytes, want %d", ErrSizeMismatch, dgst, repo, info.Size, size)
+			}
+		}
+		if err := s.deleteBlob(ctx, dgst.String()); err != nil {
+			return fmt.Errorf("deleting mismatched blob %s: %v", dgst, err)
+		}
+		return fmt.Errorf("%w: pushed %s to %s, got %d bytes, want %d", ErrSizeMismatch, dgst, repo, cr.n, size)
+	}
+	return nil
+}
+
+// pushable reports whether clients may push to the repository, because it's
+// one of the configured PushNamespaces, or nested under one.
+func (s *Storage) pushable(repo string) bool {
+	for _, ns := range s.config.PushNamespaces {
+		if repo == ns || strings.HasPrefix(repo, ns+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// pushedManifest is the part of a pushed manifest that's checked before it's
+// written.
+type pushedManifest struct {
+	MediaType   types.MediaType   `json:"mediaType"`
+	Config      *v1.Descriptor    `json:"config"`
+	Layers      []v1.Descriptor   `json:"layers"`
+	Manifests   []v1.Descriptor   `json:"manifests"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// PushManifest writes the manifest pushed to repo by ref, a tag or the
+// manifest's digest, and returns its digest. mediaType is the Content-Type
+// it was pushed with, or if that's empty, the media type in the manifest.
+//
+// Every blob and child manifest the manifest references must already have
+// been pushed, except foreign layers. Tags are recorded in the TagStore
+// rather than written as aliases, since aliases aren't scoped to a
+// repository.
+func (s *Storage) PushManifest(ctx context.Context, repo, ref string, mediaType types.MediaType, b []byte) (v1.Hash, error) {
+	if err := s.checkManifestSize(len(b)); err != nil {
+		return v1.Hash{}, err
+	}
+	digest, size, err := v1.SHA256(bytes.NewReader(b))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	var tag string
+	if h, err := v1.NewHash(ref); err == nil {
+		if h != digest {
+			return v1.Hash{}, fmt.Errorf("%w: pushed %s to %s, got %s", ErrDigestMismatch, h, repo, digest)
+		}
+	} else if tagRE.MatchString(ref) {
+		tag = ref
+	} else {
+		return v1.Hash{}, NewError(http.StatusBadRequest, transport.TagInvalidErrorCode, "invalid tag %q", ref)
+	}
+
+	var m pushedManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return v1.Hash{}, NewError(http.StatusBadRequest, transport.ManifestInvalidErrorCode, "parsing manifest: %v", err)
+	}
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	if mediaType == "" {
+		return v1.Hash{}, NewError(http.StatusBadRequest, transport.ManifestInvalidErrorCode, "manifest has no media type")
+	}
+	if err := s.checkPushedRefs(ctx, repo, m); err != nil {
+		return v1.Hash{}, err
+	}
+
+	desc := v1.Descriptor{MediaType: mediaType, Size: size, Digest: digest}
+	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mediaType), annotationMeta(m.Annotations)); err != nil {
+		return v1.Hash{}, err
+	}
+	if s.DryRun {
+		return digest, nil
+	}
+	if err := s.addReferrer(ctx, repo, desc, b); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := s.recordRepo(repo); err != nil {
+		return v1.Hash{}, err
+	}
+	if tag != "" {
+		if err := s.Tags().Record(repo, tag, digest); err != nil {
+			return v1.Hash{}, err
+		}
+		s.publish(TagUpdated, repo+":"+tag, digest, size)
+	}
+	return digest, nil
+}
+
+// checkPushedRefs returns an error if any blob or child manifest the pushed
+// manifest references hasn't been pushed.
+func (s *Storage) checkPushedRefs(ctx context.Context, repo string, m pushedManifest) error {
+	var names []string
+	descs := append(m.Layers, m.Manifests...)
+	if m.Config != nil {
+		descs = append(descs, *m.Config)
+	}
+	for _, d := range descs {
+		// Foreign layers are pulled from their URLs, not the registry.
+		if len(d.URLs) == 0 {
+			names = append(names, d.Digest.String())
+		}
+	}
+	found, err := s.BlobsExist(ctx, names...)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if _, ok := found[n]; !ok {
+			return NewError(http.StatusBadRequest, transport.ManifestBlobUnknownErrorCode, "manifest references %s, which hasn't been pushed to %s", n, repo)
+		}
+	}
+	return nil
+}
+
+// ServePush serves the push API of the OCI distribution spec, for
+// repositories in the configured PushNamespaces: blob uploads, which
+// ServeUpload serves, manifest PUTs, and GETs of the tags that have been
+// pushed or served. It reports whether it served the request; requests it
+// doesn't serve, such as for blobs, manifests by digest or tags it hasn't
+// recorded, are left to the caller.
+//
+// Pushes to other repositories are denied.
+func (s *Storage) ServePush(w http.ResponseWriter, r *http.Request) bool {
+	p, _ := requestPath(r)
+	repo := p.Repo
+	upload := p.Section == SectionUploads
+	manifest := p.Section == SectionManifests
+	write := upload || (manifest && r.Method != http.MethodGet && r.Method != http.MethodHead)
+	if repo == "" || !write && !manifest {
+		return false
+	}
+	if !s.pushable(repo) {
+		if !write {
+			return false
+		}
+		ctx := RequestContext(w, r)
+		s.setSecurityHeaders(w)
+		WriteError(w, withRequestIDErr(ctx, NewError(http.StatusForbidden, transport.DeniedErrorCode, "repository %q is read-only", repo)))
+		return true
+	}
+
+	switch {
+	case upload:
+		s.ServeUpload(w, r)
+	case r.Method == http.MethodPut:
+		s.servePushManifest(w, r, repo, p.Reference)
+	case write:
+		writeErr(w, http.StatusMethodNotAllowed, transport.UnsupportedErrorCode, fmt.Sprintf("unsupported method %s", r.Method))
+	default:
+		tag := p.Tag()
+		if tag == "" {
+			return false
+		}
+		ctx := RequestContext(w, r)
+		digest, err := s.Tags().Lookup(repo, tag)
+		if isNotFound(err) {
+			return false
+		} else if err != nil {
+			WriteError(w, withRequestIDErr(ctx, err))
+			return true
+		}
+		desc, err := s.BlobExists(ctx, digest.String())
+		if err != nil {
+			WriteError(w, withRequestIDErr(ctx, err))
+			return true
+		}
+		s.touchAsync(ctx, s.Tags().key(repo, tag))
+		s.setSecurityHeaders(w)
+		s.serveWrittenManifest(ctx, w, r, desc)
+	}
+	return true
+}
+
+// servePushManifest serves a manifest PUT to the repository.
+func (s *Storage) servePushManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	ctx := RequestContext(w, r)
+	s.setSecurityHeaders(w)
+	max := s.MaxManifestSize
+	if max <= 0 {
+		max = defaultMaxManifestSize
+	}
+	b, err := ioutil.ReadAll(&limitReader{r: r.Body, max: max})
+	if err != nil {
+		WriteError(w, withRequestIDErr(ctx, err))
+		return
+	}
+	mt := types.MediaType(r.Header.Get(metaContentType))
+	if i := strings.Index(string(mt), ";"); i >= 0 {
+		mt = types.MediaType(strings.TrimSpace(string(mt[:i])))
+	}
+	digest, err := s.PushManifest(ctx, repo, ref, mt, b)
+	if err != nil {
+		WriteError(w, withRequestIDErr(ctx, err))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repo, digest))
+	w.Header().Set(metaDockerContentDigest, digest.String())
+	w.WriteHeader(http.StatusCreated)
+}
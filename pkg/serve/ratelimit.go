@@ -0,0 +1,277 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	// defaultQuotaWindow is the period bytes quotas are counted over.
+	defaultQuotaWindow = 24 * time.Hour
+
+	// idleClientTimeout is how long a client's limits are remembered
+	// after its last request, once its bucket is full again and its quota
+	// window has passed.
+	idleClientTimeout = 10 * time.Minute
+)
+
+// Limits are the limits on each client, identified by the user it
+// authenticated as, or else by its address; see Limit.
+type Limits struct {
+	// Rate is how many requests per second each client may make, on
+	// average, and Burst how many it may make at once. Zero means no
+	// limit. Each address is limited the same way before its requests
+	// are authenticated; see LimitAddresses.
+	Rate  float64
+	Burst int
+
+	// Bytes is how many bytes of blobs, such as the layers of images
+	// built or mirrored for it, each client may have written to storage
+	// per Window. Zero means no limit.
+	Bytes  int64
+	Window time.Duration
+
+	// TrustForwardedFor takes the address of clients that don't
+	// authenticate from the X-Forwarded-For header, as Allowlist does.
+	TrustForwardedFor bool
+}
+
+// limiter tracks the requests and bytes written of each client.
+type limiter struct {
+	limits Limits
+
+	// addresses, if the limits have a rate, limits the requests from each
+	// address before they're authenticated; see LimitAddresses.
+	addresses *limiter
+
+	mu        sync.Mutex
+	clients   map[string]*clientUsage
+	lastSweep time.Time
+}
+
+type clientUsage struct {
+	// tokens is how many requests the client may make now, as of
+	// updated.
+	tokens  float64
+	updated time.Time
+
+	// written is how many bytes have been written for the client since
+	// windowStart.
+	written     int64
+	windowStart time.Time
+}
+
+func newLimiter(l Limits) *limiter {
+	if l.Burst <= 0 {
+		l.Burst = int(math.Max(1, math.Ceil(10*l.Rate)))
+	}
+	if l.Window <= 0 {
+		l.Window = defaultQuotaWindow
+	}
+	lim := &limiter{limits: l, clients: map[string]*clientUsage{}}
+	if l.Rate > 0 {
+		lim.addresses = &limiter{
+			limits:  Limits{Rate: l.Rate, Burst: l.Burst, Window: l.Window, TrustForwardedFor: l.TrustForwardedFor},
+			clients: map[string]*clientUsage{},
+		}
+	}
+	return lim
+}
+
+// WithLimits limits how fast each client may make requests, and how many
+// bytes may be written to storage for it; see Limit.
+func WithLimits(l Limits) Option {
+	return func(s *Storage) error {
+		if l.Rate < 0 || l.Burst < 0 || l.Bytes < 0 || l.Window < 0 {
+			return fmt.Errorf("invalid limits %+v", l)
+		}
+		s.limits = newLimiter(l)
+		return nil
+	}
+}
+
+// Limit wraps a registry handler so that clients that make requests faster
+// than the storage's limits allow, or have had more than their quota of
+// bytes written to storage within the quota window, get a 429 Too Many
+// Requests response with a Retry-After header saying when they may try
+// again; see WithLimits. Bytes are charged to the client whose request
+// writes them, as they're written, so a request is only refused once the
+// quota's been exceeded, and the build that exceeds it completes.
+func (s *Storage) Limit(next http.Handler) http.Handler {
+	if s.limits == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.limits.clientKey(r)
+		now := time.Now()
+		if wait, reason := s.limits.allow(key, now); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeErr(w, http.StatusTooManyRequests, transport.TooManyRequestsErrorCode, reason)
+			return
+		}
+		ctx := context.WithValue(r.Context(), quotaKey{}, func(n int64) { s.limits.charge(key, n) })
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// LimitAddresses wraps a handler so that each address may make requests no
+// faster than each client may with Limit, before they're authenticated, so
+// that clients can't guess passwords, or make the service check them, as
+// fast as they like. Requests over the limit get a 429 Too Many Requests
+// response with a Retry-After header, as with Limit. The registry API and
+// the token service are both limited; see api.Router and TokenHandler.
+func (s *Storage) LimitAddresses(next http.Handler) http.Handler {
+	if s.limits == nil || s.limits.addresses == nil {
+		return next
+	}
+	l := s.limits.addresses
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "addr:" + r.RemoteAddr
+		if ip := clientIP(r, l.limits.TrustForwardedFor); ip != nil {
+			key = "ip:" + ip.String()
+		}
+		if wait, reason := l.allow(key, time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeErr(w, http.StatusTooManyRequests, transport.TooManyRequestsErrorCode, reason)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client that made the request: the user it
+// authenticated as, or else its address.
+func (l *limiter) clientKey(r *http.Request) string {
+	if user := authenticatedUser(r.Context()); user != "" {
+		return "user:" + user
+	}
+	if ip := clientIP(r, l.limits.TrustForwardedFor); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "addr:" + r.RemoteAddr
+}
+
+// allow reports how long the client must wait before making a request, and
+// why, or zero if it may make one now, which it's charged for.
+func (l *limiter) allow(key string, now time.Time) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientUsage{tokens: float64(l.limits.Burst), updated: now, windowStart: now}
+		l.clients[key] = c
+	}
+
+	if l.limits.Bytes > 0 {
+		if now.Sub(c.windowStart) >= l.limits.Window {
+			c.written, c.windowStart = 0, now
+		}
+		if c.written >= l.limits.Bytes {
+			return c.windowStart.Add(l.limits.Window).Sub(now), fmt.Sprintf("quota of %d bytes per %s exceeded", l.limits.Bytes, l.limits.Window)
+		}
+	}
+
+	if l.limits.Rate > 0 {
+		c.tokens = math.Min(float64(l.limits.Burst), c.tokens+now.Sub(c.updated).Seconds()*l.limits.Rate)
+		c.updated = now
+		if c.tokens < 1 {
+			wait := time.Duration((1 - c.tokens) / l.limits.Rate * float64(time.Second))
+			return wait, fmt.Sprintf("rate limit of %g requests per second exceeded", l.limits.Rate)
+		}
+		c.tokens--
+	}
+	return 0, ""
+}
+
+// charge counts n bytes written for the client against its quota.
+func (l *limiter) charge(key string, n int64) {
+	if l.limits.Bytes == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.clients[key]; ok {
+		c.written += n
+	}
+}
+
+// sweep forgets clients that have been idle long enough that forgetting them
+// doesn't loosen their limits, at most once per idleClientTimeout.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleClientTimeout {
+		return
+	}
+	l.lastSweep = now
+	for k, c := range l.clients {
+		idle := now.Sub(c.updated)
+		if idle >= idleClientTimeout && (l.limits.Bytes == 0 || now.Sub(c.windowStart) >= l.limits.Window) {
+			delete(l.clients, k)
+		}
+	}
+}
+
+type quotaKey struct{}
+
+// chargeQuota counts n bytes written to storage against the quota of the
+// client whose request ctx is for, if it has one.
+func chargeQuota(ctx context.Context, n int64) {
+	if charge, ok := ctx.Value(quotaKey{}).(func(int64)); ok {
+		charge(n)
+	}
+}
+
+type userKey struct{}
+
+// withAuthenticatedUser returns ctx carrying the user the request
+// authenticated as, for limits.
+func withAuthenticatedUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// authenticatedUser returns the user the request ctx is for authenticated
+// as, if any.
+func authenticatedUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// limits returns the limits the config sets, or nil if it sets none.
+func (c Config) limits() (*limiter, error) {
+	if c.RateLimit == "" && c.BytesQuota == "" {
+		return nil, nil
+	}
+	var l Limits
+	var err error
+	if c.RateLimit != "" {
+		if l.Rate, err = strconv.ParseFloat(c.RateLimit, 64); err != nil || l.Rate < 0 {
+			return nil, fmt.Errorf("invalid rate limit (RATE_LIMIT) %q, must be a number of requests per second", c.RateLimit)
+		}
+	}
+	if c.RateBurst != "" {
+		if l.Burst, err = strconv.Atoi(c.RateBurst); err != nil || l.Burst < 0 {
+			return nil, fmt.Errorf("invalid rate burst (RATE_BURST) %q, must be a number of requests", c.RateBurst)
+		}
+	}
+	if c.BytesQuota != "" {
+		if l.Bytes, err = strconv.ParseInt(c.BytesQuota, 10, 64); err != nil || l.Bytes < 0 {
+			return nil, fmt.Errorf("invalid bytes quota (BYTES_QUOTA) %q, must be a number of bytes", c.BytesQuota)
+		}
+	}
+	if c.QuotaWindow != "" {
+		if l.Window, err = time.ParseDuration(c.QuotaWindow); err != nil || l.Window <= 0 {
+			return nil, fmt.Errorf("invalid quota window (QUOTA_WINDOW) %q, must be a positive duration", c.QuotaWindow)
+		}
+	}
+	if l.TrustForwardedFor, err = c.trustForwardedFor(); err != nil {
+		return nil, err
+	}
+	return newLimiter(l), nil
+}
@@ -0,0 +1,32 @@
+package serve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitAddressesBeforeAuth(t *testing.T) {
+	s := newTestStorage(t, Config{RateLimit: "0.001", RateBurst: "2"})
+	h := s.LimitAddresses(BasicAuth(map[string]string{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth("alice", "guess")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request %d = %d, want %d", i, rec.Code, want)
+		}
+	}
+
+	// Other addresses have their own limits.
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("request from another address = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
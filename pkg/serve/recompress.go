@@ -0,0 +1,397 @@
+package serve
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ociZstdLayer types.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// recompressedPrefix holds the digest each gzip layer was recompressed
+	// to, so that it isn't recompressed every time it's written, and
+	// recompressedChunkedPrefix the descriptor of the zstd:chunked blob it
+	// was recompressed to.
+	recompressedPrefix        = "recompressed/"
+	recompressedChunkedPrefix = "recompressed-chunked/"
+)
+
+// LayerCompression is how gzip layers of images are compressed as they're
+// written.
+type LayerCompression string
+
+const (
+	// CompressGzip writes layers as they are.
+	CompressGzip LayerCompression = "gzip"
+
+	// CompressZstd recompresses gzip layers with zstd.
+	CompressZstd LayerCompression = "zstd"
+
+	// CompressZstdChunked recompresses gzip layers with zstd, each file's
+	// contents in its own frame, and appends a table of contents, so that
+	// clients that support zstd:chunked, such as Podman and CRI-O, can pull
+	// only the files they don't already have. It's still a valid zstd
+	// stream for clients that don't.
+	CompressZstdChunked LayerCompression = "zstd:chunked"
+)
+
+// ParseLayerCompression parses gzip, zstd or zstd:chunked. The empty string
+// is gzip.
+func ParseLayerCompression(s string) (LayerCompression, error) {
+	switch c := LayerCompression(strings.ToLower(strings.TrimSpace(s))); c {
+	case "", CompressGzip:
+		return CompressGzip, nil
+	case CompressZstd, CompressZstdChunked:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown layer compression %q, must be gzip, zstd or zstd:chunked", s)
+}
+
+type layerCompressionKey struct{}
+
+// WithLayerCompression returns ctx making the images and indexes written
+// with it have their gzip layers compressed as given, rather than as the
+// Storage's LayerCompression says, for builders that let each request choose.
+func WithLayerCompression(ctx context.Context, c LayerCompression) context.Context {
+	return context.WithValue(ctx, layerCompressionKey{}, c)
+}
+
+// layerCompression returns how gzip layers written with ctx are compressed.
+func (s *Storage) layerCompression(ctx context.Context) LayerCompression {
+	if c, ok := ctx.Value(layerCompressionKey{}).(LayerCompression); ok && c != "" {
+		return c
+	}
+	if s.LayerCompression != "" {
+		return s.LayerCompression
+	}
+	if s.PreferZstd {
+		return CompressZstd
+	}
+	return CompressGzip
+}
+
+// tagCompressionSuffixes are the suffixes of tags that ask for their image
+// with its gzip layers compressed as given, since clients can't add a
+// compression query parameter to the manifest requests they make:
+// ubuntu:22.04__zstd is ubuntu:22.04 with its layers recompressed with zstd.
+var tagCompressionSuffixes = []struct {
+	suffix string
+	c      LayerCompression
+}{
+	{"__gzip", CompressGzip},
+	{"__zstd", CompressZstd},
+	{"__zstd-chunked", CompressZstdChunked},
+}
+
+// SplitTagCompression returns the tag without its compression suffix, and
+// the layer compression the suffix asks for, or the tag as it is and "" if
+// it has none.
+func SplitTagCompression(tag string) (string, LayerCompression) {
+	for _, tc := range tagCompressionSuffixes {
+		if t := strings.TrimSuffix(tag, tc.suffix); t != tag && t != "" {
+			return t, tc.c
+		}
+	}
+	return tag, ""
+}
+
+// RequestLayerCompression returns ctx with the layer compression the
+// request asks for, with a compression query parameter or the suffix of the
+// tag it's for, as SplitTagCompression says, or ctx as it is if it asks for
+// none. The query parameter is invalid if it isn't gzip, zstd or
+// zstd:chunked.
+func RequestLayerCompression(ctx context.Context, r *http.Request) (context.Context, error) {
+	v := r.URL.Query().Get("compression")
+	if v == "" {
+		p, _ := requestPath(r)
+		if _, c := SplitTagCompression(p.Tag()); c != "" {
+			return WithLayerCompression(ctx, c), nil
+		}
+		return ctx, nil
+	}
+	c, err := ParseLayerCompression(v)
+	if err != nil {
+		return ctx, NewError(http.StatusBadRequest, transport.UnsupportedErrorCode, "%v", err)
+	}
+	return WithLayerCompression(ctx, c), nil
+}
+
+// CacheKey returns the name that an image built for the key is written under
+// with ctx, for builders that check whether they've already written it with
+// BlobExists. Images with their layers as they are are written under the key
+// as it is, and those with recompressed layers under the key suffixed with
+// their compression, so that each compression has its own.
+func (s *Storage) CacheKey(ctx context.Context, key string) string {
+	c := s.layerCompression(ctx)
+	if s.StoreUncompressed || c == CompressGzip {
+		return key
+	}
+	return key + "-" + strings.Replace(string(c), ":", "-", -1)
+}
+
+// recompressesToOCI reports whether images and indexes with the given media
+// type written with ctx are converted to OCI media types first, so that
+// their layers can be recompressed: Docker manifests have no zstd layer type,
+// so they are when recompressing. Requests that don't accept OCI manifests
+// are served the Docker manifest, with its layers as they are.
+func (s *Storage) recompressesToOCI(ctx context.Context, mt types.MediaType) bool {
+	if s.StoreUncompressed || s.layerCompression(ctx) == CompressGzip {
+		return false
+	}
+	_, ok := dockerToOCI[mt]
+	return ok
+}
+
+// ociImageForRecompression returns the image converted to OCI media types if
+// it's written with ctx recompressed, as recompressesToOCI says. Images
+// that can't be converted are returned as they are, to be written without
+// recompressing their layers.
+func (s *Storage) ociImageForRecompression(ctx context.Context, img v1.Image) (v1.Image, error) {
+	mt, err := img.MediaType()
+	if err != nil || !s.recompressesToOCI(ctx, mt) {
+		return img, err
+	}
+	oimg, err := convertImage(img, dockerToOCI)
+	if err != nil {
+		debugf(ctx, "not recompressing image: %v", err)
+		return img, nil
+	}
+	return oimg, nil
+}
+
+// ociIndexForRecompression is ociImageForRecompression for indexes.
+func (s *Storage) ociIndexForRecompression(ctx context.Context, idx v1.ImageIndex) (v1.ImageIndex, error) {
+	mt, err := idx.MediaType()
+	if err != nil || !s.recompressesToOCI(ctx, mt) {
+		return idx, err
+	}
+	oidx, err := convertIndex(idx, dockerToOCI)
+	if err != nil {
+		debugf(ctx, "not recompressing index: %v", err)
+		return idx, nil
+	}
+	return oidx, nil
+}
+
+// NewRecompressReader returns a reader of the contents of the gzip stream
+// recompressed with zstd, as they're read, without buffering them. Once the
+// returned reader has been read to the end, the digest and size of the zstd
+// stream are sent on the channels; if recompressing fails, the channels are
+// closed without a value.
+//
+// Closing the returned reader closes gzipRC.
+func NewRecompressReader(gzipRC io.ReadCloser) (zstdRC io.ReadCloser, newDigest <-chan v1.Hash, newSize <-chan int64, err error) {
+	rc, descc, err := recompressStream(gzipRC, CompressZstd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	digestc, sizec := make(chan v1.Hash, 1), make(chan int64, 1)
+	go func() {
+		defer close(digestc)
+		defer close(sizec)
+		if desc, ok := <-descc; ok {
+			digestc <- desc.Digest
+			sizec <- desc.Size
+		}
+	}()
+	return rc, digestc, sizec, nil
+}
+
+// recompressStream returns a reader of the contents of the gzip stream
+// recompressed with zstd, or zstd:chunked, as they're read. Once the
+// returned reader has been read to the end, the descriptor of the new stream
+// is sent on the channel, with the annotations its layer descriptor needs;
+// if recompressing fails, the channel is closed without a value.
+func recompressStream(gzipRC io.ReadCloser, c LayerCompression) (io.ReadCloser, <-chan v1.Descriptor, error) {
+	zr, err := gzip.NewReader(gzipRC)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading gzip stream: %v", err)
+	}
+	pr, pw := io.Pipe()
+	// A single encoder goroutine makes the output deterministic, so that
+	// the same layer is always recompressed to the same digest.
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	descc := make(chan v1.Descriptor, 1)
+	go func() {
+		defer close(descc)
+		h := sha256.New()
+		cw := &countingWriter{w: io.MultiWriter(pw, h)}
+		var anns map[string]string
+		var err error
+		if c == CompressZstdChunked {
+			anns, err = writeZstdChunked(cw, zr, enc)
+		} else {
+			enc.Reset(cw)
+			if _, err = io.Copy(enc, zr); err == nil {
+				err = enc.Close()
+			}
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		// Send the result before the reader sees EOF, so that it's ready
+		// once it has.
+		descc <- v1.Descriptor{
+			MediaType:   ociZstdLayer,
+			Size:        cw.n,
+			Digest:      v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))},
+			Annotations: anns,
+		}
+		pw.Close()
+	}()
+	return &recompressReader{PipeReader: pr, rc: gzipRC}, descc, nil
+}
+
+type recompressReader struct {
+	*io.PipeReader
+	rc io.ReadCloser
+}
+
+func (r *recompressReader) Close() error {
+	r.PipeReader.Close()
+	return r.rc.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recompression returns how layers of the given media type in manifests of
+// the given media type written with ctx are recompressed. Only gzip layers
+// in OCI manifests are, since Docker manifests have no zstd layer type.
+func (s *Storage) recompression(ctx context.Context, manifestType, layerType types.MediaType) LayerCompression {
+	if manifestType != types.OCIManifestSchema1 || layerType != types.OCILayer {
+		return CompressGzip
+	}
+	return s.layerCompression(ctx)
+}
+
+// recompressedLayer returns the descriptor of the blob the gzip layer with
+// the given digest was recompressed to, or nil if it hasn't been, or that
+// blob no longer exists.
+func (s *Storage) recompressedLayer(ctx context.Context, digest v1.Hash, c LayerCompression) (*v1.Descriptor, error) {
+	prefix := recompressedPrefix
+	if c == CompressZstdChunked {
+		prefix = recompressedChunkedPrefix
+	}
+	rc, err := s.objects.Get(s.metaKey(prefix) + digest.String())
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var rec v1.Descriptor
+	if c == CompressZstdChunked {
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("recompressed layer of %s has invalid record: %v", digest, err)
+		}
+	} else if rec.Digest, err = v1.NewHash(strings.TrimSpace(string(b))); err != nil {
+		return nil, fmt.Errorf("recompressed layer of %s has invalid digest %q: %v", digest, b, err)
+	}
+	desc, err := s.BlobExists(ctx, rec.Digest.String())
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	desc.MediaType = ociZstdLayer
+	desc.Annotations = rec.Annotations
+	return &desc, nil
+}
+
+// writeZstdLayer writes the gzip layer recompressed with zstd, or
+// zstd:chunked, and returns the descriptor of the blob that was written.
+//
+// The new digest isn't known until the layer has been recompressed, so it's
+// written to a temporary upload object, then moved to blobs/<digest>.
+func (s *Storage) writeZstdLayer(ctx context.Context, l v1.Layer, c LayerCompression) (*v1.Descriptor, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	zrc, descc, err := recompressStream(rc, c)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("recompressing layer %s: %v", digest, err)
+	}
+	id, err := newSessionID()
+	if err != nil {
+		zrc.Close()
+		return nil, err
+	}
+	key := s.uploadKey(id)
+	if !s.DryRun {
+		// The temporary object is deleted however the write ends, so
+		// that a failed write doesn't leave it behind.
+		defer func() {
+			if err := s.objects.Delete(key); err != nil {
+				warnf(ctx, "deleting recompressed upload %q: %v", key, err)
+			}
+		}()
+	}
+	if err := s.putBlob(ctx, key, key, zrc, string(ociZstdLayer), nil); err != nil {
+		return nil, fmt.Errorf("recompressing layer %s: %v", digest, err)
+	}
+	desc, ok := <-descc
+	if !ok {
+		return nil, fmt.Errorf("recompressing layer %s: stream ended early", digest)
+	}
+	if s.DryRun {
+		return &desc, nil
+	}
+
+	mt := string(ociZstdLayer)
+	meta, err := s.blobMeta(desc.Digest, mt, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.objects.CopyWithMeta(key, s.blobKey(desc.Digest.String()), mt, meta); err != nil {
+		return nil, err
+	}
+	rec, prefix := desc.Digest.String(), recompressedPrefix
+	if c == CompressZstdChunked {
+		b, err := json.Marshal(v1.Descriptor{Digest: desc.Digest, Annotations: desc.Annotations})
+		if err != nil {
+			return nil, err
+		}
+		rec, prefix = string(b), recompressedChunkedPrefix
+	}
+	if err := s.objects.Put(s.metaKey(prefix)+digest.String(), strings.NewReader(rec), "text/plain; charset=utf-8", nil); err != nil {
+		warnf(ctx, "recording recompressed layer of %s: %v", digest, err)
+	}
+	return &desc, nil
+}
@@ -0,0 +1,79 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestRequestLayerCompression(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	for _, tc := range []struct {
+		path, key string
+	}{
+		{"/v2/app/manifests/latest", "ck"},
+		{"/v2/app/manifests/latest__gzip", "ck"},
+		{"/v2/app/manifests/latest__zstd", "ck-zstd"},
+		{"/v2/app/manifests/latest__zstd-chunked", "ck-zstd-chunked"},
+		{"/v2/app/manifests/latest__zstd?compression=gzip", "ck"},
+		{"/v2/app/manifests/latest?compression=zstd:chunked", "ck-zstd-chunked"},
+		{"/v2/app/manifests/__zstd", "ck"},
+	} {
+		ctx, err := RequestLayerCompression(context.Background(), httptest.NewRequest("GET", tc.path, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if got := s.CacheKey(ctx, "ck"); got != tc.key {
+			t.Errorf("%s: CacheKey = %q, want %q", tc.path, got, tc.key)
+		}
+	}
+	if _, err := RequestLayerCompression(context.Background(), httptest.NewRequest("GET", "/v2/app/manifests/latest?compression=lz4", nil)); err == nil {
+		t.Error("compression=lz4: want error")
+	}
+}
+
+func TestSplitTagCompression(t *testing.T) {
+	for tag, want := range map[string]string{
+		"latest":              "latest",
+		"22.04__zstd":         "22.04",
+		"22.04__zstd-chunked": "22.04",
+		"22.04__gzip":         "22.04",
+		"__zstd":              "__zstd",
+		"22.04_zstd":          "22.04_zstd",
+	} {
+		if got, _ := SplitTagCompression(tag); got != want {
+			t.Errorf("SplitTagCompression(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+// failingCopier is a Backend whose copies fail.
+type failingCopier struct{ Backend }
+
+func (failingCopier) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	return errors.New("copy failed")
+}
+
+func TestWriteZstdLayerDeletesUploadOnFailure(t *testing.T) {
+	b := failingCopier{newMemBackend()}
+	s := newTestStorage(t, Config{}, WithBackend(b))
+	l, err := random.Layer(1024, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.writeZstdLayer(context.Background(), l, CompressZstd); err == nil {
+		t.Fatal("writeZstdLayer: want error")
+	}
+	keys, err := b.List(s.metaKey(uploadsPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("temporary objects %v were left behind", keys)
+	}
+}
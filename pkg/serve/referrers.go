@@ -0,0 +1,266 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	referrersPrefix = "referrers/"
+
+	// cosignSignatureType is the artifact type of cosign signatures, and
+	// cosignSimpleSigningType the media type of their payloads.
+	cosignSignatureType     = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignSimpleSigningType = "application/vnd.dev.cosign.simplesigning.v1+json"
+)
+
+// referrersKey returns the key of the referrers index of the manifest with
+// the subject digest in the repository. Indexes are per repository, so that
+// artifacts pushed to one repository aren't listed as referrers in others
+// that serve the same manifest.
+func (s *Storage) referrersKey(repo string, subject v1.Hash) string {
+	return s.metaKey(referrersPrefix) + path.Join(repo, subject.String())
+}
+
+// signatureArtifactType returns the artifact type of a signature envelope of
+// the media type: cosign's for cosign's simple signing payloads, and
+// otherwise the envelope's own media type, as for DSSE envelopes.
+func signatureArtifactType(mediaType string) string {
+	if mediaType == cosignSimpleSigningType {
+		return cosignSignatureType
+	}
+	return mediaType
+}
+
+// referrer is a descriptor of an artifact referring to a manifest, as listed
+// in its referrers index. go-containerregistry's descriptor doesn't have an
+// artifact type yet.
+type referrer struct {
+	v1.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// WriteSignatureEnvelope writes the signature envelope, such as a cosign or
+// DSSE envelope of the given media type, as a blob, and adds it to the
+// referrers index of the manifest with the subject digest in the repository,
+// which must have been written. Its artifact type is derived from the media
+// type; see signatureArtifactType. It returns the digest of the envelope.
+//
+// Referrers indexes are appendable objects at referrers/<repo>/<digest>,
+// holding one JSON descriptor per line, so that signatures written at once
+// don't overwrite each other.
+func (s *Storage) WriteSignatureEnvelope(ctx context.Context, repo string, subjectDigest v1.Hash, envelope []byte, mediaType string) (v1.Hash, error) {
+	ctx = withRequestID(ctx)
+	if ok, err := s.ManifestExists(ctx, subjectDigest); err != nil {
+		return v1.Hash{}, err
+	} else if !ok {
+		return v1.Hash{}, fmt.Errorf("%w: %s", ErrBlobNotFound, subjectDigest)
+	}
+
+	digest, size, err := v1.SHA256(bytes.NewReader(envelope))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(envelope)), mediaType, nil); err != nil {
+		return v1.Hash{}, err
+	}
+	if s.DryRun {
+		return digest, nil
+	}
+
+	b, err := json.Marshal(referrer{
+		Descriptor: v1.Descriptor{
+			MediaType: types.MediaType(mediaType),
+			Size:      size,
+			Digest:    digest,
+		},
+		ArtifactType: signatureArtifactType(mediaType),
+	})
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := s.appendLine(s.referrersKey(repo, subjectDigest), string(b)); err != nil {
+		return v1.Hash{}, fmt.Errorf("adding referrer of %s: %v", subjectDigest, err)
+	}
+	return digest, nil
+}
+
+// ListSignatures returns the descriptors of the signature envelopes written
+// by WriteSignatureEnvelope referring to the manifest with the subject digest
+// in the repository, in the order they were written, or none if it has none.
+func (s *Storage) ListSignatures(ctx context.Context, repo string, subjectDigest v1.Hash) ([]v1.Descriptor, error) {
+	refs, err := s.referrers(ctx, s.referrersKey(repo, subjectDigest))
+	if err != nil {
+		return nil, err
+	}
+	var descs []v1.Descriptor
+	for _, r := range refs {
+		// Envelopes are the only referrers that aren't manifests.
+		if !isManifestType(r.MediaType) {
+			descs = append(descs, r.Descriptor)
+		}
+	}
+	return descs, nil
+}
+
+// referrersKeys returns the keys of the referrers indexes of every
+// repository, by the digest of the manifest they're of.
+func (s *Storage) referrersKeys() (map[string][]string, error) {
+	keys, err := s.objects.List(s.metaKey(referrersPrefix))
+	if err != nil {
+		return nil, err
+	}
+	byDigest := map[string][]string{}
+	for _, k := range keys {
+		d := path.Base(k)
+		byDigest[d] = append(byDigest[d], k)
+	}
+	return byDigest, nil
+}
+
+// referrers reads the referrers index with the key, omitting artifacts that
+// were added more than once.
+func (s *Storage) referrers(ctx context.Context, key string) ([]referrer, error) {
+	rc, err := s.objects.Get(key)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var refs []referrer
+	seen := map[v1.Hash]bool{}
+	sc := bufio.NewScanner(&ctxReader{ctx: ctx, r: rc})
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var r referrer
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("referrers index %s has invalid entry %q: %v", key, line, err)
+		}
+		if seen[r.Digest] {
+			continue
+		}
+		seen[r.Digest] = true
+		refs = append(refs, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// artifactManifest is the part of a manifest that says what it refers to.
+// go-containerregistry's manifests don't have subjects or artifact types yet.
+type artifactManifest struct {
+	ArtifactType string `json:"artifactType,omitempty"`
+	Config       struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+	Subject     *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// addReferrer adds the manifest that was written to the repository, with the
+// given descriptor and contents, to the referrers index of its subject, if it
+// has one and isn't already in it.
+func (s *Storage) addReferrer(ctx context.Context, repo string, desc v1.Descriptor, b []byte) error {
+	if s.DryRun {
+		return nil
+	}
+	var m artifactManifest
+	if err := json.Unmarshal(b, &m); err != nil || m.Subject == nil {
+		return nil
+	}
+	key := s.referrersKey(repo, m.Subject.Digest)
+	refs, err := s.referrers(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r.Digest == desc.Digest {
+			return nil
+		}
+	}
+
+	// Image manifests without an artifact type have their config's media
+	// type as their artifact type.
+	artifactType := m.ArtifactType
+	if artifactType == "" {
+		artifactType = m.Config.MediaType
+	}
+	desc.Annotations = m.Annotations
+	line, err := json.Marshal(referrer{Descriptor: desc, ArtifactType: artifactType})
+	if err != nil {
+		return err
+	}
+	if err := s.appendLine(key, string(line)); err != nil {
+		return fmt.Errorf("adding referrer of %s: %v", m.Subject.Digest, err)
+	}
+	return nil
+}
+
+// referrersIndex is the response of the referrers API.
+type referrersIndex struct {
+	SchemaVersion int64           `json:"schemaVersion"`
+	MediaType     types.MediaType `json:"mediaType"`
+	Manifests     []referrer      `json:"manifests"`
+}
+
+// ServeReferrers serves the referrers API for requests to
+// /v2/<name>/referrers/<digest>, as an index of the descriptors of the
+// signatures and artifacts referring to the manifest with the digest that
+// were written to the repository. The artifactType parameter filters them by
+// artifact type.
+//
+// Manifests that don't exist have no referrers, rather than being an error,
+// as the OCI distribution spec requires.
+func (s *Storage) ServeReferrers(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(w, r)
+	p, _ := requestPath(r)
+	if p.Section != SectionReferrers {
+		WriteError(w, withRequestIDErr(ctx, fmt.Errorf("%w: %s", ErrNameInvalid, r.URL.Path)))
+		return
+	}
+	digest, err := v1.NewHash(p.Reference)
+	if err != nil {
+		WriteError(w, NewError(http.StatusBadRequest, transport.DigestInvalidErrorCode, "invalid digest: %v", err))
+		return
+	}
+	refs, err := s.referrers(ctx, s.referrersKey(p.Repo, digest))
+	if err != nil {
+		WriteError(w, withRequestIDErr(ctx, err))
+		return
+	}
+
+	manifests := make([]referrer, 0, len(refs))
+	artifactType := r.URL.Query().Get("artifactType")
+	for _, ref := range refs {
+		if artifactType == "" || ref.ArtifactType == artifactType {
+			manifests = append(manifests, ref)
+		}
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set(metaContentType, string(types.OCIImageIndex))
+	json.NewEncoder(w).Encode(&referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     manifests,
+	})
+}
@@ -0,0 +1,77 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const dsseEnvelopeType = "application/vnd.dsse.envelope.v1+json"
+
+func TestReferrersScopedByRepo(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	ctx := context.Background()
+	img, err := random.Image(100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteImage(ctx, img); err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+	subject, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := s.WriteSignatureEnvelope(ctx, "signed", subject, []byte(`{"payload":""}`), dsseEnvelopeType)
+	if err != nil {
+		t.Fatalf("WriteSignatureEnvelope: %v", err)
+	}
+	artifact := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"artifactType":"application/spdx+json","config":{"mediaType":"application/vnd.oci.empty.v1+json"},"subject":{"mediaType":%q,"digest":%q,"size":1}}`,
+		types.OCIManifestSchema1, types.OCIManifestSchema1, subject))
+	sbom := v1.Hash{Algorithm: "sha256", Hex: "1111111111111111111111111111111111111111111111111111111111111111"}
+	if err := s.addReferrer(ctx, "signed", v1.Descriptor{MediaType: types.OCIManifestSchema1, Size: int64(len(artifact)), Digest: sbom}, artifact); err != nil {
+		t.Fatalf("addReferrer: %v", err)
+	}
+
+	if sigs, err := s.ListSignatures(ctx, "signed", subject); err != nil || len(sigs) != 1 || sigs[0].Digest != sig {
+		t.Errorf("ListSignatures(signed) = %v, %v, want only %s", sigs, err, sig)
+	}
+	if sigs, err := s.ListSignatures(ctx, "other", subject); err != nil || len(sigs) != 0 {
+		t.Errorf("ListSignatures(other) = %v, %v, want none", sigs, err)
+	}
+
+	for repo, want := range map[string]map[v1.Hash]string{
+		"signed": {sig: dsseEnvelopeType, sbom: "application/spdx+json"},
+		"other":  {},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeReferrers(w, httptest.NewRequest("GET", "/v2/"+repo+"/referrers/"+subject.String(), nil))
+		var idx referrersIndex
+		if err := json.NewDecoder(w.Body).Decode(&idx); err != nil {
+			t.Fatalf("decoding referrers of %s: %v", repo, err)
+		}
+		got := map[v1.Hash]string{}
+		for _, m := range idx.Manifests {
+			got[m.Digest] = m.ArtifactType
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("referrers in %s = %v, want %v", repo, got, want)
+		}
+	}
+
+	// Referrers in any repository are kept with their subject.
+	referenced, err := s.referencedBlobs(ctx, []string{subject.String()})
+	if err != nil {
+		t.Fatalf("referencedBlobs: %v", err)
+	}
+	if !referenced[sig.String()] {
+		t.Errorf("signature %s isn't kept with its subject", sig)
+	}
+}
@@ -0,0 +1,85 @@
+package serve
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+const headerRequestID = "X-Request-ID"
+
+// requestIDRE matches the client-supplied request IDs that are kept: up to
+// 128 letters, digits, and the punctuation of UUIDs and trace IDs. Others
+// are replaced, since the ID is echoed in responses and written to logs.
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying a request ID, generating one if ctx
+// doesn't already carry one, so that all operations for one push can be
+// correlated in logs.
+func withRequestID(ctx context.Context) context.Context {
+	if requestID(ctx) != "" {
+		return ctx
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, hex.EncodeToString(b))
+}
+
+type requestContextKey struct{}
+
+// RequestContext returns the request's context carrying the ID from its
+// X-Request-ID header, or a generated one if it has none or it's invalid,
+// and echoes the ID in the response.
+// Lines logged with the context, with LoggerFrom, carry the ID, and the
+// repository and reference the request is for. Handlers that log before
+// passing requests to the Storage should serve them with the context, so
+// that their lines and the Storage's share the ID; the Storage keeps the
+// context it's given if it's been returned by RequestContext already.
+func RequestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	ctx := r.Context()
+	if ctx.Value(requestContextKey{}) != nil {
+		w.Header().Set(headerRequestID, requestID(ctx))
+		return ctx
+	}
+	if id := r.Header.Get(headerRequestID); requestIDRE.MatchString(id) {
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+	}
+	ctx = withRequestID(ctx)
+	w.Header().Set(headerRequestID, requestID(ctx))
+	return context.WithValue(withRequestFields(ctx, r), requestContextKey{}, true)
+}
+
+// requestID returns the request ID carried by ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestError annotates an error with the ID of the request it occurred
+// during, so that errors reported to clients can be matched to the logs.
+type requestError struct {
+	id  string
+	err error
+}
+
+func (e *requestError) Error() string { return fmt.Sprintf("request %s: %v", e.id, e.err) }
+func (e *requestError) Unwrap() error { return e.err }
+
+// withRequestIDErr annotates err with the request ID carried by ctx, if any.
+func withRequestIDErr(ctx context.Context, err error) error {
+	id := requestID(ctx)
+	if err == nil || id == "" {
+		return err
+	}
+	if _, ok := err.(*requestError); ok {
+		return err
+	}
+	return &requestError{id: id, err: err}
+}
@@ -0,0 +1,42 @@
+package serve
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestContextValidatesID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		keep bool
+	}{
+		{"", false},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"trace:1.2_3", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"id\r\nSet-Cookie: x=y", false},
+		{"id with spaces", false},
+		{`{"level":"ERROR"}`, false},
+	} {
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.Header.Set(headerRequestID, tc.id)
+		rec := httptest.NewRecorder()
+		got := requestID(RequestContext(rec, r))
+		if got == "" {
+			t.Errorf("RequestContext(%q) has no request ID", tc.id)
+			continue
+		}
+		if kept := got == tc.id; kept != tc.keep {
+			t.Errorf("RequestContext(%q) has ID %q, kept %t, want %t", tc.id, got, kept, tc.keep)
+		}
+		if !requestIDRE.MatchString(got) {
+			t.Errorf("RequestContext(%q) has invalid ID %q", tc.id, got)
+		}
+		if h := rec.Header().Get(headerRequestID); h != got {
+			t.Errorf("RequestContext(%q) echoed %q, want %q", tc.id, h, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// RetagImage writes the aliases newTags for the already-written manifest
+// with the given digest, using server-side copies so no contents are
+// re-uploaded. It returns ErrBlobNotFound if the manifest doesn't exist.
+func (s *Storage) RetagImage(ctx context.Context, digest string, newTags ...string) error {
+	src := s.blobKey(digest)
+	if ok, err := s.objects.Exists(src); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, digest)
+	}
+
+	var g errgroup.Group
+	for _, t := range newTags {
+		t := t
+		g.Go(func() error {
+			// Copying preserves the manifest's content type and digest
+			// metadata.
+			if err := s.objects.Copy(src, s.blobKey(t)); err != nil {
+				return err
+			}
+			if h, err := v1.NewHash(digest); err == nil {
+				s.publish(TagUpdated, t, h, 0)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// CopyImage writes the aliases destAliases for the already-written manifest
+// srcDigest, as RetagImage does, after checking that every blob it
+// references, recursively, has been written. All blobs live under one prefix
+// of the same bucket, so each one's source and destination keys are
+// identical and no blob is copied; nothing is transferred over the network.
+func (s *Storage) CopyImage(ctx context.Context, srcDigest v1.Hash, destAliases []string) error {
+	if err := s.checkReferences(ctx, srcDigest); err != nil {
+		return err
+	}
+	return s.RetagImage(ctx, srcDigest.String(), destAliases...)
+}
+
+// checkReferences returns ErrBlobNotFound if the manifest with the given
+// digest, or any blob it references, recursively, hasn't been written.
+func (s *Storage) checkReferences(ctx context.Context, digest v1.Hash) error {
+	b, err := s.readBlob(ctx, digest.String())
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, digest)
+	} else if err != nil {
+		return err
+	}
+	blobs, children, err := manifestRefs(b)
+	if err != nil {
+		return fmt.Errorf("parsing manifest %s: %v", digest, err)
+	}
+	names := make([]string, len(blobs))
+	for i, h := range blobs {
+		names[i] = h.String()
+	}
+	found, err := s.BlobsExist(ctx, names...)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if _, ok := found[n]; !ok {
+			return fmt.Errorf("%w: %s, referenced by %s", ErrBlobNotFound, n, digest)
+		}
+	}
+	for _, c := range children {
+		if err := s.checkReferences(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
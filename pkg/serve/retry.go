@@ -0,0 +1,286 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+const (
+	// maxReplayBytes is how much of an object being written is kept in
+	// memory so that the write can be retried. Larger writes, which are
+	// streamed, aren't retried once they've read past it.
+	maxReplayBytes = 1 << 20
+)
+
+// RetryPolicy configures how failed storage operations are retried.
+type RetryPolicy struct {
+	// Attempts is how many times each operation is tried, including the
+	// first. One disables retries.
+	Attempts int
+
+	// Backoff is how long to wait before the first retry. Each retry after
+	// it waits twice as long as the last, up to MaxBackoff, with up to half
+	// of the wait added at random so that clients don't retry in step.
+	Backoff, MaxBackoff time.Duration
+
+	// Retryable reports whether an error is transient, so that the
+	// operation is worth retrying. The default is IsRetryable.
+	Retryable func(error) bool
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+// WithRetry sets how failed storage operations are retried. By default each
+// operation is tried up to 3 times, waiting 100ms and then 200ms between
+// attempts.
+//
+// Reads, copies and deletes are retried, including those of a Backend given
+// with WithBackend. Writes are retried if they fail within the first MiB,
+// which covers manifests and configs; larger writes can't be replayed once
+// they've streamed past it, though multipart uploads retry each part.
+// Appends aren't retried, since a failed append may still have been applied.
+func WithRetry(p RetryPolicy) Option {
+	return func(s *Storage) error {
+		if p.Attempts < 1 {
+			return fmt.Errorf("retry attempts must be at least 1, got %d", p.Attempts)
+		}
+		if p.Backoff < 0 || p.MaxBackoff < 0 {
+			return fmt.Errorf("negative retry backoff %s or %s", p.Backoff, p.MaxBackoff)
+		}
+		s.retry = &p
+		return nil
+	}
+}
+
+// IsRetryable reports whether err is a transient storage error: a 5xx or 429
+// response from the bucket, a timeout or a dropped connection.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var (
+		serr  oss.ServiceError
+		uerr  oss.UnexpectedStatusCodeError
+		s3err *s3Error
+		gerr  *gcsError
+		nerr  net.Error
+	)
+	switch {
+	case errors.As(err, &serr):
+		return retryableStatus(serr.StatusCode)
+	case errors.As(err, &uerr):
+		return retryableStatus(uerr.Got())
+	case errors.As(err, &s3err):
+		return retryableStatus(s3err.StatusCode)
+	case errors.As(err, &gerr):
+		return retryableStatus(gerr.StatusCode)
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// retryBackend retries its Backend's operations according to a RetryPolicy.
+type retryBackend struct {
+	Backend
+	policy RetryPolicy
+
+	// ctx, if set, is the context its Backend's operations are made with;
+	// they aren't retried once it's done.
+	ctx context.Context
+}
+
+func newRetryBackend(b Backend, p RetryPolicy) Backend {
+	if p.Attempts <= 1 {
+		return b
+	}
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+	return &retryBackend{Backend: b, policy: p}
+}
+
+// WithContext returns a copy of the backend retrying its Backend's
+// operations made with ctx, if it can make them with a context.
+func (b *retryBackend) WithContext(ctx context.Context) Backend {
+	return &retryBackend{Backend: withContext(ctx, b.Backend), policy: b.policy, ctx: ctx}
+}
+
+// do runs op until it succeeds, fails with an error that isn't retryable, or
+// has been tried as many times as the policy allows.
+func (b *retryBackend) do(op func() error) error {
+	backoff := b.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err != nil {
+			storageErrors.inc(1, storageErrorCode(err))
+		}
+		var perr permanentError
+		if errors.As(err, &perr) {
+			return perr.err
+		}
+		if err == nil || attempt == b.policy.Attempts || !b.policy.Retryable(err) || requestCtx(b.ctx).Err() != nil {
+			return err
+		}
+		wait := backoff
+		if wait > 0 {
+			wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > b.policy.MaxBackoff {
+			backoff = b.policy.MaxBackoff
+		}
+	}
+}
+
+// permanentError is returned by an operation given to retryBackend.do that
+// mustn't be retried, whatever its error.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (b *retryBackend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	return b.put(context.Background(), key, r, func(body io.Reader) error {
+		return b.Backend.Put(key, body, contentType, meta)
+	})
+}
+
+// PutContext is Put for a Backend that's a contextPutter, without retrying
+// once ctx is done.
+func (b *retryBackend) PutContext(ctx context.Context, key string, r io.Reader, contentType string, meta map[string]string) error {
+	p, ok := b.Backend.(contextPutter)
+	if !ok {
+		return b.Put(key, r, contentType, meta)
+	}
+	return b.put(ctx, key, r, func(body io.Reader) error {
+		return p.PutContext(ctx, key, body, contentType, meta)
+	})
+}
+
+// put runs put with the contents of r, retrying it with them replayed if
+// they're buffered.
+func (b *retryBackend) put(ctx context.Context, key string, r io.Reader, put func(io.Reader) error) error {
+	rr := &replayReader{r: r}
+	var last error
+	return b.do(func() error {
+		body := io.Reader(rr)
+		if last != nil {
+			if !rr.replayable() || ctx.Err() != nil {
+				return permanentError{last}
+			}
+			body = io.MultiReader(bytes.NewReader(rr.buf), rr)
+		}
+		last = put(body)
+		return last
+	})
+}
+
+func (b *retryBackend) Get(key string) (rc io.ReadCloser, err error) {
+	err = b.do(func() error {
+		rc, err = b.Backend.Get(key)
+		return err
+	})
+	return rc, err
+}
+
+func (b *retryBackend) GetRange(key string, offset, length int64) (rc io.ReadCloser, err error) {
+	err = b.do(func() error {
+		rc, err = getRange(b.Backend, key, offset, length)
+		return err
+	})
+	return rc, err
+}
+
+func (b *retryBackend) Stat(key string) (info ObjectInfo, err error) {
+	err = b.do(func() error {
+		info, err = b.Backend.Stat(key)
+		return err
+	})
+	return info, err
+}
+
+func (b *retryBackend) Exists(key string) (ok bool, err error) {
+	err = b.do(func() error {
+		ok, err = b.Backend.Exists(key)
+		return err
+	})
+	return ok, err
+}
+
+func (b *retryBackend) Copy(src, dst string) error {
+	return b.do(func() error { return b.Backend.Copy(src, dst) })
+}
+
+func (b *retryBackend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	return b.do(func() error { return b.Backend.CopyWithMeta(src, dst, contentType, meta) })
+}
+
+func (b *retryBackend) Delete(keys ...string) error {
+	return b.do(func() error { return b.Backend.Delete(keys...) })
+}
+
+func (b *retryBackend) DeleteBatch(keys []string) (deleted []string, err error) {
+	err = b.do(func() error {
+		deleted, err = b.Backend.DeleteBatch(keys)
+		return err
+	})
+	return deleted, err
+}
+
+func (b *retryBackend) List(prefix string) (keys []string, err error) {
+	err = b.do(func() error {
+		keys, err = b.Backend.List(prefix)
+		return err
+	})
+	return keys, err
+}
+
+// replayReader keeps what's read from r, up to maxReplayBytes, so that a
+// failed write can be retried from the start.
+type replayReader struct {
+	r   io.Reader
+	buf []byte
+	n   int64
+	// err is an error reading r itself, which retrying won't fix.
+	err error
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if rr.n <= maxReplayBytes {
+		rr.buf = append(rr.buf, p[:n]...)
+	} else {
+		rr.buf = nil
+	}
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// replayable reports whether everything read so far has been kept, and r
+// itself hasn't failed.
+func (rr *replayReader) replayable() bool {
+	return rr.n <= maxReplayBytes && rr.err == nil
+}
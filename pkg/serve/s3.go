@@ -0,0 +1,784 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion = "us-east-1"
+
+	// unsignedPayload is signed in place of the hash of request bodies, so
+	// that uploads don't have to be read twice.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	s3MetaPrefix = "X-Amz-Meta-"
+)
+
+// s3Backend stores objects in an Amazon S3 bucket, or one of another service
+// with an S3-compatible API, such as MinIO.
+//
+// It speaks the S3 REST API directly, signing requests with AWS Signature
+// Version 4.
+type s3Backend struct {
+	client                           *http.Client
+	scheme, endpoint, bucket, region string
+	accessID, accessKey              string
+	acl                              string
+
+	// ctx, if set, is the context requests are made with.
+	ctx context.Context
+}
+
+// s3Config identifies an S3 bucket and the credentials to access it with.
+type s3Config struct {
+	scheme, endpoint, bucket, region, accessID, accessKey string
+
+	// acl, if set, is the canned ACL of objects written to the bucket.
+	acl string
+
+	// connectTimeout and readWriteTimeout bound the client's connections.
+	connectTimeout, readWriteTimeout time.Duration
+}
+
+func newS3Backend(cfg s3Config) (*s3Backend, error) {
+	if cfg.bucket == "" {
+		return nil, fmt.Errorf("S3 bucket must be set")
+	}
+	if cfg.region == "" {
+		cfg.region = defaultRegion
+	}
+	if cfg.endpoint == "" {
+		cfg.endpoint = fmt.Sprintf("s3.%s.amazonaws.com", cfg.region)
+	}
+	return &s3Backend{
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: cfg.connectTimeout}).DialContext,
+			ResponseHeaderTimeout: cfg.readWriteTimeout,
+			MaxIdleConnsPerHost:   100,
+		}},
+		scheme:    cfg.scheme,
+		endpoint:  cfg.endpoint,
+		bucket:    cfg.bucket,
+		region:    cfg.region,
+		accessID:  cfg.accessID,
+		accessKey: cfg.accessKey,
+		acl:       cfg.acl,
+	}, nil
+}
+
+// s3Error is an error response from S3.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 returned %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// objectURL returns the URL of the object with the key, or of the bucket if
+// key is empty.
+func (b *s3Backend) objectURL(key string) *url.URL {
+	return &url.URL{
+		Scheme: b.scheme,
+		Host:   fmt.Sprintf("%s.%s", b.bucket, b.endpoint),
+		Path:   "/" + key,
+	}
+}
+
+// do signs and sends the request, and returns the response if it succeeded.
+// Missing objects are reported as ErrObjectNotFound.
+func (b *s3Backend) do(req *http.Request, key string) (*http.Response, error) {
+	b.sign(req, time.Now().UTC(), unsignedPayload)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	serr := &s3Error{StatusCode: resp.StatusCode}
+	if body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil && len(body) > 0 {
+		xml.Unmarshal(body, serr)
+	}
+	if serr.Code == "NoSuchKey" || (serr.StatusCode == http.StatusNotFound && req.Method == http.MethodHead) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return nil, serr
+}
+
+// sign signs the request with AWS Signature Version 4, with the hex SHA-256
+// of its body, or unsignedPayload, which do signs requests with so that their
+// bodies aren't signed.
+func (b *s3Backend) sign(req *http.Request, now time.Time, payloadHash string) {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host and every X-Amz-* header, along with those that
+	// describe the object.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" || lk == "if-match" || lk == "if-none-match" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, b.region)
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	signature := b.signature(date, stringToSign)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", b.accessID, scope, signedHeaders, signature))
+}
+
+// signature returns the hex signature of the string to sign, with the
+// signing key for the date.
+func (b *s3Backend) signature(date, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+b.accessKey), date)
+	for _, s := range []string{b.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// presignedURL returns a URL to GET the object, signed with AWS Signature
+// Version 4 in its query, valid for expiry from now.
+func (b *s3Backend) presignedURL(key string, now time.Time, expiry time.Duration) string {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, b.region)
+	u := b.objectURL(key)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {b.accessID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(expiry/time.Second), 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s3Escape(u.Path, false),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(q) + "&X-Amz-Signature=" + b.signature(date, stringToSign)
+	return u.String()
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query string as signed: sorted by key, with
+// keys and values escaped.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes s as S3 expects in signed requests: every byte other than
+// unreserved characters is percent-encoded, and slashes are too if
+// escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// newRequest returns a request to the bucket, for the object with the key if
+// it's set, with its path escaped as it's signed.
+func (b *s3Backend) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := b.objectURL(key)
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	return http.NewRequestWithContext(requestCtx(b.ctx), method, u.String(), body)
+}
+
+// WithContext returns a copy of the backend whose requests are made with ctx.
+func (b *s3Backend) WithContext(ctx context.Context) Backend {
+	c := *b
+	c.ctx = ctx
+	return &c
+}
+
+// setMetaHeaders sets the headers setting the object's content type and
+// metadata, and its ACL.
+func (b *s3Backend) setMetaHeaders(h http.Header, contentType string, meta map[string]string) {
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	for k, v := range meta {
+		h.Set(s3MetaPrefix+k, v)
+	}
+	b.setACLHeader(h)
+}
+
+func (b *s3Backend) setACLHeader(h http.Header) {
+	if b.acl != "" {
+		h.Set("X-Amz-Acl", b.acl)
+	}
+}
+
+func (b *s3Backend) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	return b.put(key, r, contentType, meta, nil)
+}
+
+// put writes the object, with the extra headers given, such as preconditions.
+//
+// S3 needs the length of uploads up front, so contents of unknown length are
+// spooled to a temporary file first.
+func (b *s3Backend) put(key string, r io.Reader, contentType string, meta map[string]string, extra http.Header) error {
+	body, size, cleanup, err := sizedBody(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	req, err := b.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType == "" {
+		contentType = string(defaultMediaType)
+	}
+	b.setMetaHeaders(req.Header, contentType, meta)
+	for k, v := range extra {
+		req.Header[k] = v
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// sizedBody returns a reader of r's contents whose size is known. The
+// cleanup function must be called once it's been read.
+func sizedBody(r io.Reader) (io.Reader, int64, func(), error) {
+	switch r := r.(type) {
+	case *bytes.Reader:
+		return r, int64(r.Len()), func() {}, nil
+	case *strings.Reader:
+		return r, int64(r.Len()), func() {}, nil
+	case *bytes.Buffer:
+		return r, int64(r.Len()), func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "s3-upload-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, n, cleanup, nil
+}
+
+func (b *s3Backend) Get(key string) (io.ReadCloser, error) {
+	req, err := b.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Backend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := b.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.do(req, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Backend) Stat(key string) (ObjectInfo, error) {
+	info, _, err := b.stat(key)
+	return info, err
+}
+
+// stat returns the object's info, along with its ETag.
+func (b *s3Backend) stat(key string) (ObjectInfo, string, error) {
+	req, err := b.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, "", err
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return ObjectInfo{}, "", err
+	}
+	resp.Body.Close()
+	h := resp.Header
+	info := ObjectInfo{
+		ContentType: h.Get("Content-Type"),
+		Meta:        map[string]string{},
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		info.Size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ObjectInfo{}, "", fmt.Errorf("object %q has invalid Content-Length %q: %v", key, v, err)
+		}
+	}
+	if v := h.Get("Last-Modified"); v != "" {
+		info.ModTime, _ = http.ParseTime(v)
+	}
+	for k, v := range h {
+		if strings.HasPrefix(k, s3MetaPrefix) && len(v) > 0 {
+			info.Meta[strings.TrimPrefix(k, s3MetaPrefix)] = v[0]
+		}
+	}
+	return info, h.Get("ETag"), nil
+}
+
+func (b *s3Backend) Exists(key string) (bool, error) {
+	_, err := b.Stat(key)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *s3Backend) Copy(src, dst string) error {
+	return b.copy(src, dst, func(h http.Header) { b.setACLHeader(h) })
+}
+
+func (b *s3Backend) CopyWithMeta(src, dst, contentType string, meta map[string]string) error {
+	return b.copy(src, dst, func(h http.Header) {
+		h.Set("X-Amz-Metadata-Directive", "REPLACE")
+		b.setMetaHeaders(h, contentType, meta)
+	})
+}
+
+// copy copies the object, with headers set by setHeaders.
+func (b *s3Backend) copy(src, dst string, setHeaders func(http.Header)) error {
+	req, err := b.newRequest(http.MethodPut, dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Copy-Source", s3Escape(fmt.Sprintf("/%s/%s", b.bucket, src), false))
+	setHeaders(req.Header)
+	resp, err := b.do(req, src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 can fail a copy after responding 200, with an error in the body.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		serr := &s3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(body, serr)
+		return serr
+	}
+	return nil
+}
+
+func (b *s3Backend) Delete(keys ...string) error {
+	switch len(keys) {
+	case 0:
+		return nil
+	case 1:
+		req, err := b.newRequest(http.MethodDelete, keys[0], nil, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := b.do(req, keys[0])
+		if isNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	_, err := b.deleteObjects(keys, true)
+	return err
+}
+
+func (b *s3Backend) DeleteBatch(keys []string) ([]string, error) {
+	return b.deleteObjects(keys, false)
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+}
+
+// deleteObjects deletes the objects in one request, and returns the keys of
+// those that were deleted, unless quiet is set.
+func (b *s3Backend) deleteObjects(keys []string, quiet bool) ([]string, error) {
+	dr := s3DeleteRequest{Quiet: quiet}
+	for _, k := range keys {
+		dr.Objects = append(dr.Objects, struct {
+			Key string `xml:"Key"`
+		}{k})
+	}
+	body, err := xml.Marshal(dr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := b.newRequest(http.MethodPost, "", url.Values{"delete": {""}}, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := b.do(req, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res s3DeleteResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("parsing delete response: %v", err)
+	}
+	deleted := make([]string, 0, len(res.Deleted))
+	for _, d := range res.Deleted {
+		deleted = append(deleted, d.Key)
+	}
+	return deleted, nil
+}
+
+// appendCopySize is the size from which objects are appended to by copying
+// them, rather than by rewriting them; it's S3's minimum part size, which
+// every part of a multipart upload but the last must have.
+const appendCopySize = 5 << 20
+
+// Append emulates appending, which S3 doesn't support. Objects of at least
+// appendCopySize bytes are appended to with a multipart upload of a copy of
+// the object, made within S3, and the contents appended, so that each append
+// only sends its own contents; smaller objects are rewritten with the
+// contents appended.
+//
+// Either way, the write is conditional on the object not having changed
+// since its size was read, so concurrent appends fail with ErrAppendPosition
+// as they do in OSS.
+func (b *s3Backend) Append(key string, r io.Reader, pos int64) (int64, error) {
+	if pos == 0 {
+		cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(r)}
+		err := b.put(key, cr, string(defaultMediaType), nil, http.Header{"If-None-Match": {"*"}})
+		if isPreconditionFailed(err) {
+			return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+		}
+		return cr.n, err
+	}
+
+	info, etag, err := b.stat(key)
+	if isNotFound(err) {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	} else if err != nil {
+		return 0, err
+	}
+	if info.Size != pos {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	if pos >= appendCopySize {
+		n, err := b.appendByCopy(key, r, info, etag)
+		if isPreconditionFailed(err) {
+			return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+		}
+		return pos + n, err
+	}
+	rc, err := b.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	cr := &countingReadCloser{ReadCloser: ioutil.NopCloser(io.MultiReader(rc, r))}
+	err = b.put(key, cr, info.ContentType, info.Meta, http.Header{"If-Match": {etag}})
+	if isPreconditionFailed(err) {
+		return 0, fmt.Errorf("%w: %s at %d", ErrAppendPosition, key, pos)
+	}
+	return cr.n, err
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CopyPartResult struct {
+	ETag string `xml:"ETag"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// appendByCopy appends the contents of r to the object, which has the info
+// and ETag given, with a multipart upload whose first part is copied from
+// the object and whose second is r's contents. Copying the part and
+// completing the upload are both conditional on the object's ETag, so that
+// an append that races with another fails. It returns the number of bytes
+// appended.
+func (b *s3Backend) appendByCopy(key string, r io.Reader, info ObjectInfo, etag string) (int64, error) {
+	body, size, cleanup, err := sizedBody(r)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	if size == 0 {
+		return 0, nil
+	}
+
+	var res s3InitiateResult
+	if err := b.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, func(h http.Header) {
+		b.setMetaHeaders(h, info.ContentType, info.Meta)
+	}, &res); err != nil {
+		return 0, err
+	}
+	uploadID := res.UploadID
+	err = func() error {
+		var copied s3CopyPartResult
+		if err := b.doXML(http.MethodPut, key, url.Values{"partNumber": {"1"}, "uploadId": {uploadID}}, nil, func(h http.Header) {
+			h.Set("X-Amz-Copy-Source", s3Escape(fmt.Sprintf("/%s/%s", b.bucket, key), false))
+			h.Set("X-Amz-Copy-Source-If-Match", etag)
+		}, &copied); err != nil {
+			return err
+		}
+
+		req, err := b.newRequest(http.MethodPut, key, url.Values{"partNumber": {"2"}, "uploadId": {uploadID}}, body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		resp, err := b.do(req, key)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		complete, err := xml.Marshal(s3CompleteRequest{Parts: []s3Part{
+			{PartNumber: 1, ETag: copied.ETag},
+			{PartNumber: 2, ETag: resp.Header.Get("ETag")},
+		}})
+		if err != nil {
+			return err
+		}
+		return b.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, complete, func(h http.Header) {
+			h.Set("Content-Type", "application/xml")
+			h.Set("If-Match", etag)
+		}, nil)
+	}()
+	if err != nil {
+		if aerr := b.abortUpload(key, uploadID); aerr != nil {
+			return 0, fmt.Errorf("%w (aborting multipart upload: %v)", err, aerr)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// doXML sends a request with the body given, and headers set by setHeaders,
+// then decodes the XML response into v, unless it's nil. Requests that S3
+// fails after responding 200, with an error in the body, fail too.
+func (b *s3Backend) doXML(method, key string, query url.Values, body []byte, setHeaders func(http.Header), v interface{}) error {
+	req, err := b.newRequest(method, key, query, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	setHeaders(req.Header)
+	resp, err := b.do(req, key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(rb, []byte("<Error>")) {
+		serr := &s3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(rb, serr)
+		return serr
+	}
+	if v == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(rb, v); err != nil {
+		return fmt.Errorf("parsing %s response: %v", method, err)
+	}
+	return nil
+}
+
+// abortUpload aborts the multipart upload, discarding its parts.
+func (b *s3Backend) abortUpload(key, uploadID string) error {
+	req, err := b.newRequest(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req, key)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func isPreconditionFailed(err error) bool {
+	var serr *s3Error
+	return errors.As(err, &serr) && serr.StatusCode == http.StatusPreconditionFailed
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *s3Backend) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := b.newRequest(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req, "")
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing list response: %v", err)
+		}
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Serve redirects to the object with a presigned URL, so that objects in
+// private buckets, the default, can be read. Presigned URLs expire, so they
+// may only be cached until then.
+func (b *s3Backend) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	u := b.presignedURL(key, time.Now().UTC(), signedURLExpiry)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(signedURLExpiry/2/time.Second)))
+	http.Redirect(w, r, u, http.StatusSeeOther)
+}
@@ -0,0 +1,35 @@
+package serve
+
+import "net/http"
+
+// SecurityHeaders are response headers set on every response served by a
+// Storage, such as to meet compliance requirements. Empty fields aren't set.
+type SecurityHeaders struct {
+	ContentSecurityPolicy   string
+	StrictTransportSecurity string
+	XFrameOptions           string
+	XContentTypeOptions     string
+}
+
+// WithSecurityHeaders sets the given headers on every manifest, blob and
+// upload response, including redirects.
+func WithSecurityHeaders(h SecurityHeaders) Option {
+	return func(s *Storage) error {
+		s.securityHeaders = h
+		return nil
+	}
+}
+
+// setSecurityHeaders sets the configured security headers on the response.
+func (s *Storage) setSecurityHeaders(w http.ResponseWriter) {
+	for k, v := range map[string]string{
+		"Content-Security-Policy":   s.securityHeaders.ContentSecurityPolicy,
+		"Strict-Transport-Security": s.securityHeaders.StrictTransportSecurity,
+		"X-Frame-Options":           s.securityHeaders.XFrameOptions,
+		"X-Content-Type-Options":    s.securityHeaders.XContentTypeOptions,
+	} {
+		if v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+}
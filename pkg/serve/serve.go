@@ -1,128 +1,1025 @@
 package serve
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"go.opencensus.io/trace"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
-var (
-	bucket    = os.Getenv("BUCKET")
-	endpoint  = os.Getenv("ENDPOINT")
-	accessID  = os.Getenv("ACCESS_KEY_ID")
-	accessKey = os.Getenv("ACCESS_KEY_SECRET")
+// blobStorage holds the *Storage most recently created by NewStorage, whose
+// blobs Blob serves.
+var blobStorage atomic.Value
+
+const (
+	defaultScheme     = "https"
+	defaultBlobPrefix = "blobs"
 )
 
 const (
 	metaContentLength       = "Content-Length"
 	metaContentType         = "Content-Type"
 	metaDockerContentDigest = "Docker-Content-Digest"
+	metaExpireAt            = "Expire-At"
+
+	headerDryRun = "X-Dry-Run"
+
+	defaultMediaType types.MediaType = "application/octet-stream"
 )
 
+// Blob redirects to the named blob, in the Storage most recently created by
+// NewStorage, or else in the bucket given by the environment. If that Storage
+// proxies blobs, the blob is streamed instead; see Config.BlobServing.
 func Blob(w http.ResponseWriter, r *http.Request, name string) {
-	url := fmt.Sprintf("https://%s.%s/blobs/%s", bucket, endpoint, name)
+	w = &cacheFoundWriter{ResponseWriter: w, cacheControl: fmt.Sprintf("max-age=%d, immutable", int64(defaultImmutableMaxAge/time.Second))}
+	if s, ok := blobStorage.Load().(*Storage); ok {
+		if r.Method == http.MethodGet && isManifestRequest(r) {
+			s.recordPullAsync(r.Context(), name)
+		}
+		if isDigestRequest(r) && s.serveStoredManifest(w, r, name) {
+			return
+		}
+		s.serveObject(w, r, s.objects, s.blobKey(name))
+		return
+	}
+	cfg := ConfigFromEnv().withDefaults()
+	sch := cfg.Scheme
+	if sch == "" {
+		sch = defaultScheme
+	}
+	url := fmt.Sprintf("%s://%s.%s/%s", sch, cfg.Bucket, cfg.Endpoint, prefixedKey(cfg.BlobPrefix, name))
 	http.Redirect(w, r, url, http.StatusSeeOther)
 }
 
 type Storage struct {
-	client *oss.Client
+	objects Backend
+
+	// config identifies where objects are stored; see WithConfig.
+	config Config
+
+	// blobPrefix is the prefix of the keys blobs are stored under; see
+	// WithBlobPrefix.
+	blobPrefix string
+
+	// replica, if set, serves reads in place of the primary bucket.
+	replica       Backend
+	replicaConfig *ossConfig
+
+	// clientOptions configure the OSS clients; see WithHTTPClient and
+	// WithMaxIdleConns.
+	clientOptions []oss.ClientOption
+
+	// connectTimeout and readWriteTimeout bound the OSS client's
+	// connections; see WithClientTimeouts.
+	connectTimeout, readWriteTimeout time.Duration
+
+	// scheme is used to connect to OSS and in redirects to blobs; see
+	// WithScheme.
+	scheme string
+
+	securityHeaders SecurityHeaders
+
+	// repos holds the repositories already recorded in the catalog, so
+	// that each is only checked for once; see ServeCatalog.
+	repos sync.Map
+
+	// objectACL, if set, is the ACL of written objects; see WithObjectACL.
+	objectACL oss.ACLType
+
+	// callback, if set, is requested of OSS when writing blobs; see
+	// WithOSSCallback.
+	callback *ossCallback
+
+	// multipart, if set, makes OSS uploads of large blobs be written in
+	// parts; see WithMultipartUpload.
+	multipart *multipartConfig
+
+	// cacheMaxAges, if set, overrides how long responses may be cached;
+	// see WithCacheControl.
+	cacheMaxAges *cacheMaxAges
+
+	// opTimeout bounds each storage operation; see WithOperationTimeout.
+	opTimeout time.Duration
+
+	// retry is how failed storage operations are retried; see WithRetry.
+	retry *RetryPolicy
+
+	// proxyBlobs streams blobs through the service instead of redirecting
+	// to them; see Config.BlobServing.
+	proxyBlobs bool
+
+	// negative remembers failed upstream lookups; see WithNegativeCache.
+	negative *negativeCache
+
+	// manifests caches manifests that have been read; see
+	// WithManifestCache.
+	manifests *manifestCache
+
+	// writes and builds deduplicate concurrent writes of the same image
+	// or index, and builds of the same image; see writeOnce and BuildOnce.
+	writes, builds singleflight.Group
+
+	// cacheTTL, if set, is how long images may go unpulled before
+	// CollectGarbage purges them; see Config.CacheTTL.
+	cacheTTL time.Duration
+
+	// signedURLExpiry, if set, makes redirects to blobs in OSS go to
+	// signed URLs; see WithSignedURLs.
+	signedURLExpiry time.Duration
+
+	// auth, if set, authorizes registry requests, and tokens, if set,
+	// issues the tokens it accepts; see WithAuth and Config.AuthTokenKey.
+	auth   *authConfig
+	tokens *TokenIssuer
+
+	// access, if set, is the allowlist and users registry requests are
+	// checked against first; see Config.AllowCIDRs and Config.AuthHtpasswd.
+	access *accessConfig
+
+	// limits, if set, limits each client's requests and the bytes written
+	// for it; see WithLimits.
+	limits *limiter
+
+	// MaxBlobSize and MaxManifestSize limit the size of blobs and manifests
+	// that may be written, in bytes. Zero means no limit.
+	MaxBlobSize, MaxManifestSize int64
+
+	// InlineSmallManifests, if set, makes ServeManifest and ServeIndex
+	// respond to GET requests with the manifest itself, rather than a
+	// redirect to it, if it's no larger than this many bytes. This saves a
+	// round trip for clients, and helps those that don't follow redirects.
+	InlineSmallManifests int64
+
+	// InlineManifests makes manifest GET requests always respond with the
+	// manifest itself, for clients that refuse redirects on the manifests
+	// endpoint. This includes manifests requested by tag with
+	// ServeManifestByTag, and by digest with Blob or ServeBlob.
+	InlineManifests bool
+
+	// MaxConcurrentUploads limits how many layers are uploaded at once,
+	// across all images being written, including every image in an index.
+	// Zero means no limit. It must be set before anything is written.
+	MaxConcurrentUploads int
+	uploadsOnce          sync.Once
+	uploads              *semaphore.Weighted
+
+	// MaxConcurrentImages limits how many images of an index are written
+	// at once, so that a large multi-arch index doesn't open connections
+	// for every image's config and manifest in parallel. Zero means no
+	// limit.
+	MaxConcurrentImages int
+
+	// UploadBufferSize is the size of the buffer blob contents are read
+	// into as they're uploaded, so that uploads are sent in larger writes
+	// than the layers are read in. Each upload in progress has its own
+	// buffer. The default is 256 KiB; zero means unbuffered.
+	UploadBufferSize int
+
+	// DryRun reads and sizes everything that would be written, and decides
+	// which blobs would be skipped, without writing anything. Responses
+	// served in a dry run have an X-Dry-Run header. Manifest GET requests
+	// are answered with 204 No Content, and the manifest's digest, rather
+	// than a redirect to a manifest that wasn't written.
+	DryRun bool
+
+	// StoreUncompressed writes layers as uncompressed tarballs keyed by
+	// their diff IDs, and rewrites manifests to reference them.
+	StoreUncompressed bool
+
+	// PreferZstd recompresses gzip layers of OCI images with zstd as
+	// they're written, streaming them rather than buffering them, and
+	// rewrites manifests to reference them. It's the same as a
+	// LayerCompression of zstd.
+	PreferZstd bool
+
+	// LayerCompression, if set, is how gzip layers of images are
+	// compressed as they're written, like PreferZstd. Docker images are
+	// converted to OCI images to be recompressed; requests that don't
+	// accept OCI manifests are served the Docker image with its layers as
+	// they are, but aliases always point at the OCI image. Requests for
+	// manifests may choose for themselves with a tag suffix of __gzip,
+	// __zstd or __zstd-chunked, or a compression query parameter, and
+	// builders with WithLayerCompression. Builders write each compression
+	// under its own alias with CacheKey.
+	LayerCompression LayerCompression
+
+	// ExpireAfter, if set, marks each blob written as expiring that long
+	// after it's written, in its Expire-At metadata. CollectGarbage deletes
+	// tags that have expired, along with the blobs only they referenced.
+	ExpireAfter time.Duration
+
+	// CanonicalizeIndex rewrites indexes before writing them so that their
+	// digests don't depend on how they were assembled: manifests are sorted
+	// by digest, and empty annotations are dropped. Child manifests are
+	// written unchanged.
+	CanonicalizeIndex bool
+
+	// OnBlobCallback, if set, is called by HandleOSSCallback with each
+	// blob OSS reports having written.
+	OnBlobCallback func(context.Context, BlobCallbackEvent) error
+
+	// ExtraMeta are labels recorded in the metadata of every blob written,
+	// such as the build that wrote it, for auditing. They're stored with a
+	// Label- prefix, so they can't replace the metadata blobs are served
+	// with, and are returned by BlobExistsWithLabels. Keys must be letters,
+	// digits and dashes.
+	ExtraMeta map[string]string
+
+	// Events, if set, is published to once each blob or alias is written.
+	Events     EventBus
+	eventsOnce sync.Once
+	events     chan StorageEvent
+
+	// UploadTrace, if set, times each layer written by WriteImageDelta,
+	// ServeManifest and ServeIndex, and reports them in the Trace of the
+	// LayerDeltaReport. ServeManifest and ServeIndex log the trace.
+	UploadTrace bool
+}
+
+// Option configures a Storage created by NewStorage.
+type Option func(*Storage) error
+
+// WithReadReplica serves reads from the given replica bucket, such as one
+// closer to clients, falling back to the primary bucket for blobs that
+// haven't been replicated yet. Writes always go to the primary bucket.
+func WithReadReplica(endpoint, bucket, accessID, accessKey string) Option {
+	return func(s *Storage) error {
+		s.replicaConfig = &ossConfig{endpoint: endpoint, bucket: bucket, accessID: accessID, accessKey: accessKey}
+		return nil
+	}
+}
+
+// WithHTTPClient makes requests to OSS using c, such as to route them through
+// a proxy, use custom TLS settings for a private endpoint, or trace them.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Storage) error {
+		if c == nil {
+			return fmt.Errorf("nil HTTP client")
+		}
+		s.clientOptions = append(s.clientOptions, oss.HTTPClient(c))
+		return nil
+	}
+}
+
+// WithHTTPTransport makes requests to OSS using rt, such as one that
+// authenticates with a client certificate, goes through a proxy, or
+// intercepts requests in tests. Like WithHTTPClient, it replaces the
+// transport the OSS client would build, along with its timeouts.
+func WithHTTPTransport(rt http.RoundTripper) Option {
+	return func(s *Storage) error {
+		if rt == nil {
+			return fmt.Errorf("nil HTTP transport")
+		}
+		return WithHTTPClient(&http.Client{Transport: rt})(s)
+	}
+}
+
+// WithMaxIdleConns sets how many idle connections the OSS client keeps open
+// in total and to each host, such as to reuse more connections when writing
+// many layers at once. The OSS client's default is 100 of each. It doesn't
+// apply to a client given to WithHTTPClient.
+func WithMaxIdleConns(total, perHost int) Option {
+	return func(s *Storage) error {
+		if total < 0 || perHost < 0 {
+			return fmt.Errorf("negative max idle connections %d and %d", total, perHost)
+		}
+		s.clientOptions = append(s.clientOptions, func(c *oss.Client) {
+			c.Config.HTTPMaxConns.MaxIdleConns = total
+			c.Config.HTTPMaxConns.MaxIdleConnsPerHost = perHost
+		})
+		return nil
+	}
+}
+
+// WithScheme connects to OSS, and redirects clients to blobs, using the given
+// URL scheme, http or https, such as for a MinIO or OSS endpoint only served
+// over plain HTTP internally. The default is https, or else the SCHEME
+// environment variable.
+func WithScheme(sch string) Option {
+	return func(s *Storage) error {
+		s.scheme = sch
+		return nil
+	}
+}
+
+// WithBlobPrefix stores blobs, and the aliases they're written under, with
+// keys under the given prefix instead of blobs/, such as prod/blobs, or one
+// per service so that services can share a bucket without their aliases
+// colliding. The default is blobs/, or else Config.BlobPrefix. Everything
+// else the storage records, such as tags and upload sessions, is stored
+// under the path components of the prefix before its last, prod/ for
+// prod/blobs.
+func WithBlobPrefix(prefix string) Option {
+	return func(s *Storage) error {
+		if strings.Trim(prefix, "/") == "" {
+			return errors.New("blob prefix must not be empty")
+		}
+		s.blobPrefix = prefix
+		return nil
+	}
+}
+
+// metaKey returns the prefix of the keys of the objects other than blobs
+// that are stored under the prefix, such as tags, in the namespace of the
+// blob prefix: the path components before its last. So with the blob prefix
+// prod/blobs, tags are stored under prod/tags/, and services given blob
+// prefixes of the form <service>/blobs share a bucket without seeing each
+// other's tags, catalog or records.
+func (s *Storage) metaKey(prefix string) string {
+	p := strings.Trim(s.blobPrefix, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i+1] + prefix
+	}
+	return prefix
+}
+
+// blobKey returns the key the named blob is stored under.
+func (s *Storage) blobKey(name string) string {
+	return prefixedKey(s.blobPrefix, name)
+}
+
+// prefixedKey returns the key of the named blob under the prefix, or under
+// blobs/ if prefix is empty.
+func prefixedKey(prefix, name string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		prefix = defaultBlobPrefix
+	}
+	return prefix + "/" + name
+}
+
+// WithBackend stores objects in the given Backend instead of the OSS bucket.
+// Options that configure the OSS client have no effect, and WithReadReplica
+// can't be used with it.
+func WithBackend(b Backend) Option {
+	return func(s *Storage) error {
+		if b == nil {
+			return errors.New("backend must not be nil")
+		}
+		s.objects = b
+		return nil
+	}
+}
+
+// WithObjectACL writes objects with the given ACL, instead of the bucket's
+// default, such as public-read so that clients can follow redirects to blobs
+// in an otherwise private bucket. WithSignedURLs keeps blobs in OSS private
+// instead; redirects to blobs in S3 are always presigned.
+func WithObjectACL(acl oss.ACLType) Option {
+	return func(s *Storage) error {
+		switch acl {
+		case oss.ACLPrivate, oss.ACLPublicRead, oss.ACLPublicReadWrite, oss.ACLDefault:
+		default:
+			return fmt.Errorf("invalid object ACL %q", acl)
+		}
+		s.objectACL = acl
+		return nil
+	}
 }
 
-func NewStorage(ctx context.Context) (*Storage, error) {
-	if endpoint == "" {
-		endpoint = "oss-cn-beijing.aliyuncs.com"
+// NewStorage returns a Storage configured by the environment, as returned by
+// ConfigFromEnv, or by WithConfig, and the other options given.
+func NewStorage(ctx context.Context, opts ...Option) (*Storage, error) {
+	cfg := ConfigFromEnv()
+	s := &Storage{
+		config:           cfg,
+		blobPrefix:       cfg.BlobPrefix,
+		opTimeout:        defaultOperationTimeout,
+		retry:            &defaultRetryPolicy,
+		connectTimeout:   defaultConnectTimeout,
+		readWriteTimeout: defaultReadWriteTimeout,
+		scheme:           cfg.Scheme,
+		manifests:        newManifestCache(defaultManifestCacheSize),
+
+		MaxBlobSize:      defaultMaxBlobSize,
+		MaxManifestSize:  defaultMaxManifestSize,
+		UploadBufferSize: defaultUploadBufferSize,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.scheme == "" {
+		s.scheme = defaultScheme
+	}
+	if s.scheme != "http" && s.scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme %q, must be http or https", s.scheme)
+	}
+
+	var err error
+	if s.proxyBlobs, err = s.config.proxyBlobs(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	}
+	if s.cacheTTL, err = s.config.cacheTTL(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	}
+	if rate, err := s.config.traceSampleRate(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	} else if rate > 0 {
+		logSpans(rate)
+	}
+	if s.auth == nil {
+		if s.auth, s.tokens, err = s.config.auth(); err != nil {
+			return nil, fmt.Errorf("invalid storage config: %v", err)
+		}
+	}
+	if s.access, err = s.config.access(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
 	}
-	if bucket == "" {
-		bucket = "nydus-demo"
+	if s.auth != nil && s.access != nil && s.access.users != nil {
+		return nil, errors.New("invalid storage config: AUTH_HTPASSWD can't be used with token auth")
 	}
+	if len(s.config.PushNamespaces) > 0 && s.auth == nil && (s.access == nil || s.access.users == nil) {
+		// Otherwise anyone could push.
+		return nil, errors.New("invalid storage config: PUSH_NAMESPACES requires token auth (AUTH_TOKEN_KEY or AUTH_PUBLIC_KEY) or users (AUTH_HTPASSWD)")
+	}
+	if s.limits == nil {
+		if s.limits, err = s.config.limits(); err != nil {
+			return nil, fmt.Errorf("invalid storage config: %v", err)
+		}
+	}
+	if s.negative, err = s.config.negativeCache(s.negative); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	}
+	if level, err := s.config.logLevel(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	} else if s.config.LogLevel != "" {
+		setLogLevel(level)
+	}
+
+	if s.objects != nil {
+		if s.replicaConfig != nil {
+			return nil, errors.New("a read replica can't be used with WithBackend")
+		}
+		s.objects = newRetryBackend(s.objects, *s.retry)
+		blobStorage.Store(s)
+		return s, nil
+	}
+
+	cfg = s.config.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid storage config: %v", err)
+	}
+	if cfg.Backend != "oss" && (s.replicaConfig != nil || s.callback != nil || s.signedURLExpiry > 0) {
+		return nil, fmt.Errorf("read replicas, OSS callbacks and signed URLs can't be used with the %s backend", cfg.Backend)
+	}
+	if s.signedURLExpiry > 0 {
+		if cfg.AccessID == "" {
+			return nil, errors.New("signed URLs require OSS credentials (ACCESS_KEY_ID and ACCESS_KEY_SECRET)")
+		}
+		if s.objectACL == oss.ACLPublicRead || s.objectACL == oss.ACLPublicReadWrite {
+			return nil, fmt.Errorf("signed URLs can't be used with the %s object ACL", s.objectACL)
+		}
+	}
+	// Canned ACLs are named the same in OSS, S3 and GCS, except for the
+	// bucket's default, which is what's used if none is given.
+	acl := string(s.objectACL)
+	if s.objectACL == oss.ACLDefault {
+		acl = ""
+	}
+
+	switch cfg.Backend {
+	case "s3":
+		s.objects, err = newS3Backend(s3Config{
+			scheme:           s.scheme,
+			endpoint:         cfg.Endpoint,
+			bucket:           cfg.Bucket,
+			region:           cfg.Region,
+			accessID:         cfg.AccessID,
+			accessKey:        cfg.AccessKey,
+			acl:              acl,
+			connectTimeout:   s.connectTimeout,
+			readWriteTimeout: s.readWriteTimeout,
+		})
+	case "gcs":
+		s.objects, err = newGCSBackend(ctx, gcsConfig{
+			scheme:           s.scheme,
+			endpoint:         cfg.Endpoint,
+			bucket:           cfg.Bucket,
+			acl:              acl,
+			connectTimeout:   s.connectTimeout,
+			readWriteTimeout: s.readWriteTimeout,
+		})
+	case "fs":
+		s.objects, err = newFSBackend(cfg.Dir)
+	case "mem":
+		s.objects = newMemBackend()
+	case "oss":
+		// Timeouts come first so that the client options given can
+		// override them.
+		s.clientOptions = append([]oss.ClientOption{
+			oss.Timeout(seconds(s.connectTimeout), seconds(s.readWriteTimeout)),
+		}, s.clientOptions...)
+
+		s.objects, err = newOSSBackend(ossConfig{
+			scheme:    s.scheme,
+			endpoint:  cfg.Endpoint,
+			bucket:    cfg.Bucket,
+			accessID:  cfg.AccessID,
+			accessKey: cfg.AccessKey,
+			acl:       s.objectACL,
+			callback:  s.callback,
+			multipart: s.multipart,
 
-	ossEndpoint := fmt.Sprintf("https://%s", endpoint)
-	client, err := oss.New(ossEndpoint, accessID, accessKey)
+			signedURLExpiry: s.signedURLExpiry,
+		}, s.clientOptions...)
+		if err == nil && s.replicaConfig != nil {
+			s.replicaConfig.scheme = s.scheme
+			s.replicaConfig.signedURLExpiry = s.signedURLExpiry
+			s.replica, err = newOSSBackend(*s.replicaConfig, s.clientOptions...)
+			if err != nil {
+				err = fmt.Errorf("replica: %v", err)
+			}
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("NewClient: %v", err)
+		return nil, err
 	}
-	return &Storage{client}, nil
+	s.objects = newRetryBackend(s.objects, *s.retry)
+	if s.replica != nil {
+		s.replica = newRetryBackend(s.replica, *s.retry)
+	}
+	blobStorage.Store(s)
+	return s, nil
 }
 
-func (s *Storage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
-	bucket, err := s.client.Bucket(bucket)
+// ServeBlob redirects to the blob's contents, in the read replica if one is
+// configured and has the blob, otherwise in the primary bucket. If blobs are
+// proxied, the contents are streamed from there instead, honoring Range
+// requests; see Config.BlobServing.
+//
+// HEAD requests are served from the blob's metadata, without a
+// Content-Encoding, since compressed layers are served as they're stored,
+// and a client told they're encoded would decompress them and then fail to
+// verify their digests. Responses for blobs named by digest
+// are marked immutable, unless they're errors; see WithCacheControl.
+//
+// GETs of manifests, by digest or by an alias such as a cache key, are
+// counted as pulls of the manifest; see PullCount.
+func (s *Storage) ServeBlob(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method == http.MethodGet && isManifestRequest(r) {
+		s.recordPullAsync(r.Context(), name)
+	}
+	s.serveBlob(w, r, name)
+}
+
+// serveBlob is ServeBlob, without counting pulls of manifests.
+func (s *Storage) serveBlob(w http.ResponseWriter, r *http.Request, name string) {
+	s.setSecurityHeaders(w)
+	if _, err := v1.NewHash(name); err == nil {
+		w = &cacheFoundWriter{ResponseWriter: w, cacheControl: s.immutableCacheControl()}
+	}
+	if r.Method == http.MethodHead {
+		desc, _, err := s.statBlob(r.Context(), name)
+		if isNotFound(err) {
+			WriteError(w, fmt.Errorf("%w: %s", ErrBlobNotFound, name))
+			return
+		} else if err != nil {
+			WriteError(w, err)
+			return
+		}
+		w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+		w.Header().Set(metaContentType, string(desc.MediaType))
+		w.Header().Set(metaContentLength, fmt.Sprintf("%d", desc.Size))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if isDigestRequest(r) {
+		s.touchAsync(r.Context(), s.blobKey(name))
+		if s.serveStoredManifest(w, r, name) {
+			return
+		}
+	}
+	key := s.blobKey(name)
+	if s.replica != nil {
+		if ok, err := s.replica.Exists(key); err == nil && ok {
+			s.serveObject(w, r, s.replica, key)
+			return
+		}
+	}
+	s.serveObject(w, r, s.objects, key)
+}
+
+// redirect responds with the named blob's contents, or a redirect to them,
+// from the primary bucket.
+func (s *Storage) redirect(w http.ResponseWriter, r *http.Request, name string) {
+	s.serveObject(w, r, s.objects, s.blobKey(name))
+}
+
+// serveManifestBody responds with the manifest described by desc, whose
+// contents are returned by raw, inline if it's small enough, and otherwise
+// with a redirect to it.
+//
+// In a dry run nothing was written to redirect to, so it responds with the
+// manifest's digest and media type and no content instead.
+func (s *Storage) serveManifestBody(ctx context.Context, w http.ResponseWriter, r *http.Request, desc *v1.Descriptor, raw func() ([]byte, error)) error {
+	if s.DryRun {
+		w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+		w.Header().Set(metaContentType, string(desc.MediaType))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	s.recordPullAsync(ctx, desc.Digest.String())
+	s.touchAsync(ctx, s.blobKey(desc.Digest.String()))
+	if !s.inlinesManifest(desc.Size) {
+		s.redirect(w, r, desc.Digest.String())
+		return nil
+	}
+	var b []byte
+	var err error
+	if s.rewritesManifests(ctx) {
+		// The manifest written was rewritten from the original.
+		b, err = s.readBlob(ctx, desc.Digest.String())
+	} else {
+		b, err = raw()
+	}
 	if err != nil {
-		return v1.Descriptor{}, err
+		return err
+	}
+	return writeManifest(w, desc, b)
+}
+
+// inlinesManifest reports whether manifest GET requests respond with
+// manifests of the given size, rather than a redirect to them.
+func (s *Storage) inlinesManifest(size int64) bool {
+	if s.InlineManifests {
+		return s.MaxManifestSize <= 0 || size <= s.MaxManifestSize
+	}
+	return s.InlineSmallManifests > 0 && size <= s.InlineSmallManifests
+}
+
+// writeManifest responds with the manifest b, described by desc.
+func writeManifest(w http.ResponseWriter, desc *v1.Descriptor, b []byte) error {
+	w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+	w.Header().Set(metaContentType, string(desc.MediaType))
+	w.Header().Set(metaContentLength, fmt.Sprintf("%d", len(b)))
+	_, err := w.Write(b)
+	return err
+}
+
+// serveStoredManifest responds to a GET request for the named manifest with
+// the manifest itself, if manifests its size are inlined, and reports whether
+// it responded.
+func (s *Storage) serveStoredManifest(w http.ResponseWriter, r *http.Request, name string) bool {
+	if r.Method != http.MethodGet || !(s.InlineManifests || s.InlineSmallManifests > 0) {
+		return false
+	}
+	ctx := r.Context()
+	desc, _, err := s.statBlob(ctx, name)
+	if err != nil || !s.inlinesManifest(desc.Size) {
+		// Fall back to serving the blob, which reports any error.
+		return false
 	}
-	fmt.Println("get bucket: ", bucket)
-	objMetadata, err := bucket.GetObjectDetailedMeta(fmt.Sprintf("blobs/%s", name))
+	b, err := s.readBlob(ctx, name)
 	if err != nil {
-		return v1.Descriptor{}, err
+		return false
 	}
-	fmt.Printf("get objMetadata: %+v\n", objMetadata)
+	if err := writeManifest(w, &desc, b); err != nil {
+		errorf(ctx, "writing manifest %q: %v", name, err)
+	}
+	return true
+}
 
-	var h v1.Hash
-	if d := objMetadata["X-Oss-Meta-"+metaDockerContentDigest]; len(d) == 1 {
-		h, err = v1.NewHash(d[0])
-		if err != nil {
-			return v1.Descriptor{}, err
+// BlobExists returns the descriptor of the named blob, read from the read
+// replica if one is configured and has the blob.
+func (s *Storage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
+	desc, _, err := s.statBlob(ctx, name)
+	return desc, err
+}
+
+// ManifestExists reports whether the manifest with the given digest has been
+// written, using a HEAD request that doesn't read the blob's metadata.
+func (s *Storage) ManifestExists(ctx context.Context, digest v1.Hash) (bool, error) {
+	var exists bool
+	err := s.withTimeout(ctx, func(ctx context.Context) error {
+		ok, err := withContext(ctx, s.objects).Exists(s.blobKey(digest.String()))
+		exists = ok
+		return err
+	})
+	return exists, err
+}
+
+// BlobsExist returns the descriptors of those named blobs that exist, keyed
+// by name. Missing blobs are omitted.
+func (s *Storage) BlobsExist(ctx context.Context, names ...string) (map[string]v1.Descriptor, error) {
+	var mu sync.Mutex
+	found := map[string]v1.Descriptor{}
+	var g errgroup.Group
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			desc, err := s.BlobExists(ctx, name)
+			if isNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			found[name] = desc
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// statBlob returns the descriptor and raw metadata of the named blob, read
+// from the read replica if one is configured and has the blob.
+func (s *Storage) statBlob(ctx context.Context, name string) (v1.Descriptor, ObjectInfo, error) {
+	if s.replica != nil {
+		desc, info, err := s.statBlobIn(ctx, s.replica, name)
+		if !isNotFound(err) {
+			return desc, info, err
 		}
 	}
+	return s.statBlobIn(ctx, s.objects, name)
+}
+
+func (s *Storage) statBlobIn(ctx context.Context, b Backend, name string) (v1.Descriptor, ObjectInfo, error) {
+	var info ObjectInfo
+	err := s.withTimeout(ctx, func(ctx context.Context) error {
+		i, err := withContext(ctx, b).Stat(s.blobKey(name))
+		info = i
+		return err
+	})
+	if err != nil {
+		return v1.Descriptor{}, ObjectInfo{}, err
+	}
 
-	var size int64 = 0
-	if d := objMetadata[metaContentLength]; len(d) == 1 {
-		size, err = strconv.ParseInt(d[0], 10, 64)
+	var h v1.Hash
+	if d := info.Meta[metaDockerContentDigest]; d != "" {
+		h, err = v1.NewHash(d)
 		if err != nil {
-			return v1.Descriptor{}, err
+			return v1.Descriptor{}, ObjectInfo{}, fmt.Errorf("blob %q has invalid %s metadata %q: %v", name, metaDockerContentDigest, d, err)
 		}
-		fmt.Printf("get size: %+v\n", size)
 	}
 
 	return v1.Descriptor{
 		Digest:    h,
-		MediaType: types.MediaType(objMetadata[metaContentType][0]),
-		Size:      size,
-	}, nil
+		MediaType: blobMediaType(info),
+		Size:      info.Size,
+	}, info, nil
+}
+
+// isNotFound reports whether err is an error for a missing object.
+func isNotFound(err error) bool {
+	if errors.Is(err, ErrObjectNotFound) {
+		return true
+	}
+	var serr oss.ServiceError
+	return errors.As(err, &serr) && serr.StatusCode == http.StatusNotFound
+}
+
+// isAlreadyExists reports whether err is from writing an object that exists
+// and may not be overwritten, such as in an OSS bucket that forbids
+// overwrites.
+func isAlreadyExists(err error) bool {
+	if errors.Is(err, ErrObjectExists) {
+		return true
+	}
+	var serr oss.ServiceError
+	return errors.As(err, &serr) && serr.Code == "FileAlreadyExists"
+}
+
+// ServeManifestByTag serves a previously written manifest by one of the
+// aliases it was written with, redirecting to the manifest blob by digest.
+func (s *Storage) ServeManifestByTag(w http.ResponseWriter, r *http.Request, tag string) (err error) {
+	ctx := RequestContext(w, r)
+	s.setSecurityHeaders(w)
+	defer func() { err = withRequestIDErr(ctx, err) }()
+	desc, err := s.BlobExists(ctx, tag)
+	if isNotFound(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	s.touchAsync(ctx, s.blobKey(tag))
+	s.serveWrittenManifest(ctx, w, r, desc)
+	return nil
+}
+
+// serveWrittenManifest serves the manifest with the descriptor, which has
+// already been written, redirecting to its blob by digest unless it's
+// inlined.
+func (s *Storage) serveWrittenManifest(ctx context.Context, w http.ResponseWriter, r *http.Request, desc v1.Descriptor) {
+	s.touchAsync(ctx, s.blobKey(desc.Digest.String()))
+	if s.setManifestCacheHeaders(w, r, desc.Digest) {
+		return
+	}
+
+	// If it's just a HEAD request, serve that.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+		w.Header().Set(metaContentType, string(desc.MediaType))
+		w.Header().Set(metaContentLength, fmt.Sprintf("%d", desc.Size))
+		return
+	}
+
+	// Redirect to manifest blob, unless it's inlined.
+	s.recordPullAsync(ctx, desc.Digest.String())
+	if !s.serveStoredManifest(w, r, desc.Digest.String()) {
+		s.serveBlob(w, r, desc.Digest.String())
+	}
+}
+
+// blobMediaType returns the media type of the blob from its Content-Type,
+// falling back to the Content-Type recorded in user metadata, for blobs that
+// were written by other tools without one.
+func blobMediaType(info ObjectInfo) types.MediaType {
+	for _, mt := range []string{info.ContentType, info.Meta[metaContentType]} {
+		if mt != "" {
+			return types.MediaType(mt)
+		}
+	}
+	return defaultMediaType
 }
 
-// FIXME only used in cmd/wait/main.go
+// WriteObject writes contents as a plain text blob, with the same digest and
+// content type metadata as any other blob, so it can be read back with
+// BlobExists.
 func (s *Storage) WriteObject(ctx context.Context, name, contents string) error {
-	bucket, err := s.client.Bucket(bucket)
+	h, _, err := v1.SHA256(strings.NewReader(contents))
 	if err != nil {
 		return err
 	}
-	key := fmt.Sprintf("blobs/%s", name)
-	return bucket.PutObject(key, strings.NewReader(contents))
+	return s.writeBlob(ctx, name, h, ioutil.NopCloser(strings.NewReader(contents)), "text/plain; charset=utf-8", nil)
 }
 
-func (s *Storage) writeBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string) error {
+func (s *Storage) writeBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string, extra map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "serve.writeBlob", trace.StringAttribute("name", name), trace.StringAttribute("media_type", contentType))
+	defer endSpan(span, &err)
 	start := time.Now()
-	defer func() { log.Printf("writeBlob(%q) took %s", name, time.Since(start)) }()
+	defer func() {
+		took := time.Since(start)
+		blobUploadDuration.observe(took.Seconds())
+		debugf(ctx, "writeBlob(%q) took %s", name, took)
+		if s.opTimeout > 0 && took > s.opTimeout/2 {
+			warnf(ctx, "writeBlob(%q) took more than half of the %s operation timeout", name, s.opTimeout)
+		}
+	}()
+
+	// Blobs named by their digest are immutable, so one that's already
+	// been written needn't be uploaded again, unless there's extra
+	// metadata, such as annotations, to record on it.
+	digestNamed := name == h.String()
+	if digestNamed && len(extra) == 0 {
+		exists, err := s.ManifestExists(ctx, h)
+		if err != nil && !isNotFound(err) {
+			rc.Close()
+			return err
+		}
+		recordCacheLookup("blob", exists)
+		if exists {
+			debugf(ctx, "blob %q already exists, skipping", name)
+			return rc.Close()
+		}
+	}
 
-	bucket, err := s.client.Bucket(bucket)
+	meta, err := s.blobMeta(h, contentType, extra)
 	if err != nil {
+		rc.Close()
+		return err
+	}
+	// Verify the contents as they're streamed, so that a blob that doesn't
+	// match its digest is never stored under it.
+	merr := &DigestMismatchError{Name: name, Meta: &h}
+	if digestNamed {
+		merr.Key = &h
+	}
+	dr := newDigestReader(rc, merr)
+	if dr != nil {
+		rc = dr
+	}
+	cr := &countingReadCloser{ReadCloser: rc}
+	key := s.blobKey(name)
+	if err := s.putBlob(ctx, name, key, cr, contentType, meta); err != nil {
+		if derr := dr.mismatch(); derr != nil {
+			if digestNamed && !s.DryRun {
+				// The failed write shouldn't have left an object
+				// behind, but make sure nothing mismatched is served
+				// under the digest. Objects under other names, such as
+				// tags, are left as they were.
+				if err := s.objects.Delete(key); err != nil && !isNotFound(err) {
+					warnf(ctx, "deleting mismatched blob %q: %v", name, err)
+				}
+			}
+			return derr
+		}
+		if digestNamed && errors.Is(err, ErrObjectExists) {
+			// It was written concurrently, with the same contents.
+			return nil
+		}
 		return err
 	}
-	key := fmt.Sprintf("blobs/%s", name)
+	blobUploadBytes.inc(float64(cr.n))
+	chargeQuota(ctx, cr.n)
+	op := TagUpdated
+	if _, err := v1.NewHash(name); err == nil {
+		op = BlobWritten
+	}
+	s.publish(op, name, h, cr.n)
+	return nil
+}
 
-	options := []oss.Option{
-		oss.ContentType(contentType),
-		oss.Meta(metaContentType, contentType),
-		oss.Meta(metaDockerContentDigest, h.String()),
+// blobMeta returns the metadata of a blob with the given digest and content
+// type, along with any extra metadata and the labels in ExtraMeta.
+func (s *Storage) blobMeta(h v1.Hash, contentType string, extra map[string]string) (map[string]string, error) {
+	meta := map[string]string{
+		metaContentType:         contentType,
+		metaDockerContentDigest: h.String(),
+		metaCreatedAt:           time.Now().UTC().Format(time.RFC3339),
+	}
+	if s.ExpireAfter > 0 {
+		meta[metaExpireAt] = time.Now().Add(s.ExpireAfter).UTC().Format(time.RFC3339)
+	}
+	for k, v := range extra {
+		meta[k] = v
+	}
+	labels, err := labelMeta(s.ExtraMeta)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		meta[k] = v
 	}
+	return meta, nil
+}
 
-	err = bucket.PutObject(key, rc, options...)
+// putBlob writes the contents of rc to the object with the given key,
+// enforcing MaxBlobSize, then closes rc. The name is used in errors.
+func (s *Storage) putBlob(ctx context.Context, name, key string, rc io.ReadCloser, contentType string, meta map[string]string) error {
+	var r io.Reader = rc
+	if s.UploadBufferSize > 0 {
+		r = bufio.NewReaderSize(rc, s.UploadBufferSize)
+	}
+	var lr *limitReader
+	if s.MaxBlobSize > 0 {
+		lr = &limitReader{r: r, max: s.MaxBlobSize}
+		r = lr
+	}
+	put := func(ctx context.Context) error {
+		return withContext(ctx, s.objects).Put(key, &ctxReader{ctx: ctx, r: r}, contentType, meta)
+	}
+	if s.DryRun {
+		// Consume the contents anyway, so that sizes and digests are
+		// still computed and limits still enforced.
+		put = func(ctx context.Context) error {
+			n, err := io.Copy(ioutil.Discard, &ctxReader{ctx: ctx, r: r})
+			infof(ctx, "dry run: would write %d bytes to %q", n, key)
+			return err
+		}
+	}
+	var err error
+	if p, ok := s.objects.(contextPutter); ok && s.multipart != nil && !s.DryRun {
+		// Multipart uploads of multi-GB blobs can outlast the operation
+		// timeout; instead each part is bounded by the client's
+		// timeouts, and the upload is aborted once ctx is done.
+		err = p.PutContext(ctx, key, &ctxReader{ctx: ctx, r: r}, contentType, meta)
+	} else {
+		err = s.withTimeout(ctx, put)
+	}
+	if lr != nil && lr.isExceeded() {
+		rc.Close()
+		if s.DryRun {
+			return fmt.Errorf("writing blob %q: %w: more than %d bytes", name, ErrTooLarge, s.MaxBlobSize)
+		}
+		// A failed PutObject shouldn't leave an object behind, but make
+		// sure nothing oversized is served.
+		if err := s.objects.Delete(key); err != nil && !isNotFound(err) {
+			warnf(ctx, "deleting oversized blob %q: %v", name, err)
+		}
+		return fmt.Errorf("writing blob %q: %w: more than %d bytes", name, ErrTooLarge, s.MaxBlobSize)
+	}
 	if err != nil {
-		// FIXME: handle already exist error
+		rc.Close()
+		if isAlreadyExists(err) {
+			return fmt.Errorf("writing blob %q: %w", name, ErrObjectExists)
+		}
 		return err
 	}
 
@@ -132,173 +1029,755 @@ func (s *Storage) writeBlob(ctx context.Context, name string, h v1.Hash, rc io.R
 	return nil
 }
 
+// readBlob returns the contents of the named blob, such as a manifest, which
+// must be no larger than MaxManifestSize since it's read into memory.
+func (s *Storage) readBlob(ctx context.Context, name string) ([]byte, error) {
+	_, err := v1.NewHash(name)
+	byDigest := err == nil
+	if byDigest && s.manifests != nil {
+		b, ok := s.manifests.get(name)
+		recordCacheLookup("manifest", ok)
+		if ok {
+			return b, nil
+		}
+	}
+	var b []byte
+	err = s.withTimeout(ctx, func(ctx context.Context) error {
+		rc, err := withContext(ctx, s.objects).Get(s.blobKey(name))
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		var r io.Reader = rc
+		if s.MaxManifestSize > 0 {
+			r = io.LimitReader(rc, s.MaxManifestSize+1)
+		}
+		b, err = ioutil.ReadAll(&ctxReader{ctx: ctx, r: r})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkManifestSize(len(b)); err != nil {
+		return nil, fmt.Errorf("reading blob %q: %w", name, err)
+	}
+	if byDigest {
+		s.manifests.add(name, b)
+	}
+	return b, nil
+}
+
+func (s *Storage) deleteBlob(ctx context.Context, name string) error {
+	if s.DryRun {
+		return nil
+	}
+	s.manifests.remove(name)
+	return s.objects.Delete(s.blobKey(name))
+}
+
 // ServeIndex writes manifest, config and layer blobs for each image in the
 // index, then writes and redirects to the index manifest contents pointing to
 // those blobs.
+//
+// If the request's Accept header doesn't accept the index's media type, the
+// index and its images are converted between OCI and Docker media types, and
+// the converted manifests are written and served too. Aliases are written
+// with the index as it is, whatever the request accepts. If it can't be
+// converted, it returns an error wrapping ErrNotAcceptable.
 func (s *Storage) ServeIndex(w http.ResponseWriter, r *http.Request, idx v1.ImageIndex, also ...string) error {
-	ctx := r.Context()
+	_, err := s.ServeIndexDescriptor(w, r, idx, also...)
+	return err
+}
+
+// ServeIndexDescriptor is like ServeIndex, but also returns the descriptor of
+// the index manifest that was served.
+func (s *Storage) ServeIndexDescriptor(w http.ResponseWriter, r *http.Request, idx v1.ImageIndex, also ...string) (_ *v1.Descriptor, err error) {
+	ctx, span := startSpan(RequestContext(w, r), "serve.ServeIndex")
+	defer endSpan(span, &err)
+	s.setSecurityHeaders(w)
+	defer func() { err = withRequestIDErr(ctx, err) }()
+	if ctx, err = RequestLayerCompression(ctx, r); err != nil {
+		return nil, err
+	}
+	stored, idx, err := s.storedIndex(ctx, w, r, idx)
+	if err != nil {
+		return nil, err
+	}
+	if s.DryRun {
+		w.Header().Set(headerDryRun, "true")
+	}
+	desc, report, err := s.writeIndexOnce(ctx, stored, also...)
+	if err != nil {
+		return nil, err
+	}
+	s.logTrace(ctx, report)
+	s.recordPullRequest(ctx, r, desc.Digest)
+	if idx != stored {
+		if desc, report, err = s.writeIndexOnce(ctx, idx); err != nil {
+			return nil, err
+		}
+		s.logTrace(ctx, report)
+	}
+
+	if s.setManifestCacheHeaders(w, r, desc.Digest) {
+		return desc, nil
+	}
+
+	// If it's just a HEAD request, serve that.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+		w.Header().Set(metaContentType, string(desc.MediaType))
+		w.Header().Set(metaContentLength, fmt.Sprintf("%d", desc.Size))
+		return desc, nil
+	}
+
+	// Redirect to manifest blob, or serve it inline.
+	raw := idx.RawManifest
+	if s.CanonicalizeIndex {
+		// The index written was rewritten from the original.
+		raw = func() ([]byte, error) { return s.readBlob(ctx, desc.Digest.String()) }
+	}
+	if err := s.serveManifestBody(ctx, w, r, desc, raw); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// writeIndex writes the blobs for each image in the index, then the index
+// manifest, and returns the descriptor of the index manifest that was
+// written, along with a report of the layers of all its images.
+func (s *Storage) writeIndex(ctx context.Context, idx v1.ImageIndex, also ...string) (_ *v1.Descriptor, _ *LayerDeltaReport, err error) {
+	ctx, span := startSpan(ctx, "serve.writeIndex")
+	defer endSpan(span, &err)
+	// Images in the index often share layers, which are only uploaded once.
+	ctx = withOpUploads(ctx)
 	im, err := idx.IndexManifest()
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	descs := make([]v1.Descriptor, len(im.Manifests))
+	reports := make([]*LayerDeltaReport, len(im.Manifests))
+	var sem chan struct{}
+	if s.MaxConcurrentImages > 0 {
+		sem = make(chan struct{}, s.MaxConcurrentImages)
 	}
 	var g errgroup.Group
-	for _, m := range im.Manifests {
-		m := m
+	for i, m := range im.Manifests {
+		i, m := i, m
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		g.Go(func() error {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
 			img, err := idx.Image(m.Digest)
 			if err != nil {
 				return err
 			}
-			return s.WriteImage(ctx, img)
+			desc, report, err := s.writeImage(ctx, img)
+			if err != nil {
+				return err
+			}
+			descs[i], reports[i] = *desc, report
+			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Write the manifest as a blob.
 	b, err := idx.RawManifest()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	mt, err := idx.MediaType()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	digest, err := idx.Digest()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
-		return err
+	if s.rewritesManifests(ctx) || s.CanonicalizeIndex {
+		im = im.DeepCopy()
+		if s.rewritesManifests(ctx) {
+			// Child manifests were rewritten, so the index must point
+			// to their new digests.
+			for i := range im.Manifests {
+				im.Manifests[i].Digest = descs[i].Digest
+				im.Manifests[i].Size = descs[i].Size
+			}
+		}
+		if s.CanonicalizeIndex {
+			canonicalizeIndex(im)
+		}
+		b, err = json.Marshal(im)
+		if err != nil {
+			return nil, nil, err
+		}
+		digest, _, err = v1.SHA256(bytes.NewReader(b))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := s.checkManifestSize(len(b)); err != nil {
+		return nil, nil, err
+	}
+	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), nil); err != nil {
+		return nil, nil, err
+	}
+	if err := s.addReferrer(ctx, contextRepo(ctx), v1.Descriptor{MediaType: mt, Size: int64(len(b)), Digest: digest}, b); err != nil {
+		return nil, nil, err
 	}
 
 	for _, a := range also {
 		a := a
 		g.Go(func() error {
-			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt))
+			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), nil)
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		s, err := idx.Size()
-		if err != nil {
-			return err
-		}
-		w.Header().Set(metaDockerContentDigest, digest.String())
-		w.Header().Set(metaContentType, string(mt))
-		w.Header().Set(metaContentLength, fmt.Sprintf("%d", s))
-		return nil
+	var report LayerDeltaReport
+	for _, r := range reports {
+		report.add(r)
 	}
-
-	// Redirect to manifest blob.
-	Blob(w, r, digest.String())
-	return nil
+	return &v1.Descriptor{
+		MediaType: mt,
+		Size:      int64(len(b)),
+		Digest:    digest,
+	}, &report, nil
 }
 
 // WriteImage writes the layer blobs, config blob and manifest.
 func (s *Storage) WriteImage(ctx context.Context, img v1.Image, also ...string) error {
+	_, _, err := s.writeImage(ctx, img, also...)
+	return err
+}
+
+// LayerDeltaReport describes how many layers of an image, and how many bytes,
+// were uploaded or skipped because they had already been written.
+type LayerDeltaReport struct {
+	UploadedLayers, SkippedLayers int
+	UploadedBytes, SkippedBytes   int64
+
+	// Trace describes each layer, if UploadTrace is set.
+	Trace []LayerTrace
+}
+
+// LayerTrace describes how long a layer took to upload, or that it was
+// skipped because it had already been written.
+type LayerTrace struct {
+	Name     string
+	Size     int64
+	Duration time.Duration
+	Skipped  bool
+}
+
+// add adds the counts and trace of o to the report.
+func (r *LayerDeltaReport) add(o *LayerDeltaReport) {
+	r.UploadedLayers += o.UploadedLayers
+	r.SkippedLayers += o.SkippedLayers
+	r.UploadedBytes += o.UploadedBytes
+	r.SkippedBytes += o.SkippedBytes
+	r.Trace = append(r.Trace, o.Trace...)
+}
+
+// logTrace logs the trace of each layer in the report, if UploadTrace is set.
+func (s *Storage) logTrace(ctx context.Context, report *LayerDeltaReport) {
+	if !s.UploadTrace {
+		return
+	}
+	for _, t := range report.Trace {
+		if t.Skipped {
+			debugf(ctx, "layer %s (%d bytes): skipped", t.Name, t.Size)
+			continue
+		}
+		debugf(ctx, "layer %s (%d bytes): uploaded in %s", t.Name, t.Size, t.Duration)
+	}
+}
+
+// WriteImageDelta writes the image like WriteImage, uploading only layers
+// that haven't already been written, and reports what was uploaded. The
+// config and manifest are always written.
+func (s *Storage) WriteImageDelta(ctx context.Context, img v1.Image, also ...string) (LayerDeltaReport, error) {
+	_, report, err := s.writeImage(ctx, img, also...)
+	if err != nil {
+		return LayerDeltaReport{}, err
+	}
+	return *report, nil
+}
+
+// WriteFastPath writes the image like WriteImage, unless its manifest has
+// already been written, in which case only the aliases are written, without
+// checking for any of its layers, and skippedAll is true. That's safe since
+// the manifest is content-addressed, so its config and layers were written
+// along with it.
+//
+// When layers are stored uncompressed or recompressed, manifests are
+// rewritten under other digests, so the image is always written like
+// WriteImage.
+func (s *Storage) WriteFastPath(ctx context.Context, img v1.Image, also ...string) (skippedAll bool, err error) {
+	ctx = withRequestID(ctx)
+	if s.rewritesManifests(ctx) {
+		return false, s.WriteImage(ctx, img, also...)
+	}
+	if desc, err := s.existingManifest(ctx, img); err != nil {
+		return false, err
+	} else if desc == nil {
+		return false, s.WriteImage(ctx, img, also...)
+	}
+
+	b, err := img.RawManifest()
+	if err != nil {
+		return false, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return false, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return false, err
+	}
+	anns := annotationMeta(m.Annotations)
+	var g errgroup.Group
+	for _, a := range also {
+		a := a
+		g.Go(func() error {
+			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), anns)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeImage writes the layer blobs, config blob and manifest, and returns
+// the descriptor of the manifest that was written, along with a report of
+// which layers had to be uploaded.
+func (s *Storage) writeImage(ctx context.Context, img v1.Image, also ...string) (_ *v1.Descriptor, _ *LayerDeltaReport, err error) {
+	ctx, span := startSpan(ctx, "serve.writeImage")
+	defer endSpan(span, &err)
+	ctx = withOpUploads(withRequestID(ctx))
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Write config blob for later serving.
 	ch, err := img.ConfigName()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	cb, err := img.RawConfigFile()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if err := s.writeBlob(ctx, ch.String(), ch, ioutil.NopCloser(bytes.NewReader(cb)), "application/json"); err != nil {
-		return err
+	if _, _, err := uploadOnce(ctx, opUploadKey{name: ch.String()}, func() (v1.Descriptor, error) {
+		return v1.Descriptor{}, s.writeBlob(ctx, ch.String(), ch, ioutil.NopCloser(bytes.NewReader(cb)), "application/json", nil)
+	}); err != nil {
+		return nil, nil, err
 	}
 
-	// Write layer blobs for later serving.
+	// Write layer blobs for later serving, skipping those already written.
 	layers, err := img.Layers()
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	_, _, existing, err := s.diffLayers(ctx, layers)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	var report LayerDeltaReport
+	descs := make([]v1.Descriptor, len(layers))
+	if s.layerCompression(ctx) != CompressGzip {
+		copy(descs, m.Layers)
+	}
+	uploaded := make([]int64, len(layers))
+	deduped := make([]bool, len(layers))
+	var traces []LayerTrace
+	if s.UploadTrace {
+		traces = make([]LayerTrace, len(layers))
 	}
 	var g errgroup.Group
-	for _, l := range layers {
-		l := l
-		g.Go(func() error {
-			rc, err := l.Compressed()
+	for i, l := range layers {
+		i, l := i, l
+		key, err := s.layerKey(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		lmt, err := l.MediaType()
+		if err != nil {
+			return nil, nil, err
+		}
+		comp := s.recompression(ctx, mt, lmt)
+		if comp != CompressGzip {
+			desc, err := s.recompressedLayer(ctx, key, comp)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			lh, err := l.Digest()
-			if err != nil {
-				return err
+			if desc != nil {
+				existing[key.String()] = *desc
+				descs[i] = *desc
+			} else {
+				// The gzip blob may have been written already, for
+				// a request that didn't recompress it, but the
+				// recompressed one hasn't been.
+				delete(existing, key.String())
+			}
+		}
+		if desc, ok := existing[key.String()]; ok {
+			report.SkippedLayers++
+			report.SkippedBytes += desc.Size
+			if traces != nil {
+				traces[i] = LayerTrace{Name: key.String(), Size: desc.Size, Skipped: true}
+			}
+			if s.StoreUncompressed {
+				descs[i] = v1.Descriptor{
+					MediaType: uncompressedLayerType(mt),
+					Size:      desc.Size,
+					Digest:    key,
+				}
 			}
-			mt, err := l.MediaType()
+			continue
+		}
+		uk := opUploadKey{name: key.String(), mediaType: lmt, compression: comp}
+		if s.StoreUncompressed {
+			uk.mediaType = uncompressedLayerType(mt)
+		}
+		g.Go(func() error {
+			start := time.Now()
+			// Another image in the same index may be uploading the
+			// same layer, written the same way.
+			desc, first, err := uploadOnce(ctx, uk, func() (v1.Descriptor, error) {
+				release, err := s.acquireUpload(ctx)
+				if err != nil {
+					return v1.Descriptor{}, err
+				}
+				defer release()
+				return s.writeLayer(ctx, l, key, mt, comp)
+			})
 			if err != nil {
 				return err
 			}
-			return s.writeBlob(ctx, lh.String(), lh, rc, string(mt))
+			descs[i] = desc
+			if first {
+				uploaded[i] = desc.Size
+			} else {
+				deduped[i] = true
+			}
+			if traces != nil {
+				traces[i] = LayerTrace{Name: key.String(), Size: desc.Size, Duration: time.Since(start), Skipped: !first}
+			}
+			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return err
+		return nil, nil, err
+	}
+	for i, d := range deduped {
+		if d {
+			report.SkippedLayers++
+			report.SkippedBytes += descs[i].Size
+		}
 	}
+	report.UploadedLayers = len(layers) - report.SkippedLayers
+	for _, n := range uploaded {
+		report.UploadedBytes += n
+	}
+	report.Trace = traces
 
 	// Write the manifest as a blob.
 	b, err := img.RawManifest()
 	if err != nil {
-		return err
-	}
-	mt, err := img.MediaType()
-	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	digest, err := img.Digest()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
-		return err
+	if s.rewritesManifests(ctx) {
+		rewritten := m.DeepCopy()
+		changed := s.StoreUncompressed
+		for i := range rewritten.Layers {
+			if !s.StoreUncompressed && descs[i].Digest == m.Layers[i].Digest {
+				// Not recompressed.
+				continue
+			}
+			rewritten.Layers[i].MediaType = descs[i].MediaType
+			rewritten.Layers[i].Size = descs[i].Size
+			rewritten.Layers[i].Digest = descs[i].Digest
+			rewritten.Layers[i].URLs = nil
+			rewritten.Layers[i].Annotations = descs[i].Annotations
+			changed = true
+		}
+		if changed {
+			m = rewritten
+			b, err = json.Marshal(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			digest, _, err = v1.SHA256(bytes.NewReader(b))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := s.checkManifestSize(len(b)); err != nil {
+		return nil, nil, err
+	}
+	anns := annotationMeta(m.Annotations)
+	if err := s.writeBlob(ctx, digest.String(), digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), anns); err != nil {
+		return nil, nil, err
+	}
+	if err := s.addReferrer(ctx, contextRepo(ctx), v1.Descriptor{MediaType: mt, Size: int64(len(b)), Digest: digest}, b); err != nil {
+		return nil, nil, err
 	}
 	for _, a := range also {
 		a := a
 		g.Go(func() error {
-			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt))
+			return s.writeBlob(ctx, a, digest, ioutil.NopCloser(bytes.NewReader(b)), string(mt), anns)
 		})
 	}
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return &v1.Descriptor{
+		MediaType: mt,
+		Size:      int64(len(b)),
+		Digest:    digest,
+	}, &report, nil
+}
 
+// DiffLayers splits the image's layers into those missing from storage and
+// those already written, so callers can estimate how much WriteImage will
+// upload.
+func (s *Storage) DiffLayers(ctx context.Context, img v1.Image) (missing []v1.Layer, cached []v1.Layer, err error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, nil, err
+	}
+	missing, cached, _, err = s.diffLayers(ctx, layers)
+	return missing, cached, err
 }
 
-// ServeManifest writes config and layer blobs for the image, then writes and
-// redirects to the image manifest contents pointing to those blobs.
-func (s *Storage) ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
-	ctx := r.Context()
-	if err := s.WriteImage(ctx, img, also...); err != nil {
-		return err
+// diffLayers splits layers into those missing from storage and those already
+// written, and returns the descriptors of the written blobs keyed by name.
+func (s *Storage) diffLayers(ctx context.Context, layers []v1.Layer) (missing, cached []v1.Layer, existing map[string]v1.Descriptor, err error) {
+	names := make([]string, len(layers))
+	for i, l := range layers {
+		key, err := s.layerKey(l)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		names[i] = key.String()
 	}
+	existing, err = s.BlobsExist(ctx, names...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, l := range layers {
+		if _, ok := existing[names[i]]; ok {
+			cached = append(cached, l)
+		} else {
+			missing = append(missing, l)
+		}
+	}
+	return missing, cached, existing, nil
+}
 
+// writeLayer writes the layer's blob under key, uncompressed if
+// StoreUncompressed is set or recompressed as comp says otherwise, and
+// returns the descriptor of the blob that was written.
+func (s *Storage) writeLayer(ctx context.Context, l v1.Layer, key v1.Hash, mt types.MediaType, comp LayerCompression) (_ v1.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "serve.writeLayer", trace.StringAttribute("digest", key.String()), trace.StringAttribute("compression", string(comp)), trace.BoolAttribute("uncompressed", s.StoreUncompressed))
+	defer endSpan(span, &err)
+	var desc *v1.Descriptor
+	switch {
+	case s.StoreUncompressed:
+		desc, err = s.writeUncompressedLayer(ctx, l, uncompressedLayerType(mt))
+	case comp != CompressGzip:
+		desc, err = s.writeZstdLayer(ctx, l, comp)
+	default:
+		if desc, err = partial.Descriptor(l); err != nil {
+			return v1.Descriptor{}, err
+		}
+		var rc io.ReadCloser
+		if rc, err = l.Compressed(); err != nil {
+			return v1.Descriptor{}, err
+		}
+		err = s.writeBlob(ctx, key.String(), key, rc, string(desc.MediaType), nil)
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return *desc, nil
+}
+
+// rewritesManifests reports whether manifests written with ctx may be
+// rewritten to reference layers written differently than they were pushed,
+// and so are written under other digests.
+func (s *Storage) rewritesManifests(ctx context.Context) bool {
+	return s.StoreUncompressed || s.layerCompression(ctx) != CompressGzip
+}
+
+// layerKey returns the digest the layer's blob is written under.
+func (s *Storage) layerKey(l v1.Layer) (v1.Hash, error) {
+	if s.StoreUncompressed {
+		return l.DiffID()
+	}
+	return l.Digest()
+}
+
+// writeUncompressedLayer writes the uncompressed contents of the layer, keyed
+// by its diff ID, and returns the descriptor of the blob that was written.
+func (s *Storage) writeUncompressedLayer(ctx context.Context, l v1.Layer, mt types.MediaType) (*v1.Descriptor, error) {
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	cr := &countingReadCloser{ReadCloser: rc}
+	if err := s.writeBlob(ctx, diffID.String(), diffID, cr, string(mt), nil); err != nil {
+		return nil, err
+	}
+	return &v1.Descriptor{
+		MediaType: mt,
+		Size:      cr.n,
+		Digest:    diffID,
+	}, nil
+}
+
+// uncompressedLayerType returns the uncompressed layer media type matching
+// the flavor of the given manifest media type.
+func uncompressedLayerType(mt types.MediaType) types.MediaType {
+	if mt == types.DockerManifestSchema2 {
+		return types.DockerUncompressedLayer
+	}
+	return types.OCIUncompressedLayer
+}
+
+// existingManifest returns the descriptor of the image's manifest if it has
+// already been written as is, or nil if it hasn't.
+func (s *Storage) existingManifest(ctx context.Context, img v1.Image) (*v1.Descriptor, error) {
 	digest, err := img.Digest()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if ok, err := s.ManifestExists(ctx, digest); err != nil || !ok {
+		return nil, err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return nil, err
 	}
+	return &v1.Descriptor{Digest: digest, MediaType: mt, Size: size}, nil
+}
 
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		mt, err := img.MediaType()
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ServeManifest writes config and layer blobs for the image, then writes and
+// redirects to the image manifest contents pointing to those blobs.
+//
+// HEAD requests for an image whose manifest was already written, with no
+// aliases to write, are answered without writing anything.
+//
+// The manifest is converted between OCI and Docker media types if the
+// request's Accept header requires it, and aliases are written with the
+// image as it is, like ServeIndex.
+func (s *Storage) ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
+	_, err := s.ServeManifestDescriptor(w, r, img, also...)
+	return err
+}
+
+// ServeManifestDescriptor is like ServeManifest, but also returns the
+// descriptor of the image manifest that was served, e.g. so that callers can
+// respond to a PUT with a Location pointing at its digest.
+func (s *Storage) ServeManifestDescriptor(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) (desc *v1.Descriptor, err error) {
+	ctx, span := startSpan(RequestContext(w, r), "serve.ServeManifest")
+	defer endSpan(span, &err)
+	s.setSecurityHeaders(w)
+	defer func() { err = withRequestIDErr(ctx, err) }()
+	if ctx, err = RequestLayerCompression(ctx, r); err != nil {
+		return nil, err
+	}
+	stored, img, err := s.storedImage(ctx, w, r, img)
+	if err != nil {
+		return nil, err
+	}
+	if s.DryRun {
+		w.Header().Set(headerDryRun, "true")
+	}
+	if r.Method == http.MethodHead && len(also) == 0 && !s.rewritesManifests(ctx) && img == stored {
+		desc, err = s.existingManifest(ctx, img)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s, err := img.Size()
+	}
+	if desc == nil {
+		var report *LayerDeltaReport
+		desc, report, err = s.writeImageOnce(ctx, stored, also...)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		w.Header().Set(metaDockerContentDigest, digest.String())
-		w.Header().Set(metaContentType, string(mt))
-		w.Header().Set(metaContentLength, fmt.Sprintf("%d", s))
-		return nil
+		s.logTrace(ctx, report)
+	}
+	s.recordPullRequest(ctx, r, desc.Digest)
+	if img != stored {
+		var report *LayerDeltaReport
+		if desc, report, err = s.writeImageOnce(ctx, img); err != nil {
+			return nil, err
+		}
+		s.logTrace(ctx, report)
 	}
 
-	// Redirect to manifest blob.
-	Blob(w, r, digest.String())
-	return nil
+	if s.setManifestCacheHeaders(w, r, desc.Digest) {
+		return desc, nil
+	}
+
+	// If it's just a HEAD request, serve that.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set(metaDockerContentDigest, desc.Digest.String())
+		w.Header().Set(metaContentType, string(desc.MediaType))
+		w.Header().Set(metaContentLength, fmt.Sprintf("%d", desc.Size))
+		return desc, nil
+	}
+
+	// Redirect to manifest blob, or serve it inline.
+	if err := s.serveManifestBody(ctx, w, r, desc, img.RawManifest); err != nil {
+		return nil, err
+	}
+	return desc, nil
 }
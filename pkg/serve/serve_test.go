@@ -0,0 +1,189 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestBlobPrefixNamespacesObjects(t *testing.T) {
+	s := newTestStorage(t, Config{BlobPrefix: "prod/blobs", NegativeCachePersist: "true"})
+	ctx := context.Background()
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+
+	if err := s.Tags().Record("app", "v1", digest); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if err := s.recordRepo("app"); err != nil {
+		t.Fatalf("recordRepo: %v", err)
+	}
+	if err := s.recordPull(ctx, digest.String()); err != nil {
+		t.Fatalf("recordPull: %v", err)
+	}
+	if _, err := s.StartUploadSession(ctx, "app"); err != nil {
+		t.Fatalf("StartUploadSession: %v", err)
+	}
+	s.RecordFailure(ctx, name.MustParseReference("example.com/gone:latest"), &transport.Error{StatusCode: http.StatusNotFound})
+
+	keys, err := s.objects.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 5 {
+		t.Errorf("got keys %v, want 5", keys)
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "prod/") || strings.HasPrefix(k, "prod/blobs/") {
+			t.Errorf("key %q isn't in the blob prefix's namespace, beside its blobs", k)
+		}
+	}
+
+	if got, err := s.Tags().List("app"); err != nil || len(got) != 1 || got[0] != "v1" {
+		t.Errorf("Tags().List = %v, %v, want [v1]", got, err)
+	}
+	if got, err := s.Repositories(); err != nil || len(got) != 1 || got[0] != "app" {
+		t.Errorf("Repositories = %v, %v, want [app]", got, err)
+	}
+	if n, err := s.PullCount(ctx, digest.String()); err != nil || n != 1 {
+		t.Errorf("PullCount = %d, %v, want 1", n, err)
+	}
+}
+
+func TestServeBlobHeadHasNoContentEncoding(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	meta, err := s.blobMeta(digest, string(types.DockerLayer), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blobs written before the encoding was dropped have it recorded.
+	meta["Content-Encoding"] = "gzip"
+	if err := s.objects.Put(s.blobKey(digest.String()), strings.NewReader("layer"), string(types.DockerLayer), meta); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeBlob(rec, httptest.NewRequest(http.MethodHead, "/v2/app/blobs/"+digest.String(), nil), digest.String())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HEAD = %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none", got)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != digest.String() {
+		t.Errorf("Docker-Content-Digest = %q, want %s", got, digest)
+	}
+}
+
+func TestBlobExistsWithoutContentType(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	if err := s.objects.Put(s.blobKey("blob"), strings.NewReader("contents"), "", nil); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := s.BlobExists(context.Background(), "blob")
+	if err != nil {
+		t.Fatalf("BlobExists: %v", err)
+	}
+	if desc.MediaType != defaultMediaType {
+		t.Errorf("MediaType = %q, want %q", desc.MediaType, defaultMediaType)
+	}
+	if desc.Size != int64(len("contents")) {
+		t.Errorf("Size = %d, want %d", desc.Size, len("contents"))
+	}
+}
+
+func TestServeBlobRedirectsWithScheme(t *testing.T) {
+	s, err := NewStorage(context.Background(), WithConfig(Config{
+		Backend:  "oss",
+		Bucket:   "bucket",
+		Endpoint: "minio.internal:9000",
+		Scheme:   "http",
+	}))
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	digest := "sha256:" + strings.Repeat("a", 64)
+	rec := httptest.NewRecorder()
+	s.ServeBlob(rec, httptest.NewRequest(http.MethodGet, "/v2/app/blobs/"+digest, nil), digest)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("GET = %d %s, want %d", rec.Code, rec.Body, http.StatusSeeOther)
+	}
+	if got, want := rec.Header().Get("Location"), "http://bucket.minio.internal:9000/blobs/"+digest; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestNewStorageRejectsInvalidScheme(t *testing.T) {
+	if _, err := NewStorage(context.Background(), WithConfig(Config{Backend: "mem", Scheme: "ftp"})); err == nil {
+		t.Error("NewStorage succeeded with scheme ftp")
+	}
+	if _, err := NewStorage(context.Background(), WithConfig(Config{Backend: "mem"}), WithScheme("gopher")); err == nil {
+		t.Error("NewStorage succeeded with WithScheme(gopher)")
+	}
+}
+
+func BenchmarkPutBlob(b *testing.B) {
+	contents := bytes.Repeat([]byte("a"), 8<<20)
+	for _, size := range []int{0, defaultUploadBufferSize, 4 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			s, err := NewStorage(context.Background(), WithConfig(Config{Backend: "mem"}))
+			if err != nil {
+				b.Fatal(err)
+			}
+			s.UploadBufferSize = size
+			ctx := context.Background()
+			b.SetBytes(int64(len(contents)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rc := ioutil.NopCloser(bytes.NewReader(contents))
+				if err := s.putBlob(ctx, "blob", s.blobKey("blob"), rc, "application/octet-stream", nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServeManifestDryRunDoesNotRedirect(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	s.DryRun = true
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := s.ServeManifest(rec, httptest.NewRequest(http.MethodGet, "/v2/app/manifests/v1", nil), img); err != nil {
+		t.Fatalf("ServeManifest: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if loc := rec.Header().Get("Location"); loc != "" {
+		t.Errorf("redirected to %q, which wasn't written", loc)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != digest.String() {
+		t.Errorf("Docker-Content-Digest = %q, want %s", got, digest)
+	}
+	if got := rec.Header().Get(headerDryRun); got != "true" {
+		t.Errorf("%s = %q, want true", headerDryRun, got)
+	}
+	if keys, err := s.objects.List(""); err != nil || len(keys) != 0 {
+		t.Errorf("dry run wrote %v, %v", keys, err)
+	}
+}
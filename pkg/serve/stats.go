@@ -0,0 +1,169 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	pullStatsPrefix = "stats/pulls/"
+
+	// maxAppendRetries bounds how many times appendLine retries an append
+	// that raced with another, such as another pull of the same manifest.
+	maxAppendRetries = 3
+
+	// maxConcurrentStatReads bounds how many counters TopImages reads at
+	// once.
+	maxConcurrentStatReads = 16
+)
+
+// PullStat is the number of times a manifest has been pulled.
+type PullStat struct {
+	Digest string
+	Count  int64
+}
+
+// recordPull increments the pull counter for the manifest, at
+// stats/pulls/<digest>.
+//
+// Counters are appendable objects holding one integer per line, and a pull
+// appends a line containing 1. Appending avoids a read-modify-write of the
+// whole counter on every pull; an append that races with another pull of the
+// same manifest is retried at the new end of the object.
+func (s *Storage) recordPull(ctx context.Context, digest string) error {
+	if s.DryRun {
+		return nil
+	}
+	return s.appendLine(s.metaKey(pullStatsPrefix)+digest, "1")
+}
+
+// appendLine appends the line to the end of the appendable object, creating
+// it if needed, and retrying if another append raced with it.
+func (s *Storage) appendLine(key, line string) error {
+	for i := 0; ; i++ {
+		var pos int64
+		info, err := s.objects.Stat(key)
+		if err == nil {
+			pos = info.Size
+		} else if !isNotFound(err) {
+			return err
+		}
+
+		_, err = s.objects.Append(key, strings.NewReader(line+"\n"), pos)
+		if !errors.Is(err, ErrAppendPosition) || i == maxAppendRetries {
+			return err
+		}
+	}
+}
+
+// recordPullAsync records a pull of the named manifest in the background, so
+// that serving it doesn't wait on the counter being written. The name is its
+// digest or an alias, which is resolved to the digest it refers to. Failures
+// are only logged.
+func (s *Storage) recordPullAsync(ctx context.Context, name string) {
+	if s.DryRun {
+		return
+	}
+	id := requestID(ctx)
+	go func() {
+		ctx := context.WithValue(context.Background(), requestIDKey{}, id)
+		digest := name
+		if _, err := v1.NewHash(name); err != nil {
+			desc, _, err := s.statBlob(ctx, name)
+			if err == nil && desc.Digest == (v1.Hash{}) {
+				err = fmt.Errorf("no %s metadata", metaDockerContentDigest)
+			}
+			if err != nil {
+				warnf(ctx, "recording pull of %q: %v", name, err)
+				return
+			}
+			digest = desc.Digest.String()
+		}
+		if err := s.recordPull(ctx, digest); err != nil {
+			warnf(ctx, "recording pull of %q: %v", digest, err)
+		}
+	}()
+}
+
+// PullCount returns the number of times the manifest with the given digest
+// has been pulled, or 0 if it never has been.
+func (s *Storage) PullCount(ctx context.Context, digest string) (int64, error) {
+	rc, err := s.objects.Get(s.metaKey(pullStatsPrefix) + digest)
+	if isNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	var n int64
+	sc := bufio.NewScanner(&ctxReader{ctx: ctx, r: rc})
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		i, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("pull counter %q has invalid count %q", digest, line)
+		}
+		n += i
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// TopImages returns the n most pulled manifests, most pulled first, by
+// reading every counter under stats/pulls/.
+func (s *Storage) TopImages(ctx context.Context, n int) ([]PullStat, error) {
+	prefix := s.metaKey(pullStatsPrefix)
+	keys, err := s.objects.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]string, len(keys))
+	for i, k := range keys {
+		digests[i] = strings.TrimPrefix(k, prefix)
+	}
+
+	stats := make([]PullStat, len(digests))
+	var g errgroup.Group
+	sem := make(chan struct{}, maxConcurrentStatReads)
+	for i, d := range digests {
+		i, d := i, d
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			c, err := s.PullCount(ctx, d)
+			if err != nil {
+				return err
+			}
+			stats[i] = PullStat{Digest: d, Count: c}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Digest < stats[j].Digest
+	})
+	if n >= 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats, nil
+}
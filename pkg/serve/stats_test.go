@@ -0,0 +1,52 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestServeBlobRecordsManifestPulls(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	ctx := context.Background()
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	meta, err := s.blobMeta(digest, string(types.OCIManifestSchema1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{digest.String(), "ck"} {
+		if err := s.objects.Put(s.blobKey(name), strings.NewReader("{}"), string(types.OCIManifestSchema1), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct{ method, path, name string }{
+		{http.MethodGet, "/v2/app/manifests/" + digest.String(), digest.String()},
+		{http.MethodGet, "/v2/app/manifests/latest", "ck"},
+		// Neither HEADs nor blob requests are pulls of the manifest.
+		{http.MethodHead, "/v2/app/manifests/latest", "ck"},
+		{http.MethodGet, "/v2/app/blobs/" + digest.String(), digest.String()},
+	} {
+		s.ServeBlob(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil), c.name)
+	}
+
+	// Pulls are recorded in the background.
+	var n int64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if n, err = s.PullCount(ctx, digest.String()); err != nil {
+			t.Fatal(err)
+		} else if n >= 2 {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err = s.PullCount(ctx, digest.String()); err != nil || n != 2 {
+		t.Errorf("PullCount = %d, %v, want 2", n, err)
+	}
+}
@@ -0,0 +1,193 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const tagsPrefix = "tags/"
+
+// paginationNumberInvalidErrorCode is the distribution spec's error code for
+// an invalid n parameter, which transport doesn't define.
+const paginationNumberInvalidErrorCode transport.ErrorCode = "PAGINATION_NUMBER_INVALID"
+
+// tagRE matches valid tags, as defined by the distribution spec.
+var tagRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// TagStore records which manifest each tag of a repository refers to, so
+// that the tags the service has served can be listed.
+//
+// Each tag is an object at tags/<repo>/<tag>, in the namespace of the blob
+// prefix, holding the digest of the manifest, so that recording a tag again
+// only rewrites that tag.
+//
+// If the storage has a cache TTL, recording a tag that's unchanged records
+// that it was pulled, in its Last-Access metadata, and CollectGarbage
+// deletes tags that haven't been pulled within the TTL, other than those of
+// repositories in PushNamespaces.
+type TagStore struct {
+	objects  Backend
+	cacheTTL time.Duration
+
+	// prefix is the prefix of the tags' keys.
+	prefix string
+}
+
+// Tags returns the store of the tags the storage has served.
+func (s *Storage) Tags() *TagStore {
+	return &TagStore{objects: s.objects, cacheTTL: s.cacheTTL, prefix: s.metaKey(tagsPrefix)}
+}
+
+func (t *TagStore) key(repo, tag string) string {
+	return t.prefix + repo + "/" + tag
+}
+
+// Record records the tag of the repository as referring to the manifest with
+// the given digest. It doesn't rewrite a tag that already refers to it, other
+// than to record the pull if the storage has a cache TTL.
+func (t *TagStore) Record(repo, tag string, digest v1.Hash) error {
+	if !tagRE.MatchString(tag) {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	key := t.key(repo, tag)
+	info, err := t.objects.Stat(key)
+	if err == nil && info.Meta[metaDockerContentDigest] == digest.String() {
+		return touchObject(t.objects, key, info, t.cacheTTL)
+	} else if err != nil && !isNotFound(err) {
+		return err
+	}
+	return t.objects.Put(key, strings.NewReader(digest.String()), "text/plain; charset=utf-8", map[string]string{
+		metaDockerContentDigest: digest.String(),
+		metaCreatedAt:           time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// Lookup returns the digest of the manifest the tag of the repository refers
+// to, or an error wrapping ErrObjectNotFound if it hasn't been recorded.
+func (t *TagStore) Lookup(repo, tag string) (v1.Hash, error) {
+	info, err := t.objects.Stat(t.key(repo, tag))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return v1.NewHash(info.Meta[metaDockerContentDigest])
+}
+
+// List returns the recorded tags of the repository, sorted.
+func (t *TagStore) List(repo string) ([]string, error) {
+	prefix := t.prefix + repo + "/"
+	keys, err := t.objects.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tag := strings.TrimPrefix(k, prefix)
+		if strings.Contains(tag, "/") {
+			// A tag of a repository nested in this one.
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// recordPullRequest records the repository the request pulled from in the
+// catalog, and the tag it pulled, if it pulled one, as referring to the
+// manifest with the digest. They're recorded in the background, like
+// touchAsync's touches, so that serving the manifest doesn't wait on them;
+// failures are only logged.
+func (s *Storage) recordPullRequest(ctx context.Context, r *http.Request, digest v1.Hash) {
+	if s.DryRun {
+		return
+	}
+	p, _ := requestPath(r)
+	repo, tag := p.Repo, p.Tag()
+	if repo == "" {
+		return
+	}
+	id := requestID(ctx)
+	go func() {
+		ctx := context.WithValue(context.Background(), requestIDKey{}, id)
+		if err := s.recordRepo(repo); err != nil {
+			warnf(ctx, "recording repository %s: %v", repo, err)
+		}
+		if tag == "" {
+			return
+		}
+		if err := s.Tags().Record(repo, tag, digest); err != nil {
+			warnf(ctx, "recording tag %s:%s: %v", repo, tag, err)
+		}
+	}()
+}
+
+// tagList is the response of the tags/list API.
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ServeTags serves the tags/list API for requests to /v2/<name>/tags/list,
+// listing the tags of the repository that ServeManifest and ServeIndex have
+// served. Results are paginated with the n and last parameters, and a Link
+// header points to the next page, if there is one.
+func (s *Storage) ServeTags(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(w, r)
+	p, _ := requestPath(r)
+	repo := p.Repo
+	if repo == "" || p.Section != SectionTags {
+		WriteError(w, withRequestIDErr(ctx, fmt.Errorf("%w: %s", ErrNameInvalid, r.URL.Path)))
+		return
+	}
+	tags, err := s.Tags().List(repo)
+	if err != nil {
+		WriteError(w, withRequestIDErr(ctx, err))
+		return
+	}
+	if len(tags) == 0 {
+		WriteError(w, NewError(http.StatusNotFound, transport.NameUnknownErrorCode, "repository %q not known", repo))
+		return
+	}
+	if tags, err = paginate(w, r, tags); err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.Header().Set(metaContentType, "application/json")
+	json.NewEncoder(w).Encode(&tagList{Name: repo, Tags: tags})
+}
+
+// paginate returns the page of the sorted items that the request's n and
+// last parameters ask for, setting a Link header pointing to the next page
+// if there is one.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) ([]string, error) {
+	n := -1
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			return nil, NewError(http.StatusBadRequest, paginationNumberInvalidErrorCode, "invalid n %q", v)
+		}
+	}
+	if last := r.URL.Query().Get("last"); last != "" {
+		items = items[sort.Search(len(items), func(i int) bool { return items[i] > last }):]
+	}
+	if n >= 0 && n < len(items) {
+		items = items[:n]
+		if n > 0 {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[n-1]}}
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+		}
+	}
+	return items, nil
+}
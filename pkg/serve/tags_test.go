@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// blockingPutter is a Backend whose writes wait until unblock is closed.
+type blockingPutter struct {
+	Backend
+	unblock chan struct{}
+}
+
+func (b *blockingPutter) Put(key string, r io.Reader, contentType string, meta map[string]string) error {
+	<-b.unblock
+	return b.Backend.Put(key, r, contentType, meta)
+}
+
+func TestRecordPullRequestIsAsync(t *testing.T) {
+	b := &blockingPutter{Backend: newMemBackend(), unblock: make(chan struct{})}
+	s := newTestStorage(t, Config{}, WithBackend(b))
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+
+	// recordPullRequest returns without waiting on the writes.
+	s.recordPullRequest(context.Background(), httptest.NewRequest("GET", "/v2/app/manifests/v1", nil), digest)
+	close(b.unblock)
+
+	var tags []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(tags) == 0; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if tags, err = s.Tags().List("app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tags) != 1 || tags[0] != "v1" {
+		t.Errorf("Tags().List = %v, want [v1]", tags)
+	}
+	if repos, err := s.Repositories(); err != nil || len(repos) != 1 || repos[0] != "app" {
+		t.Errorf("Repositories = %v, %v, want [app]", repos, err)
+	}
+}
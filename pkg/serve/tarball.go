@@ -0,0 +1,34 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// ServeTarball loads an image from a tarball at tarPath, in the format
+// written by docker save, then writes and redirects to it as ServeManifest
+// does.
+//
+// If the tarball holds more than one image, tag selects which one to serve;
+// otherwise tag may be empty.
+func (s *Storage) ServeTarball(w http.ResponseWriter, r *http.Request, tarPath, tag string, also ...string) error {
+	var t *name.Tag
+	if tag != "" {
+		nt, err := name.NewTag(tag)
+		if err != nil {
+			return err
+		}
+		t = &nt
+	}
+	img, err := tarball.ImageFromPath(tarPath, t)
+	if err != nil {
+		if t != nil {
+			return fmt.Errorf("loading %s from tarball %q: %v", t, tarPath, err)
+		}
+		return fmt.Errorf("loading tarball %q: %v", tarPath, err)
+	}
+	return s.ServeManifest(w, r, img, also...)
+}
@@ -0,0 +1,47 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestServeTarball(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := tarball.WriteToFile(path, name.MustParseReference("example.com/app:v1"), img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range []string{"", "example.com/app:v1"} {
+		rec := httptest.NewRecorder()
+		if err := s.ServeTarball(rec, httptest.NewRequest(http.MethodHead, "/v2/app/manifests/v1", nil), path, tag); err != nil {
+			t.Fatalf("ServeTarball(%q): %v", tag, err)
+		}
+		if got := rec.Header().Get("Docker-Content-Digest"); got != digest.String() {
+			t.Errorf("ServeTarball(%q) served %q, want %s", tag, got, digest)
+		}
+	}
+	if exists, err := s.ManifestExists(context.Background(), digest); err != nil || !exists {
+		t.Errorf("ManifestExists = %t, %v; want the manifest written", exists, err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := s.ServeTarball(rec, httptest.NewRequest(http.MethodGet, "/v2/app/manifests/v1", nil), path, "example.com/app:missing"); err == nil {
+		t.Error("ServeTarball succeeded for a tag the tarball doesn't hold")
+	}
+}
@@ -0,0 +1,102 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	defaultOperationTimeout = 5 * time.Minute
+	defaultConnectTimeout   = 10 * time.Second
+	defaultReadWriteTimeout = 60 * time.Second
+)
+
+// WithOperationTimeout bounds how long each storage operation may take, so
+// that a stalled connection fails the operation instead of blocking it
+// forever. The default is 5 minutes; zero disables the timeout.
+func WithOperationTimeout(d time.Duration) Option {
+	return func(s *Storage) error {
+		if d < 0 {
+			return fmt.Errorf("negative operation timeout %s", d)
+		}
+		s.opTimeout = d
+		return nil
+	}
+}
+
+// WithClientTimeouts sets how long the OSS client may take to connect, and to
+// read or write on a connection before it's considered stalled. The defaults
+// are 10 seconds to connect and 60 seconds to read or write. Timeouts are
+// rounded up to whole seconds, and don't apply to a client given to
+// WithHTTPClient.
+func WithClientTimeouts(connect, readWrite time.Duration) Option {
+	return func(s *Storage) error {
+		if connect <= 0 || readWrite <= 0 {
+			return fmt.Errorf("client timeouts must be positive, got %s and %s", connect, readWrite)
+		}
+		s.connectTimeout, s.readWriteTimeout = connect, readWrite
+		return nil
+	}
+}
+
+// seconds returns d in whole seconds, rounded up.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// withTimeout runs op with a context that's done once the operation timeout
+// passes, returning an error if it didn't complete in time.
+//
+// op must honor the context: backends that make requests with a context are
+// passed it with contextBackend, and any reader it's consuming should be
+// wrapped with ctxReader. The OSS SDK doesn't accept a context, so its
+// requests are instead bounded by the client's timeouts.
+func (s *Storage) withTimeout(ctx context.Context, op func(ctx context.Context) error) error {
+	if s.opTimeout == 0 {
+		return op(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opTimeout)
+	defer cancel()
+	err := op(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("operation did not complete within %s: %w", s.opTimeout, ctx.Err())
+	}
+	return err
+}
+
+// contextBackend is implemented by backends that can make their requests
+// with a context, so that they're canceled once it's done.
+type contextBackend interface {
+	WithContext(ctx context.Context) Backend
+}
+
+// withContext returns b making its requests with ctx, if it can.
+func withContext(ctx context.Context, b Backend) Backend {
+	if cb, ok := b.(contextBackend); ok {
+		return cb.WithContext(ctx)
+	}
+	return b
+}
+
+// requestCtx returns ctx, or the background context if it's nil.
+func requestCtx(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// ctxReader is a reader that fails once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
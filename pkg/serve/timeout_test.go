@@ -0,0 +1,35 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestWithTimeoutCancelsRequests(t *testing.T) {
+	canceled := make(chan struct{})
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		close(canceled)
+		return nil, r.Context().Err()
+	})}
+	b := &s3Backend{client: client, scheme: "https", endpoint: "s3.example.com", bucket: "bucket", region: defaultRegion}
+	s := newTestStorage(t, Config{}, WithBackend(b), WithOperationTimeout(10*time.Millisecond))
+
+	h := v1.Hash{Algorithm: "sha256", Hex: "0000000000000000000000000000000000000000000000000000000000000000"}
+	_, err := s.ManifestExists(context.Background(), h)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ManifestExists = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The request was canceled before withTimeout returned, rather than
+	// left running.
+	select {
+	case <-canceled:
+	default:
+		t.Error("request wasn't canceled")
+	}
+}
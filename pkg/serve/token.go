@@ -0,0 +1,381 @@
+package serve
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// catalogScope is the scope of a token for the catalog API.
+	catalogScope = "registry:catalog:*"
+
+	// defaultTokenExpiry is how long issued tokens are valid for.
+	defaultTokenExpiry = 5 * time.Minute
+
+	// defaultAuthService names the registry tokens are for, and the token
+	// service that issues them, unless the config names them.
+	defaultAuthService = "kontain.me"
+)
+
+// authConfig is how registry requests are authorized; see WithAuth.
+type authConfig struct {
+	authorizer     Authorizer
+	realm, service string
+}
+
+// WithAuth makes api.Router require registry requests to be authorized by a,
+// sending clients that aren't to the token service at realm for a token for
+// service; see RequireAuth. An empty realm is /token on the host the request
+// was sent to. It overrides the config's AuthTokenKey and AuthPublicKey.
+func WithAuth(a Authorizer, realm, service string) Option {
+	return func(s *Storage) error {
+		s.auth = &authConfig{authorizer: a, realm: realm, service: service}
+		return nil
+	}
+}
+
+// auth returns how registry requests are authorized, and the issuer of their
+// tokens, if the config requires tokens; see Config.AuthTokenKey.
+func (c Config) auth() (*authConfig, *TokenIssuer, error) {
+	service, issuer := c.AuthService, c.AuthIssuer
+	if service == "" {
+		service = defaultAuthService
+	}
+	if issuer == "" {
+		issuer = defaultAuthService
+	}
+	switch {
+	case c.AuthHtpasswd != "" && (c.AuthTokenKey != "" || c.AuthPublicKey != ""):
+		// Clients answer the token challenge by sending their token, not
+		// their password, with every request, which BasicAuth refuses.
+		return nil, nil, errors.New("AUTH_HTPASSWD can't be set with AUTH_TOKEN_KEY or AUTH_PUBLIC_KEY; give the token policy users instead")
+	case c.AuthTokenKey != "" && c.AuthPublicKey != "":
+		return nil, nil, errors.New("only one of AUTH_TOKEN_KEY and AUTH_PUBLIC_KEY may be set")
+	case c.AuthTokenKey != "":
+		if c.AuthPolicy == "" {
+			return nil, nil, errors.New("AUTH_POLICY must be set with AUTH_TOKEN_KEY")
+		}
+		policy, err := LoadTokenPolicy(c.AuthPolicy)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := ioutil.ReadFile(c.AuthTokenKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, err := NewTokenIssuer(key, issuer, service, policy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid token key (AUTH_TOKEN_KEY): %v", err)
+		}
+		return &authConfig{authorizer: t.Authorizer(), realm: c.AuthRealm, service: service}, t, nil
+	case c.AuthPublicKey != "":
+		key, err := ioutil.ReadFile(c.AuthPublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		a, err := NewJWTAuthorizer(key, issuer, service)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid token public key (AUTH_PUBLIC_KEY): %v", err)
+		}
+		if c.AuthRealm == "" {
+			return nil, nil, errors.New("AUTH_REALM must be set with AUTH_PUBLIC_KEY")
+		}
+		return &authConfig{authorizer: a, realm: c.AuthRealm, service: service}, nil, nil
+	}
+	return nil, nil, nil
+}
+
+// RequireAuth wraps a registry handler so that requests are checked against
+// the allowlist and users the config sets, if any, with Allowlist and
+// BasicAuth, then authorized with the package's RequireAuth, if the storage
+// requires tokens; see WithAuth.
+func (s *Storage) RequireAuth(next http.Handler) http.Handler {
+	if s.auth != nil {
+		next = RequireAuth(s.auth.authorizer, s.auth.realm, s.auth.service, next)
+	}
+	if s.access != nil {
+		next = s.access.wrap(next)
+	}
+	return next
+}
+
+// TokenHandler serves the token service issuing the tokens registry requests
+// must bear, if the storage issues them, for a binary to expose at /token:
+//
+//	http.Handle("/token", st.TokenHandler())
+//
+// It responds 404 Not Found if tokens aren't issued here. Requests are
+// limited by address, with LimitAddresses, since they check passwords.
+func (s *Storage) TokenHandler() http.Handler {
+	if s.tokens == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			WriteError(w, fmt.Errorf("%w: tokens aren't issued here", ErrNotFound))
+		})
+	}
+	return s.LimitAddresses(s.tokens)
+}
+
+// TokenPolicy says who may be issued tokens, and what access they grant.
+// It's read from JSON like:
+//
+//	{
+//	  "users": {
+//	    "alice": {
+//	      "password": "$2y$10$...",
+//	      "access": [{"namespace": "alice", "actions": ["pull", "push"]}]
+//	    }
+//	  },
+//	  "anonymous": [{"namespace": "", "actions": ["pull"]}]
+//	}
+//
+// Passwords are bcrypt hashes, as written by htpasswd -B. A grant's
+// namespace covers the repository of that name and those nested under it,
+// and the empty namespace covers every repository. The catalog, which lists
+// every repository, is only granted to those who may pull every repository.
+type TokenPolicy struct {
+	Users map[string]TokenUser `json:"users"`
+
+	// Anonymous is the access granted to clients that don't authenticate.
+	Anonymous []Grant `json:"anonymous"`
+}
+
+// TokenUser is a user of a TokenPolicy.
+type TokenUser struct {
+	// Password is the bcrypt hash of the user's password.
+	Password string  `json:"password"`
+	Access   []Grant `json:"access"`
+}
+
+// Grant allows actions on the repositories in a namespace.
+type Grant struct {
+	Namespace string   `json:"namespace"`
+	Actions   []string `json:"actions"`
+}
+
+// LoadTokenPolicy reads a TokenPolicy from the JSON file at path.
+func LoadTokenPolicy(path string) (*TokenPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p TokenPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing token policy %s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// allowed returns those of the actions that the grants allow on the
+// repository.
+func allowed(grants []Grant, repo string, actions []string) []string {
+	var ok []string
+	for _, act := range actions {
+		for _, g := range grants {
+			if !inNamespace(repo, g.Namespace) {
+				continue
+			}
+			if containsAction(g.Actions, act) {
+				ok = append(ok, act)
+				break
+			}
+		}
+	}
+	return ok
+}
+
+func inNamespace(repo, ns string) bool {
+	ns = strings.Trim(ns, "/")
+	return ns == "" || repo == ns || strings.HasPrefix(repo, ns+"/")
+}
+
+func containsAction(actions []string, want string) bool {
+	for _, a := range actions {
+		if a == want || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenIssuer is the token service of the Docker token authentication flow:
+// clients sent to it by RequireAuth's challenge authenticate with basic auth,
+// or not at all, and are issued a JWT granting the access they asked for
+// that the policy allows them, which a JWTAuthorizer with the issuer's public
+// key then accepts.
+type TokenIssuer struct {
+	key             crypto.Signer
+	alg             string
+	issuer, service string
+	policy          *TokenPolicy
+	expiry          time.Duration
+}
+
+// NewTokenIssuer returns a TokenIssuer signing tokens with the PEM-encoded
+// RSA or P-256 ECDSA private key, as issuer for service.
+func NewTokenIssuer(keyPEM []byte, issuer, service string, policy *TokenPolicy) (*TokenIssuer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in private key")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &TokenIssuer{issuer: issuer, service: service, policy: policy, expiry: defaultTokenExpiry}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		t.key, t.alg = key, "RS256"
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s, must be P-256", key.Curve.Params().Name)
+		}
+		t.key, t.alg = key, "ES256"
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return t, nil
+}
+
+// Authorizer returns an Authorizer accepting the tokens the issuer issues.
+func (t *TokenIssuer) Authorizer() *JWTAuthorizer {
+	return &JWTAuthorizer{key: t.key.Public(), issuer: t.issuer, service: t.service}
+}
+
+// ServeHTTP issues a token for the scopes requested in the query, as
+//
+//	GET /token?service=<service>&scope=repository:<name>:pull,push
+//
+// Scopes the policy doesn't allow are left out of the token, rather than
+// failing the request, as the token spec requires; the registry then
+// refuses the requests they were needed for.
+func (t *TokenIssuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErr(w, http.StatusMethodNotAllowed, transport.UnsupportedErrorCode, "tokens are only issued for GET requests")
+		return
+	}
+	if svc := r.URL.Query().Get("service"); svc != "" && t.service != "" && svc != t.service {
+		writeErr(w, http.StatusBadRequest, transport.DeniedErrorCode, fmt.Sprintf("unknown service %q", svc))
+		return
+	}
+
+	subject, grants := "", t.policy.Anonymous
+	if user, pass, ok := r.BasicAuth(); ok {
+		u, found := t.policy.Users[user]
+		if !found || bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pass)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kontain.me"`)
+			writeErr(w, http.StatusUnauthorized, transport.UnauthorizedErrorCode, "invalid username or password")
+			return
+		}
+		subject, grants = user, u.Access
+	}
+
+	var access []tokenAccess
+	for _, scope := range r.URL.Query()["scope"] {
+		if scope == catalogScope {
+			if len(allowed(grants, "", []string{ActionPull})) > 0 {
+				access = append(access, tokenAccess{Type: "registry", Name: "catalog", Actions: []string{"*"}})
+			}
+			continue
+		}
+		parts := strings.Split(scope, ":")
+		if len(parts) < 3 || parts[0] != "repository" {
+			continue
+		}
+		// Repository names may include a registry host with a port.
+		repo := strings.Join(parts[1:len(parts)-1], ":")
+		if actions := allowed(grants, repo, strings.Split(parts[len(parts)-1], ",")); len(actions) > 0 {
+			access = append(access, tokenAccess{Type: "repository", Name: repo, Actions: actions})
+		}
+	}
+
+	now := time.Now()
+	token, err := t.sign(tokenClaims{
+		Issuer:    t.issuer,
+		Subject:   subject,
+		Audience:  t.service,
+		ExpiresAt: now.Add(t.expiry).Unix(),
+		NotBefore: now.Add(-time.Minute).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        tokenID(),
+		Access:    access,
+	})
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	LoggerFrom(r.Context()).Info("issued token", "subject", subject, "scopes", len(access))
+
+	w.Header().Set(metaContentType, "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(t.expiry.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// sign returns the claims as a JWT signed by the issuer's key.
+func (t *TokenIssuer) sign(claims tokenClaims) (string, error) {
+	hb, err := json.Marshal(map[string]string{"typ": "JWT", "alg": t.alg})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := t.key.(type) {
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS signatures are r and s, each padded to 32 bytes.
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func tokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
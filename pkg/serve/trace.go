@@ -0,0 +1,99 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+)
+
+// Spans are recorded with OpenCensus, not the OpenTelemetry SDK, which isn't
+// vendored. Traces are propagated in the W3C traceparent header both use, so
+// they join those of OpenTelemetry clients and upstream registries, and can
+// be sent to an OpenTelemetry collector by registering an OpenCensus
+// exporter for it with trace.RegisterExporter, or the OpenTelemetry
+// OpenCensus bridge, until the SDK replaces OpenCensus here.
+
+// Trace wraps a registry handler so that each request it serves is traced,
+// continuing the trace of the incoming request if its traceparent header
+// names one, as OpenTelemetry clients send. Spans are named by endpoint,
+// like the metrics of Instrument.
+func Trace(next http.Handler) http.Handler {
+	return &ochttp.Handler{
+		Handler:     next,
+		Propagation: &tracecontext.HTTPFormat{},
+		FormatSpanName: func(r *http.Request) string {
+			return "registry." + requestEndpoint(r)
+		},
+	}
+}
+
+// TracingTransport wraps the transport used for upstream registry fetches so
+// that each request is a span of the trace carried by its context, such as
+// one given with remote.WithContext, and propagates the trace upstream.
+func TracingTransport(base http.RoundTripper) http.RoundTripper {
+	return &ochttp.Transport{Base: base, Propagation: &tracecontext.HTTPFormat{}}
+}
+
+// startSpan starts a span of the trace carried by ctx, if any.
+func startSpan(ctx context.Context, name string, attrs ...trace.Attribute) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	span.AddAttributes(attrs...)
+	return ctx, span
+}
+
+// endSpan ends the span, marking it failed if *err is set, for deferring
+// from functions with a named error result.
+func endSpan(span *trace.Span, err *error) {
+	if *err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: (*err).Error()})
+	}
+	span.End()
+}
+
+// traceSampleRate returns the fraction of requests to trace and log the
+// spans of, or zero if the config doesn't set one.
+func (c Config) traceSampleRate() (float64, error) {
+	if c.TraceSampleRate == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(c.TraceSampleRate, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid trace sample rate (TRACE_SAMPLE_RATE) %q, must be between 0 and 1", c.TraceSampleRate)
+	}
+	return f, nil
+}
+
+var logExporterOnce sync.Once
+
+// logSpans samples the given fraction of traces and logs their spans, for
+// operators without a tracing backend. Binaries with one can register its
+// exporter with trace.RegisterExporter instead.
+func logSpans(fraction float64) {
+	logExporterOnce.Do(func() { trace.RegisterExporter(logExporter{}) })
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(fraction)})
+}
+
+// logExporter logs each span it's given, with how long it took.
+type logExporter struct{}
+
+func (logExporter) ExportSpan(sd *trace.SpanData) {
+	kv := []interface{}{
+		"trace_id", sd.TraceID.String(),
+		"span_id", sd.SpanID.String(),
+		"parent_span_id", sd.ParentSpanID.String(),
+		"duration", sd.EndTime.Sub(sd.StartTime).String(),
+	}
+	if sd.Code != trace.StatusCodeOK {
+		kv = append(kv, "error", sd.Message)
+	}
+	if len(sd.Attributes) > 0 {
+		kv = append(kv, "attributes", sd.Attributes)
+	}
+	DefaultLogger().Info("span "+sd.Name, kv...)
+}
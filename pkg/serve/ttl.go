@@ -0,0 +1,99 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	metaCreatedAt  = "Created-At"
+	metaLastAccess = "Last-Access"
+
+	// maxTouchInterval is the longest an object's Last-Access may be stale
+	// before a pull rewrites it.
+	maxTouchInterval = time.Hour
+)
+
+// cacheTTL returns the TTL of cached images, or zero if they don't expire.
+func (c Config) cacheTTL() (time.Duration, error) {
+	if c.CacheTTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.CacheTTL)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid cache TTL (CACHE_TTL) %q, must be a positive duration such as 720h", c.CacheTTL)
+	}
+	return d, nil
+}
+
+// lastAccess returns when the object was last pulled, or written if it
+// hasn't been pulled since, falling back to its modification time for
+// objects written without timestamps.
+func lastAccess(info ObjectInfo) time.Time {
+	for _, k := range []string{metaLastAccess, metaCreatedAt} {
+		if t, err := time.Parse(time.RFC3339, info.Meta[k]); err == nil {
+			return t
+		}
+	}
+	return info.ModTime
+}
+
+// accessExpired reports whether the object hasn't been pulled within the
+// cache TTL, if there is one.
+func accessExpired(info ObjectInfo, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(lastAccess(info)) > ttl
+}
+
+// touchObject records that the object was just pulled, by copying it onto
+// itself with an updated Last-Access, unless that was recorded within a
+// tenth of the cache TTL, up to an hour, so that frequently pulled objects
+// aren't rewritten on every pull.
+func touchObject(b Backend, key string, info ObjectInfo, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	interval := ttl / 10
+	if interval > maxTouchInterval {
+		interval = maxTouchInterval
+	}
+	now := time.Now()
+	if now.Sub(lastAccess(info)) < interval {
+		return nil
+	}
+	meta := make(map[string]string, len(info.Meta)+1)
+	for k, v := range info.Meta {
+		meta[k] = v
+	}
+	meta[metaLastAccess] = now.UTC().Format(time.RFC3339)
+	return b.CopyWithMeta(key, key, info.ContentType, meta)
+}
+
+// touchAsync touches the object in the background, if cached images expire,
+// so that serving it doesn't wait on the copy. Failures are only logged.
+func (s *Storage) touchAsync(ctx context.Context, key string) {
+	if s.cacheTTL <= 0 || s.DryRun {
+		return
+	}
+	id := requestID(ctx)
+	go func() {
+		ctx := context.WithValue(context.Background(), requestIDKey{}, id)
+		info, err := s.objects.Stat(key)
+		if isNotFound(err) {
+			return
+		} else if err == nil {
+			err = touchObject(s.objects, key, info, s.cacheTTL)
+		}
+		if err != nil {
+			warnf(ctx, "recording access of %q: %v", key, err)
+		}
+	}()
+}
+
+// isManifestType reports whether the media type is that of a manifest or
+// index, which garbage collection walks, rather than a config or layer.
+func isManifestType(mt types.MediaType) bool {
+	return mt.IsImage() || mt.IsIndex()
+}
@@ -0,0 +1,379 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// StartUploadSession begins a chunked blob upload to the repository,
+// recording it as an empty appendable object under uploads/<repo>/, and
+// returns the session's ID.
+//
+// Sessions are bound to the repository they're started in, so that another
+// repository's requests can't append to, commit or cancel them, even if they
+// learn the session's ID.
+func (s *Storage) StartUploadSession(ctx context.Context, repo string) (string, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.withTimeout(ctx, func(ctx context.Context) error {
+		_, err := withContext(ctx, s.objects).Append(s.sessionKey(repo, sessionID), bytes.NewReader(nil), 0)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// AppendChunk appends the chunk to the repository's session's upload at offset, which must
+// be the current size of the upload, and returns the offset of the next chunk.
+// size is the chunk's size, or -1 if it's unknown.
+//
+// Chunks that would make the upload larger than MaxBlobSize are rejected
+// before they're appended, or, if their size is unknown, once too much of
+// them has been read.
+func (s *Storage) AppendChunk(ctx context.Context, repo, sessionID string, offset int64, chunk io.Reader, size int64) (int64, error) {
+	tooLarge := fmt.Errorf("upload %s: %w: more than %d bytes", sessionID, ErrTooLarge, s.MaxBlobSize)
+	var lr *limitReader
+	if s.MaxBlobSize > 0 {
+		if offset > s.MaxBlobSize || (size > 0 && size > s.MaxBlobSize-offset) {
+			return 0, tooLarge
+		}
+		lr = &limitReader{r: chunk, max: s.MaxBlobSize - offset}
+		chunk = lr
+	}
+	key := s.sessionKey(repo, sessionID)
+	var next int64
+	err := s.withTimeout(ctx, func(ctx context.Context) error {
+		n, err := withContext(ctx, s.objects).Append(key, &ctxReader{ctx: ctx, r: chunk}, offset)
+		next = n
+		return err
+	})
+	if (lr != nil && lr.isExceeded()) || (err == nil && s.MaxBlobSize > 0 && next > s.MaxBlobSize) {
+		// Make sure no part of the chunk that was appended is committed.
+		if err := s.deleteUpload(ctx, key); err != nil {
+			return 0, fmt.Errorf("deleting oversized upload %s: %v", sessionID, err)
+		}
+		return 0, tooLarge
+	}
+	if err != nil {
+		if errors.Is(err, ErrAppendPosition) {
+			return 0, fmt.Errorf("upload %s: %w: chunk offset %d does not match upload size", sessionID, ErrAppendPosition, offset)
+		}
+		return 0, err
+	}
+	return next, nil
+}
+
+// CommitUpload verifies that the repository's session's uploaded contents
+// match dgst, then moves them to blobs/<dgst> and ends the session.
+//
+// Blobs are content-addressed and shared across repositories, so once
+// committed, the blob isn't bound to repo as its session was.
+func (s *Storage) CommitUpload(ctx context.Context, sessionID, repo string, dgst v1.Hash) error {
+	if dgst.Algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %q", dgst.Algorithm)
+	}
+	key := s.sessionKey(repo, sessionID)
+
+	h := sha256.New()
+	if err := s.withTimeout(ctx, func(ctx context.Context) error {
+		rc, err := withContext(ctx, s.objects).Get(key)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(h, &ctxReader{ctx: ctx, r: rc})
+		return err
+	}); err != nil {
+		return err
+	}
+	if got := (v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}); got != dgst {
+		return fmt.Errorf("%w: pushed %s to %s, got %s", ErrDigestMismatch, dgst, repo, got)
+	}
+
+	contentType := string(defaultMediaType)
+	if err := s.withTimeout(ctx, func(ctx context.Context) error {
+		return withContext(ctx, s.objects).CopyWithMeta(key, s.blobKey(dgst.String()), contentType, map[string]string{
+			metaContentType:         contentType,
+			metaDockerContentDigest: dgst.String(),
+		})
+	}); err != nil {
+		return err
+	}
+	return s.deleteUpload(ctx, key)
+}
+
+// MountBlob mounts the blob with the given digest from the repository from
+// into repo, reporting whether it has been written and so could be mounted.
+//
+// Blobs are content-addressed and shared across repositories, so mounting
+// is only a check that the blob exists; from is only logged. Callers must
+// check that the request may pull from from, as ServeUpload does with
+// mayPull, or else anyone who learns a digest could read the blob.
+func (s *Storage) MountBlob(ctx context.Context, repo, from string, dgst v1.Hash) (bool, error) {
+	var ok bool
+	err := s.withTimeout(ctx, func(ctx context.Context) error {
+		exists, err := withContext(ctx, s.objects).Exists(s.blobKey(dgst.String()))
+		ok = exists
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	debugf(ctx, "mounting %s from %q into %q: found=%t", dgst, from, repo, ok)
+	return ok, nil
+}
+
+// mayPull reports whether the request may pull from repo, as RequireAuth
+// and the config's allowlist would decide for a pull of it.
+func (s *Storage) mayPull(r *http.Request, repo string) bool {
+	if repo == "" {
+		return false
+	}
+	if s.access != nil && len(s.access.namespaces) > 0 && !inNamespaces(repo, s.access.namespaces) {
+		return false
+	}
+	return s.auth == nil || s.auth.authorizer.Authorize(r, ActionPull, repo) == nil
+}
+
+// AbortUpload cancels the repository's session, discarding any uploaded
+// contents.
+func (s *Storage) AbortUpload(ctx context.Context, repo, sessionID string) error {
+	return s.deleteUpload(ctx, s.sessionKey(repo, sessionID))
+}
+
+// deleteUpload deletes the upload session's object with the key.
+func (s *Storage) deleteUpload(ctx context.Context, key string) error {
+	return s.withTimeout(ctx, func(ctx context.Context) error {
+		return withContext(ctx, s.objects).Delete(key)
+	})
+}
+
+// newSessionID returns a random upload session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionIDRE matches the session IDs newSessionID returns.
+var sessionIDRE = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// IsUploadSessionID reports whether id could be the ID of an upload session
+// started by StartUploadSession. Other IDs, which may be paths into another
+// repository's sessions, are for no session.
+func IsUploadSessionID(id string) bool { return sessionIDRE.MatchString(id) }
+
+// uploadsPrefix is the prefix of the keys of upload sessions' objects.
+const uploadsPrefix = "uploads/"
+
+func (s *Storage) uploadKey(sessionID string) string { return s.metaKey(uploadsPrefix) + sessionID }
+
+// sessionKey returns the key of the repository's upload session, which no
+// other repository's session has.
+func (s *Storage) sessionKey(repo, sessionID string) string {
+	return s.uploadKey(repo + "/" + sessionID)
+}
+
+// uploadSize returns the number of bytes uploaded so far in the repository's
+// session.
+func (s *Storage) uploadSize(ctx context.Context, repo, sessionID string) (int64, error) {
+	var size int64
+	err := s.withTimeout(ctx, func(ctx context.Context) error {
+		info, err := withContext(ctx, s.objects).Stat(s.sessionKey(repo, sessionID))
+		size = info.Size
+		return err
+	})
+	return size, err
+}
+
+// ServeUpload handles the blob upload requests of the OCI distribution API,
+// under /v2/<repo>/blobs/uploads/:
+//
+//   - POST starts an upload session, or with ?digest= pushes the request
+//     body as the whole blob. With ?mount=<digest>&from=<repo>, it mounts
+//     the blob if it's been written and the request may pull from <repo>,
+//     and otherwise starts a session.
+//   - PATCH appends the request body to the session, at the offset given by
+//     its Content-Range, if any.
+//   - PUT with ?digest= appends the request body, if any, then commits the
+//     session's contents as the blob.
+//   - GET reports the session's progress, and DELETE cancels it.
+//
+// Sessions are stored as appendable objects, so chunks must be uploaded in
+// order. Requests for a session from a repository other than the one that
+// started it are rejected as for an unknown session.
+func (s *Storage) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := RequestContext(w, r)
+	s.setSecurityHeaders(w)
+	p, _ := requestPath(r)
+	if p.Section != SectionUploads {
+		writeErr(w, http.StatusNotFound, transport.NameUnknownErrorCode, "not a blob upload path")
+		return
+	}
+	repo, sessionID := p.Repo, p.Reference
+	if sessionID != "" && !IsUploadSessionID(sessionID) {
+		writeErr(w, http.StatusNotFound, transport.BlobUploadUnknownErrorCode, fmt.Sprintf("upload %s not found", sessionID))
+		return
+	}
+	location := func(id string) string { return fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id) }
+
+	var dgst v1.Hash
+	if d := r.URL.Query().Get("digest"); d != "" {
+		var err error
+		if dgst, err = v1.NewHash(d); err != nil {
+			writeErr(w, http.StatusBadRequest, transport.DigestInvalidErrorCode, err.Error())
+			return
+		}
+	}
+
+	if sessionID == "" {
+		if r.Method != http.MethodPost {
+			writeErr(w, http.StatusMethodNotAllowed, transport.UnsupportedErrorCode, fmt.Sprintf("unsupported method %s", r.Method))
+			return
+		}
+		if m := r.URL.Query().Get("mount"); m != "" {
+			h, err := v1.NewHash(m)
+			if err != nil {
+				writeErr(w, http.StatusBadRequest, transport.DigestInvalidErrorCode, err.Error())
+				return
+			}
+			if from := r.URL.Query().Get("from"); !s.mayPull(r, from) {
+				debugf(ctx, "not mounting %s from %q into %q: pull of %q isn't authorized", h, from, repo, from)
+			} else if mounted, err := s.MountBlob(ctx, repo, from, h); err != nil {
+				writeUploadErr(w, err)
+				return
+			} else if mounted {
+				blobCreated(w, repo, h)
+				return
+			}
+			// The blob wasn't found, or can't be read from the
+			// repository, so start an upload of it instead, as the spec
+			// allows.
+		} else if dgst != (v1.Hash{}) {
+			if err := s.PushLayer(ctx, repo, dgst, r.Body, r.ContentLength); err != nil {
+				writeUploadErr(w, err)
+				return
+			}
+			blobCreated(w, repo, dgst)
+			return
+		}
+		id, err := s.StartUploadSession(ctx, repo)
+		if err != nil {
+			writeUploadErr(w, err)
+			return
+		}
+		w.Header().Set("Location", location(id))
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	size, err := s.uploadSize(ctx, repo, sessionID)
+	if isNotFound(err) {
+		writeErr(w, http.StatusNotFound, transport.BlobUploadUnknownErrorCode, fmt.Sprintf("upload %s not found", sessionID))
+		return
+	} else if err != nil {
+		writeUploadErr(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		setUploadRange(w, size)
+		w.Header().Set("Location", location(sessionID))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := s.AbortUpload(ctx, repo, sessionID); err != nil {
+			writeUploadErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPatch, http.MethodPut:
+		offset := size
+		if cr := r.Header.Get("Content-Range"); cr != "" {
+			var start, end int64
+			if _, err := fmt.Sscanf(cr, "%d-%d", &start, &end); err != nil || start != size {
+				setUploadRange(w, size)
+				writeErr(w, http.StatusRequestedRangeNotSatisfiable, transport.BlobUploadInvalidErrorCode, fmt.Sprintf("invalid Content-Range %q, %d bytes uploaded", cr, size))
+				return
+			}
+			offset = start
+		}
+		if r.ContentLength != 0 {
+			if size, err = s.AppendChunk(ctx, repo, sessionID, offset, r.Body, r.ContentLength); err != nil {
+				writeUploadErr(w, err)
+				return
+			}
+		}
+		if r.Method == http.MethodPatch {
+			setUploadRange(w, size)
+			w.Header().Set("Location", location(sessionID))
+			w.Header().Set("Docker-Upload-UUID", sessionID)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if dgst == (v1.Hash{}) {
+			writeErr(w, http.StatusBadRequest, transport.DigestInvalidErrorCode, "digest is required")
+			return
+		}
+		if err := s.CommitUpload(ctx, sessionID, repo, dgst); err != nil {
+			writeUploadErr(w, err)
+			return
+		}
+		blobCreated(w, repo, dgst)
+
+	default:
+		writeErr(w, http.StatusMethodNotAllowed, transport.UnsupportedErrorCode, fmt.Sprintf("unsupported method %s", r.Method))
+	}
+}
+
+// setUploadRange reports the bytes uploaded so far, as an inclusive range.
+func setUploadRange(w http.ResponseWriter, size int64) {
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+}
+
+func blobCreated(w http.ResponseWriter, repo string, dgst v1.Hash) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst))
+	w.Header().Set(metaDockerContentDigest, dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// writeUploadErr writes the registry error response for an upload error.
+func writeUploadErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDigestMismatch):
+		writeErr(w, http.StatusBadRequest, transport.DigestInvalidErrorCode, err.Error())
+	case errors.Is(err, ErrSizeMismatch):
+		writeErr(w, http.StatusBadRequest, transport.SizeInvalidErrorCode, err.Error())
+	case errors.Is(err, ErrTooLarge):
+		writeErr(w, http.StatusRequestEntityTooLarge, transport.SizeInvalidErrorCode, err.Error())
+	case errors.Is(err, ErrAppendPosition):
+		writeErr(w, http.StatusRequestedRangeNotSatisfiable, transport.BlobUploadInvalidErrorCode, err.Error())
+	default:
+		writeErr(w, http.StatusInternalServerError, unknownErrorCode, err.Error())
+	}
+}
@@ -0,0 +1,170 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestAppendChunkMaxBlobSize(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t, Config{})
+	s.MaxBlobSize = 10
+
+	id, err := s.StartUploadSession(ctx, "app")
+	if err != nil {
+		t.Fatalf("StartUploadSession: %v", err)
+	}
+	next, err := s.AppendChunk(ctx, "app", id, 0, strings.NewReader("12345"), 5)
+	if err != nil || next != 5 {
+		t.Fatalf("AppendChunk = %d, %v, want 5", next, err)
+	}
+
+	// A chunk whose size is known is rejected before it's appended.
+	if _, err := s.AppendChunk(ctx, "app", id, 5, strings.NewReader("678901"), 6); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("AppendChunk of a known size = %v, want %v", err, ErrTooLarge)
+	}
+	if size, err := s.uploadSize(ctx, "app", id); err != nil || size != 5 {
+		t.Fatalf("uploadSize = %d, %v, want 5", size, err)
+	}
+
+	// A chunk whose size is unknown fails once too much has been read, and
+	// the upload is deleted.
+	if _, err := s.AppendChunk(ctx, "app", id, 5, strings.NewReader("678901"), -1); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("AppendChunk of an unknown size = %v, want %v", err, ErrTooLarge)
+	}
+	if _, err := s.uploadSize(ctx, "app", id); !isNotFound(err) {
+		t.Errorf("uploadSize after an oversized chunk = %v, want not found", err)
+	}
+}
+
+func TestUploadSessionBoundToRepo(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.ServeUpload(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/v2/alice/app/blobs/uploads/", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST = %d %s", rec.Code, rec.Body)
+	}
+	loc := rec.Header().Get("Location")
+	id := loc[strings.LastIndex(loc, "/")+1:]
+
+	other := "/v2/bob/app/blobs/uploads/" + id
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodPut, http.MethodDelete} {
+		if rec := do(method, other+"?digest="+digest, "data"); rec.Code != http.StatusNotFound {
+			t.Errorf("%s from another repo = %d, want %d", method, rec.Code, http.StatusNotFound)
+		}
+	}
+	if rec := do(http.MethodPatch, loc, "data"); rec.Code != http.StatusAccepted {
+		t.Errorf("PATCH from the session's repo = %d %s, want %d", rec.Code, rec.Body, http.StatusAccepted)
+	}
+}
+
+func TestUploadSessionIDOfNestedRepo(t *testing.T) {
+	s := newTestStorage(t, Config{})
+	req := httptest.NewRequest(http.MethodPost, "/v2/alice/app/blobs/uploads/", nil)
+	rec := httptest.NewRecorder()
+	s.ServeUpload(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST = %d %s", rec.Code, rec.Body)
+	}
+	loc := rec.Header().Get("Location")
+	id := loc[strings.LastIndex(loc, "/")+1:]
+
+	// The session of alice/app, named as if it were alice's session app/<id>.
+	nested := "/v2/alice/blobs/uploads/app/" + id
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodPut, http.MethodDelete} {
+		rec := httptest.NewRecorder()
+		s.ServeUpload(rec, httptest.NewRequest(method, nested+"?digest="+digest, strings.NewReader("data")))
+		if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), string(transport.BlobUploadUnknownErrorCode)) {
+			t.Errorf("%s of the nested repo's session = %d %s, want %d %s", method, rec.Code, rec.Body, http.StatusNotFound, transport.BlobUploadUnknownErrorCode)
+		}
+	}
+	if size, err := s.uploadSize(context.Background(), "alice/app", id); err != nil || size != 0 {
+		t.Errorf("uploadSize = %d, %v; want the session untouched", size, err)
+	}
+}
+
+func TestUploadsTimeOut(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})}
+	b := &s3Backend{client: client, scheme: "https", endpoint: "s3.example.com", bucket: "bucket", region: defaultRegion}
+	s := newTestStorage(t, Config{}, WithBackend(b), WithOperationTimeout(10*time.Millisecond))
+	ctx := context.Background()
+	id := strings.Repeat("0f", 16)
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+
+	for name, op := range map[string]func() error{
+		"StartUploadSession": func() error { _, err := s.StartUploadSession(ctx, "app"); return err },
+		"AppendChunk":        func() error { _, err := s.AppendChunk(ctx, "app", id, 0, strings.NewReader("data"), 4); return err },
+		"CommitUpload":       func() error { return s.CommitUpload(ctx, id, "app", digest) },
+		"MountBlob":          func() error { _, err := s.MountBlob(ctx, "app", "other", digest); return err },
+		"AbortUpload":        func() error { return s.AbortUpload(ctx, "app", id) },
+		"uploadSize":         func() error { _, err := s.uploadSize(ctx, "app", id); return err },
+	} {
+		done := make(chan error, 1)
+		go func() { done <- op() }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("%s = %v, want %v", name, err, context.DeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s didn't time out", name)
+		}
+	}
+}
+
+// pullOnly is an Authorizer that allows pulls from the repositories, and
+// pushes to any other.
+type pullOnly []string
+
+func (p pullOnly) Authorize(r *http.Request, action, repo string) error {
+	for _, name := range p {
+		if name == repo {
+			return nil
+		}
+	}
+	if action == ActionPush {
+		return nil
+	}
+	return ErrUnauthorized
+}
+
+func TestMountBlobRequiresPullAccess(t *testing.T) {
+	s := newTestStorage(t, Config{}, WithAuth(pullOnly{"public"}, "", ""))
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	if err := s.objects.Put(s.blobKey(digest.String()), strings.NewReader("blob"), string(defaultMediaType), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from string
+		want int
+	}{
+		{"public", http.StatusCreated},
+		{"private", http.StatusAccepted},
+		{"", http.StatusAccepted},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeUpload(rec, httptest.NewRequest(http.MethodPost, "/v2/app/blobs/uploads/?mount="+digest.String()+"&from="+tc.from, nil))
+		if rec.Code != tc.want {
+			t.Errorf("mount from %q = %d %s, want %d", tc.from, rec.Code, rec.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DigestMismatchError describes a blob whose contents don't match the digest
+// it's stored under, or the digest recorded in its metadata.
+type DigestMismatchError struct {
+	Name string
+	// Key is the digest in the blob's name, if it's named by digest.
+	Key *v1.Hash
+	// Meta is the digest recorded in the blob's metadata, if any.
+	Meta *v1.Hash
+	// Actual is the digest of the blob's contents.
+	Actual v1.Hash
+}
+
+func (e *DigestMismatchError) Error() string {
+	var parts []string
+	if e.Key != nil && *e.Key != e.Actual {
+		parts = append(parts, fmt.Sprintf("named %s", e.Key))
+	}
+	if e.Meta == nil {
+		parts = append(parts, "no digest metadata")
+	} else if *e.Meta != e.Actual {
+		parts = append(parts, fmt.Sprintf("metadata %s", e.Meta))
+	}
+	return fmt.Sprintf("blob %q has digest %s but %s", e.Name, e.Actual, strings.Join(parts, " and "))
+}
+
+func (e *DigestMismatchError) Unwrap() error { return ErrDigestMismatch }
+
+// Verify reads the named blob and checks that the digest of its contents
+// matches both its name, if it's named by digest, and the digest recorded in
+// its metadata, returning a *DigestMismatchError if not.
+//
+// If repair is true, a mismatched blob's metadata is corrected, and a blob
+// named by the wrong digest is also rewritten under the right one. The
+// mismatch is still reported.
+func (s *Storage) Verify(ctx context.Context, name string, repair bool) error {
+	key := s.blobKey(name)
+	info, err := s.objects.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	rc, err := s.objects.Get(key)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, &ctxReader{ctx: ctx, r: rc})
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	merr := &DigestMismatchError{
+		Name:   name,
+		Actual: v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))},
+	}
+	if kh, err := v1.NewHash(name); err == nil {
+		merr.Key = &kh
+	}
+	if d := info.Meta[metaDockerContentDigest]; d != "" {
+		if mh, err := v1.NewHash(d); err == nil {
+			merr.Meta = &mh
+		}
+	}
+	keyOK := merr.Key == nil || *merr.Key == merr.Actual
+	metaOK := merr.Meta != nil && *merr.Meta == merr.Actual
+	if keyOK && metaOK {
+		return nil
+	}
+	if !repair {
+		return merr
+	}
+
+	// Replace the metadata while copying, carrying over everything but the
+	// digest.
+	contentType := string(blobMediaType(info))
+	meta := map[string]string{}
+	for k, v := range info.Meta {
+		meta[k] = v
+	}
+	meta[metaContentType] = contentType
+	meta[metaDockerContentDigest] = merr.Actual.String()
+	dst := key
+	if !keyOK {
+		dst = s.blobKey(merr.Actual.String())
+	}
+	if err := s.objects.CopyWithMeta(key, dst, contentType, meta); err != nil {
+		return fmt.Errorf("repairing %v: %v", merr, err)
+	}
+	infof(ctx, "repaired %v", merr)
+	return merr
+}
+
+// digestReader hashes the contents read through it, and fails in place of
+// io.EOF if they don't match the digest they're being written under, so that
+// the object being written isn't finalized.
+type digestReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	merr *DigestMismatchError
+}
+
+// newDigestReader returns a digestReader checking that rc's contents match
+// merr.Meta, or nil if its algorithm isn't supported.
+func newDigestReader(rc io.ReadCloser, merr *DigestMismatchError) *digestReader {
+	if merr.Meta.Algorithm != "sha256" {
+		return nil
+	}
+	return &digestReader{ReadCloser: rc, h: sha256.New(), merr: merr}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		d.merr.Actual = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(d.h.Sum(nil))}
+		if d.merr.Actual != *d.merr.Meta {
+			return n, d.merr
+		}
+	}
+	return n, err
+}
+
+// mismatch returns the error describing the mismatch, if the contents were
+// read to the end and didn't match.
+func (d *digestReader) mismatch() error {
+	if d == nil || d.merr.Actual == (v1.Hash{}) || d.merr.Actual == *d.merr.Meta {
+		return nil
+	}
+	return d.merr
+}
@@ -0,0 +1,202 @@
+package serve
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The annotations and footer of zstd:chunked layers, as read by
+// containers/storage.
+const (
+	zstdChunkedManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	zstdChunkedManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+
+	// zstdChunkedManifestType is the type of table of contents in the
+	// footer, the only one there is.
+	zstdChunkedManifestType = 1
+	zstdChunkedFooterSize   = 40
+)
+
+var (
+	zstdSkippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+	zstdChunkedFrameMagic   = []byte("GNUlInUx")
+)
+
+// zstdChunkedTOC is the table of contents of a zstd:chunked layer.
+type zstdChunkedTOC struct {
+	Version int                `json:"version"`
+	Entries []zstdChunkedEntry `json:"entries"`
+}
+
+// zstdChunkedEntry describes a file in a zstd:chunked layer. Its contents, if
+// it has any, are in their own zstd frames, from Offset to EndOffset in the
+// compressed stream.
+type zstdChunkedEntry struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Linkname   string            `json:"linkName,omitempty"`
+	Mode       int64             `json:"mode,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	UID        int               `json:"uid,omitempty"`
+	GID        int               `json:"gid,omitempty"`
+	ModTime    *time.Time        `json:"modtime,omitempty"`
+	AccessTime *time.Time        `json:"accesstime,omitempty"`
+	ChangeTime *time.Time        `json:"changetime,omitempty"`
+	Devmajor   int64             `json:"devMajor,omitempty"`
+	Devminor   int64             `json:"devMinor,omitempty"`
+	Xattrs     map[string]string `json:"xattrs,omitempty"`
+	Digest     string            `json:"digest,omitempty"`
+	Offset     int64             `json:"offset,omitempty"`
+	EndOffset  int64             `json:"endOffset,omitempty"`
+}
+
+var zstdChunkedTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeRegA:    "reg",
+	tar.TypeLink:    "hardlink",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeDir:     "dir",
+	tar.TypeFifo:    "fifo",
+}
+
+// writeZstdChunked writes the tar stream to w compressed as zstd:chunked with
+// enc, and returns the annotations its layer descriptor needs.
+//
+// The tar stream is written byte for byte as it's read, so that the layer's
+// diff ID doesn't change; only frame boundaries are added, before and after
+// each file's contents. Its table of contents follows in a skippable frame,
+// then a skippable frame with the footer saying where the table is.
+func writeZstdChunked(w io.Writer, tarStream io.Reader, enc *zstd.Encoder) (map[string]string, error) {
+	out := &countingWriter{w: w}
+	enc.Reset(out)
+	// restart ends the current frame, starting another at the returned
+	// offset when it's next written to.
+	restart := func() (int64, error) {
+		if err := enc.Close(); err != nil {
+			return 0, err
+		}
+		enc.Reset(out)
+		return out.n, nil
+	}
+
+	// Everything the tar reader reads, headers, contents and padding, is
+	// written as it's read.
+	tr := tar.NewReader(io.TeeReader(tarStream, enc))
+	var entries []zstdChunkedEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		typ, ok := zstdChunkedTypes[hdr.Typeflag]
+		if !ok {
+			// Global headers and the like, which Next has already
+			// written.
+			continue
+		}
+		e := zstdChunkedEntry{
+			Type:     typ,
+			Name:     hdr.Name,
+			Linkname: hdr.Linkname,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+		}
+		e.ModTime, e.AccessTime, e.ChangeTime = timeOrNil(hdr.ModTime), timeOrNil(hdr.AccessTime), timeOrNil(hdr.ChangeTime)
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				if e.Xattrs == nil {
+					e.Xattrs = map[string]string{}
+				}
+				e.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+		}
+		if typ == "reg" && hdr.Size > 0 {
+			if e.Offset, err = restart(); err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			if e.EndOffset, err = restart(); err != nil {
+				return nil, err
+			}
+			e.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, e)
+	}
+	// Keep any padding after the end of the archive.
+	if _, err := io.Copy(enc, tarStream); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	toc, err := json.Marshal(zstdChunkedTOC{Version: 1, Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+	enc.Reset(ioutil.Discard)
+	ztoc := enc.EncodeAll(toc, nil)
+	// The table of contents starts after its frame's 8 byte header.
+	tocOffset := out.n + 8
+	if err := writeSkippableFrame(out, ztoc); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(tocOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(ztoc)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(toc)))
+	binary.LittleEndian.PutUint64(footer[24:], zstdChunkedManifestType)
+	copy(footer[32:], zstdChunkedFrameMagic)
+	if err := writeSkippableFrame(out, footer); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(ztoc)
+	return map[string]string{
+		zstdChunkedManifestChecksum: "sha256:" + hex.EncodeToString(sum[:]),
+		zstdChunkedManifestPosition: fmt.Sprintf("%d:%d:%d:%d", tocOffset, len(ztoc), len(toc), zstdChunkedManifestType),
+	}, nil
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// writeSkippableFrame writes a zstd skippable frame holding the data, which
+// decompressors skip over.
+func writeSkippableFrame(w io.Writer, data []byte) error {
+	hdr := make([]byte, 8)
+	copy(hdr, zstdSkippableFrameMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
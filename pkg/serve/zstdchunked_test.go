@@ -0,0 +1,109 @@
+package serve
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWriteZstdChunkedFooter(t *testing.T) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for name, contents := range map[string]string{"a.txt": "hello", "empty": ""} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	annotations, err := writeZstdChunked(&out, bytes.NewReader(tarball.Bytes()), enc)
+	if err != nil {
+		t.Fatalf("writeZstdChunked: %v", err)
+	}
+	b := out.Bytes()
+
+	// The footer is the last frame, a skippable one.
+	if len(b) < 8+zstdChunkedFooterSize {
+		t.Fatalf("wrote %d bytes, too few for the footer", len(b))
+	}
+	frame := b[len(b)-8-zstdChunkedFooterSize:]
+	if !bytes.Equal(frame[:4], zstdSkippableFrameMagic) || binary.LittleEndian.Uint32(frame[4:8]) != zstdChunkedFooterSize {
+		t.Fatalf("footer frame header = %x, want a skippable frame of %d bytes", frame[:8], zstdChunkedFooterSize)
+	}
+	footer := frame[8:]
+	if !bytes.Equal(footer[32:], zstdChunkedFrameMagic) {
+		t.Errorf("footer magic = %q, want %q", footer[32:], zstdChunkedFrameMagic)
+	}
+	offset := binary.LittleEndian.Uint64(footer)
+	length := binary.LittleEndian.Uint64(footer[8:])
+	uncompressed := binary.LittleEndian.Uint64(footer[16:])
+	typ := binary.LittleEndian.Uint64(footer[24:])
+	if want := fmt.Sprintf("%d:%d:%d:%d", offset, length, uncompressed, typ); annotations[zstdChunkedManifestPosition] != want {
+		t.Errorf("position annotation = %q, footer says %q", annotations[zstdChunkedManifestPosition], want)
+	}
+
+	// The table of contents is in the skippable frame before it.
+	tocFrame := b[offset-8:]
+	if !bytes.Equal(tocFrame[:4], zstdSkippableFrameMagic) || uint64(binary.LittleEndian.Uint32(tocFrame[4:8])) != length {
+		t.Fatalf("table of contents frame header = %x, want a skippable frame of %d bytes", tocFrame[:8], length)
+	}
+	ztoc := b[offset : offset+length]
+	sum := sha256.Sum256(ztoc)
+	if want := "sha256:" + hex.EncodeToString(sum[:]); annotations[zstdChunkedManifestChecksum] != want {
+		t.Errorf("checksum annotation = %q, want %q", annotations[zstdChunkedManifestChecksum], want)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	raw, err := dec.DecodeAll(ztoc, nil)
+	if err != nil {
+		t.Fatalf("decompressing table of contents: %v", err)
+	}
+	if uint64(len(raw)) != uncompressed {
+		t.Errorf("table of contents is %d bytes, footer says %d", len(raw), uncompressed)
+	}
+	var toc zstdChunkedTOC
+	if err := json.Unmarshal(raw, &toc); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range toc.Entries {
+		if e.Name == "a.txt" && (e.Offset == 0 || e.EndOffset <= e.Offset || e.Digest == "") {
+			t.Errorf("entry for a.txt = %+v, want its contents' frames and digest", e)
+		}
+	}
+	if len(toc.Entries) != 2 {
+		t.Errorf("table of contents has %d entries, want 2", len(toc.Entries))
+	}
+
+	// Decompressors skip the frames, and get the tar stream back.
+	if err := dec.Reset(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	if !bytes.Equal(got, tarball.Bytes()) {
+		t.Error("decompressed layer isn't the tar stream written")
+	}
+}